@@ -0,0 +1,3 @@
+module github.com/QuanHBui/Widget-Production
+
+go 1.24
@@ -5,6 +5,7 @@
 // File: main.go
 //==============================================================================
 
+// The command line of the widget production line, running it and the tools around it
 package main
 
 import (
@@ -14,175 +15,2038 @@ import (
     "math/rand"
     "bytes"
     "strconv"
+    "strings"
     "sync"
+    "os"
+    "reflect"
+    "runtime"
+    "path"
+    "io"
+    "archive/tar"
+    "compress/gzip"
+    "os/signal"
+    "syscall"
+    "encoding/json"
+    "encoding/csv"
+    "bufio"
+    "html"
+    "os/exec"
+    "errors"
+    "context"
+    "net"
+    "net/http"
+    "slices"
+    "maps"
+
+    "github.com/QuanHBui/Widget-Production/widgetline"
 )
 
-const ASCII = "abcdefghijklmnopqrstuvxyz0123456789"
-const ID_LENGTH = 32
-const TIME_FORMAT = "15:04:05.000000"
+//=============================================================================
+// overrideList is a repeatable flag collecting name=value overrides
+type overrideList []string
 
-var wg sync.WaitGroup
+func (list *overrideList) String() string {
+    return strings.Join(*list, " ")
+}
 
-//==============================================================================
-type Widget struct {
-    id      string      // Universally unique
-    source  string      // Which Producer created this Widget
-    time    time.Time   // Time set by Producer when Widget was created
-    broken  bool        // Widget is broken or not
+func (list *overrideList) Set(value string) error {
+    *list = append(*list, value)
+    return nil
 }
 
-func idMaker() string {
-    var buffer bytes.Buffer
+// Print the outcome of a replay side by side with the original
+func compareOutcomes(originalName string, original widgetline.Outcome, replayName string, replay widgetline.Outcome) {
+    fmt.Printf("%-14s %16s %16s\n", "", originalName, replayName)
+    fmt.Printf("%-14s %16s %16s\n", "duration", original.Duration, replay.Duration)
+    fmt.Printf("%-14s %16d %16d\n", "produced", original.NumProduced, replay.NumProduced)
+    fmt.Printf("%-14s %16d %16d\n", "consumed", original.NumConsumed, replay.NumConsumed)
+    fmt.Printf("%-14s %16s %16s\n", "mean latency", original.MeanLatency, replay.MeanLatency)
+    fmt.Printf("%-14s %16s %16s\n", "max latency", original.MaxLatency, replay.MaxLatency)
+    fmt.Printf("%-14s %14.1f/s %14.1f/s\n", "throughput", original.Throughput, replay.Throughput)
+    fmt.Printf("%-14s %16d %16d\n", "warm-up", original.NumWarmup, replay.NumWarmup)
+    if (original.Resources != nil && replay.Resources != nil) {
+        fmt.Printf("%-14s %16s %16s\n", "cpu", original.Resources.CPU(), replay.Resources.CPU())
+        fmt.Printf("%-14s %12.1f MiB %12.1f MiB\n", "allocated", float64(original.Resources.Allocated) / (1 << 20), float64(replay.Resources.Allocated) / (1 << 20))
+        fmt.Printf("%-14s %16d %16d\n", "gc cycles", original.Resources.NumGC, replay.Resources.NumGC)
+    }
+    if (original.Tardiness != nil && replay.Tardiness != nil) {
+        fmt.Printf("%-14s %16d %16d\n", "tardy", original.Tardiness.NumTardy, replay.Tardiness.NumTardy)
+        fmt.Printf("%-14s %16s %16s\n", "tardiness", original.Tardiness.Total, replay.Tardiness.Total)
+        fmt.Printf("%-14s %16.6f %16.6f\n", "cost of delay", original.Tardiness.Weighted, replay.Tardiness.Weighted)
+    }
+    if (original.Takt != nil && replay.Takt != nil) {
+        fmt.Printf("%-14s %16d %16d\n", "on takt", original.Takt.NumOnTakt, replay.Takt.NumOnTakt)
+        fmt.Printf("%-14s %16d %16d\n", "early", original.Takt.NumEarly, replay.Takt.NumEarly)
+        fmt.Printf("%-14s %16d %16d\n", "late", original.Takt.NumLate, replay.Takt.NumLate)
+    }
+    if (len(original.Wip) > 0 && len(original.Wip) == len(replay.Wip)) {
+        for stage := range original.Wip {
+            fmt.Printf("%-14s %16.2f %16.2f\n", "wip " + original.Wip[stage].Stage, original.Wip[stage].Mean, replay.Wip[stage].Mean)
+            fmt.Printf("%-14s %16d %16d\n", "max wip", original.Wip[stage].Max, replay.Wip[stage].Max)
+        }
+    }
+}
 
-    for i := 0; i < ID_LENGTH; i++ {
-        if i == ID_LENGTH / 2 {
-            buffer.WriteString("-")
-        } else {
-            buffer.WriteString(string(ASCII[rand.Intn(len(ASCII))]))
+// replay [-with name=value]... recording.json
+func replayMain(args []string) {
+    flagSet := flag.NewFlagSet("replay", flag.ExitOnError)
+    var overrides overrideList
+    flagSet.Var(&overrides, "with", "Overrides a setting of the recorded run, e.g. consumers=8 (repeatable)")
+    flagSet.Parse(args)
+    if flagSet.NArg() != 1 {
+        fmt.Fprintln(os.Stderr, "usage: replay [-with name=value]... recording.json")
+        os.Exit(2)
+    }
+
+    recording, err := widgetline.ReadRecording(flagSet.Arg(0))
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    config := recording.Config
+    for _, setting := range overrides {
+        if err := config.Override(setting); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(2)
         }
     }
-    return buffer.String()
+    if err := config.Check(); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+
+    replay, err := widgetline.WidgetProductionConsumptionLine(config, widgetline.LineOptions{Arrivals: recording.Arrivals})
+    if (err != nil && replay.Err() == nil) {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    compareOutcomes("original", recording.Outcome, "replay", replay.Outcome)
+    printAnnotations("original", recording.Annotations)
+    failOnViolations(replay.Outcome)
+}
+
+// resume -skip-broken [-record out.json] recording.json
+// Carry on a recorded run which stopped at its broken Widget, from the job after the broken one
+func resumeMain(args []string) {
+    flagSet := flag.NewFlagSet("resume", flag.ExitOnError)
+    var skipBroken = flagSet.Bool("skip-broken", false, "Goes past the broken Widget the run stopped at")
+    var recordFile = flagSet.String("record", "", "Records the resumed part of the run to this file")
+    flagSet.Parse(args)
+    if flagSet.NArg() != 1 {
+        fmt.Fprintln(os.Stderr, "usage: resume -skip-broken [-record out.json] recording.json")
+        os.Exit(2)
+    }
+
+    recording, err := widgetline.ReadRecording(flagSet.Arg(0))
+    switch {
+    case err != nil:
+    case recording.Outcome.Failures[widgetline.CAUSE_INJECTED] == 0:
+        err = fmt.Errorf("%s did not stop at a broken widget, there is nothing to resume", flagSet.Arg(0))
+    case !*skipBroken:
+        err = fmt.Errorf("%s stopped at a broken widget, resume it with -skip-broken", flagSet.Arg(0))
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    config := recording.Config
+    config.ResumeAfter, config.NumKth = config.NumKth, -1
+    config.Seed += int64(config.ResumeAfter)    // Not the ids of the Widgets already produced
+    if err := config.Check(); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+
+    fmt.Printf("[resuming after job %d of %d]\n", config.ResumeAfter, config.NumWidgets)
+    resumed, err := widgetline.WidgetProductionConsumptionLine(config, widgetline.LineOptions{})
+    if (err != nil && resumed.Err() == nil) {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    compareOutcomes("stopped", recording.Outcome, "resumed", resumed.Outcome)
+    if *recordFile != "" {
+        if err := widgetline.WriteRecording(*recordFile, resumed); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    }
+    failOnViolations(resumed.Outcome)
+}
+
+// Print the diagnostics of every violated invariant and leaked goroutine, and exit with a non-zero status
+func failOnViolations(outcome widgetline.Outcome) {
+    if len(outcome.Violations) == 0 {
+        return
+    }
+    for _, violation := range outcome.Violations {
+        fmt.Fprintln(os.Stderr, violation)
+    }
+    os.Exit(1)
+}
+
+// Print the diagnostics of every violated invariant and exit with the status of the verdict, a run passing goes on
+func exitOnVerdict(outcome widgetline.Outcome) {
+    for _, violation := range outcome.Violations {
+        fmt.Fprintln(os.Stderr, violation)
+    }
+    if code := outcome.Verdict.ExitCode(); code != 0 {
+        os.Exit(code)
+    }
 }
 
 //==============================================================================
-type Producer struct {
-    name        string
-}
-
-// The process when a Producer produces a Widget
-func (prod Producer) produce(broken bool) Widget {
-    return Widget{idMaker(), prod.name, time.Now(), broken}
-}
-
-// jobChannel will be used to keep track of how many widgets got produced, and which widget is broken
-func productionLine(producerTable []Producer, numWidgets int, numKth int, jobChannel <-chan int, outWidgetChannel chan<- Widget, quitChannel <-chan struct{}) {
-    defer wg.Done()
-    defer close(outWidgetChannel)
-    var productionWaitGroup sync.WaitGroup
-
-    productionWaitGroup.Add(len(producerTable))
-    for _, workingProducer := range producerTable {
-        go func(workingProducer Producer) {
-            defer productionWaitGroup.Done()
-            for i := range jobChannel {
-                select {
-                default:
-                    if (numKth == i) {
-                        // Produce broken widget if i = numKth
-                        outWidgetChannel <- workingProducer.produce(true)
-                    } else {
-                        outWidgetChannel <- workingProducer.produce(false)
-                    }
-                case <-quitChannel:
+// Manifest declares what a run is expected to come to, the fields left out are not checked
+type Manifest struct {
+    Produced    *int    `json:"produced,omitempty"`
+    Consumed    *int    `json:"consumed,omitempty"`
+    Broken      *int    `json:"broken,omitempty"`          // Broken widgets produced
+    BrokenAt    *int    `json:"broken_at,omitempty"`       // Position of the first broken widget among the ones produced, from 1
+    Dropped     *int    `json:"dropped,omitempty"`
+    Quarantined *int    `json:"quarantined,omitempty"`
+    Rejected    *int    `json:"rejected,omitempty"`
+    Scrapped    *int    `json:"scrapped,omitempty"`
+    Discarded   *int    `json:"discarded,omitempty"`
+    Contiguous  *bool   `json:"contiguous,omitempty"`      // No sequence number missing, out of order or duplicated
+}
+
+// Unknown fields are refused, so a misspelt expectation does not go unchecked
+func readManifest(fileName string) (Manifest, error) {
+    var manifest Manifest
+    data, err := os.ReadFile(fileName)
+    if err != nil {
+        return manifest, err
+    }
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&manifest); err != nil {
+        return manifest, fmt.Errorf("manifest %s: %s", fileName, err)
+    }
+    return manifest, nil
+}
+
+// Every expectation the recording deviates from, as a diff of the expected against the actual
+// Violations need no manifest, they fail a run anyway
+func (manifest Manifest) diff(recording widgetline.Recording) []string {
+    outcome := recording.Outcome
+    numBroken, brokenAt := 0, 0
+    for i, arrival := range recording.Arrivals {
+        if arrival.Broken {
+            numBroken++
+            if brokenAt == 0 {
+                brokenAt = i + 1
+            }
+        }
+    }
+    var diffs []string
+    check := func(field string, expected *int, actual int) {
+        if (expected != nil && *expected != actual) {
+            diffs = append(diffs, fmt.Sprintf("- %s: %d\n+ %s: %d", field, *expected, field, actual))
+        }
+    }
+    check("produced", manifest.Produced, outcome.NumProduced)
+    check("consumed", manifest.Consumed, outcome.NumConsumed)
+    check("broken", manifest.Broken, numBroken)
+    check("broken_at", manifest.BrokenAt, brokenAt)
+    check("dropped", manifest.Dropped, outcome.Census[widgetline.STATE_DROPPED])
+    check("quarantined", manifest.Quarantined, outcome.Census[widgetline.STATE_QUARANTINED])
+    check("rejected", manifest.Rejected, outcome.Census[widgetline.STATE_REJECTED])
+    check("scrapped", manifest.Scrapped, outcome.Census[widgetline.STATE_SCRAPPED])
+    check("discarded", manifest.Discarded, outcome.Census[widgetline.STATE_DISCARDED])
+    if manifest.Contiguous != nil {
+        switch {
+        case outcome.Irregular == nil:
+            diffs = append(diffs, fmt.Sprintf("- contiguous: %t\n+ contiguous: unknown, the sequences were not followed", *manifest.Contiguous))
+        case *manifest.Contiguous != (*outcome.Irregular == 0):
+            diffs = append(diffs, fmt.Sprintf("- contiguous: %t\n+ contiguous: %t (%d irregular)", *manifest.Contiguous, *outcome.Irregular == 0, *outcome.Irregular))
+        }
+    }
+    return diffs
+}
+
+// Print the deviations from the manifest and exit, a run as expected goes on
+func failOnDeviations(manifestName string, manifest Manifest, recording widgetline.Recording) {
+    diffs := manifest.diff(recording)
+    if len(diffs) == 0 {
+        fmt.Printf("[run as expected by %s]\n", manifestName)
+        return
+    }
+    fmt.Fprintf(os.Stderr, "--- expected by %s\n+++ actual\n", manifestName)
+    for _, diff := range diffs {
+        fmt.Fprintln(os.Stderr, diff)
+    }
+    os.Exit(3)
+}
+
+//=============================================================================
+// Pick a random small scenario, always verified, the settings it does not pick keep their defaults
+func randomScenario(scenarios *rand.Rand) widgetline.LineConfig {
+    config := widgetline.DefaultConfig()
+    config.NumWidgets = scenarios.Intn(50)
+    config.NumProducers = 1 + scenarios.Intn(4)
+    config.NumConsumers = 1 + scenarios.Intn(4)
+    config.LotSize = scenarios.Intn(6)
+    config.ConsumeDelay = time.Duration(scenarios.Intn(100)) * time.Microsecond
+    config.NumCrews = 1 + scenarios.Intn(2)
+    config.Deterministic = scenarios.Intn(4) == 0
+    config.Seed = scenarios.Int63()
+    config.Verify = true
+    if (config.NumWidgets > 0 && scenarios.Intn(2) == 0) {
+        config.NumKth = 1 + scenarios.Intn(config.NumWidgets)
+    }
+    if (scenarios.Intn(4) == 0) {
+        config.Mtbf = widgetline.DurationList{time.Duration(1 + scenarios.Intn(500)) * time.Microsecond}
+        config.Mttr = widgetline.DurationList{time.Duration(scenarios.Intn(100)) * time.Microsecond}
+    }
+    if (scenarios.Intn(4) == 0) {
+        config.Due, config.Weights = widgetline.DurationList{time.Duration(1 + scenarios.Intn(1000)) * time.Microsecond}, widgetline.WeightList{float64(1 + scenarios.Intn(5))}
+    }
+    if (scenarios.Intn(4) == 0) {
+        config.Work = widgetline.DurationList{time.Duration(scenarios.Intn(50)) * time.Microsecond, time.Duration(scenarios.Intn(50)) * time.Microsecond}
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        switch {
+        case (len(config.Due) > 0 && scenarios.Intn(2) == 0):
+            config.Dispatch = "edd"
+        case len(config.Work) > 0:
+            config.Dispatch = "spt"
+        }
+    }
+    if (scenarios.Intn(4) == 0) {
+        config.ConsumeTime = widgetline.ConsumeTimeList{"10us", "5us..50us", "exp:20us"}[:1 + scenarios.Intn(3)]
+    }
+    if (scenarios.Intn(4) == 0) {
+        config.MaintenanceEvery = 1 + scenarios.Intn(10)
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Pull, config.Credits = true, 1 + scenarios.Intn(4)
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Quotas = widgetline.QuotaList{"source=*:" + strconv.Itoa(1 + scenarios.Intn(100)) + "%"}
+        config.QuotaShed = scenarios.Intn(2) == 0
+    }
+    if (scenarios.Intn(4) == 0) {
+        config.Split, config.TransformRate, config.Generations = 1 + scenarios.Intn(3), scenarios.Float64(), 1 + scenarios.Intn(2)
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Until = widgetline.EndList{"good=" + strconv.Itoa(1 + scenarios.Intn(50))}
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Groups = widgetline.GroupList{"line:" + strconv.Itoa(1 + scenarios.Intn(3)), "audit:" + strconv.Itoa(1 + scenarios.Intn(3))}
+    }
+    if (!config.Deterministic && !config.Pull && scenarios.Intn(4) == 0) {
+        config.Partitions = 1 + scenarios.Intn(8)
+        config.Rebalance = []string{"range", "round-robin", "sticky"}[scenarios.Intn(3)]
+        if (scenarios.Intn(3) == 0) {
+            config.Autoscale, config.ScaleUp, config.ScaleDown = "1.." + strconv.Itoa(config.NumConsumers + 3), 1 + scenarios.Intn(20), 0
+            config.ScaleEvery, config.AutoscaleProducers = time.Duration(1 + scenarios.Intn(5)) * time.Millisecond, scenarios.Intn(config.NumProducers + 1)
+            if len(config.Groups) > 0 {
+                config.Autoscale = "1..6"
+            }
+        }
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Shutdown = []string{"cancel", "producers-first", "drain"}[scenarios.Intn(3)]
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Scores, config.ScoreThreshold = widgetline.ScoreList{"skew=1ms", "entropy", "labels:2"}, scenarios.Float64()
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Rules = widgetline.RuleList{"queue_depth > " + strconv.Itoa(scenarios.Intn(10)) + " then pause producer producer_0"}
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Feedback = strconv.Itoa(1 + scenarios.Intn(2)) + " of 3 then " + []string{"slow", "recalibrate"}[scenarios.Intn(2)] + " 1ms"
+    }
+    if (!config.Deterministic && len(config.Groups) == 0 && scenarios.Intn(4) == 0) {
+        config.Kanban = widgetline.CardList{1 + scenarios.Intn(8), 1 + scenarios.Intn(4)}[:1 + scenarios.Intn(2)]
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Takt = time.Duration(1 + scenarios.Intn(100)) * time.Microsecond
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.ProduceRate, config.ProduceJitter = float64(1000 + scenarios.Intn(100000)), scenarios.Float64() * 0.5
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Buffer = scenarios.Intn(4)
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Inspect, config.RepairRate = true, scenarios.Float64()
+    }
+    if (scenarios.Intn(4) == 0) {
+        config.PayloadSize = scenarios.Intn(4096)
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.ConsumeFailRate, config.ConsumeAttempts = scenarios.Float64() * 0.5, 1 + scenarios.Intn(3)
+        config.ConsumeBackoff = time.Duration(1 + scenarios.Intn(50)) * time.Microsecond
+    }
+    if (config.NumKth > 0 && scenarios.Intn(3) == 0) {
+        config.StopPolicy = []string{"halt", "skip", "threshold=" + strconv.Itoa(1 + scenarios.Intn(3))}[scenarios.Intn(3)]
+        if (!config.Deterministic && scenarios.Intn(4) == 0) {
+            config.StopPolicy = "dead-letter"
+        }
+    }
+    if (!config.Deterministic && scenarios.Intn(4) == 0) {
+        config.Stages = widgetline.StageList{"inspect:" + strconv.Itoa(1 + scenarios.Intn(3)) + ":" + strconv.Itoa(scenarios.Intn(50)) + "us:0.1", "paint:2:10us"}[:1 + scenarios.Intn(2)]
+    }
+    if (scenarios.Intn(4) == 0) {
+        config.Verdict = widgetline.CriterionList{"defects:0.05:0.1:2", "violations:0:1:4", "drops:0.01:0.05"}
+    }
+    if (!config.Deterministic && !config.Pull && config.Partitions == 0 && len(config.Groups) == 0 && config.NumConsumers > 1 && scenarios.Intn(4) == 0) {
+        config.Pools = []string{"a:1", "b:" + strconv.Itoa(config.NumConsumers - 1)}
+        config.Steal = (config.ConsumerCrash > 0 || scenarios.Intn(2) == 0)
+    }
+    config.Stats = scenarios.Intn(4) == 0
+    config.Ids = []string{widgetline.ID_LEGACY, widgetline.ID_UUID, widgetline.ID_ULID}[scenarios.Intn(3)]
+    config.LogLevel = []string{"", "trace", "error"}[scenarios.Intn(3)]
+    // Nothing listens on port 1, the spans are traced all the same and dropped once exporting them fails
+    if scenarios.Intn(8) == 0 {
+        config.OtelEndpoint = "http://127.0.0.1:1"
+    }
+    return config
+}
+
+// Run a scenario with its output discarded, returning the invariants it violated
+func runQuietly(config widgetline.LineConfig) []string {
+    recording, err := recordQuietly(config)
+    if err != nil {
+        return []string{err.Error()}
+    }
+    return recording.Outcome.Violations
+}
+
+// The error is only the one of a line which could not run at all, the failures of a run are left to its recording
+func recordQuietly(config widgetline.LineConfig) (widgetline.Recording, error) {
+    quiet := widgetline.Services{Log: io.Discard, Report: io.Discard}
+    recording, err := quiet.Line(config, widgetline.LineOptions{})
+    if recording.Err() != nil {
+        return recording, nil
+    }
+    return recording, err
+}
+
+// A failing scenario fails again within a few attempts, since concurrency failures do not show up on every run
+func fails(config widgetline.LineConfig, attempts int) bool {
+    for i := 0; i < attempts; i++ {
+        if len(runQuietly(config)) > 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// Every scenario one step simpler than config
+func simplerScenarios(config widgetline.LineConfig) []widgetline.LineConfig {
+    var candidates []widgetline.LineConfig
+    simplify := func(change func(candidate *widgetline.LineConfig)) {
+        candidate := config
+        change(&candidate)
+        if (candidate.Check() == nil && !reflect.DeepEqual(candidate, config)) {
+            candidates = append(candidates, candidate)
+        }
+    }
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Mtbf, candidate.Mttr = nil, nil })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.MaintenanceEvery = 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.LotSize = 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Quotas, candidate.QuotaShed = nil, false })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Split = 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Until = nil })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Groups = nil })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Partitions, candidate.Rebalance = 0, "" })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Autoscale, candidate.AutoscaleProducers = "", 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Scores, candidate.ScoreThreshold = nil, 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Shutdown = "" })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Rules = nil })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Feedback = "" })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Due, candidate.Weights, candidate.Dispatch = nil, nil, "" })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Work, candidate.Dispatch = nil, "" })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Kanban, candidate.Wip = nil, false })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Takt = 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.ProduceRate, candidate.ProduceJitter = 0, 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Buffer = -1 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Stages = nil })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Inspect, candidate.RepairRate = false, 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.StopPolicy = "" })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.PayloadSize = 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.ConsumeFailRate = 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Pools, candidate.Steal = nil, false })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Verdict = nil })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Stats = false })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Ids = "" })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.LogLevel = "" })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.OtelEndpoint = "" })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.ConsumeDelay = 0 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.ConsumeTime = nil })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.NumKth = -1 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.Deterministic = false })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.NumCrews = 1 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.NumProducers = 1 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.NumConsumers = 1 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.NumProducers-- })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.NumConsumers-- })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.NumWidgets /= 2 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.NumWidgets-- })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.NumKth /= 2 })
+    simplify(func(candidate *widgetline.LineConfig) { candidate.NumKth-- })
+    return candidates
+}
+
+// Shrink a failing scenario until none of its simpler scenarios fail anymore
+func shrink(config widgetline.LineConfig, attempts int) widgetline.LineConfig {
+    for shrunk := true; shrunk; {
+        shrunk = false
+        for _, candidate := range simplerScenarios(config) {
+            if fails(candidate, attempts) {
+                config, shrunk = candidate, true
+                break
+            }
+        }
+    }
+    return config
+}
+
+// stress [-runs N] [-seed S] [-attempts A] [-out reproducer.json] | stress -repro reproducer.json
+func stressMain(args []string) {
+    flagSet := flag.NewFlagSet("stress", flag.ExitOnError)
+    var numRuns = flagSet.Int("runs", 100, "Sets the number of random scenarios to run")
+    var seed = flagSet.Int64("seed", 0, "Sets the seed picking the scenarios (0 means seeded from the clock)")
+    var attempts = flagSet.Int("attempts", 3, "Sets how many times a scenario is retried while shrinking")
+    var outFile = flagSet.String("out", "stress-reproducer.json", "Sets where the minimal reproducer of a failure is written")
+    var reproFile = flagSet.String("repro", "", "Runs a reproducer written by an earlier stress run instead")
+    flagSet.Parse(args)
+
+    if *reproFile != "" {
+        data, err := os.ReadFile(*reproFile)
+        if err == nil {
+            // Settings added since the reproducer was written keep their defaults
+            config := widgetline.DefaultConfig()
+            if err = json.Unmarshal(data, &config); err == nil {
+                var recording widgetline.Recording
+                if recording, err = widgetline.WidgetProductionConsumptionLine(config, widgetline.LineOptions{}); (err == nil || recording.Err() != nil) {
+                    failOnViolations(recording.Outcome)
                     return
                 }
             }
-        }(workingProducer)
+        }
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    if (*seed == 0) {
+        *seed = time.Now().UnixNano()
+    }
+    scenarios := rand.New(rand.NewSource(*seed))
+    for run := 1; run <= *numRuns; run++ {
+        config := randomScenario(scenarios)
+        violations := runQuietly(config)
+        if len(violations) == 0 {
+            continue
+        }
+
+        fmt.Printf("stress run %d of seed %d failed:\n", run, *seed)
+        for _, violation := range violations {
+            fmt.Printf("    %s\n", violation)
+        }
+        config = shrink(config, *attempts)
+        data, _ := json.MarshalIndent(config, "", "    ")
+        if err := os.WriteFile(*outFile, data, 0644); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        fmt.Printf("minimal reproducer written to %s:\n%s\n", *outFile, data)
+        os.Exit(1)
+    }
+    fmt.Printf("%d stress runs of seed %d passed\n", *numRuns, *seed)
+}
+
+// bench [-policies fifo,edd,spt] [-sweep-producers 1,2,4] [-sweep-consumers 1,2,4] [-sweep-buffers 0,16] [-csv sweep.csv]
+// [flags of the line], runs the line with the consumers pushed to then pulling, pushing then with -kanban when given,
+// once with every dispatch policy, or once with every combination swept, with the same seed
+func benchMain(args []string) {
+    flagSet := flag.NewFlagSet("bench", flag.ExitOnError)
+    var policies = flagSet.String("policies", "", "Runs the line once with every dispatch policy instead, comma separated (e.g. fifo,edd,spt)")
+    var sweepProducers = flagSet.String("sweep-producers", "", "Sweeps the number of producers over these values, comma separated (e.g. 1,2,4)")
+    var sweepConsumers = flagSet.String("sweep-consumers", "", "Sweeps the number of consumers over these values, comma separated (e.g. 1,2,4)")
+    var sweepBuffers = flagSet.String("sweep-buffers", "", "Sweeps the capacity of the channels over these values, comma separated (e.g. 0,16,-1)")
+    var csvFile = flagSet.String("csv", "", "Writes the rows of a sweep to this CSV file as well")
+    config, err := widgetline.ResolveConfig(flagSet, args)
+    if err == nil && config.Soak {
+        err = fmt.Errorf("-soak runs cannot be benchmarked")
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    if (config.Seed == 0) {
+        config.Seed = time.Now().UnixNano()
+    }
+    if *policies != "" {
+        benchPolicies(config, strings.Split(*policies, ","))
+        return
+    }
+    if (*sweepProducers != "" || *sweepConsumers != "" || *sweepBuffers != "") {
+        producers, err := parseSweep("-sweep-producers", *sweepProducers, config.NumProducers)
+        consumers, errConsumers := parseSweep("-sweep-consumers", *sweepConsumers, config.NumConsumers)
+        buffers, errBuffers := parseSweep("-sweep-buffers", *sweepBuffers, config.Buffer)
+        if err = errors.Join(err, errConsumers, errBuffers); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(2)
+        }
+        benchSweep(config, producers, consumers, buffers, *csvFile)
+        return
+    }
+    if *csvFile != "" {
+        fmt.Fprintln(os.Stderr, "-csv needs a sweep")
+        os.Exit(2)
+    }
+
+    // A kanban line is compared with the same line pushing, the WIP of both followed
+    push, pull, pullName := config, config, "pull"
+    push.Pull, pull.Pull = false, true
+    header := fmt.Sprintf("%d credits per pulling consumer", config.Credits)
+    if len(config.Kanban) > 0 {
+        push.Kanban, push.Wip, pull.Pull, pullName = nil, true, config.Pull, "kanban"
+        header = fmt.Sprintf("%s kanban cards", config.Kanban.String())
+    }
+    var outcomes []widgetline.Outcome
+    for _, run := range []widgetline.LineConfig{push, pull} {
+        recording, err := recordQuietly(run)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        outcomes = append(outcomes, recording.Outcome)
+    }
+    fmt.Printf("[bench with seed %d, %s]\n", config.Seed, header)
+    compareOutcomes("push", outcomes[0], pullName, outcomes[1])
+}
+
+// Run the line once with every dispatch policy and score them side by side on throughput and tardiness
+func benchPolicies(config widgetline.LineConfig, policies []string) {
+    var outcomes []widgetline.Outcome
+    for _, policy := range policies {
+        config.Dispatch = strings.TrimSpace(policy)
+        if err := config.Check(); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(2)
+        }
+        recording, err := recordQuietly(config)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        outcomes = append(outcomes, recording.Outcome)
+    }
+
+    fmt.Printf("[bench with seed %d]\n", config.Seed)
+    row := func(name string, cell func(outcome widgetline.Outcome) string) {
+        fmt.Printf("%-14s", name)
+        for _, outcome := range outcomes {
+            fmt.Printf(" %16s", cell(outcome))
+        }
+        fmt.Println()
+    }
+    fmt.Printf("%-14s", "")
+    for _, policy := range policies {
+        fmt.Printf(" %16s", strings.TrimSpace(policy))
+    }
+    fmt.Println()
+    row("consumed", func(outcome widgetline.Outcome) string { return strconv.Itoa(outcome.NumConsumed) })
+    row("throughput", func(outcome widgetline.Outcome) string { return fmt.Sprintf("%.1f/s", outcome.Throughput) })
+    row("mean latency", func(outcome widgetline.Outcome) string { return outcome.MeanLatency.String() })
+    row("max latency", func(outcome widgetline.Outcome) string { return outcome.MaxLatency.String() })
+    if outcomes[0].Tardiness != nil {
+        row("tardy", func(outcome widgetline.Outcome) string { return strconv.Itoa(outcome.Tardiness.NumTardy) })
+        row("tardiness", func(outcome widgetline.Outcome) string { return outcome.Tardiness.Total.String() })
+        row("max tardiness", func(outcome widgetline.Outcome) string { return outcome.Tardiness.Max.String() })
+        row("cost of delay", func(outcome widgetline.Outcome) string { return fmt.Sprintf("%.6f", outcome.Tardiness.Weighted) })
+    }
+}
+
+// The values swept by a -sweep flag, only the value of the line when not swept
+func parseSweep(name string, spec string, value int) ([]int, error) {
+    if spec == "" {
+        return []int{value}, nil
+    }
+    var values []int
+    for _, field := range strings.Split(spec, ",") {
+        value, err := strconv.Atoi(strings.TrimSpace(field))
+        if err != nil {
+            return nil, fmt.Errorf("%s takes whole numbers, comma separated, got %q", name, spec)
+        }
+        values = append(values, value)
+    }
+    return values, nil
+}
+
+// Run the line once with every combination of producers, consumers and channel capacity, the producers varying
+// slowest, and compare them side by side on throughput and latency, each against the best throughput of the sweep
+func benchSweep(config widgetline.LineConfig, producers []int, consumers []int, buffers []int, csvFileName string) {
+    type Cell struct {
+        numProducers    int
+        numConsumers    int
+        buffer          int
+        outcome         widgetline.Outcome
+    }
+    var cells []Cell
+    best := 0.0
+    for _, numProducers := range producers {
+        for _, numConsumers := range consumers {
+            for _, buffer := range buffers {
+                run := config
+                run.NumProducers, run.NumConsumers, run.Buffer = numProducers, numConsumers, buffer
+                if err := run.Check(); err != nil {
+                    fmt.Fprintf(os.Stderr, "%d producers, %d consumers, buffer %d: %s\n", numProducers, numConsumers, buffer, err)
+                    os.Exit(2)
+                }
+                recording, err := recordQuietly(run)
+                if err != nil {
+                    fmt.Fprintln(os.Stderr, err)
+                    os.Exit(1)
+                }
+                cells = append(cells, Cell{numProducers, numConsumers, buffer, recording.Outcome})
+                best = max(best, recording.Outcome.Throughput)
+            }
+        }
+    }
+
+    fmt.Printf("[bench sweep of %d runs with seed %d]\n", len(cells), config.Seed)
+    fmt.Printf("%9s %9s %7s %9s %14s %16s %16s %8s\n", "producers", "consumers", "buffer", "consumed", "throughput", "mean latency", "max latency", "of best")
+    for _, cell := range cells {
+        buffer := strconv.Itoa(cell.buffer)
+        if cell.buffer < 0 {
+            buffer = "all"
+        }
+        ofBest := 0.0
+        if best > 0 {
+            ofBest = 100 * cell.outcome.Throughput / best
+        }
+        fmt.Printf("%9d %9d %7s %9d %12.1f/s %16s %16s %7.0f%%\n", cell.numProducers, cell.numConsumers, buffer, cell.outcome.NumConsumed,
+            cell.outcome.Throughput, cell.outcome.MeanLatency, cell.outcome.MaxLatency, ofBest)
+    }
+    if csvFileName == "" {
+        return
+    }
+
+    // The CSV keeps the numbers whole, in seconds, for spreadsheets to chart
+    file, err := os.Create(csvFileName)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    writer := csv.NewWriter(file)
+    writer.Write([]string{"producers", "consumers", "buffer", "consumed", "throughput_per_second", "mean_latency_seconds", "max_latency_seconds",
+        "duration_seconds"})
+    for _, cell := range cells {
+        writer.Write([]string{strconv.Itoa(cell.numProducers), strconv.Itoa(cell.numConsumers), strconv.Itoa(cell.buffer),
+            strconv.Itoa(cell.outcome.NumConsumed), strconv.FormatFloat(cell.outcome.Throughput, 'f', 3, 64),
+            strconv.FormatFloat(cell.outcome.MeanLatency.Seconds(), 'f', 9, 64), strconv.FormatFloat(cell.outcome.MaxLatency.Seconds(), 'f', 9, 64),
+            strconv.FormatFloat(cell.outcome.Duration.Seconds(), 'f', 9, 64)})
+    }
+    writer.Flush()
+    if err = errors.Join(writer.Error(), file.Close()); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    fmt.Printf("[bench sweep written to %s]\n", csvFileName)
+}
+
+// ParallelLine is one of the independent lines run by parallel, in a process of its own
+type ParallelLine struct {
+    args        []string    // Flags of the line, the seed included so it runs the same alone and together
+    procs       int         // GOMAXPROCS of its process
+    alone       widgetline.Outcome
+    together    widgetline.Outcome
+}
+
+// Run the line in a child process limited to its GOMAXPROCS, returning the outcome it recorded
+func (line *ParallelLine) run() (widgetline.Outcome, error) {
+    executable, err := os.Executable()
+    if err != nil {
+        return widgetline.Outcome{}, err
+    }
+    file, err := os.CreateTemp("", "parallel-*.json")
+    if err != nil {
+        return widgetline.Outcome{}, err
+    }
+    file.Close()
+    defer os.Remove(file.Name())
+
+    var stderr bytes.Buffer
+    command := exec.Command(executable, append(append([]string{}, line.args...), "-record", file.Name())...)
+    command.Env = append(os.Environ(), "GOMAXPROCS=" + strconv.Itoa(line.procs))
+    command.Stderr = &stderr
+    if err := command.Run(); err != nil {
+        return widgetline.Outcome{}, fmt.Errorf("%s: %s %s", strings.Join(line.args, " "), err, strings.TrimSpace(stderr.String()))
+    }
+    recording, err := widgetline.ReadRecording(file.Name())
+    return recording.Outcome, err
+}
+
+// parallel [-procs n,n,...] -- '<flags of a line>' '<flags of a line>'...
+// Run independent lines, every one alone and then all of them at once, each in its own process holding its share of
+// GOMAXPROCS, to measure how much they slow each other down
+func parallelMain(args []string) {
+    flagSet := flag.NewFlagSet("parallel", flag.ExitOnError)
+    var procs = flagSet.String("procs", "", "Sets the GOMAXPROCS of every line, comma separated (default an even share of the CPUs)")
+    flagSet.Parse(args)
+    if flagSet.NArg() < 1 {
+        fmt.Fprintln(os.Stderr, "usage: parallel [-procs n,n,...] -- '<flags of a line>' '<flags of a line>'...")
+        os.Exit(2)
+    }
+
+    var shares []string
+    if *procs != "" {
+        shares = strings.Split(*procs, ",")
+    }
+    if (len(shares) > 0 && len(shares) != flagSet.NArg()) {
+        fmt.Fprintf(os.Stderr, "-procs must give a share to every one of the %d lines, got %d\n", flagSet.NArg(), len(shares))
+        os.Exit(2)
+    }
+    var lines []*ParallelLine
+    for i, spec := range flagSet.Args() {
+        line := &ParallelLine{args: strings.Fields(spec), procs: max(runtime.NumCPU() / flagSet.NArg(), 1)}
+        lineFlags := flag.NewFlagSet("line", flag.ContinueOnError)
+        lineFlags.SetOutput(io.Discard)
+        config, err := widgetline.ResolveConfig(lineFlags, line.args)
+        if (err == nil && config.Soak) {
+            err = fmt.Errorf("-soak runs cannot run in parallel")
+        }
+        if (err == nil && len(shares) > 0) {
+            if line.procs, err = strconv.Atoi(shares[i]); (err == nil && line.procs < 1) {
+                err = fmt.Errorf("-procs must be at least 1, got %d", line.procs)
+            }
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "line %d: %s\n", i + 1, err)
+            os.Exit(2)
+        }
+        if config.Seed == 0 {
+            line.args = append(line.args, "-seed", strconv.FormatInt(time.Now().UnixNano() + int64(i), 10))
+        }
+        lines = append(lines, line)
+    }
+
+    var err error
+    for _, line := range lines {
+        if line.alone, err = line.run(); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    }
+    var lineWaitGroup sync.WaitGroup
+    errs := make([]error, len(lines))
+    for i, line := range lines {
+        lineWaitGroup.Add(1)
+        go func() {
+            defer lineWaitGroup.Done()
+            line.together, errs[i] = line.run()
+        }()
+    }
+    lineWaitGroup.Wait()
+    if err := errors.Join(errs...); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    numProcs := 0
+    for _, line := range lines {
+        numProcs += line.procs
+    }
+    fmt.Printf("[%d lines on %d of %d CPUs]\n", len(lines), numProcs, runtime.NumCPU())
+    fmt.Printf("%-6s %6s %16s %16s %10s %14s %14s\n", "line", "procs", "alone", "together", "slowdown", "cpu alone", "cpu together")
+    for i, line := range lines {
+        slowdown := 0.0
+        if line.alone.Throughput > 0 {
+            slowdown = 100 * (1 - line.together.Throughput / line.alone.Throughput)
+        }
+        fmt.Printf("%-6d %6d %14.1f/s %14.1f/s %9.1f%% %14s %14s\n", i + 1, line.procs, line.alone.Throughput, line.together.Throughput, slowdown,
+            line.alone.Resources.CPU(), line.together.Resources.CPU())
+    }
+}
+
+//==============================================================================
+// Trend is a metric followed across the runs of the history
+type Trend struct {
+    name    string
+    unit    string
+    value   func(entry widgetline.HistoryEntry) float64
+}
+
+var TRENDS = []Trend{
+    {"throughput", "widgets/s", func(entry widgetline.HistoryEntry) float64 { return entry.Outcome.Throughput }},
+    {"defect rate", "%", func(entry widgetline.HistoryEntry) float64 { return 100 * entry.DefectRate() }},
+    {"mean latency", "ms", func(entry widgetline.HistoryEntry) float64 { return float64(entry.Outcome.MeanLatency) / float64(time.Millisecond) }},
+}
+
+// Print the trends as a table, the last line is the change from the first run to the last
+func printTrends(history []widgetline.HistoryEntry) {
+    fmt.Printf("%-20s %10s %10s", "run", "produced", "consumed")
+    for _, trend := range TRENDS {
+        fmt.Printf(" %22s", fmt.Sprintf("%s (%s)", trend.name, trend.unit))
+    }
+    fmt.Println()
+    for _, entry := range history {
+        fmt.Printf("%-20s %10d %10d", entry.Time.Format("2006-01-02 15:04:05"), entry.Outcome.NumProduced, entry.Outcome.NumConsumed)
+        for _, trend := range TRENDS {
+            fmt.Printf(" %22.3f", trend.value(entry))
+        }
+        fmt.Println()
+    }
+    first, last := history[0], history[len(history) - 1]
+    fmt.Printf("%-42s", fmt.Sprintf("change over %d runs", len(history)))
+    for _, trend := range TRENDS {
+        fmt.Printf(" %+22.3f", trend.value(last) - trend.value(first))
+    }
+    fmt.Println()
+    for _, entry := range history {
+        printAnnotations(entry.Time.Format("2006-01-02 15:04:05"), entry.Annotations)
+    }
+    outcomes := make([]widgetline.Outcome, len(history))
+    for i, entry := range history {
+        outcomes[i] = entry.Outcome
+    }
+    widgetline.PrintPareto(os.Stdout, paretos(outcomes)[0])
+}
+
+// Print the annotations of a run next to their offset from its start
+func printAnnotations(run string, annotations []widgetline.Annotation) {
+    for _, annotation := range annotations {
+        fmt.Printf("%-20s +%-12s %s\n", run, annotation.Offset.Round(time.Millisecond), annotation.Text)
+    }
+}
+
+// Write the trends as an HTML page, one line chart per metric
+func writeTrendsHTML(fileName string, history []widgetline.HistoryEntry) error {
+    const width, height = 600.0, 150.0
+    var buffer bytes.Buffer
+    buffer.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Widget line trends</title></head>\n<body style=\"font-family: sans-serif\">\n")
+    fmt.Fprintf(&buffer, "<h1>Trends over the last %d runs</h1>\n<p>%s to %s</p>\n", len(history),
+        history[0].Time.Format(time.RFC3339), history[len(history) - 1].Time.Format(time.RFC3339))
+    for _, trend := range TRENDS {
+        lowest, highest := trend.value(history[0]), trend.value(history[0])
+        for _, entry := range history {
+            lowest, highest = min(lowest, trend.value(entry)), max(highest, trend.value(entry))
+        }
+        span := highest - lowest
+        if span == 0 {
+            span = 1
+        }
+        var points []string
+        for i, entry := range history {
+            x := 0.0
+            if len(history) > 1 {
+                x = width * float64(i) / float64(len(history) - 1)
+            }
+            y := height - height * (trend.value(entry) - lowest) / span
+            points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+        }
+        fmt.Fprintf(&buffer, "<h2>%s (%s)</h2>\n<p>lowest %.3f, highest %.3f, last %.3f</p>\n", trend.name, trend.unit,
+            lowest, highest, trend.value(history[len(history) - 1]))
+        fmt.Fprintf(&buffer, "<svg width=\"%.0f\" height=\"%.0f\" viewBox=\"-5 -5 %.0f %.0f\" style=\"border: 1px solid #ccc\">", width + 10, height + 10, width + 10, height + 10)
+        fmt.Fprintf(&buffer, "<polyline fill=\"none\" stroke=\"steelblue\" stroke-width=\"2\" points=\"%s\"/></svg>\n", strings.Join(points, " "))
+    }
+    outcomes := make([]widgetline.Outcome, len(history))
+    for i, entry := range history {
+        outcomes[i] = entry.Outcome
+    }
+    for _, pareto := range paretos(outcomes) {
+        writeParetoHTML(&buffer, pareto)
+    }
+    buffer.WriteString("</body></html>\n")
+    return os.WriteFile(fileName, buffer.Bytes(), 0644)
+}
+
+// The Pareto breakdowns of the outcomes together, by cause, by producer and by kind
+func paretos(outcomes []widgetline.Outcome) []widgetline.Pareto {
+    byCause, bySource, byKind := make(map[string]int), make(map[string]int), make(map[string]int)
+    for _, outcome := range outcomes {
+        for cause, count := range outcome.Failures {
+            byCause[cause] += count
+        }
+        for source, count := range outcome.FailuresBySource {
+            bySource[source] += count
+        }
+        for kind, count := range outcome.FailuresByKind {
+            byKind[kind] += count
+        }
+    }
+    return []widgetline.Pareto{{By: "cause", Counts: byCause}, {By: "producer", Counts: bySource}, {By: "kind", Counts: byKind}}
+}
+
+// Write a Pareto breakdown as an HTML bar chart, with the cumulative percentage as a line over the bars
+func writeParetoHTML(buffer *bytes.Buffer, pareto widgetline.Pareto) {
+    const width, height = 600.0, 150.0
+    bars := pareto.Bars()
+    if len(bars) == 0 {
+        return
+    }
+    slot := width / float64(len(bars))
+    fmt.Fprintf(buffer, "<h2>Defects by %s</h2>\n", pareto.By)
+    fmt.Fprintf(buffer, "<svg width=\"%.0f\" height=\"%.0f\" viewBox=\"-5 -5 %.0f %.0f\" style=\"border: 1px solid #ccc\">", width + 10, height + 10, width + 10, height + 10)
+    var points []string
+    for i, bar := range bars {
+        x := slot * float64(i)
+        barHeight := height * float64(bar.Count) / float64(bars[0].Count)
+        fmt.Fprintf(buffer, "<rect x=\"%.1f\" y=\"%.1f\" width=\"%.1f\" height=\"%.1f\" fill=\"steelblue\"><title>%s</title></rect>",
+            x + slot * 0.1, height - barHeight, slot * 0.8, barHeight, html.EscapeString(bar.Name))
+        points = append(points, fmt.Sprintf("%.1f,%.1f", x + slot / 2, height - height * bar.Cumulative / 100))
+    }
+    fmt.Fprintf(buffer, "<polyline fill=\"none\" stroke=\"darkorange\" stroke-width=\"2\" points=\"%s\"/></svg>\n", strings.Join(points, " "))
+    buffer.WriteString("<table>\n<tr><th align=\"left\">" + pareto.By + "</th><th>defects</th><th>share</th><th>cumulative</th></tr>\n")
+    for _, bar := range bars {
+        fmt.Fprintf(buffer, "<tr><td>%s</td><td align=\"right\">%d</td><td align=\"right\">%.1f%%</td><td align=\"right\">%.1f%%</td></tr>\n",
+            html.EscapeString(bar.Name), bar.Count, bar.Share, bar.Cumulative)
+    }
+    buffer.WriteString("</table>\n")
+}
+
+// report trends [-last N] [-html file] history.jsonl
+func reportMain(args []string) {
+    switch {
+    case (len(args) > 0 && args[0] == "trends"):
+        trendsMain(args[1:])
+    case (len(args) > 0 && args[0] == "lineage"):
+        lineageMain(args[1:])
+    case (len(args) > 0 && args[0] == "pareto"):
+        paretoMain(args[1:])
+    case (len(args) > 0 && args[0] == "widgets"):
+        widgetsMain(args[1:])
+    default:
+        fmt.Fprintln(os.Stderr, "usage: report trends [-last N] [-html file] history.jsonl | report lineage <id> recording.json | report pareto [-last N] [-html file] history.jsonl|recording.json | report widgets ledger.jsonl")
+        os.Exit(2)
+    }
+}
+
+// report pareto [-last N] [-html file] history.jsonl|recording.json
+// Break the defects of a recorded run, or of the latest runs of a history, down by cause, producer and kind
+func paretoMain(args []string) {
+    flagSet := flag.NewFlagSet("report pareto", flag.ExitOnError)
+    var last = flagSet.Int("last", 20, "Sets how many of the latest runs of a history are added up")
+    var htmlFile = flagSet.String("html", "", "Also writes the breakdowns as charts to this HTML file")
+    flagSet.Parse(args)
+    if (flagSet.NArg() != 1 || *last < 1) {
+        fmt.Fprintln(os.Stderr, "usage: report pareto [-last N] [-html file] history.jsonl|recording.json")
+        os.Exit(2)
+    }
+
+    var outcomes []widgetline.Outcome
+    recording, err := widgetline.ReadRecording(flagSet.Arg(0))
+    if err == nil {
+        outcomes = append(outcomes, recording.Outcome)
+    } else if history, historyErr := widgetline.ReadHistory(flagSet.Arg(0)); historyErr == nil {
+        err = nil
+        if len(history) > *last {
+            history = history[len(history) - *last:]
+        }
+        for _, entry := range history {
+            outcomes = append(outcomes, entry.Outcome)
+        }
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    breakdowns := paretos(outcomes)
+    if len(breakdowns[0].Counts) == 0 {
+        fmt.Printf("[no defects in %d runs]\n", len(outcomes))
+        return
+    }
+    for _, pareto := range breakdowns {
+        widgetline.PrintPareto(os.Stdout, pareto)
+    }
+    if *htmlFile != "" {
+        var buffer bytes.Buffer
+        buffer.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Widget line defects</title></head>\n<body style=\"font-family: sans-serif\">\n")
+        fmt.Fprintf(&buffer, "<h1>Defects over %d runs</h1>\n", len(outcomes))
+        for _, pareto := range breakdowns {
+            writeParetoHTML(&buffer, pareto)
+        }
+        buffer.WriteString("</body></html>\n")
+        if err := os.WriteFile(*htmlFile, buffer.Bytes(), 0644); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    }
+}
+
+// report widgets ledger.jsonl
+// Run the canned queries over the ledger of a run: the widgets in every final state, the percentiles of the consume
+// and queue latencies, and the widgets and defect rate of every producer and consumer
+func widgetsMain(args []string) {
+    if len(args) != 1 {
+        fmt.Fprintln(os.Stderr, "usage: report widgets ledger.jsonl")
+        os.Exit(2)
+    }
+    records, err := widgetline.ReadWidgetLedger(args[0])
+    if (err == nil && len(records) == 0) {
+        err = fmt.Errorf("%s has no widgets", args[0])
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    states := make(map[string]int)
+    var latencies, waits []time.Duration
+    for _, record := range records {
+        states[record.State]++
+        if !record.Consumed.IsZero() {
+            latencies = append(latencies, record.Consumed.Sub(record.Produced))
+            waits = append(waits, record.Started.Sub(record.Produced))
+        }
+    }
+    fmt.Printf("[%d widgets in %s]\n", len(records), args[0])
+    for _, state := range slices.Sorted(maps.Keys(states)) {
+        fmt.Printf("%-14s %10d\n", state, states[state])
+    }
+    fmt.Printf("\n%-14s %14s %14s %14s %14s\n", "latency", "p50", "p90", "p99", "max")
+    printPercentiles("consume", latencies)
+    printPercentiles("queue", waits)
+    printDefectRates("producer", records, func(record widgetline.WidgetRecord) string { return record.Source })
+    printDefectRates("consumer", records, func(record widgetline.WidgetRecord) string { return record.Consumer })
+}
+
+func printPercentiles(name string, latencies []time.Duration) {
+    if len(latencies) == 0 {
+        fmt.Printf("%-14s %14s\n", name, "none consumed")
+        return
+    }
+    slices.Sort(latencies)
+    percentile := func(p int) time.Duration {
+        return latencies[(len(latencies) * p + 99) / 100 - 1]
+    }
+    fmt.Printf("%-14s %14s %14s %14s %14s\n", name, percentile(50), percentile(90), percentile(99), latencies[len(latencies) - 1])
+}
+
+// Print the widgets of every producer or consumer, how many of them were broken or defective and their share
+func printDefectRates(by string, records []widgetline.WidgetRecord, key func(record widgetline.WidgetRecord) string) {
+    widgets, defects := make(map[string]int), make(map[string]int)
+    for _, record := range records {
+        name := key(record)
+        if name == "" {
+            continue
+        }
+        widgets[name]++
+        if (record.Broken || record.Defective) {
+            defects[name]++
+        }
+    }
+    fmt.Printf("\n%-14s %10s %10s %12s\n", by, "widgets", "defects", "defect rate")
+    for _, name := range slices.Sorted(maps.Keys(widgets)) {
+        fmt.Printf("%-14s %10d %10d %11.2f%%\n", name, widgets[name], defects[name], 100 * float64(defects[name]) / float64(widgets[name]))
+    }
+}
+
+// report trends [-last N] [-html file] history.jsonl
+func trendsMain(args []string) {
+    flagSet := flag.NewFlagSet("report trends", flag.ExitOnError)
+    var last = flagSet.Int("last", 20, "Sets how many of the latest runs are shown")
+    var htmlFile = flagSet.String("html", "", "Also writes the trends as charts to this HTML file")
+    flagSet.Parse(args)
+    if (flagSet.NArg() != 1 || *last < 1) {
+        fmt.Fprintln(os.Stderr, "usage: report trends [-last N] [-html file] history.jsonl")
+        os.Exit(2)
+    }
+
+    history, err := widgetline.ReadHistory(flagSet.Arg(0))
+    if err == nil && len(history) == 0 {
+        err = fmt.Errorf("%s has no runs", flagSet.Arg(0))
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    if len(history) > *last {
+        history = history[len(history) - *last:]
+    }
+    printTrends(history)
+    if *htmlFile != "" {
+        if err := writeTrendsHTML(*htmlFile, history); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    }
+}
+
+// report lineage <id> recording.json
+// Print the whole family tree of a Widget, from the produced Widget it comes from down to the last Widgets derived
+func lineageMain(args []string) {
+    if len(args) != 2 {
+        fmt.Fprintln(os.Stderr, "usage: report lineage <id> recording.json")
+        os.Exit(2)
+    }
+    id := args[0]
+    recording, err := widgetline.ReadRecording(args[1])
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    parents := make(map[string]string)
+    children := make(map[string][]string)
+    for _, derivation := range recording.Derivations {
+        parents[derivation.Child] = derivation.Parent
+        children[derivation.Parent] = append(children[derivation.Parent], derivation.Child)
+    }
+    if (parents[id] == "" && len(children[id]) == 0) {
+        fmt.Fprintf(os.Stderr, "%s has no lineage in %s, no widget was derived from it nor is it derived\n", id, args[1])
+        os.Exit(1)
+    }
+
+    root, generation := id, 0
+    for parents[root] != "" {
+        root, generation = parents[root], generation + 1
+    }
+    fmt.Printf("Lineage of %s, generation %d of %s:\n", id, generation, root)
+    printLineage(root, "", "", id, children)
+}
+
+// Print a Widget and, below it, the Widgets derived from it, the Widget asked for is pointed at
+func printLineage(node string, indent string, branch string, id string, children map[string][]string) {
+    marker := ""
+    if node == id {
+        marker = "  <--"
+    }
+    fmt.Printf("%s%s%s%s\n", indent, branch, node, marker)
+    switch branch {
+    case "├── ":
+        indent += "│   "
+    case "└── ":
+        indent += "    "
+    }
+    for i, child := range children[node] {
+        if i == len(children[node]) - 1 {
+            printLineage(child, indent, "└── ", id, children)
+        } else {
+            printLineage(child, indent, "├── ", id, children)
+        }
     }
-    productionWaitGroup.Wait()
 }
 
 //==============================================================================
-type Consumer struct {
-    name string
+// Dashboard redraws a Snapshot of the running line in place every DASHBOARD_EVERY, the latest events under it
+const DASHBOARD_EVERY = 100 * time.Millisecond
+const DASHBOARD_EVENTS = 8      // Latest events shown
+const DASHBOARD_GAUGE = 30      // Width of a queue gauge
+
+// EventTail keeps the latest lines of the event stream, for the dashboard to show them instead of scrolling them by
+type EventTail struct {
+    mutex   sync.Mutex
+    partial string      // Of the line being written
+    lines   []string
+}
+
+func (tail *EventTail) Write(data []byte) (int, error) {
+    tail.mutex.Lock()
+    defer tail.mutex.Unlock()
+    lines := strings.Split(tail.partial + string(data), "\n")
+    tail.partial = lines[len(lines) - 1]
+    tail.lines = append(tail.lines, lines[:len(lines) - 1]...)
+    if len(tail.lines) > DASHBOARD_EVENTS {
+        tail.lines = tail.lines[len(tail.lines) - DASHBOARD_EVENTS:]
+    }
+    return len(data), nil
+}
+
+func (tail *EventTail) latest() []string {
+    tail.mutex.Lock()
+    defer tail.mutex.Unlock()
+    return append([]string{}, tail.lines...)
+}
+
+// A nil Dashboard draws nothing
+type Dashboard struct {
+    snapshotChannel chan<- chan<- widgetline.Snapshot
+    events          *EventTail
+    pausable        bool                // Whether p and r pause and resume the producers
+    previous        map[string]int      // Widgets of every worker at the previous frame
+    timePrevious    time.Time
+    stopChannel     chan struct{}
+    doneChannel     chan struct{}
+}
+
+func NewDashboard(snapshotChannel chan<- chan<- widgetline.Snapshot, events *EventTail, pausable bool) *Dashboard {
+    return &Dashboard{snapshotChannel, events, pausable, make(map[string]int), time.Now(), make(chan struct{}), make(chan struct{})}
 }
 
-func (con Consumer) consume(wid Widget) bool {
-    if !wid.broken {
-        fmt.Printf("%s consumes [id=%s source=%s time=%s broken=%t] in %s time\n",
-            con.name, wid.id, wid.source, wid.time.Format(TIME_FORMAT), wid.broken, time.Since(wid.time))
+// Ask for a Snapshot every DASHBOARD_EVERY and draw it, until stop is called
+func (dashboard *Dashboard) run() {
+    defer close(dashboard.doneChannel)
+    fmt.Print("\x1b[2J")
+    ticker := time.NewTicker(DASHBOARD_EVERY)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            reply := make(chan widgetline.Snapshot, 1)
+            select {
+            case dashboard.snapshotChannel <- reply:
+                dashboard.draw(<-reply)
+            case <-dashboard.stopChannel:
+                return
+            }
+        case <-dashboard.stopChannel:
+            return
+        }
+    }
+}
+
+// Draw over the previous frame from the top left corner, clearing what is left of every line and below the last one
+func (dashboard *Dashboard) draw(snapshot widgetline.Snapshot) {
+    timeNow := time.Now()
+    elapsed := timeNow.Sub(dashboard.timePrevious).Seconds()
+    var screen strings.Builder
+    line := func(format string, args ...any) {
+        fmt.Fprintf(&screen, format + "\x1b[K\n", args...)
+    }
+    screen.WriteString("\x1b[H")
+    line("Widget production line at %s: produced [ %d ] consumed [ %d ]", snapshot.Time, snapshot.Produced, snapshot.Consumed)
+    if snapshot.Stopped {
+        line("\x1b[1;31mBROKEN WIDGETS [ %d ], the line is stopping\x1b[0m", snapshot.Broken)
+    } else if snapshot.Broken > 0 {
+        line("\x1b[1;33mBROKEN WIDGETS [ %d ], scrapped by the stop policy\x1b[0m", snapshot.Broken)
+    } else {
+        line("")
+    }
+    if dashboard.pausable {
+        line("p pauses the producers, r resumes them, each followed by Enter")
     } else {
-        fmt.Printf("%s found a broken widget [id=%s source=%s time=%s broken=%t] -- stopping production\n",
-            con.name, wid.id, wid.source, wid.time.Format(TIME_FORMAT), wid.broken)
+        line("")
     }
-    return wid.broken
+    line("%-16s %-9s %8s %10s  %s", "worker", "role", "widgets", "rate", "state")
+    for _, worker := range snapshot.Workers {
+        role := worker.Role
+        if role == "" {
+            role = "-"
+        }
+        rate := float64(worker.Widgets - dashboard.previous[worker.Name]) / elapsed
+        line("%-16s %-9s %8d %8.0f/s  %s", worker.Name, role, worker.Widgets, rate, worker.State)
+        dashboard.previous[worker.Name] = worker.Widgets
+    }
+    line("")
+    for _, queue := range snapshot.Queues {
+        filled := 0
+        if queue.Capacity > 0 {
+            filled = DASHBOARD_GAUGE * queue.Length / queue.Capacity
+        }
+        line("%-16s [%s%s] %d/%d", queue.Name, strings.Repeat("#", filled), strings.Repeat(".", DASHBOARD_GAUGE - filled), queue.Length, queue.Capacity)
+    }
+    line("")
+    for _, event := range dashboard.events.latest() {
+        line("%s", event)
+    }
+    screen.WriteString("\x1b[J")
+    fmt.Print(screen.String())
+    dashboard.timePrevious = timeNow
 }
 
-// Consumer will quit working once the widgetChannel is closed
-func consumptionLine(consumerTable []Consumer, inWidgetChannel <-chan Widget, brokenWidgetChannel chan<- struct{}) {
-    defer wg.Done()
-    var consumptionWaitGroup sync.WaitGroup
-    doneChannel := make(chan struct{})
+// Stop drawing, the last frame stays on the screen above the reports
+func (dashboard *Dashboard) stop() {
+    if dashboard == nil {
+        return
+    }
+    close(dashboard.stopChannel)
+    <-dashboard.doneChannel
+}
 
-    consumptionWaitGroup.Add(len(consumerTable))
-    for _, workingConsumer := range consumerTable {
-        go func(workingConsumer Consumer) {
-            defer consumptionWaitGroup.Done()
-            for workingWidget := range inWidgetChannel {
-                select {
-                case <-doneChannel:
-                    return
-                default:
-                    if (workingConsumer.consume(workingWidget)) {
-                        close(brokenWidgetChannel)      // brokenWidgetChannel used to signify a broken widget has been encountered
-                        close(doneChannel)              // doneChannel to let the rest of the consumers knows that they need to stop
-                        return
-                    }
-                }
+//==============================================================================
+// Bundle a recording, and optionally the history and the event log of the run, into a gzipped tar archive
+// With an anonymizer every file is bundled as rewritten by it
+func exportRun(archiveName string, files map[string]string, anonymizer *widgetline.Anonymizer) error {
+    archive, err := os.Create(archiveName)
+    if err != nil {
+        return err
+    }
+    defer archive.Close()
+    compressed := gzip.NewWriter(archive)
+    bundle := tar.NewWriter(compressed)
+
+    for _, name := range []string{widgetline.ARCHIVE_RECORDING, widgetline.ARCHIVE_HISTORY, widgetline.ARCHIVE_LOG} {
+        if files[name] == "" {
+            continue
+        }
+        data, err := os.ReadFile(files[name])
+        if err != nil {
+            return err
+        }
+        if anonymizer != nil {
+            if data, err = anonymizer.File(name, data); err != nil {
+                return fmt.Errorf("%s: %s", files[name], err)
             }
-        }(workingConsumer)
+        }
+        header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+        if err := bundle.WriteHeader(header); err != nil {
+            return err
+        }
+        if _, err := bundle.Write(data); err != nil {
+            return err
+        }
+    }
+    if err := bundle.Close(); err != nil {
+        return err
+    }
+    if err := compressed.Close(); err != nil {
+        return err
     }
-    consumptionWaitGroup.Wait()
+    return archive.Close()
+}
+
+// Unpack a run archive into dir, returning the names of the files found
+func importRun(archiveName string, dir string) ([]string, error) {
+    archive, err := os.Open(archiveName)
+    if err != nil {
+        return nil, err
+    }
+    defer archive.Close()
+    compressed, err := gzip.NewReader(archive)
+    if err != nil {
+        return nil, err
+    }
+    bundle := tar.NewReader(compressed)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+
+    var names []string
+    for {
+        header, err := bundle.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return names, err
+        }
+        if (header.Name != widgetline.ARCHIVE_RECORDING && header.Name != widgetline.ARCHIVE_HISTORY && header.Name != widgetline.ARCHIVE_LOG) {
+            return names, fmt.Errorf("%s holds unexpected file %q", archiveName, header.Name)
+        }
+        data, err := io.ReadAll(bundle)
+        if err != nil {
+            return names, err
+        }
+        if err := os.WriteFile(path.Join(dir, header.Name), data, 0644); err != nil {
+            return names, err
+        }
+        names = append(names, header.Name)
+    }
+    if (len(names) > 0 && names[0] == widgetline.ARCHIVE_RECORDING) {
+        if _, err := widgetline.ReadRecording(path.Join(dir, widgetline.ARCHIVE_RECORDING)); err != nil {
+            return names, err
+        }
+    }
+    return names, nil
 }
 
 //=============================================================================
-// ProductionLine should be a Producer produces following by a consumer consumes
-func WidgetProductionConsumptionLine(numWidgets int, numProducers int, numConsumers int, numKth int) {
-    // Make all the Producers first
-    var producerTable []Producer
-    for i := 0; i < numProducers; i++ {
-        var buffer bytes.Buffer
-        buffer.WriteString("producer_")
-        buffer.WriteString(strconv.Itoa(i))
-        producerTable = append(producerTable, Producer{buffer.String()})
+// RunStream is the Sink of a line run by serve, holding its events for whoever follows them
+// Only the latest RUN_EVENTS_KEPT are sure to be kept, a follower further behind skips the ones it missed
+type RunStream struct {
+    mutex       sync.Mutex
+    events      []string
+    first       int             // Number of events[0] among all the events of the run
+    closed      bool
+    changed     chan struct{}   // Closed on every event and once the stream is closed, a new one made for the next event
+}
+
+const RUN_EVENTS_KEPT = 10000
+
+func NewRunStream() *RunStream {
+    return &RunStream{changed: make(chan struct{})}
+}
+
+func (stream *RunStream) Send(ctx context.Context, line string) error {
+    stream.mutex.Lock()
+    defer stream.mutex.Unlock()
+    stream.events = append(stream.events, strings.TrimRight(line, "\n"))
+    if len(stream.events) >= 2 * RUN_EVENTS_KEPT {
+        stream.first += len(stream.events) - RUN_EVENTS_KEPT
+        stream.events = append([]string{}, stream.events[len(stream.events) - RUN_EVENTS_KEPT:]...)
     }
+    close(stream.changed)
+    stream.changed = make(chan struct{})
+    return nil
+}
 
-    // Make all the consumers
-    var consumerTable []Consumer
-    for i := 0; i < numConsumers; i++ {
+// Every consumer of the run shares the stream, which is closed once
+func (stream *RunStream) Close() error {
+    stream.mutex.Lock()
+    defer stream.mutex.Unlock()
+    if !stream.closed {
+        stream.closed = true
+        close(stream.changed)
+    }
+    return nil
+}
+
+// The events from number next on, the number following the last of them, whether there will be no more, and what
+// is closed once there are
+func (stream *RunStream) since(next int) ([]string, int, bool, <-chan struct{}) {
+    stream.mutex.Lock()
+    defer stream.mutex.Unlock()
+    next = min(max(next, stream.first), stream.first + len(stream.events))
+    return slices.Clone(stream.events[next - stream.first:]), stream.first + len(stream.events), stream.closed, stream.changed
+}
+
+func (stream *RunStream) count() int {
+    stream.mutex.Lock()
+    defer stream.mutex.Unlock()
+    return stream.first + len(stream.events)
+}
+
+// ServedRun is a line started over HTTP, in the JSON GET /runs/{id} answers with
+type ServedRun struct {
+    Id          string                  `json:"id"`
+    State       string                  `json:"state"`                // running, paused, stopping, done or failed
+    Started     time.Time               `json:"started"`
+    Events      int                     `json:"events"`               // Sent by the consumers so far
+    Config      widgetline.LineConfig   `json:"config"`
+    Outcome     *widgetline.Outcome     `json:"outcome,omitempty"`    // Once the line is done
+    Error       string                  `json:"error,omitempty"`      // What went wrong in the run, or why it could not run
+    stream      *RunStream
+    interrupt   chan struct{}
+    pipeline    *widgetline.Pipeline
+}
+
+// RunServer runs the lines posted to it side by side, and keeps them until they are deleted
+type RunServer struct {
+    mutex       sync.Mutex
+    runs        map[string]*ServedRun
+    numRuns     int
+}
+
+func NewRunServer() *RunServer {
+    return &RunServer{runs: make(map[string]*ServedRun)}
+}
+
+func (server *RunServer) handler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("POST /runs", server.start)
+    mux.HandleFunc("GET /runs/{id}", server.get)
+    mux.HandleFunc("DELETE /runs/{id}", server.delete)
+    mux.HandleFunc("GET /runs/{id}/events", server.events)
+    mux.HandleFunc("POST /runs/{id}/pause", server.pause)
+    mux.HandleFunc("POST /runs/{id}/resume", server.pause)
+    return mux
+}
+
+// The run as it is now, or nil when there is no such run
+func (server *RunServer) run(id string) *ServedRun {
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+    run := server.runs[id]
+    if run == nil {
+        return nil
+    }
+    view := *run
+    view.Events = run.stream.count()
+    return &view
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value any) {
+    data, _ := json.MarshalIndent(value, "", "    ")
+    writer.Header().Set("Content-Type", "application/json")
+    writer.WriteHeader(status)
+    writer.Write(append(data, '\n'))
+}
+
+// A line posted over HTTP runs in the process of the service for whoever posted it, so it may not write files, send
+// anything to other hosts or listen on an address of its own
+func servable(config widgetline.LineConfig) error {
+    for _, spec := range append(append([]string{}, config.Sinks...), config.DivertSink...) {
+        if (spec != "stdout" && spec != "null") {
+            return fmt.Errorf("a posted line sends its events to its stream, its sinks can only be stdout or null, got %q", spec)
+        }
+    }
+    for _, setting := range []struct {
+        key     string
+        value   string
+    }{{"alert_webhook", config.AlertWebhook}, {"otel_endpoint", config.OtelEndpoint}, {"reserve", config.Reserve}, {"metrics_addr", config.MetricsAddr},
+        {"ledger", config.Ledger}, {"out", config.Out}, {"dead_letters", config.DeadLetters}, {"connect", config.Connect}, {"listen", config.Listen}} {
+        if setting.value != "" {
+            return fmt.Errorf("a posted line cannot set %s, it would reach outside the service", setting.key)
+        }
+    }
+    return nil
+}
+
+// POST /runs starts a line configured by the JSON of the body, as a -config file, answering with the new run
+// The line may not reach outside the service, see servable
+func (server *RunServer) start(writer http.ResponseWriter, request *http.Request) {
+    data, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, 1 << 20))
+    if err != nil {
+        http.Error(writer, err.Error(), http.StatusBadRequest)
+        return
+    }
+    config, err := widgetline.ParseConfig(data)
+    if err == nil {
+        err = servable(config)
+    }
+    var pipeline *widgetline.Pipeline
+    if err == nil {
+        pipeline, err = widgetline.NewPipeline(config)
+    }
+    if err != nil {
+        http.Error(writer, err.Error(), http.StatusBadRequest)
+        return
+    }
+    stream := NewRunStream()
+    pipeline.Sink = stream
+
+    server.mutex.Lock()
+    server.numRuns++
+    run := &ServedRun{Id: "run_" + strconv.Itoa(server.numRuns), State: "running", Started: time.Now(), Config: pipeline.Config(), stream: stream,
+        interrupt: make(chan struct{}), pipeline: pipeline}
+    server.runs[run.Id] = run
+    server.mutex.Unlock()
+    fmt.Printf("[%s started]\n", run.Id)
+
+    go func() {
+        recording, err := pipeline.Run(run.interrupt)
+        stream.Close()
+        server.mutex.Lock()
+        defer server.mutex.Unlock()
+        switch {
+        case (err != nil && recording.Err() == nil):
+            run.State, run.Error = "failed", err.Error()
+        case recording.Err() != nil:
+            run.State, run.Error, run.Outcome = "done", recording.Err().Error(), &recording.Outcome
+        default:
+            run.State, run.Outcome = "done", &recording.Outcome
+        }
+        fmt.Printf("[%s %s]\n", run.Id, run.State)
+    }()
+    writer.Header().Set("Location", "/runs/" + run.Id)
+    writeJSON(writer, http.StatusCreated, server.run(run.Id))
+}
+
+func (server *RunServer) get(writer http.ResponseWriter, request *http.Request) {
+    run := server.run(request.PathValue("id"))
+    if run == nil {
+        http.NotFound(writer, request)
+        return
+    }
+    writeJSON(writer, http.StatusOK, run)
+}
+
+// DELETE /runs/{id} stops a running line, which then drains, and forgets a line which is done
+func (server *RunServer) delete(writer http.ResponseWriter, request *http.Request) {
+    id := request.PathValue("id")
+    server.mutex.Lock()
+    run := server.runs[id]
+    switch {
+    case run == nil:
+        server.mutex.Unlock()
+        http.NotFound(writer, request)
+    case (run.State == "running" || run.State == "paused"):
+        run.State = "stopping"
+        close(run.interrupt)
+        server.mutex.Unlock()
+        writeJSON(writer, http.StatusAccepted, server.run(id))
+    case run.State == "stopping":
+        server.mutex.Unlock()
+        writeJSON(writer, http.StatusAccepted, server.run(id))
+    default:
+        delete(server.runs, id)
+        server.mutex.Unlock()
+        writer.WriteHeader(http.StatusNoContent)
+    }
+}
+
+// POST /runs/{id}/pause pauses the producers of a running line while its consumers drain, POST /runs/{id}/resume
+// resumes them, a line no longer running cannot be paused or resumed
+func (server *RunServer) pause(writer http.ResponseWriter, request *http.Request) {
+    id := request.PathValue("id")
+    pause := strings.HasSuffix(request.URL.Path, "/pause")
+    server.mutex.Lock()
+    run := server.runs[id]
+    switch {
+    case run == nil:
+        server.mutex.Unlock()
+        http.NotFound(writer, request)
+    case (run.State != "running" && run.State != "paused"):
+        server.mutex.Unlock()
+        http.Error(writer, fmt.Sprintf("%s is %s", id, run.State), http.StatusConflict)
+    default:
+        if pause {
+            run.pipeline.Pause()
+            run.State = "paused"
+        } else {
+            run.pipeline.Resume()
+            run.State = "running"
+        }
+        server.mutex.Unlock()
+        writeJSON(writer, http.StatusOK, server.run(id))
+    }
+}
+
+// GET /runs/{id}/events streams the events of the run as server-sent events, numbered from 0 by their id, from the
+// first one kept or the one after Last-Event-ID, and ends with an end event once the run is done
+func (server *RunServer) events(writer http.ResponseWriter, request *http.Request) {
+    server.mutex.Lock()
+    run := server.runs[request.PathValue("id")]
+    server.mutex.Unlock()
+    if run == nil {
+        http.NotFound(writer, request)
+        return
+    }
+    next := 0
+    if last, err := strconv.Atoi(request.Header.Get("Last-Event-ID")); err == nil {
+        next = last + 1
+    }
+    controller := http.NewResponseController(writer)
+    writer.Header().Set("Content-Type", "text/event-stream")
+    writer.Header().Set("Cache-Control", "no-cache")
+    writer.WriteHeader(http.StatusOK)
+    for {
+        events, following, closed, changed := run.stream.since(next)
         var buffer bytes.Buffer
-        buffer.WriteString("consumer_")
-        buffer.WriteString(strconv.Itoa(i))
-        consumerTable = append(consumerTable, Consumer{buffer.String()})
+        for i, event := range events {
+            fmt.Fprintf(&buffer, "id: %d\n", following - len(events) + i)
+            for _, line := range strings.Split(event, "\n") {
+                fmt.Fprintf(&buffer, "data: %s\n", line)
+            }
+            buffer.WriteString("\n")
+        }
+        next = following
+        if closed {
+            buffer.WriteString("event: end\ndata: " + run.Id + "\n\n")
+        }
+        if _, err := writer.Write(buffer.Bytes()); err != nil {
+            return
+        }
+        if (controller.Flush() != nil || closed) {
+            return
+        }
+        select {
+        case <-changed:
+        case <-request.Context().Done():
+            return
+        }
     }
+}
 
-    jobChannel := make(chan int, numWidgets)        // Job channel to keep track of how many widgets produced and which widget would be broken
-    widgetChannel := make(chan Widget, numWidgets)  // Widget channel to send to consumers to consume
-    quitChannel := make(chan struct{})              // To signify when the consumptionLine and productionLine will quit
-    brokenWidgetChannel := make(chan struct{})      // Written by a consumer when a broken widget is met
+// serve [-addr localhost:8080], runs the lines posted to it side by side for as long as it is up
+func serveMain(args []string) {
+    flagSet := flag.NewFlagSet("serve", flag.ExitOnError)
+    var address = flagSet.String("addr", "localhost:8080", "Sets the address the runs are served on")
+    flagSet.Parse(args)
+    listener, err := net.Listen("tcp", *address)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    fmt.Printf("[runs served on http://%s/runs]\n", listener.Addr())
+    if err := http.Serve(listener, NewRunServer().handler()); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+}
 
-    // Rack up all the jobs first
-    for i := 1; i <= numWidgets; i++ {
-        jobChannel <- i
+// export -recording run.json [-history runs.jsonl] [-log events.log] [-anonymize [-noise d] [-salt s]] run.tar.gz
+func exportMain(args []string) {
+    flagSet := flag.NewFlagSet("export", flag.ExitOnError)
+    var recordingFile = flagSet.String("recording", "", "Sets the recording of the run, as written by -record")
+    var historyFile = flagSet.String("history", "", "Also bundles this history file, as written by -history")
+    var logFile = flagSet.String("log", "", "Also bundles the event log of the run, e.g. the file of a file: sink")
+    var anonymize = flagSet.Bool("anonymize", false, "Replaces names and ids by pseudonyms, drops free text and moves timestamps by up to -noise")
+    var noise = flagSet.Duration("noise", 100 * time.Millisecond, "Sets how far an anonymized timestamp may move either way")
+    var salt = flagSet.String("salt", "", "Keys the pseudonyms, so they match across exports with the same salt (random by default)")
+    flagSet.Parse(args)
+    if (flagSet.NArg() != 1 || *recordingFile == "" || *noise < 0) {
+        fmt.Fprintln(os.Stderr, "usage: export -recording run.json [-history runs.jsonl] [-log events.log] [-anonymize [-noise d] [-salt s]] run.tar.gz")
+        os.Exit(2)
     }
-    close(jobChannel)
 
-    wg.Add(2)
-    // Producers will then grab job requests from jobChannel and produce
-    go productionLine(producerTable, numWidgets, numKth, jobChannel, widgetChannel, quitChannel)
+    var anonymizer *widgetline.Anonymizer
+    if *anonymize {
+        var err error
+        if anonymizer, err = widgetline.NewAnonymizer(*salt, *noise); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    }
+    files := map[string]string{widgetline.ARCHIVE_RECORDING: *recordingFile, widgetline.ARCHIVE_HISTORY: *historyFile, widgetline.ARCHIVE_LOG: *logFile}
+    if err := exportRun(flagSet.Arg(0), files, anonymizer); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    fmt.Printf("run exported to %s\n", flagSet.Arg(0))
+}
 
-    // Consumers grabbing widgets from widget channel and consume
-    go consumptionLine(consumerTable, widgetChannel, brokenWidgetChannel)
+// import [-dir directory] run.tar.gz
+func importMain(args []string) {
+    flagSet := flag.NewFlagSet("import", flag.ExitOnError)
+    var dir = flagSet.String("dir", "", "Sets where the run is unpacked (defaults to the name of the archive)")
+    flagSet.Parse(args)
+    if flagSet.NArg() != 1 {
+        fmt.Fprintln(os.Stderr, "usage: import [-dir directory] run.tar.gz")
+        os.Exit(2)
+    }
+    if *dir == "" {
+        *dir = strings.TrimSuffix(strings.TrimSuffix(path.Base(flagSet.Arg(0)), ".gz"), ".tar")
+    }
 
-    // When brokenWidgetChannel is closed by a consumer, this will close the quitChannel to tell consumptionLine and productionLine to stop
-    if (numKth > 0) {
-        <-brokenWidgetChannel
-        fmt.Println("[execution stops]")
-        close(quitChannel)
+    names, err := importRun(flagSet.Arg(0), *dir)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    fmt.Printf("run imported into %s\n", *dir)
+    for _, name := range names {
+        switch name {
+        case widgetline.ARCHIVE_RECORDING:
+            fmt.Printf("    replay it with: replay %s\n", path.Join(*dir, name))
+        case widgetline.ARCHIVE_HISTORY:
+            fmt.Printf("    report it with: report trends %s\n", path.Join(*dir, name))
+        case widgetline.ARCHIVE_LOG:
+            fmt.Printf("    its events are in %s\n", path.Join(*dir, name))
+        }
     }
-    wg.Wait()
 }
 
 func main() {
     timeBegin := time.Now()
-    rand.Seed(time.Now().UnixNano())
 
-    var numWidgets = flag.Int("n", 10, "Sets the number of Widgets created")
-    var numProducers = flag.Int("p", 1, "Sets the number of Producers created")
-    var numConsumers = flag.Int("c", 1, "Sets the number of consumers created")
-    var numKth = flag.Int("k", -1, "Sets the kth Widget to be broken")
-    flag.Parse()
+    if (len(os.Args) > 1 && os.Args[1] == "replay") {
+        replayMain(os.Args[2:])
+        return
+    }
+    if (len(os.Args) > 1 && os.Args[1] == "resume") {
+        resumeMain(os.Args[2:])
+        return
+    }
+    if (len(os.Args) > 1 && os.Args[1] == "stress") {
+        stressMain(os.Args[2:])
+        return
+    }
+    if (len(os.Args) > 1 && os.Args[1] == "bench") {
+        benchMain(os.Args[2:])
+        return
+    }
+    if (len(os.Args) > 1 && os.Args[1] == "parallel") {
+        parallelMain(os.Args[2:])
+        return
+    }
+    if (len(os.Args) > 1 && os.Args[1] == "serve") {
+        serveMain(os.Args[2:])
+        return
+    }
+    if (len(os.Args) > 1 && os.Args[1] == "report") {
+        reportMain(os.Args[2:])
+        return
+    }
+    if (len(os.Args) > 1 && os.Args[1] == "export") {
+        exportMain(os.Args[2:])
+        return
+    }
+    if (len(os.Args) > 1 && os.Args[1] == "import") {
+        importMain(os.Args[2:])
+        return
+    }
+
+    var recordFile = flag.String("record", "", "Records the run to this file so it can be replayed")
+    var summaryFile = flag.String("summary", "", "Writes the outcome of the run, its verdict included, to this JSON file")
+    var historyFile = flag.String("history", "", "Appends the outcome of the run to this history file, see report trends")
+    var annotate = flag.Bool("annotate", false, "Annotates the event stream with every line read from stdin while the line runs")
+    var control = flag.Bool("control", false, "Reads membership changes from stdin while the line runs: join [<group>] or leave <consumer>, needs -partitions")
+    var expectFile = flag.String("expect", "", "Checks the run against this manifest of expected outcomes, exiting with 3 and a diff when it deviates")
+    var tui = flag.Bool("tui", false, "Redraws a dashboard of the running line every 100ms instead of printing its events, the reports follow at the end")
+    var randomize = flag.Bool("randomize-scenario", false, "Runs a random scenario instead, printed first so it can be run again with stress -repro, no flag of the line goes with it")
+    // produce -to host:port and consume -from :port [-producers n] run the two ends of a line distributed over TCP, any
+    // number of producing processes sending their Widgets to one consuming process
+    args := os.Args[1:]
+    var connect, listen *string
+    var remoteProducers *int
+    if (len(args) > 0 && args[0] == "produce") {
+        connect = flag.String("to", "", "Sends the Widgets to the consuming process on this address")
+        args = args[1:]
+    } else if (len(args) > 0 && args[0] == "consume") {
+        listen = flag.String("from", "", "Takes the Widgets of the producing processes on this address")
+        remoteProducers = flag.Int("producers", 1, "Waits for this many producing processes")
+        args = args[1:]
+    }
+    // The flags of the command itself, those of the line are added by ResolveConfig
+    commandFlags := make(map[string]bool)
+    flag.VisitAll(func(f *flag.Flag) { commandFlags[f.Name] = true })
+    config, err := widgetline.ResolveConfig(flag.CommandLine, args)
+    if (err == nil && connect != nil) {
+        config.Connect = *connect
+        if err = config.Check(); (err == nil && config.Connect == "") {
+            err = fmt.Errorf("produce needs -to")
+        }
+    }
+    if (err == nil && listen != nil) {
+        config.Listen, config.RemoteProducers = *listen, *remoteProducers
+        if err = config.Check(); (err == nil && config.Listen == "") {
+            err = fmt.Errorf("consume needs -from")
+        }
+    }
+    // A random scenario is the whole line, a flag setting some of it would be lost
+    if (err == nil && *randomize) {
+        if (connect != nil || listen != nil) {
+            err = fmt.Errorf("-randomize-scenario runs cannot be distributed")
+        }
+        flag.Visit(func(f *flag.Flag) {
+            if (err == nil && !commandFlags[f.Name]) {
+                err = fmt.Errorf("-randomize-scenario picks the whole line, it cannot go with -%s", f.Name)
+            }
+        })
+    }
+    if (err == nil && *randomize) {
+        config = randomScenario(rand.New(rand.NewSource(time.Now().UnixNano())))
+        data, _ := json.MarshalIndent(config, "", "    ")
+        fmt.Printf("[random scenario, save it and run it again with stress -repro <file>]\n%s\n", data)
+    }
+    if (err == nil && config.Soak && *recordFile != "") {
+        err = fmt.Errorf("-soak runs cannot be recorded")
+    }
+    if (err == nil && *control && config.Partitions == 0) {
+        err = fmt.Errorf("-control needs -partitions")
+    }
+    // The dashboard takes the place of the events, which would scroll it away, sinks left on stdout go nowhere
+    if (err == nil && *tui) {
+        for _, spec := range append(append([]string{}, config.Sinks...), config.DivertSink...) {
+            if spec == "stdout" {
+                err = fmt.Errorf("-tui needs the sinks off stdout")
+            }
+        }
+        if len(config.Sinks) == 0 {
+            config.Sinks.Set("null")
+        }
+        if len(config.DivertSink) == 0 {
+            config.DivertSink.Set("null")
+        }
+    }
+    // Contiguous sequences can only be told by following them
+    var manifest Manifest
+    if (err == nil && *expectFile != "") {
+        if manifest, err = readManifest(*expectFile); (err == nil && manifest.Contiguous != nil) {
+            config.Gaps = true
+        }
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+
+    // A soak run goes on until Ctrl-C, any other run stops producing on it and drains, a second Ctrl-C kills the run outright
+    // Deterministic runs are scheduled in one go and cannot be interrupted
+    var interruptChannel chan struct{}
+    if !config.Deterministic {
+        interruptChannel = make(chan struct{})
+        signalChannel := make(chan os.Signal, 1)
+        signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+        go func() {
+            <-signalChannel
+            signal.Stop(signalChannel)
+            config.LogEvent(widgetline.MSG_INTERRUPTED)
+            close(interruptChannel)
+        }()
+    }
 
-    WidgetProductionConsumptionLine(*numWidgets, *numProducers, *numConsumers, *numKth)
-    fmt.Printf("The program took [ %s ] to finish.\n", time.Since(timeBegin).String())
+    // With -annotate, every line typed while the line runs goes into its event stream, with -control the membership
+    // changes typed go to the consumer groups instead, and with -tui p pauses the producers and r resumes them
+    var annotationChannel chan string
+    var membershipChannel chan widgetline.Membership
+    var pauseChannel chan bool
+    if *annotate {
+        annotationChannel = make(chan string)
+    }
+    if *control {
+        membershipChannel = make(chan widgetline.Membership)
+    }
+    if (*tui && !config.Deterministic) {
+        pauseChannel = make(chan bool)
+    }
+    if (*annotate || *control || pauseChannel != nil) {
+        go func() {
+            if annotationChannel != nil {
+                defer close(annotationChannel)
+            }
+            scanner := bufio.NewScanner(os.Stdin)
+            for scanner.Scan() {
+                text := strings.TrimSpace(scanner.Text())
+                if text == "" {
+                    continue
+                }
+                if ((text == "p" || text == "r") && pauseChannel != nil) {
+                    pauseChannel <- (text == "p")
+                } else if change, ok := widgetline.ParseMembership(text); (ok && membershipChannel != nil) {
+                    membershipChannel <- change
+                } else if annotationChannel != nil {
+                    annotationChannel <- text
+                } else if membershipChannel == nil {
+                    fmt.Fprintf(os.Stderr, "not a key of the dashboard: %q, use p or r\n", text)
+                } else {
+                    fmt.Fprintf(os.Stderr, "not a membership change: %q, use join [<group>] or leave <consumer>\n", text)
+                }
+            }
+        }()
+    }
+
+    // kill -USR1 prints a Snapshot of the running line to stderr
+    snapshotChannel := make(chan chan<- widgetline.Snapshot)
+    snapshotSignalChannel := make(chan os.Signal, 1)
+    signal.Notify(snapshotSignalChannel, syscall.SIGUSR1)
+    go func() {
+        for range snapshotSignalChannel {
+            reply := make(chan widgetline.Snapshot)
+            snapshotChannel <- reply
+            data, _ := json.MarshalIndent(<-reply, "", "    ")
+            fmt.Fprintf(os.Stderr, "%s\n", data)
+        }
+    }()
+
+    if (config.Seed == 0) {
+        config.Seed = time.Now().UnixNano()
+    }
+
+    // With -tui, the events are kept for the dashboard instead of being printed
+    run := widgetline.WidgetProductionConsumptionLine
+    var dashboard *Dashboard
+    if *tui {
+        events := &EventTail{}
+        dashboard = NewDashboard(snapshotChannel, events, pauseChannel != nil)
+        go dashboard.run()
+        run = widgetline.Services{Log: events}.Line
+    }
+    recording, err := run(config, widgetline.LineOptions{Interrupt: interruptChannel, Snapshots: snapshotChannel, Annotations: annotationChannel,
+        Membership: membershipChannel, Pause: pauseChannel})
+    dashboard.stop()
+    // A run which failed still goes on to be recorded, its exit status is the one of its violations or verdict
+    if (err != nil && recording.Err() == nil) {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    select {
+    case <-interruptChannel:
+        fmt.Printf("[interrupted] produced [ %d ] consumed [ %d ] discarded [ %d ]\n",
+            recording.Outcome.NumProduced, recording.Outcome.NumConsumed, recording.Outcome.NumDiscarded)
+    default:
+    }
+    if *recordFile != "" {
+        if err := widgetline.WriteRecording(*recordFile, recording); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    }
+    if *historyFile != "" {
+        if err := widgetline.AppendHistory(*historyFile, recording); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    }
+    if *summaryFile != "" {
+        if err := widgetline.WriteSummary(*summaryFile, recording.Outcome); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    }
+    config.LogEvent(widgetline.MSG_TOOK, time.Since(timeBegin).String())
+    if *expectFile != "" {
+        failOnDeviations(*expectFile, manifest, recording)
+    }
+    // With a verdict, it alone says how the run went, violations included
+    if recording.Outcome.Verdict != nil {
+        exitOnVerdict(recording.Outcome)
+        return
+    }
+    failOnViolations(recording.Outcome)
 }
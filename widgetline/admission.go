@@ -0,0 +1,320 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/admission.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "math/rand"
+    "strconv"
+    "strings"
+    "sync"
+    "path"
+)
+
+// Reasons a Validator rejects a Widget at the source
+const REJECT_BAD_ID = "bad-id"
+const REJECT_BAD_TIME = "bad-time"
+const REJECT_BAD_CHECKSUM = "bad-checksum"
+
+// Validator checks every Widget right after production and rejects the malformed ones before they are queued, a nil
+// Validator lets everything through
+// Broken widgets are never rejected, so a consumer still gets to stop the line
+type Validator struct {
+    env         *environment
+    malformed   float64     // Probability of a Producer making a malformed Widget, to exercise the validation
+    lifecycle   *Lifecycle
+    recorder    *Recorder
+    checker     *Checker
+}
+
+func newValidator(env *environment, malformed float64, lifecycle *Lifecycle, recorder *Recorder, checker *Checker) *Validator {
+    return &Validator{env: env, malformed: malformed, lifecycle: lifecycle, recorder: recorder, checker: checker}
+}
+
+// Spoil one of the id, the timestamp or the checksum of a freshly produced Widget now and then
+func (validator *Validator) malform(wid Widget, source *rand.Rand) Widget {
+    if (validator == nil || validator.malformed == 0 || source.Float64() >= validator.malformed) {
+        return wid
+    }
+    switch source.Intn(3) {
+    case 0:
+        wid.id = wid.id[:len(wid.id) / 2]
+    case 1:
+        wid.time = wid.time.Add(time.Hour)
+    default:
+        wid.checksum ^= 1
+    }
+    return wid
+}
+
+// Why a Widget is malformed, empty when it is well-formed
+func (validator *Validator) check(wid Widget) string {
+    if !validator.env.ids.Valid(wid.id) {
+        return REJECT_BAD_ID
+    }
+    if (wid.time.Before(validator.recorder.timeBegin) || wid.time.After(validator.env.now())) {
+        return REJECT_BAD_TIME
+    }
+    if wid.checksum != wid.sum() {
+        return REJECT_BAD_CHECKSUM
+    }
+    return ""
+}
+
+// Report whether a Widget may be queued, a rejected Widget is done with
+func (validator *Validator) pass(wid Widget) bool {
+    if (validator == nil || wid.broken) {
+        return true
+    }
+    reason := validator.check(wid)
+    if reason == "" {
+        return true
+    }
+    validator.lifecycle.move(wid, STATE_REJECTED)
+    validator.recorder.rejected(reason)
+    validator.checker.filtered()
+    validator.env.logEvent(MSG_REJECT, wid.source, wid.id, wid.time.Format(TIME_FORMAT), reason)
+    return false
+}
+
+//==============================================================================
+// Enqueuer hands produced Widgets to a bounded queue, retrying with backoff while it is full and shedding the Widget after
+// the last retry, a nil Enqueuer blocks until there is room
+// Broken widgets are never shed, so a consumer still gets to stop the line
+type Enqueuer struct {
+    env         *environment
+    mutex       sync.Mutex
+    capacity    int
+    retries     int
+    backoff     time.Duration       // Doubled after every retry
+    lifecycle   *Lifecycle
+    checker     *Checker
+    numRetried  int                 // Widgets enqueued after at least one retry
+    numShed     int
+}
+
+func newEnqueuer(env *environment, capacity int, retries int, backoff time.Duration, lifecycle *Lifecycle, checker *Checker) *Enqueuer {
+    return &Enqueuer{env: env, capacity: capacity, retries: retries, backoff: backoff, lifecycle: lifecycle, checker: checker}
+}
+
+// Enqueue a Widget, reporting whether it was enqueued rather than shed, and false when the line quits while waiting
+func (enqueuer *Enqueuer) enqueue(wid Widget, outWidgetChannel chan<- Widget, outEdge *Edge, quitChannel <-chan struct{}) (bool, bool) {
+    timeSend := outEdge.begin()
+    if (enqueuer == nil || wid.broken) {
+        select {
+        case outWidgetChannel <- wid:
+            outEdge.sent(timeSend)
+            return true, true
+        case <-quitChannel:
+            return false, false
+        }
+    }
+
+    backoff := enqueuer.backoff
+    for retry := 0; ; retry++ {
+        select {
+        case outWidgetChannel <- wid:
+            outEdge.sent(timeSend)
+            if (retry > 0) {
+                enqueuer.mutex.Lock()
+                enqueuer.numRetried++
+                enqueuer.mutex.Unlock()
+            }
+            return true, true
+        case <-quitChannel:
+            return false, false
+        default:
+        }
+        if (retry == enqueuer.retries) {
+            break
+        }
+        select {
+        case <-time.After(backoff):
+        case <-quitChannel:
+            return false, false
+        }
+        backoff *= 2
+    }
+
+    enqueuer.mutex.Lock()
+    enqueuer.numShed++
+    enqueuer.mutex.Unlock()
+    enqueuer.lifecycle.move(wid, STATE_DROPPED)
+    enqueuer.checker.filtered()
+    enqueuer.env.logEvent(MSG_SHED_QUEUE, wid.source, wid.id, enqueuer.env.now().Format(TIME_FORMAT), enqueuer.retries)
+    return false, true
+}
+
+func (enqueuer *Enqueuer) report(out io.Writer) {
+    if enqueuer == nil {
+        return
+    }
+    fmt.Fprintf(out, "[queue of %d] retried [ %d ] shed [ %d ]\n", enqueuer.capacity, enqueuer.numRetried, enqueuer.numShed)
+}
+
+//==============================================================================
+// Quota bounds the share of the queue the Widgets matching it may occupy at once
+type Quota struct {
+    spec        string
+    field       string  // source or priority
+    pattern     string  // As understood by path.Match
+    share       float64 // Fraction of the queue, in (0, 1]
+    limit       int     // Widgets the share amounts to, at least 1
+    occupancy   int
+    peak        int
+    numDelayed  int
+    numShed     int
+}
+
+// Rules look like source=<pattern>:<percent>% or priority=<pattern>:<percent>%, e.g. priority=2:10%
+func parseQuota(spec string) (*Quota, error) {
+    quota := &Quota{spec: spec}
+    matcher, share, found := strings.Cut(spec, ":")
+    percent, err := strconv.ParseFloat(strings.TrimSuffix(share, "%"), 64)
+    if (!found || !strings.HasSuffix(share, "%") || err != nil) {
+        return nil, fmt.Errorf("quota %q is not of the form source|priority=<pattern>:<percent>%%", spec)
+    }
+    if (percent <= 0 || percent > 100) {
+        return nil, fmt.Errorf("quota %q must be over 0%% and at most 100%%", spec)
+    }
+    quota.share = percent / 100
+    quota.field, quota.pattern, found = strings.Cut(matcher, "=")
+    if (!found || (quota.field != "source" && quota.field != "priority")) {
+        return nil, fmt.Errorf("quota %q is not of the form source|priority=<pattern>:<percent>%%", spec)
+    }
+    if _, err := path.Match(quota.pattern, ""); err != nil {
+        return nil, fmt.Errorf("quota %q: %s", spec, err)
+    }
+    return quota, nil
+}
+
+func (quota *Quota) matches(wid Widget) bool {
+    value := wid.source
+    if quota.field == "priority" {
+        value = strconv.Itoa(wid.priority)
+    }
+    matched, _ := path.Match(quota.pattern, value)
+    return matched
+}
+
+// quotaList is a repeatable flag collecting quota rules
+type QuotaList []string
+
+func (list *QuotaList) String() string {
+    return strings.Join(*list, " ")
+}
+
+func (list *QuotaList) Set(value string) error {
+    if _, err := parseQuota(value); err != nil {
+        return err
+    }
+    *list = append(*list, value)
+    return nil
+}
+
+// Quotas admit the Widgets onto the queue, the first matching rule counts a Widget until it leaves the queued state
+// An over-quota Widget waits for room, or is shed straight away when shed is set, a nil Quotas admits everything
+// Broken widgets are never held back, so a consumer still gets to stop the line
+type Quotas struct {
+    env         *environment
+    mutex       sync.Mutex
+    rules       []*Quota
+    shed        bool
+    admitted    map[string]*Quota   // Rule every admitted Widget counts against, by id
+    released    chan struct{}       // Closed and replaced whenever a Widget leaves the queue
+    lifecycle   *Lifecycle
+    checker     *Checker
+}
+
+func newQuotas(env *environment, specs QuotaList, capacity int, shed bool, lifecycle *Lifecycle, checker *Checker) (*Quotas, error) {
+    quotas := &Quotas{env: env, shed: shed, admitted: make(map[string]*Quota), released: make(chan struct{}), lifecycle: lifecycle, checker: checker}
+    for _, spec := range specs {
+        quota, err := parseQuota(spec)
+        if err != nil {
+            return nil, err
+        }
+        quota.limit = max(int(quota.share * float64(capacity)), 1)
+        quotas.rules = append(quotas.rules, quota)
+    }
+    return quotas, nil
+}
+
+// Admit a queued Widget, reporting whether it may be enqueued and false for ok when the line quits while waiting
+func (quotas *Quotas) admit(wid Widget, quitChannel <-chan struct{}) (admitted bool, ok bool) {
+    if (quotas == nil || wid.broken) {
+        return true, true
+    }
+    var quota *Quota
+    for _, rule := range quotas.rules {
+        if rule.matches(wid) {
+            quota = rule
+            break
+        }
+    }
+    if quota == nil {
+        return true, true
+    }
+
+    delayed := false
+    for {
+        quotas.mutex.Lock()
+        if quota.occupancy < quota.limit {
+            quota.occupancy++
+            quota.peak = max(quota.peak, quota.occupancy)
+            quotas.admitted[wid.id] = quota
+            quotas.mutex.Unlock()
+            return true, true
+        }
+        if quotas.shed {
+            quota.numShed++
+            quotas.mutex.Unlock()
+            quotas.lifecycle.move(wid, STATE_DROPPED)
+            quotas.checker.filtered()
+            quotas.env.logEvent(MSG_SHED_QUOTA, wid.source, wid.id, quotas.env.now().Format(TIME_FORMAT), quota.spec)
+            return false, true
+        }
+        if !delayed {
+            quota.numDelayed++
+            delayed = true
+        }
+        released := quotas.released
+        quotas.mutex.Unlock()
+        select {
+        case <-released:
+        case <-quitChannel:
+            return false, false
+        }
+    }
+}
+
+// Give back the room of a Widget leaving the queue, waking up every Widget waiting for room
+func (quotas *Quotas) release(wid Widget) {
+    if quotas == nil {
+        return
+    }
+    quotas.mutex.Lock()
+    defer quotas.mutex.Unlock()
+    quota, found := quotas.admitted[wid.id]
+    if !found {
+        return
+    }
+    delete(quotas.admitted, wid.id)
+    quota.occupancy--
+    close(quotas.released)
+    quotas.released = make(chan struct{})
+}
+
+func (quotas *Quotas) report(out io.Writer) {
+    if quotas == nil {
+        return
+    }
+    for _, quota := range quotas.rules {
+        fmt.Fprintf(out, "Quota %s of %d widgets: peak [ %d ] (%.0f%% used) delayed [ %d ] shed [ %d ]\n",
+            quota.spec, quota.limit, quota.peak, 100 * float64(quota.peak) / float64(quota.limit), quota.numDelayed, quota.numShed)
+    }
+}
@@ -0,0 +1,215 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/anonymizer.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "time"
+    "math/rand"
+    "bytes"
+    "strconv"
+    "strings"
+    "sort"
+    "regexp"
+    "crypto/hmac"
+    "crypto/sha256"
+    cryptorand "crypto/rand"
+    "encoding/hex"
+)
+
+// Files bundled into a run archive, under fixed names so importing never writes anywhere else
+const ARCHIVE_RECORDING = "recording.json"
+const ARCHIVE_HISTORY = "history.jsonl"
+const ARCHIVE_LOG = "events.log"
+
+//==============================================================================
+// Anonymizer rewrites the files of a run so they can be shared outside: names and ids are replaced by keyed hashes,
+// the same within an export, free text is dropped and timestamps are moved by up to noise either way
+type Anonymizer struct {
+    salt    []byte
+    noise   time.Duration
+    jitter  *rand.Rand
+    names   *regexp.Regexp  // Producers, consumers and standbys, with the group prefix of their consumers
+    ids     *regexp.Regexp  // Widget ids of the format of the run, derived ids included
+    times   *regexp.Regexp  // Clock times as written in the event log
+    groups  *regexp.Regexp  // Names of the consumer groups, known from the recording only, nil without groups
+}
+
+// The start of annotation events in the catalogs, followed by the text of the operator
+var annotationLine = regexp.MustCompile(`^\[(?:annotation|anotación) time=[^\]]*\] `)
+
+// An empty salt is drawn at random, pseudonyms then only hold within the export
+func NewAnonymizer(salt string, noise time.Duration) (*Anonymizer, error) {
+    anonymizer := &Anonymizer{salt: []byte(salt), noise: noise, jitter: rand.New(rand.NewSource(time.Now().UnixNano()))}
+    if salt == "" {
+        anonymizer.salt = make([]byte, 32)
+        if _, err := cryptorand.Read(anonymizer.salt); err != nil {
+            return nil, err
+        }
+    }
+    anonymizer.names = regexp.MustCompile(`\b(?:[\w-]+\.)?(?:producer|consumer|standby)_\d+\b`)
+    anonymizer.times = regexp.MustCompile(`\b\d{2}:\d{2}:\d{2}\.\d{6}\b`)
+    anonymizer.follow(DefaultConfig())
+    return anonymizer, nil
+}
+
+// Take the id format and the group names from the configuration of the run
+func (anonymizer *Anonymizer) follow(config LineConfig) {
+    if config.SerialIds {
+        anonymizer.ids = regexp.MustCompile(`\b\d{` + strconv.Itoa(config.IdLength) + `}(?:\.\d+)*\b`)
+    } else {
+        anonymizer.ids = regexp.MustCompile(config.idStrategy().Pattern() + `(?:\.\d+)*`)
+    }
+    var names []string
+    for _, spec := range config.Groups {
+        group, _ := parseConsumerGroup(spec)
+        names = append(names, regexp.QuoteMeta(group.name))
+    }
+    anonymizer.groups = nil
+    if len(names) > 0 {
+        anonymizer.groups = regexp.MustCompile(`\b(?:` + strings.Join(names, "|") + `)\b`)
+    }
+}
+
+func (anonymizer *Anonymizer) pseudonym(name string) string {
+    mac := hmac.New(sha256.New, anonymizer.salt)
+    mac.Write([]byte(name))
+    return hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+func (anonymizer *Anonymizer) shift() time.Duration {
+    if anonymizer.noise <= 0 {
+        return 0
+    }
+    return time.Duration(anonymizer.jitter.Int63n(2 * int64(anonymizer.noise) + 1)) - anonymizer.noise
+}
+
+// Settings naming places, people or conventions are dropped or replaced by pseudonyms
+func (anonymizer *Anonymizer) config(config LineConfig) LineConfig {
+    config.Sinks, config.DivertSink, config.AlertWebhook, config.Reserve, config.Messages = nil, nil, "", "", nil
+    config.OtelEndpoint = ""
+    groups := GroupList{}
+    for _, spec := range config.Groups {
+        name, rest, _ := strings.Cut(spec, ":")
+        groups = append(groups, anonymizer.pseudonym(name) + ":" + rest)
+    }
+    if len(config.Groups) > 0 {
+        config.Groups = groups
+    }
+    queues := nameList{}
+    for _, name := range config.PriorityQueues {
+        queues = append(queues, anonymizer.pseudonym(name))
+    }
+    if len(config.PriorityQueues) > 0 {
+        config.PriorityQueues = queues
+    }
+    return config
+}
+
+func (anonymizer *Anonymizer) outcome(outcome Outcome) Outcome {
+    if outcome.FailuresBySource != nil {
+        bySource := make(map[string]int)
+        for source, count := range outcome.FailuresBySource {
+            bySource[anonymizer.pseudonym(source)] += count
+        }
+        outcome.FailuresBySource = bySource
+    }
+    violations := []string{}
+    for _, violation := range outcome.Violations {
+        violations = append(violations, anonymizer.text(violation))
+    }
+    if len(outcome.Violations) > 0 {
+        outcome.Violations = violations
+    }
+    return outcome
+}
+
+// Annotations keep their time, moved, and lose their text
+func (anonymizer *Anonymizer) annotations(annotations []Annotation) []Annotation {
+    var anonymized []Annotation
+    for _, annotation := range annotations {
+        anonymized = append(anonymized, Annotation{max(annotation.Offset + anonymizer.shift(), 0), "redacted"})
+    }
+    return anonymized
+}
+
+// The recording still replays, its arrivals in the order of their moved offsets
+func (anonymizer *Anonymizer) recording(recording Recording) Recording {
+    for i, arrival := range recording.Arrivals {
+        recording.Arrivals[i].Source = anonymizer.pseudonym(arrival.Source)
+        recording.Arrivals[i].Offset = max(arrival.Offset + anonymizer.shift(), 0)
+    }
+    sort.SliceStable(recording.Arrivals, func(i, j int) bool { return recording.Arrivals[i].Offset < recording.Arrivals[j].Offset })
+    for i, derivation := range recording.Derivations {
+        recording.Derivations[i] = Derivation{anonymizer.pseudonym(derivation.Parent), anonymizer.pseudonym(derivation.Child)}
+    }
+    recording.Config = anonymizer.config(recording.Config)
+    recording.Outcome = anonymizer.outcome(recording.Outcome)
+    recording.Annotations = anonymizer.annotations(recording.Annotations)
+    return recording
+}
+
+func (anonymizer *Anonymizer) history(entry HistoryEntry) HistoryEntry {
+    entry.Time = entry.Time.Add(anonymizer.shift())
+    entry.Config = anonymizer.config(entry.Config)
+    entry.Outcome = anonymizer.outcome(entry.Outcome)
+    entry.Annotations = anonymizer.annotations(entry.Annotations)
+    return entry
+}
+
+// Lines of text have their names, ids and clock times replaced, annotations lose their text
+func (anonymizer *Anonymizer) text(text string) string {
+    lines := strings.Split(text, "\n")
+    for i, line := range lines {
+        if annotation := annotationLine.FindString(line); annotation != "" {
+            line = annotation + "redacted"
+        }
+        line = anonymizer.times.ReplaceAllStringFunc(line, func(clock string) string {
+            parsed, err := time.Parse(TIME_FORMAT, clock)
+            if err != nil {
+                return clock
+            }
+            return parsed.Add(anonymizer.shift()).Format(TIME_FORMAT)
+        })
+        line = anonymizer.names.ReplaceAllStringFunc(line, anonymizer.pseudonym)
+        line = anonymizer.ids.ReplaceAllStringFunc(line, anonymizer.pseudonym)
+        if anonymizer.groups != nil {
+            line = anonymizer.groups.ReplaceAllStringFunc(line, anonymizer.pseudonym)
+        }
+        lines[i] = line
+    }
+    return strings.Join(lines, "\n")
+}
+
+// Anonymize one file of the run by what it holds
+func (anonymizer *Anonymizer) File(name string, data []byte) ([]byte, error) {
+    switch name {
+    case ARCHIVE_RECORDING:
+        recording, err := decodeRecording(data)
+        if err != nil {
+            return nil, err
+        }
+        anonymizer.follow(recording.Config)
+        return DefaultServices().Codec.Marshal(anonymizer.recording(recording))
+    case ARCHIVE_HISTORY:
+        history, err := decodeHistory(name, data)
+        if err != nil {
+            return nil, err
+        }
+        var buffer bytes.Buffer
+        for _, entry := range history {
+            line, err := DefaultServices().Codec.Marshal(anonymizer.history(entry))
+            if err != nil {
+                return nil, err
+            }
+            buffer.Write(append(line, '\n'))
+        }
+        return buffer.Bytes(), nil
+    }
+    return []byte(anonymizer.text(string(data))), nil
+}
+
+//=============================================================================
+// Fuzzing entry points in the go-fuzz style: 1 for inputs worth keeping in the corpus, 0 otherwise
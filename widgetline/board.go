@@ -0,0 +1,221 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/board.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "sync"
+    "os"
+    "context"
+    "sort"
+)
+
+// Annotation is a note of the operator, kept at its offset from the start of the run
+type Annotation struct {
+    Offset  time.Duration   `json:"offset"`
+    Text    string          `json:"text"`
+}
+
+// Annotator puts the annotations of the operator into the event stream as they come, so external incidents can be
+// correlated with the line later on, a nil Annotator takes none
+type Annotator struct {
+    env         *environment
+    sinks       []Sink  // Every distinct sink of the line
+    recorder    *Recorder
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+}
+
+func newAnnotator(env *environment, sinks []Sink, recorder *Recorder) *Annotator {
+    annotator := &Annotator{env: env, recorder: recorder, stopChannel: make(chan struct{}), doneChannel: make(chan struct{})}
+    distinct := make(map[Sink]bool)
+    for _, sink := range sinks {
+        if !distinct[sink] {
+            distinct[sink] = true
+            annotator.sinks = append(annotator.sinks, sink)
+        }
+    }
+    return annotator
+}
+
+// Annotate the run with every text received until stop is called
+func (annotator *Annotator) watch(annotationChannel <-chan string) {
+    defer close(annotator.doneChannel)
+    for {
+        select {
+        case text, ok := <-annotationChannel:
+            if !ok {
+                annotationChannel = nil
+                continue
+            }
+            annotator.recorder.annotated(text)
+            line := annotator.env.event(MSG_ANNOTATION, annotator.env.now().Format(TIME_FORMAT), text)
+            for _, sink := range annotator.sinks {
+                if err := sink.Send(context.Background(), line); err != nil {
+                    fmt.Fprintf(os.Stderr, "annotation failed to reach a sink: %s\n", err)
+                }
+            }
+        case <-annotator.stopChannel:
+            return
+        }
+    }
+}
+
+// Stop taking annotations and wait for the annotator to quit
+func (annotator *Annotator) stop() {
+    if annotator == nil {
+        return
+    }
+    close(annotator.stopChannel)
+    <-annotator.doneChannel
+}
+
+//==============================================================================
+// Board keeps what every worker of the line is doing, so a Snapshot of a wedged run can be taken without stopping it
+// A nil Board keeps nothing
+type Board struct {
+    env         *environment
+    mutex       sync.Mutex
+    lifecycle   *Lifecycle
+    recorder    *Recorder
+    workers     map[string]WorkerState
+    queues      map[string]func() (int, int)    // Length and capacity of every queue
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+}
+
+type WorkerState struct {
+    Name    string  `json:"name"`
+    State   string  `json:"state"`
+    Widget  string  `json:"widget,omitempty"`   // Id of the Widget the worker holds
+    Since   string  `json:"since"`
+    Role    string  `json:"role,omitempty"`     // Producer or consumer, once it is done with a Widget
+    Widgets int     `json:"widgets"`            // Produced or consumed so far
+}
+
+// QueuedWidget is a Widget on the line which has not reached a final state yet, with how long ago it was produced
+type QueuedWidget struct {
+    Id      string          `json:"id"`
+    Age     time.Duration   `json:"age"`
+}
+
+type QueueState struct {
+    Name        string  `json:"name"`
+    Length      int     `json:"length"`
+    Capacity    int     `json:"capacity"`
+}
+
+// Snapshot is the state of a running line, queues are channels which cannot be looked into without draining them,
+// so only their depth is kept, along with the oldest Widgets queued anywhere on the line
+type Snapshot struct {
+    Time        string          `json:"time"`
+    Produced    int             `json:"produced"`
+    Consumed    int             `json:"consumed"`
+    Broken      int             `json:"broken"`        // Broken Widgets consumed
+    Stopped     bool            `json:"stopped"`       // Whether one of them stopped the line
+    Lifecycle   map[string]int  `json:"lifecycle"`     // Widgets in every state of their lifecycle
+    Queues      []QueueState    `json:"queues"`
+    Queued      []QueuedWidget  `json:"queued"`        // The oldest SNAPSHOT_QUEUED Widgets queued or held by a worker, oldest first
+    Workers     []WorkerState   `json:"workers"`
+}
+
+// The most Widgets queued a Snapshot lists
+const SNAPSHOT_QUEUED = 100
+
+func newBoard(env *environment, lifecycle *Lifecycle, recorder *Recorder) *Board {
+    lifecycle.keepQueued()
+    return &Board{env: env, lifecycle: lifecycle, recorder: recorder, workers: make(map[string]WorkerState), queues: make(map[string]func() (int, int)),
+        stopChannel: make(chan struct{}), doneChannel: make(chan struct{})}
+}
+
+// A worker takes up a new state, holding the Widget with the given id or none when empty
+func (board *Board) working(name string, state string, widget string) {
+    if board == nil {
+        return
+    }
+    board.mutex.Lock()
+    defer board.mutex.Unlock()
+    worker := board.workers[name]
+    board.workers[name] = WorkerState{name, state, widget, board.env.now().Format(TIME_FORMAT), worker.Role, worker.Widgets}
+}
+
+// A worker is done with one more Widget, as a producer or a consumer
+func (board *Board) finished(role string, name string) {
+    if board == nil {
+        return
+    }
+    board.mutex.Lock()
+    defer board.mutex.Unlock()
+    worker := board.workers[name]
+    worker.Name, worker.Role, worker.Widgets = name, role, worker.Widgets + 1
+    board.workers[name] = worker
+}
+
+func (board *Board) queue(name string, depth func() (int, int)) {
+    if board == nil {
+        return
+    }
+    board.mutex.Lock()
+    defer board.mutex.Unlock()
+    board.queues[name] = depth
+}
+
+// Capture the queues, the workers and the counters at once, no worker changes state while the Snapshot is taken
+func (board *Board) Snapshot() Snapshot {
+    board.mutex.Lock()
+    defer board.mutex.Unlock()
+    timeNow := board.env.now()
+    snapshot := Snapshot{Time: timeNow.Format(TIME_FORMAT), Queues: []QueueState{}, Workers: []WorkerState{}}
+    snapshot.Produced, snapshot.Consumed, _ = board.recorder.counters()
+    snapshot.Broken, snapshot.Stopped = board.recorder.brokenSoFar(), board.recorder.stoppedSoFar()
+    snapshot.Lifecycle, snapshot.Queued = board.lifecycle.census(), board.lifecycle.oldestQueued(timeNow, SNAPSHOT_QUEUED)
+    for name, depth := range board.queues {
+        length, capacity := depth()
+        snapshot.Queues = append(snapshot.Queues, QueueState{name, length, capacity})
+    }
+    for _, worker := range board.workers {
+        snapshot.Workers = append(snapshot.Workers, worker)
+    }
+    sort.Slice(snapshot.Queues, func(i, j int) bool { return snapshot.Queues[i].Name < snapshot.Queues[j].Name })
+    sort.Slice(snapshot.Workers, func(i, j int) bool { return snapshot.Workers[i].Name < snapshot.Workers[j].Name })
+    return snapshot
+}
+
+// Answer every request for a Snapshot, and log the occupancy of the queues every sampleEvery unless zero, until stop
+// is called
+func (board *Board) serve(snapshotChannel <-chan chan<- Snapshot, sampleEvery time.Duration) {
+    defer close(board.doneChannel)
+    var tickChannel <-chan time.Time
+    if sampleEvery > 0 {
+        ticker := time.NewTicker(sampleEvery)
+        defer ticker.Stop()
+        tickChannel = ticker.C
+    }
+    for {
+        select {
+        case reply := <-snapshotChannel:
+            reply <- board.Snapshot()
+        case <-tickChannel:
+            var queues []string
+            for _, queue := range board.Snapshot().Queues {
+                queues = append(queues, fmt.Sprintf("%s=%d/%d", queue.Name, queue.Length, queue.Capacity))
+            }
+            board.env.logEvent(MSG_OCCUPANCY, strings.Join(queues, " "))
+        case <-board.stopChannel:
+            return
+        }
+    }
+}
+
+func (board *Board) stop() {
+    if board == nil {
+        return
+    }
+    close(board.stopChannel)
+    <-board.doneChannel
+}
@@ -0,0 +1,1111 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/config.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "fmt"
+    "flag"
+    "time"
+    "bytes"
+    "strconv"
+    "strings"
+    "path"
+    "encoding/json"
+    "slices"
+    "reflect"
+    "io"
+)
+
+// durationList is a flag holding comma separated durations, e.g. 50ms,200ms
+type DurationList []time.Duration
+
+func (list *DurationList) String() string {
+    var parts []string
+    for _, duration := range *list {
+        parts = append(parts, duration.String())
+    }
+    return strings.Join(parts, ",")
+}
+
+func (list *DurationList) Set(value string) error {
+    *list = nil
+    for _, part := range strings.Split(value, ",") {
+        duration, err := time.ParseDuration(strings.TrimSpace(part))
+        if err != nil {
+            return err
+        }
+        *list = append(*list, duration)
+    }
+    return nil
+}
+
+// nameList is a comma separated flag of names
+type nameList []string
+
+func (list *nameList) String() string {
+    return strings.Join(*list, ",")
+}
+
+func (list *nameList) Set(value string) error {
+    *list = nil
+    for _, name := range strings.Split(value, ",") {
+        *list = append(*list, strings.TrimSpace(name))
+    }
+    return nil
+}
+
+// A DurationList reads from JSON as a list of nanoseconds or Go duration strings, e.g. [50000000, "200ms"], or as the
+// flag does from a comma separated string
+func (list *DurationList) UnmarshalJSON(data []byte) error {
+    var text string
+    if (len(data) > 0 && data[0] == '"') {
+        if err := json.Unmarshal(data, &text); err != nil {
+            return err
+        }
+        return list.Set(text)
+    }
+    var items []json.RawMessage
+    if err := json.Unmarshal(data, &items); err != nil {
+        return err
+    }
+    *list = nil
+    for _, item := range items {
+        var duration time.Duration
+        if err := unmarshalDuration(item, &duration); err != nil {
+            return err
+        }
+        *list = append(*list, duration)
+    }
+    return nil
+}
+
+// A duration in nanoseconds or as a Go duration string
+func unmarshalDuration(data []byte, duration *time.Duration) error {
+    var text string
+    if (len(data) > 0 && data[0] == '"') {
+        if err := json.Unmarshal(data, &text); err != nil {
+            return err
+        }
+        parsed, err := time.ParseDuration(text)
+        *duration = parsed
+        return err
+    }
+    return json.Unmarshal(data, duration)
+}
+
+// The ith duration of the list, the last one applies to everything past the end of the list
+func (list DurationList) at(i int) time.Duration {
+    if len(list) == 0 {
+        return 0
+    }
+    if i >= len(list) {
+        return list[len(list) - 1]
+    }
+    return list[i]
+}
+
+// weightList is a comma separated flag of weights, one per Producer
+type WeightList []float64
+
+func (list *WeightList) String() string {
+    var parts []string
+    for _, weight := range *list {
+        parts = append(parts, strconv.FormatFloat(weight, 'g', -1, 64))
+    }
+    return strings.Join(parts, ",")
+}
+
+func (list *WeightList) Set(value string) error {
+    *list = nil
+    for _, part := range strings.Split(value, ",") {
+        weight, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+        if err != nil {
+            return err
+        }
+        *list = append(*list, weight)
+    }
+    return nil
+}
+
+// cardList is a comma separated flag of numbers of kanban cards, one per stage
+type CardList []int
+
+func (list *CardList) String() string {
+    var parts []string
+    for _, cards := range *list {
+        parts = append(parts, strconv.Itoa(cards))
+    }
+    return strings.Join(parts, ",")
+}
+
+func (list *CardList) Set(value string) error {
+    *list = nil
+    for _, part := range strings.Split(value, ",") {
+        cards, err := strconv.Atoi(strings.TrimSpace(part))
+        if err != nil {
+            return err
+        }
+        *list = append(*list, cards)
+    }
+    return nil
+}
+
+// The ith weight of the list, the last one applies to everything past the end of the list, 1 for an empty list
+func (list WeightList) at(i int) float64 {
+    if len(list) == 0 {
+        return 1
+    }
+    if i >= len(list) {
+        return list[len(list) - 1]
+    }
+    return list[i]
+}
+
+//=============================================================================
+// LineConfig holds everything needed to set up a production line
+type LineConfig struct {
+    NumWidgets          int             `json:"n"`
+    NumProducers        int             `json:"p"`
+    NumConsumers        int             `json:"c"`
+    Groups              GroupList       `json:"groups"`
+    NumKth              int             `json:"k"`
+    LotSize             int             `json:"lot"`
+    Recall              string          `json:"recall"`
+    SerialIds           bool            `json:"serial"`
+    IdLength            int             `json:"id_length"`
+    IdAlphabet          string          `json:"id_alphabet"`
+    Ids                 string          `json:"ids,omitempty"`
+    ConsumeDelay        time.Duration   `json:"consume_delay"`
+    ConsumeTime         ConsumeTimeList `json:"consume_time,omitempty"`
+    ProduceEnergy       float64         `json:"energy_produce"`
+    ConsumeEnergy       float64         `json:"energy_consume"`
+    PackageEnergy       float64         `json:"energy_package"`
+    IdlePower           float64         `json:"idle_power"`
+    Mtbf                DurationList    `json:"mtbf"`
+    Mttr                DurationList    `json:"mttr"`
+    MaintenanceEvery    int             `json:"maintenance"`
+    IdealCycle          DurationList    `json:"ideal_cycle"`
+    NumCrews            int             `json:"crews"`
+    Deterministic       bool            `json:"deterministic"`
+    Seed                int64           `json:"seed"`
+    Verify              bool            `json:"verify"`
+    Sinks               sinkList        `json:"sinks"`
+    Filters             filterList      `json:"filters"`
+    Scores              ScoreList       `json:"scores"`
+    ScoreThreshold      float64         `json:"score_threshold"`
+    DivertSink          sinkList        `json:"divert_sink"`
+    Validate            bool            `json:"validate"`
+    Malformed           float64         `json:"malformed_rate"`
+    Quotas              QuotaList       `json:"quotas"`
+    Contention          bool            `json:"contention"`
+    Stages              StageList       `json:"stages,omitempty"`
+    StopPolicy          string          `json:"stop_policy,omitempty"`
+    Inspect             bool            `json:"inspect,omitempty"`
+    RepairRate          float64         `json:"repair_rate,omitempty"`
+    Split               int             `json:"split"`
+    TransformRate       float64         `json:"transform_rate"`
+    Generations         int             `json:"generations"`
+    Until               EndList         `json:"until"`
+    Price               float64         `json:"price"`
+    ScrapCost           float64         `json:"scrap_cost"`
+    ResumeAfter         int             `json:"resume_after,omitempty"`    // Jobs done by the run this one resumes, set by resume only
+    Locale              string          `json:"locale"`
+    Messages            messageMap      `json:"messages"`
+    Format              string          `json:"format,omitempty"`
+    LogLevel            string          `json:"log_level,omitempty"`
+    LogFormat           string          `json:"log_format,omitempty"`
+    QuotaShed           bool            `json:"quota_shed"`
+    Sample              float64         `json:"sample"`
+    AlertDrop           float64         `json:"alert_drop"`
+    AlertWindow         time.Duration   `json:"alert_window"`
+    AlertWebhook        string          `json:"alert_webhook"`
+    OtelEndpoint        string          `json:"otel_endpoint,omitempty"`
+    Soak                bool            `json:"soak"`
+    DrainTimeout        time.Duration   `json:"drain_timeout"`
+    RollupEvery         time.Duration   `json:"rollup_every"`
+    RotateEvery         time.Duration   `json:"rotate_every"`
+    PauseBuffer         int             `json:"pause_buffer"`
+    ProbeEvery          time.Duration   `json:"probe_every"`
+    Warmup              time.Duration   `json:"warmup"`
+    Steady              string          `json:"steady"`
+    QueueSize           int             `json:"queue"`
+    Buffer              int             `json:"buffer"`
+    Retries             int             `json:"retries"`
+    Backoff             time.Duration   `json:"backoff"`
+    Gaps                bool            `json:"gaps"`
+    AuditJobs           bool            `json:"audit_jobs"`
+    Pareto              bool            `json:"pareto"`
+    ProduceLimit        int             `json:"produce_limit"`
+    ConsumeLimit        int             `json:"consume_limit"`
+    SinkLimit           int             `json:"sink_limit"`
+    Priorities          int             `json:"priorities"`
+    PriorityQueues      nameList        `json:"priority_queues"`
+    Drain               string          `json:"drain"`
+    PriorityMix         string          `json:"priority_mix,omitempty"`
+    Aging               time.Duration   `json:"aging"`
+    NumStandbys         int             `json:"standby"`
+    ConsumerCrash       float64         `json:"consumer_crash"`
+    ConsumeFailRate     float64         `json:"consume_fail_rate,omitempty"`
+    ConsumeAttempts     int             `json:"consume_attempts"`
+    ConsumeBackoff      time.Duration   `json:"consume_backoff"`
+    DeadLetters         string          `json:"dead_letters,omitempty"`
+    Pull                bool            `json:"pull"`
+    Kanban              CardList        `json:"kanban"`
+    Wip                 bool            `json:"wip"`
+    Stats               bool            `json:"stats"`
+    Resources           bool            `json:"resources"`
+    Takt                time.Duration   `json:"takt"`
+    ProduceRate         float64         `json:"produce_rate,omitempty"`
+    ProduceJitter       float64         `json:"produce_jitter,omitempty"`
+    Verdict             CriterionList   `json:"verdict"`
+    Credits             int             `json:"credits"`
+    Pools               nameList        `json:"pools,omitempty"`
+    Steal               bool            `json:"steal,omitempty"`
+    Partitions          int             `json:"partitions"`
+    Rebalance           string          `json:"rebalance"`
+    Shutdown            string          `json:"shutdown"`
+    Rules               RuleList        `json:"rules"`
+    Autoscale           string          `json:"autoscale,omitempty"`
+    ScaleUp             int             `json:"scale_up"`
+    ScaleDown           int             `json:"scale_down"`
+    ScaleEvery          time.Duration   `json:"scale_every"`
+    AutoscaleProducers  int             `json:"autoscale_producers,omitempty"`
+    Feedback            string          `json:"feedback"`
+    Due                 DurationList    `json:"due"`
+    Weights             WeightList      `json:"weights"`
+    Work                DurationList    `json:"work"`
+    PayloadSize         int             `json:"payload_size,omitempty"`
+    Dispatch            string          `json:"dispatch"`
+    Reserve             string          `json:"reserve"`
+    MetricsAddr         string          `json:"metrics_addr"`
+    Ledger              string          `json:"ledger,omitempty"`
+    Out                 string          `json:"out,omitempty"`
+    Connect             string          `json:"connect,omitempty"`            // Set by produce, the consuming process to send the Widgets to
+    Listen              string          `json:"listen,omitempty"`             // Set by consume, the address to take the Widgets on
+    RemoteProducers     int             `json:"remote_producers,omitempty"`   // Set by consume, the producing processes to wait for
+    ReserveSize         int             `json:"reserve_size"`
+    Lease               time.Duration   `json:"lease"`
+    DefectRate          float64         `json:"defect_rate"`
+    BadDefectRate       float64         `json:"bad_defect_rate"`
+    EnterBad            float64         `json:"bad_enter"`
+    ExitBad             float64         `json:"bad_exit"`
+}
+
+// The configuration of the line when nothing else is asked for
+func DefaultConfig() LineConfig {
+    return LineConfig{NumWidgets: 10, NumProducers: 1, NumConsumers: 1, NumKth: -1, NumCrews: 1, Sample: 1, AlertWindow: 100 * time.Millisecond,
+        IdLength: ID_LENGTH, IdAlphabet: ASCII, RollupEvery: time.Hour, RotateEvery: time.Hour, ProbeEvery: 100 * time.Millisecond, Retries: -1, Buffer: -1, Backoff: time.Millisecond,
+        ConsumeAttempts: 3, ConsumeBackoff: time.Millisecond, ScaleUp: 100, ScaleDown: 10, ScaleEvery: 100 * time.Millisecond,
+        BadDefectRate: 0.5, ExitBad: 0.1, Credits: 1, TransformRate: 1, Generations: 1, ReserveSize: 16, Lease: 30 * time.Second,
+        DrainTimeout: 10 * time.Second}
+}
+
+// Named presets for common scenarios, each starts from the DefaultConfig
+var profiles = map[string]func(config *LineConfig){
+    "smoke": func(config *LineConfig) {
+        config.NumWidgets, config.NumProducers, config.NumConsumers = 20, 2, 2
+        config.Verify = true
+    },
+    "soak": func(config *LineConfig) {
+        config.Soak, config.NumProducers, config.NumConsumers = true, 8, 8
+        config.ConsumeDelay = 100 * time.Microsecond
+        config.Sample = 0.001
+        config.AlertDrop, config.AlertWindow = 0.5, time.Second
+        config.Sinks = sinkList{"rotate:soak.log"}
+        config.Verify = true
+    },
+    "stress": func(config *LineConfig) {
+        config.NumWidgets, config.NumProducers, config.NumConsumers = 100000, 32, 32
+        config.Mtbf, config.Mttr, config.NumCrews = DurationList{time.Millisecond}, DurationList{100 * time.Microsecond}, 4
+        config.Sinks = sinkList{"null"}
+        config.Verify = true
+    },
+    "demo": func(config *LineConfig) {
+        config.NumWidgets, config.NumProducers, config.NumConsumers, config.NumKth = 30, 3, 2, 25
+        config.ConsumeDelay = 50 * time.Millisecond
+        config.LotSize = 5
+    },
+}
+
+// Find the values of the -profile and -config flags before the flags are parsed, since they set the defaults of the other
+// flags. The args are parsed over stand-ins of every flag, so the values of the other flags are told from flags and the
+// two are found wherever they are; a bad flag is left for the real parse to report
+func presetArgs(flagSet *flag.FlagSet, args []string) (string, string) {
+    scratch := flag.NewFlagSet("", flag.ContinueOnError)
+    scratch.SetOutput(io.Discard)
+    flagSet.VisitAll(func(f *flag.Flag) {
+        if boolean, ok := f.Value.(interface{ IsBoolFlag() bool }); (ok && boolean.IsBoolFlag()) {
+            scratch.Bool(f.Name, false, "")
+        } else {
+            scratch.String(f.Name, "", "")
+        }
+    })
+    var stand LineConfig
+    stand.flags(scratch)
+    profile, fileName := scratch.String("profile", "", ""), scratch.String("config", "", "")
+    scratch.Parse(args)
+    return *profile, *fileName
+}
+
+// Resolve the configuration of the line: the DefaultConfig, overridden by the -profile, overridden by the -config file,
+// overridden by any other flag
+func ResolveConfig(flagSet *flag.FlagSet, args []string) (LineConfig, error) {
+    config := DefaultConfig()
+    profile, fileName := presetArgs(flagSet, args)
+    if profile != "" {
+        applyProfile, found := profiles[profile]
+        if !found {
+            return config, fmt.Errorf("unknown profile %q (smoke, soak, stress or demo)", profile)
+        }
+        applyProfile(&config)
+    }
+    if fileName != "" {
+        if err := readConfigFile(fileName, &config); err != nil {
+            return config, err
+        }
+    }
+    flagSet.String("profile", "", "Starts from a preset configuration: smoke, soak, stress or demo")
+    flagSet.String("config", "", "Reads the setup of the line from this JSON file, the keys of a recorded config, before any other flag")
+    config.flags(flagSet)
+    if err := flagSet.Parse(args); err != nil {
+        return config, err
+    }
+    return config, config.Check()
+}
+
+// Read a configuration file over the config, only the settings it holds are changed. The file is a LineConfig in JSON,
+// like the config of a recording or a stress reproducer, durations in nanoseconds or Go duration strings, and a key the
+// line does not know is an error rather than a setting silently ignored. YAML and TOML would need packages outside the standard library
+func readConfigFile(fileName string, config *LineConfig) error {
+    switch path.Ext(fileName) {
+    case ".yaml", ".yml", ".toml":
+        return fmt.Errorf("config file %s: only JSON is read, not %s", fileName, strings.TrimPrefix(path.Ext(fileName), "."))
+    }
+    data, err := DefaultServices().Store.ReadFile(fileName)
+    if err != nil {
+        return err
+    }
+    if err := decodeConfig(data, config); err != nil {
+        return fmt.Errorf("config file %s: %w", fileName, err)
+    }
+    return nil
+}
+
+func decodeConfig(data []byte, config *LineConfig) error {
+    data, err := durationsInNanoseconds(data)
+    if err != nil {
+        return err
+    }
+    type plain LineConfig
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    return decoder.Decode((*plain)(config))
+}
+
+// The durations of a LineConfig read from JSON may be in nanoseconds or Go duration strings, e.g. "100us"
+func (config *LineConfig) UnmarshalJSON(data []byte) error {
+    data, err := durationsInNanoseconds(data)
+    if err != nil {
+        return err
+    }
+    type plain LineConfig
+    return json.Unmarshal(data, (*plain)(config))
+}
+
+// The JSON of a LineConfig with the Go duration strings of its durations turned into nanoseconds, its lists of durations
+// read either way on their own. What is not an object is left for the decoding to fail on
+func durationsInNanoseconds(data []byte) ([]byte, error) {
+    var fields map[string]json.RawMessage
+    if (json.Unmarshal(data, &fields) != nil || fields == nil) {
+        return data, nil
+    }
+    changed := false
+    configType := reflect.TypeFor[LineConfig]()
+    for i := 0; i < configType.NumField(); i++ {
+        field := configType.Field(i)
+        key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+        raw, found := fields[key]
+        if (field.Type != reflect.TypeFor[time.Duration]() || !found || string(raw) == "null") {
+            continue
+        }
+        var duration time.Duration
+        if err := unmarshalDuration(raw, &duration); err != nil {
+            return nil, fmt.Errorf("%s: %w", key, err)
+        }
+        fields[key], _ = json.Marshal(duration)
+        changed = true
+    }
+    if !changed {
+        return data, nil
+    }
+    return json.Marshal(fields)
+}
+
+// The configuration in JSON, as a -config file holds it, over the DefaultConfig and checked as the flags are
+func ParseConfig(data []byte) (LineConfig, error) {
+    config := DefaultConfig()
+    if err := decodeConfig(data, &config); err != nil {
+        return config, err
+    }
+    return config, config.Check()
+}
+
+// Register the command line flags setting up the line, the current settings are the defaults
+func (config *LineConfig) flags(flagSet *flag.FlagSet) {
+    flagSet.IntVar(&config.NumWidgets, "n", config.NumWidgets, "Sets the number of Widgets created")
+    flagSet.IntVar(&config.NumProducers, "p", config.NumProducers, "Sets the number of Producers created")
+    flagSet.IntVar(&config.NumConsumers, "c", config.NumConsumers, "Sets the number of consumers created")
+    flagSet.Var(&config.Groups, "group", "Adds a consumer group getting every Widget, its consumers competing for them: <name>:<consumers>[:<drain>] (repeatable, replaces -c)")
+    flagSet.StringVar(&config.Reserve, "reserve", config.Reserve, "Adds the external group, whose widgets external systems reserve over HTTP on this address, e.g. localhost:8080")
+    flagSet.StringVar(&config.MetricsAddr, "metrics-addr", config.MetricsAddr, "Serves the counters of the line in the Prometheus text format on http://<address>/metrics, e.g. localhost:9100")
+    flagSet.StringVar(&config.Ledger, "ledger", config.Ledger, "Writes every Widget reaching a final state to this file, one JSON object per line, see report widgets")
+    flagSet.StringVar(&config.Out, "out", config.Out, "Writes every Widget reaching a final state to this CSV file, one row per Widget with its times, latencies and status")
+    flagSet.IntVar(&config.ReserveSize, "reserve-size", config.ReserveSize, "Sets how many widgets the external group may have out at once")
+    flagSet.DurationVar(&config.Lease, "lease", config.Lease, "Sets the longest lease of reserved widgets, and the lease of reservations asking for none")
+    flagSet.IntVar(&config.NumKth, "k", config.NumKth, "Sets the kth Widget to be broken, every kth one unless -stop-policy is halt")
+    flagSet.StringVar(&config.StopPolicy, "stop-policy", config.StopPolicy, "Sets what a broken Widget does to the line: halt it, skip it as scrap, dead-letter it, or threshold=<n> to halt at the nth, defective Widgets are scrapped and never counted")
+    flagSet.IntVar(&config.LotSize, "lot", config.LotSize, "Sets the number of finished Widgets packed into a lot (0 means no packaging)")
+    flagSet.StringVar(&config.Recall, "recall", config.Recall, "Recalls every lot holding a Widget matching the predicates, as in a -filter rule")
+    flagSet.BoolVar(&config.SerialIds, "serial", config.SerialIds, "Uses dense, gap-free serial numbers as Widget ids instead of random ids")
+    flagSet.IntVar(&config.IdLength, "id-length", config.IdLength, "Sets the length of the Widget ids, the dash in the middle included")
+    flagSet.StringVar(&config.IdAlphabet, "id-alphabet", config.IdAlphabet, "Sets the characters random Widget ids are made of")
+    flagSet.StringVar(&config.Ids, "ids", config.Ids, "Sets how random Widget ids are made: legacy (-id-length characters of -id-alphabet), uuid (version 4) or ulid")
+    flagSet.DurationVar(&config.ConsumeDelay, "consume-delay", config.ConsumeDelay, "Sets how long a consumer takes to consume a Widget")
+    flagSet.BoolVar(&config.Inspect, "inspect", config.Inspect, "Adds an Inspector right after the Producers, repairing broken Widgets or discarding them so they no longer stop the line")
+    flagSet.Float64Var(&config.RepairRate, "repair-rate", config.RepairRate, "Sets the probability of the Inspector repairing a broken Widget rather than discarding it")
+    flagSet.Var(&config.Stages, "stages", "Adds stations between the Producers and consumers, in order, comma separated: <name>:<workers>:<work>[:<scrap rate>], e.g. inspect:2:200us:0.01,paint:4:1ms")
+    flagSet.Var(&config.ConsumeTime, "consume-time", "Sets how much longer than -consume-delay consuming a Widget takes, drawn for every Widget, per consumer, comma separated: <duration>, <min>..<max> or exp:<mean>")
+    flagSet.Float64Var(&config.ProduceEnergy, "energy-produce", config.ProduceEnergy, "Sets the energy in joules used to produce a Widget")
+    flagSet.Float64Var(&config.ConsumeEnergy, "energy-consume", config.ConsumeEnergy, "Sets the energy in joules used to consume a Widget")
+    flagSet.Float64Var(&config.PackageEnergy, "energy-package", config.PackageEnergy, "Sets the energy in joules used to pack a Widget into a lot")
+    flagSet.Float64Var(&config.IdlePower, "idle-power", config.IdlePower, "Sets the power in watts drawn by every idle worker")
+    flagSet.Var(&config.Due, "due", "Gives the Widgets a due date this long after they are made, per Producer, comma separated (e.g. 5ms,20ms)")
+    flagSet.Var(&config.Weights, "weights", "Sets the cost of every second a Widget is late, per Producer, comma separated (defaults to 1)")
+    flagSet.IntVar(&config.PayloadSize, "payload-size", config.PayloadSize, "Fills every Widget produced with this many random bytes, carried along to the consumers")
+    flagSet.Var(&config.Work, "work", "Sets how much longer than -consume-delay consuming a Widget takes, per Producer, comma separated (e.g. 50us,500us)")
+    flagSet.StringVar(&config.Dispatch, "dispatch", config.Dispatch, "Sets which waiting Widget goes to the consumers first: fifo, edd (earliest due date) or spt (shortest work)")
+    flagSet.Var(&config.Mtbf, "mtbf", "Sets the mean time between breakdowns per Producer, comma separated (e.g. 5ms,20ms)")
+    flagSet.Var(&config.Mttr, "mttr", "Sets the mean time to repair per Producer, comma separated (e.g. 1ms)")
+    flagSet.IntVar(&config.MaintenanceEvery, "maintenance", config.MaintenanceEvery, "Sets the number of Widgets a Producer makes between scheduled maintenances")
+    flagSet.Var(&config.IdealCycle, "ideal-cycle", "Sets the ideal cycle time per Producer the OEE performance is measured against, comma separated (e.g. 50us), the fastest cycle of every machine by default")
+    flagSet.IntVar(&config.NumCrews, "crews", config.NumCrews, "Sets the number of repair crews")
+    flagSet.BoolVar(&config.Deterministic, "deterministic", config.Deterministic, "Runs every worker on a single goroutine, interleaved by a scheduler seeded with -seed")
+    flagSet.Int64Var(&config.Seed, "seed", config.Seed, "Sets the seed of the random number generators (0 means seeded from the clock)")
+    flagSet.BoolVar(&config.Verify, "verify", config.Verify, "Checks the invariants of the line and fails the run when any is violated")
+    flagSet.Var(&config.Sinks, "sinks", "Sets the sink per consumer, comma separated: stdout, null, file:<path> or an http(s):// url")
+    flagSet.Var(&config.Filters, "filter", "Adds a filter rule Widgets must pass before consumption: [!]source|type|priority|label=<pattern>, joined by & or |, then [:drop|:divert] (repeatable)")
+    flagSet.Var(&config.Verdict, "verdict", "Adds a criterion of the run verdict: defects, sla, violations or drops, then :<warn>:<fail>[:<weight>] (repeatable)")
+    flagSet.Var(&config.Scores, "score", "Adds a quality score rule: skew=<max>, entropy or labels, then [:<weight>] (repeatable)")
+    flagSet.Float64Var(&config.ScoreThreshold, "score-threshold", config.ScoreThreshold, "Flags the Widgets scoring below this quality, between 0 and 1")
+    flagSet.BoolVar(&config.Validate, "validate", config.Validate, "Checks the id, timestamp and checksum of every Widget right after production, rejecting malformed ones")
+    flagSet.Float64Var(&config.Malformed, "malformed-rate", config.Malformed, "Sets the probability of a Producer making a malformed Widget, for -validate to reject")
+    flagSet.IntVar(&config.Split, "split", config.Split, "Derives this many Widgets from every good Widget on its way to the consumers, 1 to enrich and forward it (0 means no transformer)")
+    flagSet.Float64Var(&config.TransformRate, "transform-rate", config.TransformRate, "Sets the probability of a Widget being transformed")
+    flagSet.IntVar(&config.Generations, "generations", config.Generations, "Sets how many times over derived Widgets are transformed again")
+    flagSet.Var(&config.Until, "until", "Ends the run as soon as this is met, ahead of -n: good|broken=<n>, profit=<amount> or steady=<percent>%/<duration> (repeatable, any ends it)")
+    flagSet.Float64Var(&config.Price, "price", config.Price, "Sets what a good Widget earns, for -until profit")
+    flagSet.Float64Var(&config.ScrapCost, "scrap-cost", config.ScrapCost, "Sets what a Widget which is not good costs, for -until profit")
+    flagSet.BoolVar(&config.Contention, "contention", config.Contention, "Times how long senders block and receivers wait on every channel, and reports the choke point")
+    flagSet.StringVar(&config.Locale, "locale", config.Locale, "Sets the language of the event messages: en or es")
+    flagSet.Var(&config.Messages, "message", "Overrides an event message: <key>=<format>, e.g. consume=%s took %[6]s (repeatable)")
+    flagSet.StringVar(&config.Format, "format", config.Format, "Sets the format of the consume events sent to the sinks: text or json")
+    flagSet.StringVar(&config.LogLevel, "log-level", config.LogLevel, "Logs the events from this level up: trace, verbose, debug, with the lines of every Widget, info, warn or error (default debug)")
+    flagSet.BoolFunc("quiet", "Logs no event but the summary, as -log-level error", func(string) error {
+        config.LogLevel = "error"
+        return nil
+    })
+    flagSet.BoolFunc("v", "Logs every Widget produced too, as -log-level verbose", func(string) error {
+        config.LogLevel = "verbose"
+        return nil
+    })
+    flagSet.BoolFunc("vv", "Logs every Widget produced and the occupancy of the queues every 100ms too, as -log-level trace", func(string) error {
+        config.LogLevel = "trace"
+        return nil
+    })
+    flagSet.StringVar(&config.LogFormat, "log-format", config.LogFormat, "Logs the events as they read, or as text or json records of log/slog: plain, text or json (default plain)")
+    flagSet.Var(&config.Quotas, "quota", "Adds a quota on the share of the queue matching Widgets may occupy: source|priority=<pattern>:<percent>% (repeatable)")
+    flagSet.BoolVar(&config.QuotaShed, "quota-shed", config.QuotaShed, "Sheds over-quota Widgets instead of delaying them until there is room")
+    flagSet.Var(&config.DivertSink, "divert", "Sets the sink diverted Widgets are sent to")
+    flagSet.Float64Var(&config.Sample, "sample", config.Sample, "Sets the fraction of consumed Widgets sent to the sinks, statistics still count every Widget")
+    flagSet.Float64Var(&config.AlertDrop, "alert-drop", config.AlertDrop, "Alerts when consumption throughput drops by more than this fraction within a window (0 means no alerts)")
+    flagSet.DurationVar(&config.AlertWindow, "alert-window", config.AlertWindow, "Sets the window throughput drops are measured over")
+    flagSet.StringVar(&config.AlertWebhook, "alert-webhook", config.AlertWebhook, "Posts throughput alerts as JSON to this url")
+    flagSet.StringVar(&config.OtelEndpoint, "otel-endpoint", config.OtelEndpoint, "Exports a trace of every Widget to this OpenTelemetry collector, OTLP over HTTP in JSON, e.g. http://localhost:4318")
+    flagSet.BoolVar(&config.Soak, "soak", config.Soak, "Produces without a fixed number of Widgets until interrupted, ignoring -n")
+    flagSet.DurationVar(&config.DrainTimeout, "drain-timeout", config.DrainTimeout, "Sets how long an interrupted run drains the Widgets already produced before it stops, leaving the rest unconsumed")
+    flagSet.DurationVar(&config.RollupEvery, "rollup-every", config.RollupEvery, "Sets how often a soak run reports its rollup")
+    flagSet.DurationVar(&config.RotateEvery, "rotate-every", config.RotateEvery, "Sets how often rotate:<path> sinks move their file aside")
+    flagSet.IntVar(&config.PauseBuffer, "pause-buffer", config.PauseBuffer, "Pauses a failing file or url sink, buffering up to this many lines until a probe gets through (0 means failed sends are lost)")
+    flagSet.DurationVar(&config.ProbeEvery, "probe-every", config.ProbeEvery, "Sets how often a paused sink is probed for recovery")
+    flagSet.IntVar(&config.QueueSize, "queue", config.QueueSize, "Bounds the queue between Producers and consumers to this many Widgets (0 means room for every Widget)")
+    flagSet.IntVar(&config.Buffer, "buffer", config.Buffer, "Sets the capacity of every channel between Producers and consumers, 0 for unbuffered (-1 means room for every Widget)")
+    flagSet.IntVar(&config.Retries, "retries", config.Retries, "Sets how many times a Producer retries a full queue before shedding the Widget (-1 means waiting for room)")
+    flagSet.DurationVar(&config.Backoff, "backoff", config.Backoff, "Sets the wait before the first retry on a full queue, doubled after every retry")
+    flagSet.Float64Var(&config.DefectRate, "defect-rate", config.DefectRate, "Sets the probability of a defective Widget while its Producer is in a good state, scrapped without stopping the line whatever the -stop-policy")
+    flagSet.Float64Var(&config.BadDefectRate, "bad-defect-rate", config.BadDefectRate, "Sets the probability of a defective Widget while its Producer is in a bad state")
+    flagSet.Float64Var(&config.EnterBad, "bad-enter", config.EnterBad, "Sets the probability per Widget of a Producer entering a bad state")
+    flagSet.Float64Var(&config.ExitBad, "bad-exit", config.ExitBad, "Sets the probability per Widget of a Producer leaving its bad state")
+    flagSet.IntVar(&config.ProduceLimit, "produce-limit", config.ProduceLimit, "Sets how many Widgets may be produced at once, whatever the number of Producers (0 means no limit)")
+    flagSet.IntVar(&config.ConsumeLimit, "consume-limit", config.ConsumeLimit, "Sets how many Widgets may be consumed at once, whatever the number of consumers (0 means no limit)")
+    flagSet.IntVar(&config.SinkLimit, "sink-limit", config.SinkLimit, "Sets how many sends to the sinks may be in flight at once (0 means no limit)")
+    flagSet.IntVar(&config.Priorities, "priorities", config.Priorities, "Spreads the Widgets over this many priority classes, dispatching class 0 first (0 means no priority dispatch)")
+    flagSet.Var(&config.PriorityQueues, "priority-queues", "Spreads the Widgets over these named priority queues, comma separated and dispatched first to last, e.g. express,standard,bulk")
+    flagSet.StringVar(&config.Drain, "drain", config.Drain, "Sets how consumers drain the priority queues: strict, or weighted=<w0>/<w1>/... round-robin")
+    flagSet.StringVar(&config.PriorityMix, "priority-mix", config.PriorityMix, "Sets the share of the Widgets every priority class gets: <w0>/<w1>/..., even when not set")
+    flagSet.DurationVar(&config.Aging, "aging", config.Aging, "Promotes a waiting Widget by one priority class every period, so no class starves (0 means strict priorities)")
+    flagSet.IntVar(&config.NumStandbys, "standby", config.NumStandbys, "Sets the number of standby consumers taking over from crashed ones")
+    flagSet.Float64Var(&config.ConsumerCrash, "consumer-crash", config.ConsumerCrash, "Sets the probability of a consumer crashing after every Widget")
+    flagSet.Float64Var(&config.ConsumeFailRate, "consume-fail-rate", config.ConsumeFailRate, "Sets the probability of a consume attempt failing transiently, the Widget is retried")
+    flagSet.IntVar(&config.ConsumeAttempts, "consume-attempts", config.ConsumeAttempts, "Sets how many times a consumer attempts a Widget before giving up on it, to the dead-letter channel")
+    flagSet.DurationVar(&config.ConsumeBackoff, "consume-backoff", config.ConsumeBackoff, "Sets the wait before the second consume attempt, doubled after every failed attempt")
+    flagSet.StringVar(&config.DeadLetters, "dead-letters", config.DeadLetters, "Writes every Widget the consumers give up on to this file, one JSON object per line")
+    flagSet.BoolVar(&config.Pull, "pull", config.Pull, "Consumers pull the Widgets when ready instead of having them pushed")
+    flagSet.IntVar(&config.Credits, "credits", config.Credits, "Sets how many Widgets a pulling consumer may ask for ahead")
+    flagSet.Var(&config.Pools, "pools", "Splits the consumers into named pools with a queue each, comma separated <name>:<consumers>, e.g. fast:2,slow:2")
+    flagSet.BoolVar(&config.Steal, "steal", config.Steal, "Lets the consumers of an idle pool steal the Widgets waiting in the queues of the others")
+    flagSet.Var(&config.Kanban, "kanban", "Only produces and consumes Widgets with a free kanban card, cards per stage: <production>[,<consumption>]")
+    flagSet.BoolVar(&config.Wip, "wip", config.Wip, "Reports the work in process of every stage, which -kanban does too")
+    flagSet.BoolVar(&config.Stats, "stats", config.Stats, "Reports the Widgets of every Producer and consumer, with the min, mean, max and p99 queue latency of every consumer")
+    flagSet.BoolVar(&config.Resources, "resources", config.Resources, "Reports the CPU time, peak memory and garbage collection of the run")
+    flagSet.DurationVar(&config.Takt, "takt", config.Takt, "Paces the line to start one Widget every takt time, whatever the number of Producers (0 means unpaced)")
+    flagSet.Float64Var(&config.ProduceRate, "produce-rate", config.ProduceRate, "Limits every Producer to this many Widgets per second with a token bucket (0 means unlimited)")
+    flagSet.Float64Var(&config.ProduceJitter, "produce-jitter", config.ProduceJitter, "Sets the fraction of the -produce-rate interval tokens come early or late by, between 0 and 1")
+    flagSet.IntVar(&config.Partitions, "partitions", config.Partitions, "Hands the Widgets to consumers by partition of their id, rebalanced as consumers join and leave (0 means no partitions)")
+    flagSet.StringVar(&config.Shutdown, "shutdown", config.Shutdown, "Sets how the stages are stopped, reporting the timeline: cancel at once, producers-first or drain in order")
+    flagSet.Var(&config.Rules, "rule", "Adds a rule acting on the live metrics: [if] <metric> <op> <value> [for <duration>] then <action>, see the README (repeatable, or ; separated)")
+    flagSet.StringVar(&config.Autoscale, "autoscale", config.Autoscale, "Scales the consumers of the line between <min>..<max> by the queue depth")
+    flagSet.IntVar(&config.ScaleUp, "scale-up", config.ScaleUp, "Sets the queue depth above which the autoscaler adds a consumer")
+    flagSet.IntVar(&config.ScaleDown, "scale-down", config.ScaleDown, "Sets the queue depth at or below which the autoscaler removes a consumer")
+    flagSet.DurationVar(&config.ScaleEvery, "scale-every", config.ScaleEvery, "Sets how often the autoscaler looks at the queue depth, scaling by one step at most")
+    flagSet.IntVar(&config.AutoscaleProducers, "autoscale-producers", config.AutoscaleProducers, "Also scales the producers, keeping at least this many running (0 means the producers are not scaled)")
+    flagSet.StringVar(&config.Feedback, "feedback", config.Feedback, "Responds to the failures inspection finds among the latest widgets of a producer: <n> of <m> then slow|recalibrate <duration>")
+    flagSet.StringVar(&config.Rebalance, "rebalance", config.Rebalance, "Sets how the partitions are rebalanced over the consumers: range, round-robin or sticky")
+    flagSet.BoolVar(&config.Gaps, "gaps", config.Gaps, "Reports the sequence numbers of every Producer missing or out of order at the consumers")
+    flagSet.BoolVar(&config.Pareto, "pareto", config.Pareto, "Reports the broken and defective Widgets consumed by cause, largest first, with their cumulative percentage")
+    flagSet.BoolVar(&config.AuditJobs, "audit-jobs", config.AuditJobs, "Reports by number the jobs consumed, produced but never consumed and never produced, when not all were consumed")
+    flagSet.DurationVar(&config.Warmup, "warmup", config.Warmup, "Leaves the Widgets consumed during this first period out of the latencies and the throughput")
+    flagSet.StringVar(&config.Steady, "steady", config.Steady, "Leaves the Widgets consumed until the throughput holds within tolerance for a while out of the statistics: <percent>%/<duration>")
+}
+
+// The consumer groups of the line, the first one is the line's own, a single unnamed group of -c consumers without -group
+// With -reserve, the external group comes last
+func (config LineConfig) consumerGroups() []*ConsumerGroup {
+    var groups []*ConsumerGroup
+    if len(config.Groups) == 0 {
+        groups = append(groups, &ConsumerGroup{size: config.NumConsumers, drain: config.Drain, membership: make(chan Membership, MEMBERSHIP_CAPACITY), rebalance: config.Rebalance})
+    }
+    for _, spec := range config.Groups {
+        group, _ := parseConsumerGroup(spec)
+        if group.drain == "" {
+            group.drain = config.Drain
+        }
+        group.membership, group.rebalance = make(chan Membership, MEMBERSHIP_CAPACITY), config.Rebalance
+        groups = append(groups, group)
+    }
+    if config.Reserve != "" {
+        groups = append(groups, &ConsumerGroup{name: RESERVE_GROUP, size: config.ReserveSize, drain: config.Drain, membership: make(chan Membership, MEMBERSHIP_CAPACITY), rebalance: config.Rebalance})
+    }
+    return groups
+}
+
+// The number of consumers over every group
+func (config LineConfig) consumers() int {
+    numConsumers := 0
+    for _, group := range config.consumerGroups() {
+        numConsumers += group.size
+    }
+    return numConsumers
+}
+
+// The number of priority classes, numbered or named, 0 without priority dispatch
+func (config LineConfig) classes() int {
+    if len(config.PriorityQueues) > 0 {
+        return len(config.PriorityQueues)
+    }
+    return config.Priorities
+}
+
+// How the random Widget ids are made, the legacy ones unless told otherwise
+func (config LineConfig) idStrategy() IdStrategy {
+    switch config.Ids {
+    case ID_UUID:
+        return UUIDv4{}
+    case ID_ULID:
+        return ULID{}
+    }
+    return IdFormat{config.IdLength, config.IdAlphabet}
+}
+
+// The defaults stand in for the fields left zero whose zero is no setting of their own, so a zero LineConfig runs
+// as the DefaultConfig would, but for producing no Widgets over unbuffered channels
+func (config LineConfig) complete() LineConfig {
+    defaults := DefaultConfig()
+    for _, field := range []struct{ value *int; fallback int }{{&config.NumProducers, defaults.NumProducers},
+        {&config.NumConsumers, defaults.NumConsumers}, {&config.NumCrews, defaults.NumCrews}, {&config.IdLength, defaults.IdLength},
+        {&config.ConsumeAttempts, defaults.ConsumeAttempts}, {&config.ScaleUp, defaults.ScaleUp}, {&config.Credits, defaults.Credits},
+        {&config.Generations, defaults.Generations}, {&config.ReserveSize, defaults.ReserveSize}} {
+        if *field.value == 0 {
+            *field.value = field.fallback
+        }
+    }
+    for _, field := range []struct{ value *time.Duration; fallback time.Duration }{{&config.AlertWindow, defaults.AlertWindow},
+        {&config.RollupEvery, defaults.RollupEvery}, {&config.RotateEvery, defaults.RotateEvery}, {&config.ProbeEvery, defaults.ProbeEvery},
+        {&config.Backoff, defaults.Backoff}, {&config.ConsumeBackoff, defaults.ConsumeBackoff}, {&config.ScaleEvery, defaults.ScaleEvery},
+        {&config.Lease, defaults.Lease}, {&config.DrainTimeout, defaults.DrainTimeout}} {
+        if *field.value == 0 {
+            *field.value = field.fallback
+        }
+    }
+    for _, field := range []struct{ value *float64; fallback float64 }{{&config.Sample, defaults.Sample}, {&config.ExitBad, defaults.ExitBad},
+        {&config.TransformRate, defaults.TransformRate}} {
+        if *field.value == 0 {
+            *field.value = field.fallback
+        }
+    }
+    if config.IdAlphabet == "" {
+        config.IdAlphabet = defaults.IdAlphabet
+    }
+    return config
+}
+
+// Reject settings the line cannot run with, rather than crashing or hanging halfway through the run
+// The fields left zero are checked with their defaults
+func (config LineConfig) Check() error {
+    config = config.complete()
+    switch {
+    case config.NumWidgets < 0:
+        return fmt.Errorf("-n must not be negative, got %d", config.NumWidgets)
+    case config.NumProducers < 1:
+        return fmt.Errorf("-p must be at least 1, got %d", config.NumProducers)
+    case config.NumConsumers < 1:
+        return fmt.Errorf("-c must be at least 1, got %d", config.NumConsumers)
+    case config.Split < 0:
+        return fmt.Errorf("-split must not be negative, got %d", config.Split)
+    case config.Split > 0 && (config.TransformRate < 0 || config.TransformRate > 1):
+        return fmt.Errorf("-transform-rate must be between 0 and 1, got %g", config.TransformRate)
+    case config.Split > 0 && config.Generations < 1:
+        return fmt.Errorf("-generations must be at least 1, got %d", config.Generations)
+    case config.ResumeAfter < 0 || config.ResumeAfter > config.NumWidgets:
+        return fmt.Errorf("a run can only resume after 0 to %d jobs, got %d", config.NumWidgets, config.ResumeAfter)
+    case config.ResumeAfter > 0 && config.Soak:
+        return fmt.Errorf("-soak runs cannot be resumed")
+    case config.NumKth > config.NumWidgets && !config.Soak:
+        return fmt.Errorf("-k must be at most -n (%d), got %d", config.NumWidgets, config.NumKth)
+    case config.IdLength < 2:
+        return fmt.Errorf("-id-length must be at least 2, got %d", config.IdLength)
+    case config.Ids != "" && config.Ids != ID_LEGACY && config.Ids != ID_UUID && config.Ids != ID_ULID:
+        return fmt.Errorf("-ids must be legacy, uuid or ulid, got %q", config.Ids)
+    case config.SerialIds && config.Ids != "" && config.Ids != ID_LEGACY:
+        return fmt.Errorf("-serial ids are neither uuid nor ulid")
+    case config.LotSize < 0:
+        return fmt.Errorf("-lot must not be negative, got %d", config.LotSize)
+    case config.Recall != "" && config.LotSize == 0:
+        return fmt.Errorf("-recall works on lots, it needs -lot")
+    case config.PayloadSize < 0:
+        return fmt.Errorf("-payload-size must not be negative, got %d", config.PayloadSize)
+    case config.ConsumeDelay < 0:
+        return fmt.Errorf("-consume-delay must not be negative, got %s", config.ConsumeDelay)
+    case config.ProduceEnergy < 0 || config.ConsumeEnergy < 0 || config.PackageEnergy < 0 || config.IdlePower < 0:
+        return fmt.Errorf("energy costs and idle power must not be negative")
+    case config.MaintenanceEvery < 0:
+        return fmt.Errorf("-maintenance must not be negative, got %d", config.MaintenanceEvery)
+    case config.NumCrews < 1:
+        return fmt.Errorf("-crews must be at least 1, got %d", config.NumCrews)
+    case config.Sample < 0 || config.Sample > 1:
+        return fmt.Errorf("-sample must be between 0 and 1, got %g", config.Sample)
+    case config.AlertDrop < 0 || config.AlertDrop > 1:
+        return fmt.Errorf("-alert-drop must be between 0 and 1, got %g", config.AlertDrop)
+    case config.AlertDrop > 0 && config.AlertWindow <= 0:
+        return fmt.Errorf("-alert-window must be positive, got %s", config.AlertWindow)
+    case config.Soak && config.Deterministic:
+        return fmt.Errorf("-soak runs cannot be -deterministic")
+    case config.Soak && config.RollupEvery <= 0:
+        return fmt.Errorf("-rollup-every must be positive, got %s", config.RollupEvery)
+    case config.DrainTimeout < 0:
+        return fmt.Errorf("-drain-timeout must be positive, got %s", config.DrainTimeout)
+    case config.RotateEvery < 0:
+        return fmt.Errorf("-rotate-every must not be negative, got %s", config.RotateEvery)
+    case config.PauseBuffer < 0:
+        return fmt.Errorf("-pause-buffer must not be negative, got %d", config.PauseBuffer)
+    case config.PauseBuffer > 0 && config.ProbeEvery <= 0:
+        return fmt.Errorf("-probe-every must be positive, got %s", config.ProbeEvery)
+    case config.Warmup < 0:
+        return fmt.Errorf("-warmup must not be negative, got %s", config.Warmup)
+    case config.Warmup > 0 && config.Steady != "":
+        return fmt.Errorf("-warmup and -steady cannot both set the warm-up")
+    case config.QueueSize < 0:
+        return fmt.Errorf("-queue must not be negative, got %d", config.QueueSize)
+    case config.QueueSize > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no bounded queue")
+    case config.Buffer < -1:
+        return fmt.Errorf("-buffer must be -1 or more, got %d", config.Buffer)
+    case config.Buffer >= 0 && config.QueueSize > 0:
+        return fmt.Errorf("-buffer and -queue cannot both size the queue")
+    case config.Buffer >= 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no channels to buffer")
+    case len(config.Stages) > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no stages")
+    case config.RepairRate < 0 || config.RepairRate > 1:
+        return fmt.Errorf("-repair-rate must be between 0 and 1, got %g", config.RepairRate)
+    case config.RepairRate > 0 && !config.Inspect:
+        return fmt.Errorf("-repair-rate needs -inspect")
+    case config.Inspect && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no inspector")
+    case config.DefectRate < 0 || config.DefectRate > 1:
+        return fmt.Errorf("-defect-rate must be between 0 and 1, got %g", config.DefectRate)
+    case config.BadDefectRate < 0 || config.BadDefectRate > 1:
+        return fmt.Errorf("-bad-defect-rate must be between 0 and 1, got %g", config.BadDefectRate)
+    case config.EnterBad < 0 || config.EnterBad > 1:
+        return fmt.Errorf("-bad-enter must be between 0 and 1, got %g", config.EnterBad)
+    case config.ExitBad < 0 || config.ExitBad > 1:
+        return fmt.Errorf("-bad-exit must be between 0 and 1, got %g", config.ExitBad)
+    case config.EnterBad > 0 && config.ExitBad == 0:
+        return fmt.Errorf("-bad-exit must be positive when producers can enter a bad state")
+    case config.ProduceLimit < 0 || config.ConsumeLimit < 0 || config.SinkLimit < 0:
+        return fmt.Errorf("-produce-limit, -consume-limit and -sink-limit must not be negative")
+    case config.Priorities < 0:
+        return fmt.Errorf("-priorities must not be negative, got %d", config.Priorities)
+    case config.Priorities > 0 && len(config.PriorityQueues) > 0:
+        return fmt.Errorf("-priorities and -priority-queues cannot both set the priority classes")
+    case config.Drain != "" && config.classes() == 0:
+        return fmt.Errorf("-drain needs -priorities or -priority-queues")
+    case config.PriorityMix != "" && config.classes() == 0:
+        return fmt.Errorf("-priority-mix needs -priorities or -priority-queues")
+    case strings.HasPrefix(config.Drain, "weighted") && config.Aging > 0:
+        return fmt.Errorf("-aging only promotes Widgets of a strict drain")
+    case config.classes() > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no priority dispatch")
+    case config.Dispatch != "" && config.Dispatch != "fifo" && config.Dispatch != "edd" && config.Dispatch != "spt":
+        return fmt.Errorf("-dispatch must be fifo, edd or spt, got %q", config.Dispatch)
+    case config.Dispatch != "" && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no dispatch stage")
+    case (config.Dispatch == "edd" || config.Dispatch == "spt") && config.Aging > 0:
+        return fmt.Errorf("-aging only promotes Widgets of a fifo dispatch")
+    case config.Dispatch == "edd" && len(config.Due) == 0:
+        return fmt.Errorf("-dispatch edd needs -due")
+    case config.Dispatch == "spt" && len(config.Work) == 0:
+        return fmt.Errorf("-dispatch spt needs -work")
+    case config.Aging < 0:
+        return fmt.Errorf("-aging must not be negative, got %s", config.Aging)
+    case config.NumStandbys < 0:
+        return fmt.Errorf("-standby must not be negative, got %d", config.NumStandbys)
+    case config.ConsumerCrash < 0 || config.ConsumerCrash > 1:
+        return fmt.Errorf("-consumer-crash must be between 0 and 1, got %g", config.ConsumerCrash)
+    case config.ConsumeFailRate < 0 || config.ConsumeFailRate > 1:
+        return fmt.Errorf("-consume-fail-rate must be between 0 and 1, got %g", config.ConsumeFailRate)
+    case config.ConsumeFailRate > 0 && config.ConsumeAttempts < 1:
+        return fmt.Errorf("-consume-attempts must be at least 1, got %d", config.ConsumeAttempts)
+    case config.ConsumeFailRate > 0 && config.ConsumeAttempts > 1 && config.ConsumeBackoff <= 0:
+        return fmt.Errorf("-consume-backoff must be positive, got %s", config.ConsumeBackoff)
+    case config.ConsumeFailRate > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no consume failures")
+    case config.ConsumerCrash > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no consumers to crash")
+    case config.Pull && config.Credits < 1:
+        return fmt.Errorf("-credits must be at least 1, got %d", config.Credits)
+    case config.Takt < 0:
+        return fmt.Errorf("-takt must not be negative, got %s", config.Takt)
+    case config.Takt > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs are not paced by -takt")
+    case config.ProduceRate < 0:
+        return fmt.Errorf("-produce-rate must not be negative, got %g", config.ProduceRate)
+    case config.ProduceJitter < 0 || config.ProduceJitter >= 1:
+        return fmt.Errorf("-produce-jitter must be at least 0 and below 1, got %g", config.ProduceJitter)
+    case config.ProduceJitter > 0 && config.ProduceRate == 0:
+        return fmt.Errorf("-produce-jitter needs -produce-rate")
+    case config.ProduceRate > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs are not limited by -produce-rate")
+    case len(config.Kanban) > 2:
+        return fmt.Errorf("-kanban has cards for the production and consumption stages only, got %d stages", len(config.Kanban))
+    case slices.ContainsFunc(config.Kanban, func(cards int) bool { return cards < 1 }):
+        return fmt.Errorf("-kanban cards must be at least 1, got %s", config.Kanban.String())
+    case (len(config.Kanban) > 0 || config.Wip) && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no kanban")
+    case len(config.Kanban) > 0 && (len(config.Groups) > 0 || config.Reserve != ""):
+        return fmt.Errorf("-kanban cards follow the Widgets through a single consumer group")
+    case config.Pull && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no consumers to pull")
+    case config.Partitions < 0:
+        return fmt.Errorf("-partitions must not be negative, got %d", config.Partitions)
+    case config.Partitions > 0 && (config.Pull || config.Deterministic):
+        return fmt.Errorf("-partitions cannot go with -pull or -deterministic")
+    case config.Steal && len(config.Pools) == 0:
+        return fmt.Errorf("-steal needs -pools")
+    case len(config.Pools) > 0 && (config.Pull || config.Partitions > 0 || config.Deterministic):
+        return fmt.Errorf("-pools cannot go with -pull, -partitions or -deterministic")
+    case len(config.Pools) > 0 && config.ConsumerCrash > 0 && !config.Steal:
+        return fmt.Errorf("-pools without -steal cannot go with -consumer-crash, the queue of a pool whose consumers all crashed is never drained")
+    case config.Shutdown != "" && config.Shutdown != "cancel" && config.Shutdown != "producers-first" && config.Shutdown != "drain":
+        return fmt.Errorf("-shutdown must be cancel, producers-first or drain, got %q", config.Shutdown)
+    case config.Shutdown != "" && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no stages to shut down")
+    case len(config.Rules) > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no live metrics for rules")
+    case config.Feedback != "" && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no producers of their own to give feedback to")
+    case config.Rebalance != "" && config.Partitions == 0:
+        return fmt.Errorf("-rebalance needs -partitions")
+    case config.Locale != "" && eventMessages[config.Locale] == nil:
+        return fmt.Errorf("-locale must be en or es, got %q", config.Locale)
+    case config.Format != "" && config.Format != FORMAT_TEXT && config.Format != FORMAT_JSON:
+        return fmt.Errorf("-format must be text or json, got %q", config.Format)
+    case config.OtelEndpoint != "" && !strings.HasPrefix(config.OtelEndpoint, "http://") && !strings.HasPrefix(config.OtelEndpoint, "https://"):
+        return fmt.Errorf("-otel-endpoint must be an http:// or https:// url, got %q", config.OtelEndpoint)
+    case config.LogFormat != "" && config.LogFormat != LOG_FORMAT_PLAIN && config.LogFormat != LOG_FORMAT_TEXT && config.LogFormat != LOG_FORMAT_JSON:
+        return fmt.Errorf("-log-format must be plain, text or json, got %q", config.LogFormat)
+    case config.Malformed < 0 || config.Malformed > 1:
+        return fmt.Errorf("-malformed-rate must be between 0 and 1, got %g", config.Malformed)
+    case config.ScoreThreshold < 0 || config.ScoreThreshold > 1:
+        return fmt.Errorf("-score-threshold must be between 0 and 1, got %g", config.ScoreThreshold)
+    case config.ScoreThreshold > 0 && len(config.Scores) == 0:
+        return fmt.Errorf("-score-threshold needs a -score rule")
+    case len(config.Scores) > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no scoring stage")
+    case config.Malformed > 0 && !config.Validate:
+        return fmt.Errorf("-malformed-rate needs -validate")
+    case (len(config.Groups) > 0 || config.Reserve != "") && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have a single consumer group")
+    case config.Reserve != "" && config.ReserveSize < 1:
+        return fmt.Errorf("-reserve-size must be at least 1, got %d", config.ReserveSize)
+    case config.Reserve != "" && config.Lease <= 0:
+        return fmt.Errorf("-lease must be positive, got %s", config.Lease)
+    case len(config.Quotas) > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs have no queue to hold quotas on")
+    case len(config.Until) > 0 && config.Deterministic:
+        return fmt.Errorf("-deterministic runs cannot end -until a condition is met")
+    case config.Price < 0 || config.ScrapCost < 0:
+        return fmt.Errorf("-price and -scrap-cost must not be negative")
+    case config.Retries < -1:
+        return fmt.Errorf("-retries must be -1 or more, got %d", config.Retries)
+    case config.Retries > 0 && config.Backoff <= 0:
+        return fmt.Errorf("-backoff must be positive, got %s", config.Backoff)
+    case config.Ledger != "" && config.Ledger == config.Out:
+        return fmt.Errorf("-ledger and -out cannot both write %s", config.Out)
+    case config.DeadLetters != "" && (config.DeadLetters == config.Ledger || config.DeadLetters == config.Out):
+        return fmt.Errorf("-dead-letters cannot write %s, the ledger does", config.DeadLetters)
+    case config.Connect != "" && config.Listen != "":
+        return fmt.Errorf("a process of a distributed line either produces or consumes")
+    case (config.Connect != "" || config.Listen != "") && (config.Verify || config.Deterministic):
+        return fmt.Errorf("-verify and -deterministic runs cannot be distributed")
+    case config.Connect != "" && (config.LotSize > 0 || config.Partitions > 0 || len(config.Groups) > 0 || config.Reserve != "" || len(config.Pools) > 0):
+        return fmt.Errorf("-lot, -partitions, -groups, -reserve and -pools take place in the consuming process")
+    case config.Connect != "" && (len(config.Kanban) > 0 || config.Wip):
+        return fmt.Errorf("-kanban cards come back from the consumers, which are in the consuming process")
+    case config.Listen != "" && config.Soak:
+        return fmt.Errorf("-soak runs cannot be distributed")
+    case config.Listen != "" && config.RemoteProducers < 1:
+        return fmt.Errorf("-producers must be at least 1, got %d", config.RemoteProducers)
+    }
+    if err := validAlphabet(config.IdAlphabet); err != nil {
+        return err
+    }
+    for _, duration := range config.Due {
+        if duration <= 0 {
+            return fmt.Errorf("-due must be positive, got %s", duration)
+        }
+    }
+    for _, duration := range config.Work {
+        if duration < 0 {
+            return fmt.Errorf("-work must not be negative, got %s", duration)
+        }
+    }
+    for _, weight := range config.Weights {
+        if weight < 0 {
+            return fmt.Errorf("-weights must not be negative, got %g", weight)
+        }
+    }
+    if (len(config.Weights) > 0 && len(config.Due) == 0) {
+        return fmt.Errorf("-weights needs -due")
+    }
+    for _, duration := range append(append(DurationList{}, config.Mtbf...), config.Mttr...) {
+        if duration < 0 {
+            return fmt.Errorf("-mtbf and -mttr must not be negative, got %s", duration)
+        }
+    }
+    for _, duration := range config.IdealCycle {
+        if duration < 0 {
+            return fmt.Errorf("-ideal-cycle must not be negative, got %s", duration)
+        }
+    }
+    for _, spec := range config.ConsumeTime {
+        if _, err := parseConsumeTime(spec); err != nil {
+            return err
+        }
+    }
+    stationNames := make(map[string]bool)
+    for _, spec := range config.Stages {
+        station, err := parseStation(spec)
+        if err != nil {
+            return err
+        }
+        if stationNames[station.name] {
+            return fmt.Errorf("stage %q is in -stages more than once", station.name)
+        }
+        stationNames[station.name] = true
+    }
+    for _, spec := range config.Filters {
+        if _, err := parseFilterRule(spec); err != nil {
+            return err
+        }
+    }
+    if config.Recall != "" {
+        if _, err := parseFilterPredicates(config.Recall); err != nil {
+            return fmt.Errorf("recall %q %s", config.Recall, err)
+        }
+    }
+    for _, spec := range config.Scores {
+        if _, err := parseScoreRule(spec); err != nil {
+            return err
+        }
+    }
+    for _, spec := range config.Verdict {
+        criterion, err := parseCriterion(spec)
+        if err != nil {
+            return err
+        }
+        if (criterion.metric == "sla" && len(config.Due) == 0) {
+            return fmt.Errorf("criterion %q needs -due", spec)
+        }
+    }
+    for _, spec := range config.Quotas {
+        if _, err := parseQuota(spec); err != nil {
+            return err
+        }
+    }
+    if config.Autoscale != "" {
+        minConsumers, maxConsumers, err := parseAutoscale(config.Autoscale)
+        if err != nil {
+            return err
+        }
+        switch size := config.consumerGroups()[0].size; {
+        case config.Pull || config.Deterministic || len(config.Pools) > 0 || config.Connect != "":
+            return fmt.Errorf("-autoscale scales the consumers, which cannot go with -pull, -deterministic, -pools or -connect")
+        case size < minConsumers || size > maxConsumers:
+            return fmt.Errorf("-autoscale %s must allow the %d consumers the line starts with", config.Autoscale, size)
+        case config.ScaleDown < 0 || config.ScaleUp <= config.ScaleDown:
+            return fmt.Errorf("-scale-down must be 0 or more and below -scale-up, got %d and %d", config.ScaleDown, config.ScaleUp)
+        case config.ScaleEvery <= 0:
+            return fmt.Errorf("-scale-every must be positive, got %s", config.ScaleEvery)
+        case config.AutoscaleProducers < 0 || config.AutoscaleProducers > config.NumProducers:
+            return fmt.Errorf("-autoscale-producers must be between 0 and the %d producers, got %d", config.NumProducers, config.AutoscaleProducers)
+        }
+    } else if config.AutoscaleProducers != 0 {
+        return fmt.Errorf("-autoscale-producers needs -autoscale")
+    }
+    for _, spec := range config.Rules {
+        rule, err := parseRule(spec)
+        if err != nil {
+            return err
+        }
+        if (rule.scaleBy != 0 && (config.Pull || config.Deterministic || len(config.Pools) > 0 || config.Connect != "")) {
+            return fmt.Errorf("rule %q scales the consumers, which cannot go with -pull, -deterministic, -pools or -connect", spec)
+        }
+    }
+    if config.Feedback != "" {
+        if _, err := parseFeedbackPolicy(config.Feedback); err != nil {
+            return err
+        }
+    }
+    if config.Steady != "" {
+        if _, err := parseSteadiness(config.Steady); err != nil {
+            return err
+        }
+    }
+    if _, err := parseRebalance(config.Rebalance); err != nil {
+        return err
+    }
+    policy, err := parseStopPolicy(config.StopPolicy)
+    if err != nil {
+        return err
+    }
+    if (policy.deadLetter && config.Deterministic) {
+        return fmt.Errorf("-deterministic runs have no dead letters")
+    }
+    if (config.DeadLetters != "" && config.ConsumeFailRate == 0 && !policy.deadLetter) {
+        return fmt.Errorf("-dead-letters needs -consume-fail-rate or -stop-policy dead-letter")
+    }
+    if _, err := parseDrain(config.Drain, config.classes()); err != nil {
+        return err
+    }
+    if _, err := parsePriorityMix(config.PriorityMix, config.classes()); err != nil {
+        return err
+    }
+    if _, err := parsePools(config.Pools, config.consumerGroups()[0].size, config.Steal); err != nil {
+        return err
+    }
+    if _, err := parseLogLevel(config.LogLevel); err != nil {
+        return err
+    }
+    names := make(map[string]bool)
+    for _, spec := range config.Groups {
+        group, err := parseConsumerGroup(spec)
+        if err != nil {
+            return err
+        }
+        if names[group.name] {
+            return fmt.Errorf("consumer group %q is set up twice", group.name)
+        }
+        if (group.name == RESERVE_GROUP && config.Reserve != "") {
+            return fmt.Errorf("consumer group %q is the one of -reserve", group.name)
+        }
+        names[group.name] = true
+        if (group.drain != "" && config.classes() == 0) {
+            return fmt.Errorf("consumer group %q drains priority queues, there are none", spec)
+        }
+        if _, err := parseDrain(group.drain, config.classes()); err != nil {
+            return fmt.Errorf("consumer group %q: %s", spec, err)
+        }
+    }
+    for i, name := range config.PriorityQueues {
+        if (name == "" || slices.Index(config.PriorityQueues, name) != i) {
+            return fmt.Errorf("-priority-queues must name every queue once, got %q", config.PriorityQueues.String())
+        }
+    }
+    for _, spec := range config.Until {
+        if _, err := parseEndCondition(spec); err != nil {
+            return err
+        }
+        if (strings.HasPrefix(spec, "profit=") && config.Price == 0) {
+            return fmt.Errorf("end condition %q needs -price", spec)
+        }
+    }
+    for key := range config.Messages {
+        if _, known := eventMessages["en"][key]; !known {
+            return fmt.Errorf("message %q overrides no event message", key)
+        }
+    }
+    if len(config.DivertSink) > 1 {
+        return fmt.Errorf("-divert takes a single sink, got %d", len(config.DivertSink))
+    }
+    if err := config.DivertSink.validate(); err != nil {
+        return err
+    }
+    return config.Sinks.validate()
+}
+
+// Override a single setting by name, e.g. consumers=8
+func (config *LineConfig) Override(setting string) error {
+    name, value, found := strings.Cut(setting, "=")
+    if !found {
+        return fmt.Errorf("override %q is not of the form name=value", setting)
+    }
+    var err error
+    switch name {
+    case "consumers":
+        config.NumConsumers, err = strconv.Atoi(value)
+    case "consume-delay":
+        config.ConsumeDelay, err = time.ParseDuration(value)
+    case "lot":
+        config.LotSize, err = strconv.Atoi(value)
+    case "energy-consume":
+        config.ConsumeEnergy, err = strconv.ParseFloat(value, 64)
+    case "idle-power":
+        config.IdlePower, err = strconv.ParseFloat(value, 64)
+    default:
+        return fmt.Errorf("unknown override %q", name)
+    }
+    return err
+}
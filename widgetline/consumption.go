@@ -0,0 +1,627 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/consumption.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "math/rand"
+    "strconv"
+    "strings"
+    "sync"
+    "os"
+    "context"
+    "slices"
+)
+
+// ConsumeTimeList is a comma separated flag of consume time distributions, one per consumer
+type ConsumeTimeList []string
+
+func (list *ConsumeTimeList) String() string {
+    return strings.Join(*list, ",")
+}
+
+func (list *ConsumeTimeList) Set(value string) error {
+    *list = nil
+    for _, part := range strings.Split(value, ",") {
+        spec := strings.TrimSpace(part)
+        if _, err := parseConsumeTime(spec); err != nil {
+            return err
+        }
+        *list = append(*list, spec)
+    }
+    return nil
+}
+
+// The distribution of the ith consumer, the last one applies to everything past the end of the list, nil for an empty list
+func (list ConsumeTimeList) at(i int) *ConsumeTime {
+    if len(list) == 0 {
+        return nil
+    }
+    consumeTime, _ := parseConsumeTime(list[min(i, len(list) - 1)])
+    return consumeTime
+}
+
+// ConsumeTime is how long consuming a Widget takes on top of the consume delay, drawn afresh for every Widget
+// A nil ConsumeTime takes no time
+type ConsumeTime struct {
+    low         time.Duration
+    high        time.Duration   // Same as low for a fixed time
+    exponential bool            // Drawn with low as the mean, high is then unused
+}
+
+// Consume times look like 5ms for a fixed time, 5ms..20ms drawn uniformly or exp:10ms drawn exponentially with that mean
+func parseConsumeTime(spec string) (*ConsumeTime, error) {
+    if mean, found := strings.CutPrefix(spec, "exp:"); found {
+        duration, err := time.ParseDuration(mean)
+        if (err != nil || duration <= 0) {
+            return nil, fmt.Errorf("consume time %q must have a positive mean", spec)
+        }
+        return &ConsumeTime{low: duration, exponential: true}, nil
+    }
+    low, high, found := strings.Cut(spec, "..")
+    if !found {
+        high = low
+    }
+    durationLow, errLow := time.ParseDuration(low)
+    durationHigh, errHigh := time.ParseDuration(high)
+    if (errLow != nil || errHigh != nil) {
+        return nil, fmt.Errorf("consume time %q is not of the form <duration>, <min>..<max> or exp:<mean>", spec)
+    }
+    if (durationLow < 0 || durationHigh < durationLow) {
+        return nil, fmt.Errorf("consume time %q must not be negative nor have its max below its min", spec)
+    }
+    return &ConsumeTime{low: durationLow, high: durationHigh}, nil
+}
+
+func (consumeTime *ConsumeTime) draw(source *rand.Rand) time.Duration {
+    switch {
+    case consumeTime == nil:
+        return 0
+    case consumeTime.exponential:
+        return time.Duration(source.ExpFloat64() * float64(consumeTime.low))
+    case consumeTime.high > consumeTime.low:
+        return consumeTime.low + time.Duration(source.Int63n(int64(consumeTime.high - consumeTime.low) + 1))
+    }
+    return consumeTime.low
+}
+
+//==============================================================================
+type Consumer struct {
+    env         *environment
+    name        string
+    delay       time.Duration   // How long consuming a Widget takes
+    consumeTime *ConsumeTime    // Drawn for every Widget on top of the delay
+    sink        Sink
+    sample      float64         // Fraction of good Widgets sent to the sink, the counters still see every Widget
+    crash       float64         // Probability of crashing after every Widget
+    retry       *ConsumeRetry
+    deadLetters *DeadLetters    // Given the Widgets the consumer gives up on
+    meter       *EnergyMeter
+    feedback    *Feedback
+    kanban      *Kanban
+    takt        *Takt
+    dues        *DueDates
+    desk        *ReservationDesk    // Handing the Widgets out to external systems, for the consumers of the external group
+    gaps        *GapDetector
+    ends        *EndConditions
+    stats       *Stats
+    ledger      *WidgetLedger
+    tracer      *Tracer
+    limits      StageLimits
+    board       *Board
+    lifecycle   *Lifecycle
+    recorder    *Recorder
+    checker     *Checker
+    random      *rand.Rand      // Of the consumer, drawn from for its consume times, retries, samples and crashes
+}
+
+// Consuming is given up once ctx is done, an interrupted Widget is not counted as consumed
+// The error is the one of ctx when the consume has been interrupted, otherwise whether the policy stops the consumers on the Widget
+func (con Consumer) consume(ctx context.Context, wid Widget, cancellation *Cancellation, policy *StopPolicy) (bool, error) {
+    if err := con.kanban.withdraw(ctx, wid); err != nil {
+        return false, err
+    }
+    if err := con.limits.consume.acquire(ctx); err != nil {
+        return false, err
+    }
+    defer con.limits.consume.release()
+    timeStart := con.env.now()
+    // A failed attempt is consumed again after the backoff, a Widget failing the last one is given up on, broken
+    // Widgets never fail so as to still stop the line
+    for attempt := 1; ; attempt++ {
+        if delay := con.delay + wid.work + con.consumeTime.draw(con.random); delay > 0 {
+            timer := time.NewTimer(delay)
+            select {
+            case <-timer.C:
+            case <-ctx.Done():
+                timer.Stop()
+                return false, ctx.Err()
+            }
+        }
+        if wid.broken {
+            break
+        }
+        failed, last := con.retry.fails(attempt, con.random)
+        if !failed {
+            break
+        }
+        if last {
+            con.deadLetters.take(con.name, wid, DEAD_LETTER_FAILED, attempt, con.lifecycle, con.checker)
+            return false, nil
+        }
+        backoff := con.retry.wait(attempt)
+        con.env.logEvent(MSG_RETRY, con.name, wid.id, attempt, con.retry.attempts, backoff)
+        timer := time.NewTimer(backoff)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return false, ctx.Err()
+        }
+    }
+    // A broken Widget the policy dead-letters is given up on like one which failed every attempt
+    if (wid.broken && policy.deadLetters()) {
+        con.deadLetters.take(con.name, wid, DEAD_LETTER_BROKEN, 1, con.lifecycle, con.checker)
+        return false, nil
+    }
+    if con.desk != nil {
+        if err := con.desk.handOut(ctx, wid); err != nil {
+            return false, err
+        }
+    }
+    latency := con.env.since(wid.time)
+    stops := false
+    finished := cancellation.unlessCancelled(func() {
+        con.meter.consumed(wid)
+        con.gaps.seen(wid)
+        if wid.good() {
+            con.lifecycle.move(wid, STATE_CONSUMED)
+            con.ledger.consumed(con.name, wid, STATE_CONSUMED, timeStart)
+            con.tracer.consumed(con.name, wid, STATE_CONSUMED, timeStart)
+        } else {
+            con.lifecycle.move(wid, STATE_SCRAPPED)
+            con.ledger.consumed(con.name, wid, STATE_SCRAPPED, timeStart)
+            con.tracer.consumed(con.name, wid, STATE_SCRAPPED, timeStart)
+        }
+        con.recorder.consumed(latency)
+        con.recorder.failed(wid)
+        con.feedback.inspected(wid)
+        con.dues.completed(wid)
+        con.takt.completed()
+        if (wid.broken && policy.stops()) {
+            stops = true
+            con.recorder.stoppedBy(con.name, wid)
+        }
+        con.checker.consumed()
+        con.ends.consumed(wid)
+        con.stats.consumed(con.name, timeStart.Sub(wid.time))
+        con.board.finished("consumer", con.name)
+    })
+    if !finished {
+        return false, ctx.Err()
+    }
+    // A broken Widget the policy carries on past is scrapped like a defective one
+    var line string
+    if (wid.defective || (wid.broken && !stops)) {
+        line = con.env.consumeEvent(MSG_SCRAP, con.name, wid, latency)
+    } else if !wid.broken {
+        line = con.env.consumeEvent(MSG_CONSUME, con.name, wid, latency)
+    } else {
+        line = con.env.consumeEvent(MSG_BROKEN, con.name, wid, latency)
+    }
+    if (!wid.broken && con.sample < 1 && con.random.Float64() >= con.sample) {
+        return stops, nil
+    }
+    if err := con.limits.sink.acquire(ctx); err != nil {
+        return stops, err
+    }
+    defer con.limits.sink.release()
+    if err := con.sink.Send(ctx, line); err != nil {
+        if ctx.Err() != nil {
+            return stops, ctx.Err()
+        }
+        fmt.Fprintf(os.Stderr, "%s failed to send to its sink: %s\n", con.name, err)
+    }
+    return stops, nil
+}
+
+// ConsumeRetry fails consume attempts with the fail rate, as a flaky downstream service would. A failed Widget is tried
+// again after a backoff doubled after every failed attempt, and given up on to the dead letters once it has failed every
+// attempt
+// A nil ConsumeRetry never fails a consume
+type ConsumeRetry struct {
+    mutex           sync.Mutex
+    failRate        float64
+    attempts        int
+    backoff         time.Duration       // Before the second attempt
+    numFailures     int                 // Attempts failed
+    numRetried      int                 // Widgets tried more than once
+    numRecovered    int                 // Widgets consumed on a later attempt
+    numDeadLettered int
+}
+
+func newConsumeRetry(failRate float64, attempts int, backoff time.Duration) *ConsumeRetry {
+    return &ConsumeRetry{failRate: failRate, attempts: attempts, backoff: backoff}
+}
+
+// Whether the attempt fails, and whether it was the last one
+func (retry *ConsumeRetry) fails(attempt int, source *rand.Rand) (bool, bool) {
+    if (retry == nil || source.Float64() >= retry.failRate) {
+        if (retry != nil && attempt > 1) {
+            retry.mutex.Lock()
+            retry.numRecovered++
+            retry.mutex.Unlock()
+        }
+        return false, false
+    }
+    retry.mutex.Lock()
+    defer retry.mutex.Unlock()
+    retry.numFailures++
+    if attempt == 1 {
+        retry.numRetried++
+    }
+    if attempt == retry.attempts {
+        retry.numDeadLettered++
+    }
+    return true, attempt == retry.attempts
+}
+
+// The backoff after the attempt failed
+func (retry *ConsumeRetry) wait(attempt int) time.Duration {
+    return retry.backoff << (attempt - 1)
+}
+
+func (retry *ConsumeRetry) report(out io.Writer) {
+    if retry == nil {
+        return
+    }
+    retry.mutex.Lock()
+    defer retry.mutex.Unlock()
+    fmt.Fprintf(out, "Consume retries [ fail rate %g, %d attempts ]: failed attempts [ %d ] widgets retried [ %d ] recovered [ %d ] dead-lettered [ %d ]\n",
+        retry.failRate, retry.attempts, retry.numFailures, retry.numRetried, retry.numRecovered, retry.numDeadLettered)
+}
+
+// Cancellation stops the consumers once a broken widget is met, interrupting the consumes in flight
+// Finishing a consume and cancelling are mutually exclusive, so no Widget is counted as consumed after the stop
+type Cancellation struct {
+    mutex   sync.Mutex
+    ctx     context.Context
+    cancel  context.CancelFunc
+}
+
+func newCancellation() *Cancellation {
+    ctx, cancel := context.WithCancel(context.Background())
+    return &Cancellation{ctx: ctx, cancel: cancel}
+}
+
+// Run finish unless the consumers have been cancelled, reporting whether it ran
+func (cancellation *Cancellation) unlessCancelled(finish func()) bool {
+    if cancellation == nil {
+        finish()
+        return true
+    }
+    cancellation.mutex.Lock()
+    defer cancellation.mutex.Unlock()
+    if cancellation.ctx.Err() != nil {
+        return false
+    }
+    finish()
+    return true
+}
+
+// Run stopped and cancel the consumers
+func (cancellation *Cancellation) stop(stopped func()) {
+    cancellation.mutex.Lock()
+    defer cancellation.mutex.Unlock()
+    stopped()
+    cancellation.cancel()
+}
+
+//==============================================================================
+// StopPolicy decides which broken Widget stops the consumers: halt stops them at the first one, skip scraps every broken
+// Widget and carries on, dead-letter gives every one up to the dead letters and carries on, threshold=<n> stops them at
+// the nth. Every consumer group keeps its own count
+// A nil StopPolicy halts
+type StopPolicy struct {
+    mutex       sync.Mutex
+    spec        string
+    threshold   int             // Broken Widgets the consumers stop at, 0 for never
+    deadLetter  bool            // Broken Widgets go to the dead letters rather than being consumed
+    numBroken   int
+}
+
+// Stop policies look like halt, skip, dead-letter or threshold=<n>, halt when not set
+func parseStopPolicy(spec string) (*StopPolicy, error) {
+    switch spec {
+    case "", "halt":
+        return &StopPolicy{spec: spec, threshold: 1}, nil
+    case "skip":
+        return &StopPolicy{spec: spec}, nil
+    case "dead-letter":
+        return &StopPolicy{spec: spec, deadLetter: true}, nil
+    }
+    value, found := strings.CutPrefix(spec, "threshold=")
+    threshold, err := strconv.Atoi(value)
+    if (!found || err != nil || threshold < 1) {
+        return nil, fmt.Errorf("-stop-policy must be halt, skip, dead-letter or threshold=<n> with n at least 1, got %q", spec)
+    }
+    return &StopPolicy{spec: spec, threshold: threshold}, nil
+}
+
+// Whether the kth Widget is the only one broken, otherwise every kth Widget is so there are more to count
+func (policy *StopPolicy) halts() bool {
+    return (policy == nil || policy.threshold == 1)
+}
+
+// Whether the job is the one to produce broken
+func (policy *StopPolicy) breaks(job int, numKth int) bool {
+    if policy.halts() {
+        return job == numKth
+    }
+    return (numKth > 0 && job % numKth == 0)
+}
+
+// Count one more broken Widget consumed, true for the one the consumers stop at, which can only happen once
+func (policy *StopPolicy) stops() bool {
+    if policy == nil {
+        return true
+    }
+    policy.mutex.Lock()
+    defer policy.mutex.Unlock()
+    policy.numBroken++
+    return policy.numBroken == policy.threshold
+}
+
+// Count one more broken Widget met, true when it goes to the dead letters rather than being consumed
+func (policy *StopPolicy) deadLetters() bool {
+    if (policy == nil || !policy.deadLetter) {
+        return false
+    }
+    policy.mutex.Lock()
+    defer policy.mutex.Unlock()
+    policy.numBroken++
+    return true
+}
+
+func (policy *StopPolicy) report(out io.Writer) {
+    if (policy == nil || policy.spec == "") {
+        return
+    }
+    policy.mutex.Lock()
+    defer policy.mutex.Unlock()
+    if (policy.threshold > 0 && policy.numBroken >= policy.threshold) {
+        fmt.Fprintf(out, "Stop policy %s: broken widgets [ %d ], the line stopped at the broken widget [ %d ]\n", policy.spec, policy.numBroken,
+            policy.threshold)
+    } else {
+        fmt.Fprintf(out, "Stop policy %s: broken widgets [ %d ], the line was not stopped\n", policy.spec, policy.numBroken)
+    }
+}
+
+// In pull mode the Widgets are only handed to the consumers which asked for one, every consumer sends its index on
+// creditChannel once ready for another Widget, and holds at most as many Widgets as it has credits
+// Every inbox is closed once the inWidgetChannel is closed or the consumers are cancelled
+func dispatchLine(ctx context.Context, inWidgetChannel <-chan Widget, inEdge *Edge, creditChannel <-chan int, inboxes []chan Widget, inboxEdge *Edge) {
+    defer func() {
+        for _, inbox := range inboxes {
+            close(inbox)
+        }
+    }()
+    for {
+        var consumer int
+        select {
+        case consumer = <-creditChannel:
+        case <-ctx.Done():
+            return
+        }
+        timeWait := inEdge.begin()
+        select {
+        case workingWidget, ok := <-inWidgetChannel:
+            if !ok {
+                return
+            }
+            inEdge.received(timeWait)
+            timeSend := inboxEdge.begin()
+            inboxes[consumer] <- workingWidget
+            inboxEdge.sent(timeSend)
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// Consumer will quit working once the widgetChannel is closed
+// Good widgets are passed on to outWidgetChannel for packaging when it is not nil
+// Consumers pull the Widgets with a window of credits each when credits is positive, the Widgets are pushed to them otherwise
+// In pull mode the consumers take their Widgets from their inboxes over inboxEdge, fed by the dispatcher from inWidgetChannel
+// With pools every consumer pulls one Widget at a time from the pool dispatcher instead
+// Without either, consumers join and leave the group through its membership channel, a leave naming no consumer taking
+// the newest one
+// Once endChannel is closed the consumers stop as on a broken widget, leaving the Widgets still on their way
+func consumptionLine(wg *sync.WaitGroup, group *ConsumerGroup, standbyNames []string, credits int, pools *Pools, inWidgetChannel <-chan Widget, inEdge *Edge, inboxEdge *Edge,
+    outWidgetChannel chan<- Widget, outEdge *Edge, policy *StopPolicy, brokenWidgetChannel chan<- struct{}, endChannel <-chan struct{}) {
+    defer wg.Done()
+    if outWidgetChannel != nil {
+        defer close(outWidgetChannel)
+    }
+    consumerTable := group.consumers
+    var consumptionWaitGroup sync.WaitGroup
+    cancellation := newCancellation()
+    defer cancellation.cancel()
+    // The consumers waiting for a Widget are stopped from here
+    go func() {
+        select {
+        case <-endChannel:
+            cancellation.stop(consumerTable[0].checker.stopped)
+        case <-cancellation.ctx.Done():
+        }
+    }()
+
+    // Where every consumer takes its Widgets from, and how it asks for the next one
+    sources := make([]<-chan Widget, len(consumerTable))
+    asks := make([]func(), len(consumerTable))
+    for i := range consumerTable {
+        sources[i], asks[i] = inWidgetChannel, func() {}
+    }
+    membership := group.membership
+    sourceEdge := inEdge
+    if pools != nil {
+        credits = 1
+    }
+    if credits > 0 {
+        creditChannel := make(chan int, len(consumerTable) * credits)
+        inboxes := make([]chan Widget, len(consumerTable))
+        for i := range consumerTable {
+            inboxes[i] = make(chan Widget, credits)
+            sources[i], asks[i] = inboxes[i], func() { creditChannel <- i }
+            for credit := 0; credit < credits; credit++ {
+                asks[i]()
+            }
+        }
+        consumptionWaitGroup.Add(1)
+        go func() {
+            defer consumptionWaitGroup.Done()
+            if pools != nil {
+                poolLine(consumerTable[0].env, cancellation.ctx, pools, inWidgetChannel, inEdge, creditChannel, inboxes, inboxEdge)
+            } else {
+                dispatchLine(cancellation.ctx, inWidgetChannel, inEdge, creditChannel, inboxes, inboxEdge)
+            }
+        }()
+        sourceEdge = inboxEdge
+        membership = nil
+    }
+
+    // Every consumer reports on exitChannel the index of its slot when it crashes, or -1 when it is done or left
+    exitChannel := make(chan int, len(consumerTable))
+    run := func(slot int, workingConsumer Consumer, source <-chan Widget, ask func(), leaveChannel <-chan struct{}) {
+        crashed := false
+        defer func() {
+            if crashed {
+                exitChannel <- slot
+            } else {
+                exitChannel <- -1
+            }
+        }()
+        timeBegin, busyTime := workingConsumer.env.now(), time.Duration(0)
+        defer func() { workingConsumer.meter.idle(workingConsumer.env.since(timeBegin) - busyTime) }()
+        defer workingConsumer.board.working(workingConsumer.name, "stopped", "")
+        workingConsumer.board.working(workingConsumer.name, "waiting for a widget", "")
+        timeWait := sourceEdge.begin()
+        for {
+            var workingWidget Widget
+            select {
+            case wid, ok := <-source:
+                if !ok {
+                    return
+                }
+                workingWidget = wid
+            case <-leaveChannel:
+                return
+            }
+            sourceEdge.received(timeWait)
+            select {
+            case <-cancellation.ctx.Done():
+                return
+            case <-endChannel:
+                cancellation.stop(workingConsumer.checker.stopped)
+                return
+            default:
+                workingConsumer.board.working(workingConsumer.name, "consuming", workingWidget.id)
+                timeConsume := workingConsumer.env.now()
+                stops, err := workingConsumer.consume(cancellation.ctx, workingWidget, cancellation, policy)
+                busyTime += workingConsumer.env.since(timeConsume)
+                if err != nil {
+                    workingConsumer.recorder.interrupted()
+                    return
+                }
+                if (stops) {
+                    // Cancelling lets the rest of the consumers know that they need to stop
+                    cancellation.stop(workingConsumer.checker.stopped)
+                    close(brokenWidgetChannel)      // brokenWidgetChannel used to signify a broken widget has been encountered
+                    return
+                }
+                if (outWidgetChannel != nil && workingWidget.good()) {
+                    workingConsumer.board.working(workingConsumer.name, "handing over to packaging", workingWidget.id)
+                    timeSend := outEdge.begin()
+                    outWidgetChannel <- workingWidget
+                    outEdge.sent(timeSend)
+                }
+                workingConsumer.board.working(workingConsumer.name, "waiting for a widget", "")
+                ask()
+                if (workingConsumer.crash > 0 && workingConsumer.random.Float64() < workingConsumer.crash) {
+                    workingConsumer.env.logEvent(MSG_CRASH, workingConsumer.name)
+                    crashed = true
+                    return
+                }
+                timeWait = sourceEdge.begin()
+            }
+        }
+    }
+
+    // A crashed consumer is replaced by the next standby, which takes over its slot: its share of the Widgets and its sink
+    // A consumer joining gets a slot of its own, a consumer leaving is told so through the leave channel of its slot
+    slots := slices.Clone(consumerTable)     // The consumer of every slot, with no name once it is gone for good
+    leaveChannels := make([]chan struct{}, len(slots))
+    for slot, workingConsumer := range slots {
+        leaveChannels[slot] = make(chan struct{})
+        go run(slot, workingConsumer, sources[slot], asks[slot], leaveChannels[slot])
+    }
+    group.numMembers.Store(int32(len(slots)))
+    for running, numStandbys, numJoined := len(slots), 0, len(slots); running > 0; {
+        select {
+        case slot := <-exitChannel:
+            running--
+            if slot < 0 {
+                continue
+            }
+            if numStandbys == len(standbyNames) {
+                slots[slot].env.logEvent(MSG_NO_STANDBY, slots[slot].name)
+                slots[slot].name = ""
+                group.numMembers.Add(-1)
+                continue
+            }
+            slots[slot].env.logEvent(MSG_FAILOVER, standbyNames[numStandbys], slots[slot].name)
+            slots[slot].name = standbyNames[numStandbys]
+            numStandbys++
+            running++
+            go run(slot, slots[slot], sources[slot], asks[slot], leaveChannels[slot])
+        case change := <-membership:
+            if change.Join {
+                workingConsumer := consumerTable[0]
+                workingConsumer.name = group.prefix() + "consumer_" + strconv.Itoa(numJoined)
+                workingConsumer.random = namedRandom(workingConsumer.env.workerSeed, workingConsumer.name)
+                numJoined++
+                slots, leaveChannels = append(slots, workingConsumer), append(leaveChannels, make(chan struct{}))
+                sources, asks = append(sources, inWidgetChannel), append(asks, func() {})
+                running++
+                group.numMembers.Add(1)
+                go run(len(slots) - 1, workingConsumer, sources[len(slots) - 1], asks[len(slots) - 1], leaveChannels[len(slots) - 1])
+                workingConsumer.env.logEvent(MSG_JOIN, workingConsumer.name, group.title())
+                continue
+            }
+            // A leave naming no consumer, from a rule scaling the consumers down, takes the newest member
+            slot := slices.IndexFunc(slots, func(workingConsumer Consumer) bool { return workingConsumer.name == change.Consumer })
+            if change.Consumer == "" {
+                slot = len(slots) - 1
+                for (slot >= 0 && slots[slot].name == "") {
+                    slot--
+                }
+            }
+            if (slot < 0 || group.live() == 1) {
+                fmt.Fprintf(os.Stderr, "%s cannot leave group %s, it is not one of its members or the last one\n", change.Consumer, group.title())
+                continue
+            }
+            close(leaveChannels[slot])
+            slots[slot].env.logEvent(MSG_LEAVE, slots[slot].name, group.title())
+            slots[slot].name = ""
+            group.numMembers.Add(-1)
+        }
+    }
+    // The dispatcher may still be waiting on consumers which crashed
+    cancellation.cancel()
+    consumptionWaitGroup.Wait()
+}
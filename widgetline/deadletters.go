@@ -0,0 +1,171 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/deadletters.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strings"
+    "sync"
+    "os"
+    "context"
+    "sort"
+    "bufio"
+)
+
+// Why the consumers gave up on a Widget
+const DEAD_LETTER_FAILED = "failed"     // Every consume attempt failed
+const DEAD_LETTER_BROKEN = "broken"     // Broken under the dead-letter stop policy
+
+// DeadLetters collects the Widgets the consumers gave up on, those which failed every consume attempt and the broken
+// ones under the dead-letter stop policy. They are thrown into a channel drained by a worker, which takes every one off
+// the line with an event to the divert sink and writes it to the dead-letter file, if any
+// A nil DeadLetters is never given a Widget
+type DeadLetters struct {
+    env         *environment
+    mutex       sync.Mutex
+    letters     chan deadLetter
+    divertSink  Sink
+    fileName    string
+    file        *os.File
+    writer      *bufio.Writer       // Of the JSON lines, nil without a file
+    numReasons  map[string]int
+    numTaken    map[string]int      // By consumer
+    numWritten  int
+    err         error               // Of the first write which failed, nothing is written after it
+}
+
+// DeadLetter is a Widget of the dead-letter file, with the consumer which gave up on it and why
+type DeadLetter struct {
+    Id          string      `json:"id"`
+    Source      string      `json:"source"`
+    Produced    time.Time   `json:"produced"`
+    Consumer    string      `json:"consumer"`
+    Reason      string      `json:"reason"`
+    Attempts    int         `json:"attempts"`
+    Cause       string      `json:"cause,omitempty"`
+    Taken       time.Time   `json:"taken"`
+}
+
+// A Widget given up on, the consumers of the other groups leave the line's state alone, so do their dead letters
+type deadLetter struct {
+    wid         Widget
+    consumer    string
+    reason      string
+    attempts    int
+    lifecycle   *Lifecycle
+    checker     *Checker
+}
+
+// Every consumer may give up on a Widget without waiting for the worker when the channel holds capacity of them
+func newDeadLetters(env *environment, capacity int, divertSink Sink, fileName string) (*DeadLetters, error) {
+    deadLetters := &DeadLetters{env: env, letters: make(chan deadLetter, capacity), divertSink: divertSink, fileName: fileName,
+        numReasons: make(map[string]int), numTaken: make(map[string]int)}
+    if fileName != "" {
+        file, err := os.Create(fileName)
+        if err != nil {
+            return nil, err
+        }
+        deadLetters.file, deadLetters.writer = file, bufio.NewWriter(file)
+    }
+    return deadLetters, nil
+}
+
+func (deadLetters *DeadLetters) take(consumer string, wid Widget, reason string, attempts int, lifecycle *Lifecycle, checker *Checker) {
+    deadLetters.letters <- deadLetter{wid, consumer, reason, attempts, lifecycle, checker}
+}
+
+// Take a dead-lettered Widget off the line, it is neither consumed nor a failure
+func (deadLetters *DeadLetters) deadLettered(letter deadLetter) {
+    letter.lifecycle.move(letter.wid, STATE_DEAD_LETTERED)
+    letter.checker.filtered()
+    wid := letter.wid
+    var line string
+    if letter.reason == DEAD_LETTER_BROKEN {
+        line = deadLetters.env.event(MSG_DEAD_LETTER_BROKEN, wid.id, wid.source, wid.time.Format(TIME_FORMAT), wid.cause, letter.consumer)
+    } else {
+        line = deadLetters.env.event(MSG_DEAD_LETTER, wid.id, wid.source, wid.time.Format(TIME_FORMAT), letter.consumer, letter.attempts)
+    }
+    if err := deadLetters.divertSink.Send(context.Background(), line); err != nil {
+        fmt.Fprintf(os.Stderr, "dead-letter channel failed to send to its divert sink: %s\n", err)
+    }
+    deadLetters.mutex.Lock()
+    defer deadLetters.mutex.Unlock()
+    deadLetters.numReasons[letter.reason]++
+    deadLetters.numTaken[letter.consumer]++
+    if (deadLetters.writer == nil || deadLetters.err != nil) {
+        return
+    }
+    data, err := deadLetters.env.services.Codec.Marshal(DeadLetter{wid.id, wid.source, wid.time, letter.consumer, letter.reason, letter.attempts, wid.cause,
+        deadLetters.env.now()})
+    if err == nil {
+        _, err = deadLetters.writer.Write(append(data, '\n'))
+    }
+    if err != nil {
+        deadLetters.err = err
+        return
+    }
+    deadLetters.numWritten++
+}
+
+// No consumer gives up on a Widget any more, the worker stops once it has taken the last ones off the line
+func (deadLetters *DeadLetters) close() {
+    if deadLetters != nil {
+        close(deadLetters.letters)
+    }
+}
+
+// Once the worker is done
+func (deadLetters *DeadLetters) closeFile() {
+    if (deadLetters == nil || deadLetters.file == nil) {
+        return
+    }
+    deadLetters.mutex.Lock()
+    defer deadLetters.mutex.Unlock()
+    if err := deadLetters.writer.Flush(); deadLetters.err == nil {
+        deadLetters.err = err
+    }
+    if err := deadLetters.file.Close(); deadLetters.err == nil {
+        deadLetters.err = err
+    }
+}
+
+// The summary of the Widgets given up on, by reason and by consumer
+func (deadLetters *DeadLetters) report(out io.Writer) {
+    if deadLetters == nil {
+        return
+    }
+    deadLetters.mutex.Lock()
+    defer deadLetters.mutex.Unlock()
+    numLetters := 0
+    for _, count := range deadLetters.numReasons {
+        numLetters += count
+    }
+    fmt.Fprintf(out, "Dead letters: [ %d ] failed every attempt [ %d ] broken [ %d ]\n", numLetters, deadLetters.numReasons[DEAD_LETTER_FAILED],
+        deadLetters.numReasons[DEAD_LETTER_BROKEN])
+    var consumers []string
+    for consumer, count := range deadLetters.numTaken {
+        consumers = append(consumers, fmt.Sprintf("%s [ %d ]", consumer, count))
+    }
+    sort.Strings(consumers)
+    if len(consumers) > 0 {
+        fmt.Fprintf(out, "Dead letters by consumer: %s\n", strings.Join(consumers, " "))
+    }
+    if deadLetters.err != nil {
+        fmt.Fprintf(out, "Dead letters: writing %s failed after [ %d ] widgets: %s\n", deadLetters.fileName, deadLetters.numWritten, deadLetters.err)
+    } else if deadLetters.file != nil {
+        fmt.Fprintf(out, "Dead letters: [ %d ] widgets written to %s\n", deadLetters.numWritten, deadLetters.fileName)
+    }
+}
+
+// The dead-letter worker takes every Widget given up on off the line, until the consumers are all done
+func deadLetterLine(wg *sync.WaitGroup, deadLetters *DeadLetters) {
+    defer wg.Done()
+    for letter := range deadLetters.letters {
+        deadLetters.deadLettered(letter)
+    }
+}
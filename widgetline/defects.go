@@ -0,0 +1,304 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/defects.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "math/rand"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// DefectModel makes defects cluster in time: every Producer goes through a two state Markov chain, defects are rare while
+// it is good and spike while it is bad, a nil DefectModel makes no defects
+type DefectModel struct {
+    mutex       sync.Mutex
+    rate        float64     // Probability of a defect while good
+    badRate     float64     // Probability of a defect while bad
+    enterBad    float64     // Probability per Widget of turning bad
+    exitBad     float64     // Probability per Widget of recovering, bad states last 1/exitBad Widgets on average
+    chains      []*DefectChain
+}
+
+// DefectChain is the state of one Producer
+type DefectChain struct {
+    model           *DefectModel
+    random          *rand.Rand      // The one of its Producer
+    bad             bool
+    badLength       int     // Widgets produced in the current bad state
+    clusterSize     int     // Defects in a row so far
+    numWidgets      int
+    numDefects      int
+    numBadDefects   int     // Defects produced while bad
+    badStates       []int   // Length of every bad state, the current one included once closed
+    clusters        []int   // Size of every run of defects in a row
+}
+
+func newDefectModel(rate float64, badRate float64, enterBad float64, exitBad float64) *DefectModel {
+    return &DefectModel{rate: rate, badRate: badRate, enterBad: enterBad, exitBad: exitBad}
+}
+
+func (model *DefectModel) chain(source *rand.Rand) *DefectChain {
+    if model == nil {
+        return nil
+    }
+    model.mutex.Lock()
+    defer model.mutex.Unlock()
+    chain := &DefectChain{model: model, random: source}
+    model.chains = append(model.chains, chain)
+    return chain
+}
+
+// Move the chain one Widget forward, reporting whether that Widget is defective
+func (chain *DefectChain) next() bool {
+    if chain == nil {
+        return false
+    }
+    model := chain.model
+    model.mutex.Lock()
+    defer model.mutex.Unlock()
+    switch {
+    case !chain.bad && chain.random.Float64() < model.enterBad:
+        chain.bad = true
+    case chain.bad && chain.random.Float64() < model.exitBad:
+        chain.bad = false
+        chain.badStates = append(chain.badStates, chain.badLength)
+        chain.badLength = 0
+    }
+
+    rate := model.rate
+    if chain.bad {
+        rate = model.badRate
+        chain.badLength++
+    }
+    defective := chain.random.Float64() < rate
+    chain.numWidgets++
+    if defective {
+        chain.numDefects++
+        chain.clusterSize++
+        if chain.bad {
+            chain.numBadDefects++
+        }
+    } else if (chain.clusterSize > 0) {
+        chain.clusters = append(chain.clusters, chain.clusterSize)
+        chain.clusterSize = 0
+    }
+    return defective
+}
+
+// Leave the bad state, as a recalibrated machine does
+func (chain *DefectChain) recalibrate() {
+    if chain == nil {
+        return
+    }
+    chain.model.mutex.Lock()
+    defer chain.model.mutex.Unlock()
+    if chain.bad {
+        chain.bad = false
+        chain.badStates = append(chain.badStates, chain.badLength)
+        chain.badLength = 0
+    }
+}
+
+func (model *DefectModel) report(out io.Writer) {
+    if model == nil {
+        return
+    }
+    model.mutex.Lock()
+    defer model.mutex.Unlock()
+    numWidgets, numDefects, numBadDefects := 0, 0, 0
+    var badStates, clusters []int
+    for _, chain := range model.chains {
+        numWidgets += chain.numWidgets
+        numDefects += chain.numDefects
+        numBadDefects += chain.numBadDefects
+        badStates = append(badStates, chain.badStates...)
+        if (chain.badLength > 0) {
+            badStates = append(badStates, chain.badLength)
+        }
+        clusters = append(clusters, chain.clusters...)
+        if (chain.clusterSize > 0) {
+            clusters = append(clusters, chain.clusterSize)
+        }
+    }
+
+    // Mean and largest of a list of lengths
+    spread := func(lengths []int) (float64, int) {
+        total, largest := 0, 0
+        for _, length := range lengths {
+            total += length
+            if length > largest {
+                largest = length
+            }
+        }
+        if len(lengths) == 0 {
+            return 0, 0
+        }
+        return float64(total) / float64(len(lengths)), largest
+    }
+    defectRate := 0.0
+    if numWidgets > 0 {
+        defectRate = float64(numDefects) / float64(numWidgets)
+    }
+    meanBad, longestBad := spread(badStates)
+    meanCluster, largestCluster := spread(clusters)
+    fmt.Fprintf(out, "Defects: [ %d ] of [ %d ] widgets (%.2f%%), [ %d ] while in a bad state.\n", numDefects, numWidgets, 100 * defectRate, numBadDefects)
+    fmt.Fprintf(out, "Bad states: [ %d ] lasting [ %.1f ] widgets on average, [ %d ] at most.\n", len(badStates), meanBad, longestBad)
+    fmt.Fprintf(out, "Defect clusters: [ %d ] of [ %.1f ] defects in a row on average, [ %d ] at most.\n", len(clusters), meanCluster, largestCluster)
+}
+
+//==============================================================================
+// FeedbackPolicy is how a Producer responds once too many of its latest Widgets fail inspection
+type FeedbackPolicy struct {
+    spec        string
+    numFailed   int             // Failures among the window triggering the response
+    window      int             // Latest Widgets of the Producer inspected
+    recalibrate bool            // Stop for the duration and come back in the good state, or else slow down by it
+    duration    time.Duration   // Stop for recalibration, or delay before every Widget while slowed down
+}
+
+// Policies look like <n> of <m> then slow <duration> or <n> of <m> then recalibrate <duration>, e.g. 3 of 10 then slow 5ms
+func parseFeedbackPolicy(spec string) (*FeedbackPolicy, error) {
+    fields := strings.Fields(spec)
+    if (len(fields) != 6 || fields[1] != "of" || fields[3] != "then" || (fields[4] != "slow" && fields[4] != "recalibrate")) {
+        return nil, fmt.Errorf("feedback %q is not of the form <n> of <m> then slow|recalibrate <duration>", spec)
+    }
+    numFailed, errFailed := strconv.Atoi(fields[0])
+    window, errWindow := strconv.Atoi(fields[2])
+    if (errFailed != nil || errWindow != nil || numFailed < 1 || window < numFailed) {
+        return nil, fmt.Errorf("feedback %q must have 1 <= n <= m", spec)
+    }
+    duration, err := time.ParseDuration(fields[5])
+    if (err != nil || duration <= 0) {
+        return nil, fmt.Errorf("feedback %q must respond for a positive duration", spec)
+    }
+    return &FeedbackPolicy{strings.Join(fields, " "), numFailed, window, fields[4] == "recalibrate", duration}, nil
+}
+
+// ProducerQuality is what inspection found of the latest Widgets of one Producer
+type ProducerQuality struct {
+    chain           *DefectChain    // Back in the good state after a recalibration
+    failed          []bool          // The latest inspections, oldest first, at most the window of the policy
+    numFailed       int
+    responding      bool            // Slowed down, or due for recalibration
+    timeReset       time.Time       // Widgets made before the last recalibration are not held against the Producer
+    numResponses    int
+    timeResponding  time.Duration
+}
+
+// Feedback carries what the consumers find on inspection back to the Producer of every Widget, which responds by the
+// policy, a nil Feedback carries nothing
+type Feedback struct {
+    env         *environment
+    mutex       sync.Mutex
+    policy      *FeedbackPolicy
+    producers   map[string]*ProducerQuality
+    names       []string        // In the order the Producers were made
+}
+
+func newFeedback(env *environment, spec string) (*Feedback, error) {
+    policy, err := parseFeedbackPolicy(spec)
+    if err != nil {
+        return nil, err
+    }
+    return &Feedback{env: env, policy: policy, producers: make(map[string]*ProducerQuality)}, nil
+}
+
+func (feedback *Feedback) follow(name string, chain *DefectChain) {
+    if feedback == nil {
+        return
+    }
+    feedback.mutex.Lock()
+    defer feedback.mutex.Unlock()
+    feedback.producers[name] = &ProducerQuality{chain: chain}
+    feedback.names = append(feedback.names, name)
+}
+
+// Tell the Producer of the Widget how it was found, derived Widgets are no Producer's own
+func (feedback *Feedback) inspected(wid Widget) {
+    if feedback == nil {
+        return
+    }
+    feedback.mutex.Lock()
+    defer feedback.mutex.Unlock()
+    quality := feedback.producers[wid.source]
+    if (quality == nil || wid.time.Before(quality.timeReset)) {
+        return
+    }
+    quality.failed = append(quality.failed, !wid.good())
+    if !wid.good() {
+        quality.numFailed++
+    }
+    if len(quality.failed) > feedback.policy.window {
+        if quality.failed[0] {
+            quality.numFailed--
+        }
+        quality.failed = quality.failed[1:]
+    }
+    policy := feedback.policy
+    switch {
+    case (!quality.responding && quality.numFailed >= policy.numFailed):
+        quality.responding = true
+        quality.numResponses++
+        feedback.env.logEvent(MSG_FEEDBACK, wid.source, quality.numFailed, len(quality.failed), strings.Join(strings.Fields(policy.spec)[4:], " "))
+    case (quality.responding && !policy.recalibrate && quality.numFailed < policy.numFailed):
+        quality.responding = false
+        feedback.env.logEvent(MSG_FEEDBACK_CLEAR, wid.source, quality.numFailed, len(quality.failed))
+    }
+}
+
+// Respond to the inspections before making the next Widget, reporting false when the line quits first
+func (feedback *Feedback) respond(name string, board *Board, quitChannel <-chan struct{}) bool {
+    if feedback == nil {
+        return true
+    }
+    feedback.mutex.Lock()
+    quality := feedback.producers[name]
+    responding := quality.responding
+    feedback.mutex.Unlock()
+    if !responding {
+        return true
+    }
+    if feedback.policy.recalibrate {
+        board.working(name, "recalibrating", "")
+    } else {
+        board.working(name, "slowed down by inspection", "")
+    }
+    timer := time.NewTimer(feedback.policy.duration)
+    select {
+    case <-timer.C:
+    case <-quitChannel:
+        timer.Stop()
+        return false
+    }
+    feedback.mutex.Lock()
+    defer feedback.mutex.Unlock()
+    quality.timeResponding += feedback.policy.duration
+    if feedback.policy.recalibrate {
+        quality.chain.recalibrate()
+        quality.failed, quality.numFailed, quality.responding, quality.timeReset = nil, 0, false, feedback.env.now()
+    }
+    return true
+}
+
+func (feedback *Feedback) report(out io.Writer) {
+    if feedback == nil {
+        return
+    }
+    feedback.mutex.Lock()
+    defer feedback.mutex.Unlock()
+    response := "slowed down"
+    if feedback.policy.recalibrate {
+        response = "recalibrated"
+    }
+    for _, name := range feedback.names {
+        quality := feedback.producers[name]
+        fmt.Fprintf(out, "[feedback %s] %s %s [ %d ] times for [ %s ]\n", feedback.policy.spec, name, response, quality.numResponses, quality.timeResponding)
+    }
+}
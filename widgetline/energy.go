@@ -0,0 +1,75 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/energy.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "sync"
+)
+
+// EnergyMeter accounts for the simulated energy used by the line, a nil EnergyMeter accounts for nothing
+type EnergyMeter struct {
+    mutex       sync.Mutex
+    produceCost float64     // Joules per Widget produced
+    consumeCost float64     // Joules per Widget consumed
+    packageCost float64     // Joules per Widget packed into a lot
+    idlePower   float64     // Watts drawn by every worker while it is idle
+    used        float64     // Joules used so far
+    goodWidgets int         // Good Widgets consumed so far
+}
+
+func (meter *EnergyMeter) spend(joules float64) {
+    meter.mutex.Lock()
+    defer meter.mutex.Unlock()
+    meter.used += joules
+}
+
+// A worker reports how long it was idle once it quits working
+func (meter *EnergyMeter) idle(idleTime time.Duration) {
+    if meter == nil {
+        return
+    }
+    meter.spend(meter.idlePower * idleTime.Seconds())
+}
+
+func (meter *EnergyMeter) produced() {
+    if meter == nil {
+        return
+    }
+    meter.spend(meter.produceCost)
+}
+
+func (meter *EnergyMeter) packed(numWidgets int) {
+    if meter == nil {
+        return
+    }
+    meter.spend(meter.packageCost * float64(numWidgets))
+}
+
+func (meter *EnergyMeter) consumed(wid Widget) {
+    if meter == nil {
+        return
+    }
+    meter.mutex.Lock()
+    defer meter.mutex.Unlock()
+    meter.used += meter.consumeCost
+    if wid.good() {
+        meter.goodWidgets++
+    }
+}
+
+func (meter *EnergyMeter) report(out io.Writer) {
+    if meter == nil {
+        return
+    }
+    perGoodWidget := 0.0
+    if meter.goodWidgets > 0 {
+        perGoodWidget = meter.used / float64(meter.goodWidgets)
+    }
+    fmt.Fprintf(out, "The line used [ %.6f J ] of energy, [ %.6f J ] per good widget.\n", meter.used, perGoodWidget)
+}
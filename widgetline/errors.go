@@ -0,0 +1,95 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/errors.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "fmt"
+    "time"
+    "errors"
+)
+
+// Failure modes of a run, for programs driving the line to branch on with errors.Is, the typed errors below wrap them
+// with what happened and can be taken apart with errors.As
+var ErrBrokenWidget = errors.New("broken widget")
+var ErrQueueFull = errors.New("queue full")
+var ErrScrapped = errors.New("scrapped")
+var ErrStageTimeout = errors.New("stage timeout")
+var ErrVerificationFailed = errors.New("verification failed")
+
+// BrokenWidgetError is the broken Widget a consumer stopped the line on
+type BrokenWidgetError struct {
+    Consumer    string
+    Id          string
+    Cause       string
+}
+
+func (err *BrokenWidgetError) Error() string {
+    return fmt.Sprintf("%s: %s found %s, broken by %s", ErrBrokenWidget, err.Consumer, err.Id, err.Cause)
+}
+
+func (err *BrokenWidgetError) Unwrap() error {
+    return ErrBrokenWidget
+}
+
+// QueueFullError is the Widgets shed by the bounded queue, still full after every retry
+type QueueFullError struct {
+    Capacity    int
+    Retries     int
+    NumShed     int
+}
+
+func (err *QueueFullError) Error() string {
+    return fmt.Sprintf("%s: %d widgets shed by the queue of %d after %d retries", ErrQueueFull, err.NumShed, err.Capacity, err.Retries)
+}
+
+func (err *QueueFullError) Unwrap() error {
+    return ErrQueueFull
+}
+
+// StageTimeoutError is the goroutines of the stages still running a grace period after the line stopped
+type StageTimeoutError struct {
+    Grace       time.Duration
+    Stacks      []string
+}
+
+func (err *StageTimeoutError) Error() string {
+    return fmt.Sprintf("%s: %d goroutines still running %s after the line stopped", ErrStageTimeout, len(err.Stacks), err.Grace)
+}
+
+func (err *StageTimeoutError) Unwrap() error {
+    return ErrStageTimeout
+}
+
+// VerificationError is the invariants of the line a run checked with -verify violated
+type VerificationError struct {
+    Violations  []string
+}
+
+func (err *VerificationError) Error() string {
+    return fmt.Sprintf("%s: %d invariants violated, first %s", ErrVerificationFailed, len(err.Violations), err.Violations[0])
+}
+
+func (err *VerificationError) Unwrap() error {
+    return ErrVerificationFailed
+}
+
+// The failures of a run as errors, nil when it had none
+func runErrors(broken *BrokenWidgetError, enqueuer *Enqueuer, stragglers []string, violations []string) error {
+    var errs []error
+    if broken != nil {
+        errs = append(errs, broken)
+    }
+    if (enqueuer != nil && enqueuer.numShed > 0) {
+        errs = append(errs, &QueueFullError{enqueuer.capacity, enqueuer.retries, enqueuer.numShed})
+    }
+    if len(stragglers) > 0 {
+        errs = append(errs, &StageTimeoutError{LEAK_GRACE, stragglers})
+    }
+    if len(violations) > 0 {
+        errs = append(errs, &VerificationError{violations})
+    }
+    return errors.Join(errs...)
+}
@@ -0,0 +1,389 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/events.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "io"
+    "context"
+    "sort"
+    "encoding/json"
+    "log/slog"
+)
+
+// Every event of the line goes to the log of its run, at the level of its key
+func (env *environment) logEvent(key string, args ...any) {
+    level, found := eventLevels[key]
+    if !found {
+        level = slog.LevelInfo
+    }
+    if env.logging(level) {
+        env.logLine(level, env.event(key, args...), slog.String("event", key))
+    }
+}
+
+// LogEvent logs an event outside of a run, in the messages, log level and log format of the configuration
+func (config LineConfig) LogEvent(key string, args ...any) {
+    newEnvironment(DefaultServices(), config).logEvent(key, args...)
+}
+
+// Whether the log of the run takes the events of the level, for the events of every Widget to be made only then
+func (env *environment) logging(level slog.Level) bool {
+    return env.handler.Enabled(context.Background(), level)
+}
+
+// Log a line as a record at the level, unless the log of the run is above it
+func (env *environment) logLine(level slog.Level, line string, attrs ...slog.Attr) {
+    if !env.handler.Enabled(context.Background(), level) {
+        return
+    }
+    record := slog.NewRecord(env.now(), level, strings.TrimSuffix(line, "\n"), 0)
+    record.AddAttrs(attrs...)
+    env.handler.Handle(context.Background(), record)
+}
+
+//==============================================================================
+// Keys of the event messages, each a format string taking the arguments listed, in that order
+const MSG_CONSUME = "consume"               // consumer, id, source, time, broken, latency
+const MSG_SCRAP = "scrap"                   // consumer, id, source, time, broken, cause, latency
+const MSG_BROKEN = "broken"                 // consumer, id, source, time, broken, cause
+const MSG_DIVERT = "divert"                 // id, source, time, broken, rule
+const MSG_REJECT = "reject"                 // producer, id, time, reason
+const MSG_SHED_QUEUE = "shed-queue"         // producer, id, time, retries
+const MSG_SHED_QUOTA = "shed-quota"         // producer, id, time, quota
+const MSG_BREAKDOWN = "breakdown"           // machine
+const MSG_MAINTENANCE = "maintenance"       // machine
+const MSG_REPAIRED = "repaired"             // machine, downtime
+const MSG_CRASH = "crash"                   // consumer
+const MSG_FAILOVER = "failover"             // standby, consumer
+const MSG_NO_STANDBY = "no-standby"         // consumer
+const MSG_LOT = "lot"                       // lot, size, first id, last id, time
+const MSG_RECALL = "recall"                 // lot, size, id, rule
+const MSG_ALERT = "alert"                   // drop in percent, window, previous throughput, current throughput
+const MSG_STOPS = "stops"
+const MSG_INTERRUPTED = "interrupted"
+const MSG_DRAIN_TIMEOUT = "drain-timeout"   // drain timeout
+const MSG_TOOK = "took"                     // duration
+const MSG_ANNOTATION = "annotation"         // time, text
+const MSG_TRANSFORM = "transform"           // number of derived widgets, id, generation, derived ids
+const MSG_END = "end"                       // end condition
+const MSG_STEADY = "steady"                 // warm-up duration
+const MSG_JOIN = "join"                     // consumer, group
+const MSG_LEAVE = "leave"                   // consumer, group
+const MSG_REBALANCE = "rebalance"           // group, partitions of every member, partitions moved, widgets moved
+const MSG_PAUSE = "pause"                   // sink, error
+const MSG_RESUME = "resume"                 // sink, paused for
+const MSG_LOW_SCORE = "low-score"           // id, score, threshold
+const MSG_RULE = "rule"                     // rule, metric, value, action
+const MSG_RULE_CLEAR = "rule-clear"         // rule, metric, value
+const MSG_FEEDBACK = "feedback"             // producer, failed, inspected, response
+const MSG_FEEDBACK_CLEAR = "feedback-clear" // producer, failed, inspected
+const MSG_RESERVE = "reserve"               // lease, widgets, duration
+const MSG_CONFIRM = "confirm"               // lease, widgets
+const MSG_RELEASE = "release"               // lease, widgets, released or expired
+const MSG_REPAIR = "repair"                 // id, source, cause
+const MSG_DISCARD = "discard"               // id, source, time, cause
+const MSG_RETRY = "retry"                   // consumer, id, attempt, attempts, backoff
+const MSG_DEAD_LETTER = "dead-letter"       // id, source, time, consumer, attempts
+const MSG_DEAD_LETTER_BROKEN = "dead-letter-broken" // id, source, time, cause, consumer
+const MSG_SCALE_CONSUMERS = "scale-consumers" // from, to, queue depth
+const MSG_SCALE_PRODUCERS = "scale-producers" // from, to, queue depth
+const MSG_LINE_PAUSED = "line-paused"
+const MSG_LINE_RESUMED = "line-resumed"     // paused for
+const MSG_PRODUCE = "produce"               // producer, id, time, broken
+const MSG_OCCUPANCY = "occupancy"           // length and capacity of every queue
+
+// Event messages by locale, a translation may take the arguments in another order with explicit indexes such as %[2]s
+var eventMessages = map[string]map[string]string{
+    "en": {
+        MSG_CONSUME:        "%s consumes [id=%s source=%s time=%s broken=%t] in %s time",
+        MSG_SCRAP:          "%s scraps a defective widget [id=%s source=%s time=%s broken=%t cause=%s] in %s time",
+        MSG_BROKEN:         "%s found a broken widget [id=%s source=%s time=%s broken=%t cause=%s] -- stopping production",
+        MSG_DIVERT:         "filter diverts [id=%s source=%s time=%s broken=%t] by rule %s",
+        MSG_REJECT:         "%s rejects [id=%s time=%s] -- %s",
+        MSG_SHED_QUEUE:     "%s shed [id=%s time=%s] -- queue full after %d retries",
+        MSG_SHED_QUOTA:     "%s shed [id=%s time=%s] -- over quota %s",
+        MSG_BREAKDOWN:      "%s breaks down -- waiting for a repair crew",
+        MSG_MAINTENANCE:    "%s goes through scheduled maintenance -- waiting for a repair crew",
+        MSG_REPAIRED:       "%s repaired after %s down",
+        MSG_CRASH:          "%s crashes",
+        MSG_FAILOVER:       "[failover] %s takes over from %s",
+        MSG_NO_STANDBY:     "[failover] no standby left to take over from %s",
+        MSG_LOT:            "%s completed [size=%d first=%s last=%s time=%s]",
+        MSG_RECALL:         "%s recalled [size=%d] -- holds [id=%s] matching %s",
+        MSG_ALERT:          "[alert] consumption throughput dropped %.0f%% within %s (%.0f/s -> %.0f/s)",
+        MSG_STOPS:          "[execution stops]",
+        MSG_INTERRUPTED:    "[run interrupted]",
+        MSG_DRAIN_TIMEOUT:  "[drain timed out after %s, the line stops]",
+        MSG_TOOK:           "The program took [ %s ] to finish.",
+        MSG_ANNOTATION:     "[annotation time=%s] %s",
+        MSG_TRANSFORM:      "transformer derives %d widgets from [id=%s generation=%d]: %s",
+        MSG_END:            "[end condition %s met, the line stops]",
+        MSG_STEADY:         "[steady state reached after %s, statistics start now]",
+        MSG_JOIN:           "[membership] %s joins group %s",
+        MSG_LEAVE:          "[membership] %s leaves group %s",
+        MSG_REBALANCE:      "[rebalance] group %s: %s, %d partitions and %d widgets moved",
+        MSG_PAUSE:          "[pause] sink %s failed, buffering until it recovers: %s",
+        MSG_RESUME:         "[resume] sink %s recovered after %s",
+        MSG_LOW_SCORE:      "[low score] widget %s scores %.2f, below %.2f",
+        MSG_RULE:           "[rule] %s fires at %s %.2f -- %s",
+        MSG_RULE_CLEAR:     "[rule] %s clears at %s %.2f",
+        MSG_FEEDBACK:       "[feedback] %s failed %d of its last %d widgets -- %s",
+        MSG_FEEDBACK_CLEAR: "[feedback] %s back to speed with %d failed of its last %d widgets",
+        MSG_RESERVE:        "[reservations] %s reserves %d widgets for %s",
+        MSG_CONFIRM:        "[reservations] %s confirms %d widgets",
+        MSG_RELEASE:        "[reservations] %s puts %d widgets back, %s",
+        MSG_REPAIR:         "inspector repairs a broken widget [id=%s source=%s cause=%s]",
+        MSG_DISCARD:        "scrap bin discards a broken widget [id=%s source=%s time=%s cause=%s] -- beyond repair",
+        MSG_RETRY:          "%s fails to consume [id=%s] on attempt %d of %d -- retrying in %s",
+        MSG_DEAD_LETTER:    "dead-letter channel takes [id=%s source=%s time=%s] from %s -- failed %d attempts",
+        MSG_DEAD_LETTER_BROKEN: "dead-letter channel takes a broken widget [id=%s source=%s time=%s cause=%s] from %s",
+        MSG_SCALE_CONSUMERS: "[autoscale] consumers %d -> %d at queue depth %d",
+        MSG_SCALE_PRODUCERS: "[autoscale] producers %d -> %d at queue depth %d",
+        MSG_LINE_PAUSED:    "[line paused] the producers hold, the consumers drain what is queued",
+        MSG_LINE_RESUMED:   "[line resumed] the producers are back at work after %s paused",
+        MSG_PRODUCE:        "%s produces [id=%s time=%s broken=%t]",
+        MSG_OCCUPANCY:      "[occupancy] %s",
+    },
+    "es": {
+        MSG_CONSUME:        "%s consume [id=%s source=%s time=%s broken=%t] en %s",
+        MSG_SCRAP:          "%s desecha un widget defectuoso [id=%s source=%s time=%s broken=%t cause=%s] en %s",
+        MSG_BROKEN:         "%s encontró un widget roto [id=%s source=%s time=%s broken=%t cause=%s] -- se detiene la producción",
+        MSG_DIVERT:         "el filtro desvía [id=%s source=%s time=%s broken=%t] por la regla %s",
+        MSG_REJECT:         "%s rechaza [id=%s time=%s] -- %s",
+        MSG_SHED_QUEUE:     "%s descarta [id=%s time=%s] -- cola llena tras %d reintentos",
+        MSG_SHED_QUOTA:     "%s descarta [id=%s time=%s] -- cuota %s superada",
+        MSG_BREAKDOWN:      "%s se avería -- esperando a un equipo de reparación",
+        MSG_MAINTENANCE:    "%s pasa su mantenimiento programado -- esperando a un equipo de reparación",
+        MSG_REPAIRED:       "%s reparada tras %s parada",
+        MSG_CRASH:          "%s se cae",
+        MSG_FAILOVER:       "[relevo] %s sustituye a %s",
+        MSG_NO_STANDBY:     "[relevo] no queda nadie de reserva para sustituir a %s",
+        MSG_LOT:            "%s completado [size=%d first=%s last=%s time=%s]",
+        MSG_RECALL:         "%s retirado [size=%d] -- contiene [id=%s] que cumple %s",
+        MSG_ALERT:          "[alerta] el rendimiento del consumo bajó un %.0f%% en %s (%.0f/s -> %.0f/s)",
+        MSG_STOPS:          "[la ejecución se detiene]",
+        MSG_INTERRUPTED:    "[ejecución interrumpida]",
+        MSG_DRAIN_TIMEOUT:  "[el vaciado agotó su plazo de %s, la línea se detiene]",
+        MSG_TOOK:           "El programa tardó [ %s ] en terminar.",
+        MSG_ANNOTATION:     "[anotación time=%s] %s",
+        MSG_TRANSFORM:      "el transformador deriva %d widgets de [id=%s generation=%d]: %s",
+        MSG_END:            "[condición de fin %s cumplida, la línea se detiene]",
+        MSG_STEADY:         "[régimen estable alcanzado tras %s, las estadísticas empiezan ahora]",
+        MSG_JOIN:           "[membresía] %s entra en el grupo %s",
+        MSG_LEAVE:          "[membresía] %s sale del grupo %s",
+        MSG_REBALANCE:      "[reequilibrio] grupo %s: %s, %d particiones y %d widgets movidos",
+        MSG_PAUSE:          "[pausa] el destino %s falla, se guarda lo enviado hasta que se recupere: %s",
+        MSG_RESUME:         "[reanudación] el destino %s se recupera tras %s",
+        MSG_LOW_SCORE:      "[puntuación baja] el widget %s puntúa %.2f, por debajo de %.2f",
+        MSG_RULE:           "[regla] %s se dispara con %s %.2f -- %s",
+        MSG_RULE_CLEAR:     "[regla] %s deja de cumplirse con %s %.2f",
+        MSG_FEEDBACK:       "[inspección] %s falló %d de sus últimos %d widgets -- %s",
+        MSG_FEEDBACK_CLEAR: "[inspección] %s recupera su ritmo con %d fallidos de sus últimos %d widgets",
+        MSG_RESERVE:        "[reservas] %s reserva %d widgets durante %s",
+        MSG_CONFIRM:        "[reservas] %s confirma %d widgets",
+        MSG_RELEASE:        "[reservas] %s devuelve %d widgets, %s",
+        MSG_REPAIR:         "el inspector repara un widget roto [id=%s source=%s cause=%s]",
+        MSG_DISCARD:        "el contenedor de chatarra desecha un widget roto [id=%s source=%s time=%s cause=%s] -- sin reparación posible",
+        MSG_RETRY:          "%s no consigue consumir [id=%s] en el intento %d de %d -- reintento en %s",
+        MSG_DEAD_LETTER:    "el canal de mensajes muertos recoge [id=%s source=%s time=%s] de %s -- %d intentos fallidos",
+        MSG_DEAD_LETTER_BROKEN: "el canal de mensajes muertos recoge un widget roto [id=%s source=%s time=%s cause=%s] de %s",
+        MSG_SCALE_CONSUMERS: "[autoescalado] consumidores %d -> %d con %d en cola",
+        MSG_SCALE_PRODUCERS: "[autoescalado] productores %d -> %d con %d en cola",
+        MSG_LINE_PAUSED:    "[línea en pausa] los productores esperan, los consumidores vacían lo que hay en cola",
+        MSG_LINE_RESUMED:   "[línea reanudada] los productores vuelven al trabajo tras %s en pausa",
+        MSG_PRODUCE:        "%s produce [id=%s time=%s broken=%t]",
+        MSG_OCCUPANCY:      "[ocupación] %s",
+    },
+}
+
+// Consume events are sent to the sinks as messages, or as JSON objects for log pipelines
+const FORMAT_TEXT = "text"
+const FORMAT_JSON = "json"
+
+// The events are logged as they read, or as the records of log/slog in its text or JSON format
+const LOG_FORMAT_PLAIN = "plain"
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+
+// Below debug, the Widgets produced are logged at the verbose level of -v, and the occupancy of the queues at the trace
+// level of -vv. The summary closing a run is logged whatever the level of the log
+const LEVEL_TRACE = slog.LevelDebug - 8
+const LEVEL_VERBOSE = slog.LevelDebug - 4
+const LEVEL_SUMMARY = slog.LevelError + 4
+
+// The levels of -log-level by name
+var logLevels = map[string]slog.Level{
+    "trace":    LEVEL_TRACE,
+    "verbose":  LEVEL_VERBOSE,
+    "debug":    slog.LevelDebug,
+    "info":     slog.LevelInfo,
+    "warn":     slog.LevelWarn,
+    "error":    slog.LevelError,
+}
+
+// How often the occupancy of the queues is logged at the trace level
+const OCCUPANCY_EVERY = 100 * time.Millisecond
+
+// Level of every event logged, info when not listed: the events of single Widgets are debug, along with the lines of the
+// stdout sink, and those of something going wrong warn
+var eventLevels = map[string]slog.Level{
+    MSG_OCCUPANCY:      LEVEL_TRACE,
+    MSG_PRODUCE:        LEVEL_VERBOSE,
+    MSG_REJECT:         slog.LevelDebug,
+    MSG_SHED_QUEUE:     slog.LevelDebug,
+    MSG_SHED_QUOTA:     slog.LevelDebug,
+    MSG_TRANSFORM:      slog.LevelDebug,
+    MSG_LOW_SCORE:      slog.LevelDebug,
+    MSG_REPAIR:         slog.LevelDebug,
+    MSG_RETRY:          slog.LevelDebug,
+    MSG_CRASH:          slog.LevelWarn,
+    MSG_NO_STANDBY:     slog.LevelWarn,
+    MSG_ALERT:          slog.LevelWarn,
+    MSG_STOPS:          slog.LevelWarn,
+    MSG_INTERRUPTED:    slog.LevelWarn,
+    MSG_DRAIN_TIMEOUT:  slog.LevelWarn,
+    MSG_PAUSE:          slog.LevelWarn,
+    MSG_TOOK:           LEVEL_SUMMARY,
+}
+
+// plainHandler writes the message of every record as it reads, one per line
+type plainHandler struct {
+    level   slog.Level
+    log     io.Writer
+}
+
+func (handler plainHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    return level >= handler.level
+}
+
+func (handler plainHandler) Handle(ctx context.Context, record slog.Record) error {
+    _, err := fmt.Fprintln(handler.log, record.Message)
+    return err
+}
+
+func (handler plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return handler
+}
+
+func (handler plainHandler) WithGroup(name string) slog.Handler {
+    return handler
+}
+
+// The level of -log-level, debug when empty
+func parseLogLevel(spec string) (slog.Level, error) {
+    if spec == "" {
+        return slog.LevelDebug, nil
+    }
+    level, found := logLevels[strings.ToLower(spec)]
+    if !found {
+        return slog.LevelDebug, fmt.Errorf("-log-level must be trace, verbose, debug, info, warn or error, got %q", spec)
+    }
+    return level, nil
+}
+
+// The log taking the events from the level up in the format
+func newEventHandler(spec string, format string, log io.Writer) slog.Handler {
+    level, _ := parseLogLevel(spec)
+    options := &slog.HandlerOptions{Level: level, ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+        if attr.Key != slog.LevelKey {
+            return attr
+        }
+        switch attr.Value.Any() {
+        case LEVEL_TRACE:
+            attr.Value = slog.StringValue("TRACE")
+        case LEVEL_VERBOSE:
+            attr.Value = slog.StringValue("VERBOSE")
+        case LEVEL_SUMMARY:
+            attr.Value = slog.StringValue("SUMMARY")
+        }
+        return attr
+    }}
+    var handler slog.Handler = plainHandler{level, log}
+    switch format {
+    case LOG_FORMAT_TEXT:
+        handler = slog.NewTextHandler(log, options)
+    case LOG_FORMAT_JSON:
+        handler = slog.NewJSONHandler(log, options)
+    }
+    return handler
+}
+
+// ConsumeEvent is a Widget consumed, scrapped or found broken, one JSON object per line with -format json
+type ConsumeEvent struct {
+    Event       string      `json:"event"`                // consume, scrap or broken, as the keys of the messages
+    Id          string      `json:"id"`
+    Source      string      `json:"source"`
+    Consumer    string      `json:"consumer"`
+    CreatedAt   time.Time   `json:"created_at"`
+    LatencyNs   int64       `json:"latency_ns"`
+    Broken      bool        `json:"broken"`
+    Cause       string      `json:"cause,omitempty"`
+}
+
+// A consume event as a line in the format of the run
+func (env *environment) consumeEvent(key string, consumer string, wid Widget, latency time.Duration) string {
+    if env.format != FORMAT_JSON {
+        switch key {
+        case MSG_SCRAP:
+            return env.event(key, consumer, wid.id, wid.source, wid.time.Format(TIME_FORMAT), wid.broken, wid.cause, latency)
+        case MSG_BROKEN:
+            return env.event(key, consumer, wid.id, wid.source, wid.time.Format(TIME_FORMAT), wid.broken, wid.cause)
+        }
+        return env.event(key, consumer, wid.id, wid.source, wid.time.Format(TIME_FORMAT), wid.broken, latency)
+    }
+    data, _ := json.Marshal(ConsumeEvent{key, wid.id, wid.source, consumer, wid.time, latency.Nanoseconds(), wid.broken, wid.cause})
+    return string(data) + "\n"
+}
+
+// The messages of a locale, English when empty, with some of them overridden
+func newMessages(locale string, overrides messageMap) map[string]string {
+    if locale == "" {
+        locale = "en"
+    }
+    messages := make(map[string]string, len(eventMessages[locale]))
+    for key, format := range eventMessages[locale] {
+        messages[key] = format
+    }
+    for key, format := range overrides {
+        messages[key] = format
+    }
+    return messages
+}
+
+// An event message of the run as a line
+func (env *environment) event(key string, args ...any) string {
+    return fmt.Sprintf(env.messages[key], args...) + "\n"
+}
+
+// messageMap is a repeatable flag overriding event messages, e.g. consume=%s took %[2]s
+type messageMap map[string]string
+
+func (overrides *messageMap) String() string {
+    var parts []string
+    for key, format := range *overrides {
+        parts = append(parts, key + "=" + format)
+    }
+    sort.Strings(parts)
+    return strings.Join(parts, " ")
+}
+
+func (overrides *messageMap) Set(value string) error {
+    key, format, found := strings.Cut(value, "=")
+    if !found {
+        return fmt.Errorf("message %q is not of the form <key>=<format>", value)
+    }
+    if _, known := eventMessages["en"][key]; !known {
+        return fmt.Errorf("message %q overrides no event message", key)
+    }
+    if *overrides == nil {
+        *overrides = make(messageMap)
+    }
+    (*overrides)[key] = format
+    return nil
+}
@@ -0,0 +1,504 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/flow.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "math/rand"
+    "sync"
+    "context"
+)
+
+// Tardiness is how late the Widgets with a due date were consumed
+type Tardiness struct {
+    NumDue      int             `json:"due"`
+    NumTardy    int             `json:"tardy"`
+    Total       time.Duration   `json:"total"`
+    Max         time.Duration   `json:"max"`
+    Weighted    float64         `json:"weighted"`     // The cost of delay: weight times tardiness in seconds, summed
+}
+
+// DueDates account for the Widgets consumed past their due date, a nil DueDates accounts for none
+// The due dates and weights themselves are set by the Producers
+type DueDates struct {
+    env         *environment
+    mutex       sync.Mutex
+    tardiness   Tardiness
+}
+
+// A Widget is done once consumed, Widgets without a due date are never tardy
+func (dues *DueDates) completed(wid Widget) {
+    if (dues == nil || wid.due.IsZero()) {
+        return
+    }
+    tardiness := max(dues.env.since(wid.due), 0)
+    dues.mutex.Lock()
+    defer dues.mutex.Unlock()
+    dues.tardiness.NumDue++
+    if tardiness > 0 {
+        dues.tardiness.NumTardy++
+        dues.tardiness.Total += tardiness
+        dues.tardiness.Max = max(dues.tardiness.Max, tardiness)
+        dues.tardiness.Weighted += wid.weight * tardiness.Seconds()
+    }
+}
+
+func (dues *DueDates) outcome() *Tardiness {
+    if dues == nil {
+        return nil
+    }
+    dues.mutex.Lock()
+    defer dues.mutex.Unlock()
+    tardiness := dues.tardiness
+    return &tardiness
+}
+
+// The mean tardiness is over every Widget due, the on time ones count as 0
+func (tardiness Tardiness) report(out io.Writer) {
+    mean := time.Duration(0)
+    if tardiness.NumDue > 0 {
+        mean = tardiness.Total / time.Duration(tardiness.NumDue)
+    }
+    fmt.Fprintf(out, "Tardiness: [ %d ] of [ %d ] widgets past due, mean [ %s ] max [ %s ] cost of delay [ %.6f ]\n",
+        tardiness.NumTardy, tardiness.NumDue, mean, tardiness.Max, tardiness.Weighted)
+}
+
+//==============================================================================
+// How far from the takt time the gap between two Widgets consumed may be, as a share of it, for the later one to be on takt
+const TAKT_TOLERANCE = 0.1
+
+// TaktAdherence is how closely the line kept to its takt time
+type TaktAdherence struct {
+    Takt        time.Duration   `json:"takt"`
+    NumOnTakt   int             `json:"on_takt"`
+    NumEarly    int             `json:"early"`          // Consumed too soon after the Widget before them
+    NumLate     int             `json:"late"`           // Consumed too long after the Widget before them
+    Deviation   time.Duration   `json:"deviation"`      // From the takt time of the gaps between Widgets consumed, summed
+    MaxDeviation    time.Duration   `json:"max_deviation"`
+    NumLateStarts   int         `json:"late_starts"`    // Widgets a Producer started past their slot
+}
+
+// Takt paces the line to the demand, one Widget started every takt time whatever the number of Producers, and follows
+// how closely the Widgets consumed keep to it. A Producer busy past the slot of its Widget starts it late and the slots
+// after it move on, the line never catches up with bursts. A nil Takt neither paces nor follows anything
+type Takt struct {
+    env         *environment
+    mutex       sync.Mutex
+    slot        time.Time       // When the next Widget is to be started
+    consumed    time.Time       // When the last Widget was consumed
+    adherence   TaktAdherence
+}
+
+func newTakt(env *environment, takt time.Duration) *Takt {
+    return &Takt{env: env, slot: env.now(), adherence: TaktAdherence{Takt: takt}}
+}
+
+// A Producer waits for the slot of its next Widget, false when the line quits first
+func (takt *Takt) pace(name string, board *Board, quitChannel <-chan struct{}) bool {
+    if takt == nil {
+        return true
+    }
+    takt.mutex.Lock()
+    slot := takt.slot
+    if timeStart := takt.env.now(); timeStart.After(slot) {
+        if timeStart.Sub(slot) > takt.tolerance() {
+            takt.adherence.NumLateStarts++
+        }
+        slot = timeStart
+    }
+    takt.slot = slot.Add(takt.adherence.Takt)
+    takt.mutex.Unlock()
+
+    board.working(name, "waiting for its takt", "")
+    timer := time.NewTimer(takt.env.until(slot))
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return true
+    case <-quitChannel:
+        return false
+    }
+}
+
+func (takt *Takt) tolerance() time.Duration {
+    return time.Duration(TAKT_TOLERANCE * float64(takt.adherence.Takt))
+}
+
+// A Widget is consumed, early or late by how long after the one before it
+func (takt *Takt) completed() {
+    if takt == nil {
+        return
+    }
+    takt.mutex.Lock()
+    defer takt.mutex.Unlock()
+    timeConsumed := takt.env.now()
+    if !takt.consumed.IsZero() {
+        gap := timeConsumed.Sub(takt.consumed)
+        deviation := gap - takt.adherence.Takt
+        switch {
+        case deviation < -takt.tolerance():
+            takt.adherence.NumEarly++
+        case deviation > takt.tolerance():
+            takt.adherence.NumLate++
+        default:
+            takt.adherence.NumOnTakt++
+        }
+        deviation = max(deviation, -deviation)
+        takt.adherence.Deviation += deviation
+        takt.adherence.MaxDeviation = max(takt.adherence.MaxDeviation, deviation)
+    }
+    takt.consumed = timeConsumed
+}
+
+func (takt *Takt) outcome() *TaktAdherence {
+    if takt == nil {
+        return nil
+    }
+    takt.mutex.Lock()
+    defer takt.mutex.Unlock()
+    adherence := takt.adherence
+    return &adherence
+}
+
+// The first Widget consumed has no gap before it, so is neither on takt nor off it
+func (adherence TaktAdherence) report(out io.Writer) {
+    numGaps := adherence.NumOnTakt + adherence.NumEarly + adherence.NumLate
+    mean := time.Duration(0)
+    if numGaps > 0 {
+        mean = adherence.Deviation / time.Duration(numGaps)
+    }
+    fmt.Fprintf(out, "Takt [ %s ]: [ %d ] of [ %d ] widgets on takt, [ %d ] early [ %d ] late, deviation mean [ %s ] max [ %s ], started late [ %d ]\n",
+        adherence.Takt, adherence.NumOnTakt, numGaps, adherence.NumEarly, adherence.NumLate, mean, adherence.MaxDeviation, adherence.NumLateStarts)
+}
+
+//==============================================================================
+// TokenBucket limits a Producer to its production rate, a Widget started for every token taken. Tokens come in every
+// interval, give or take the jitter, and never pile up beyond one, so an idle Producer does not make up for lost time
+// in a burst. A nil TokenBucket never limits anything
+type TokenBucket struct {
+    env         *environment
+    name        string
+    interval    time.Duration   // Between two tokens on average
+    jitter      float64         // Fraction of the interval tokens come early or late by, drawn uniformly
+    tokens      float64
+    last        time.Time       // When the tokens were last topped up
+    numWaits    int
+    waited      time.Duration
+    random      *rand.Rand      // The one of its Producer
+}
+
+// ProductionRates hand every Producer a TokenBucket of its own at the same rate, a nil ProductionRates none
+type ProductionRates struct {
+    env         *environment
+    mutex       sync.Mutex
+    rate        float64         // Widgets per second per Producer
+    jitter      float64
+    buckets     []*TokenBucket
+}
+
+func newProductionRates(env *environment, rate float64, jitter float64) *ProductionRates {
+    return &ProductionRates{env: env, rate: rate, jitter: jitter}
+}
+
+// The bucket of a Producer, full to start with
+func (rates *ProductionRates) bucket(name string, source *rand.Rand) *TokenBucket {
+    if rates == nil {
+        return nil
+    }
+    rates.mutex.Lock()
+    defer rates.mutex.Unlock()
+    bucket := &TokenBucket{env: rates.env, name: name, interval: time.Duration(float64(time.Second) / rates.rate), jitter: rates.jitter, tokens: 1, last: rates.env.now(), random: source}
+    rates.buckets = append(rates.buckets, bucket)
+    return bucket
+}
+
+func (bucket *TokenBucket) refill() {
+    timeNow := bucket.env.now()
+    bucket.tokens = min(1, bucket.tokens + float64(timeNow.Sub(bucket.last)) / float64(bucket.interval))
+    bucket.last = timeNow
+}
+
+// A Producer takes a token before starting a Widget, waiting for one if need be, false when the line quits first
+// Only the goroutine of the Producer takes from its bucket
+func (bucket *TokenBucket) take(board *Board, quitChannel <-chan struct{}) bool {
+    if bucket == nil {
+        return true
+    }
+    bucket.refill()
+    if bucket.tokens < 1 {
+        wait := time.Duration((1 - bucket.tokens) * float64(bucket.interval) * (1 + bucket.jitter * (2 * bucket.random.Float64() - 1)))
+        board.working(bucket.name, "waiting for a token", "")
+        timer := time.NewTimer(wait)
+        select {
+        case <-timer.C:
+        case <-quitChannel:
+            timer.Stop()
+            return false
+        }
+        bucket.numWaits++
+        bucket.waited += wait
+        bucket.tokens, bucket.last = 1, bucket.env.now()
+    }
+    bucket.tokens--
+    return true
+}
+
+// How often every Producer had to wait for a token, read once the Producers are done
+func (rates *ProductionRates) report(out io.Writer) {
+    if rates == nil {
+        return
+    }
+    for _, bucket := range rates.buckets {
+        fmt.Fprintf(out, "Produce rate of %s [ %g/s ± %g%% ]: waited for a token [ %d ] times [ %s ] in total\n",
+            bucket.name, rates.rate, rates.jitter * 100, bucket.numWaits, bucket.waited)
+    }
+}
+
+//==============================================================================
+// Stages of the line a kanban card is held for, in order
+const KANBAN_PRODUCTION = 0     // From a Producer starting a Widget until a consumer withdraws it
+const KANBAN_CONSUMPTION = 1    // From a consumer withdrawing a Widget until it is consumed
+
+var kanbanStages = []string{"production", "consumption"}
+
+// KanbanStage counts the Widgets in process in a stage of the line, WIP, and the cards limiting them
+type KanbanStage struct {
+    name        string
+    cards       int             // 0 when the stage is not limited
+    wip         int
+    peak        int
+    area        float64         // WIP integrated over time, in widget seconds
+    changed     time.Time       // When the WIP last changed
+    numWaits    int             // Times a card was waited for
+    waited      time.Duration
+}
+
+// Kanban pulls the Widgets through the line: a Producer only starts a Widget once a production card is free, and a
+// consumer only withdraws one once a consumption card is, a card going back to its stage when the Widget leaves it
+// Without cards it only follows the WIP of every stage, a nil Kanban follows nothing
+type Kanban struct {
+    env         *environment
+    mutex       sync.Mutex
+    stages      []*KanbanStage
+    holding     map[string]int  // Stage whose card every Widget holds, by id
+    freed       chan struct{}   // Closed and replaced whenever a card is given back
+    timeBegin   time.Time
+}
+
+func newKanban(env *environment, cards CardList) *Kanban {
+    kanban := &Kanban{env: env, holding: make(map[string]int), freed: make(chan struct{}), timeBegin: env.now()}
+    for stage, name := range kanbanStages {
+        kanban.stages = append(kanban.stages, &KanbanStage{name: name, changed: kanban.timeBegin})
+        if stage < len(cards) {
+            kanban.stages[stage].cards = cards[stage]
+        }
+    }
+    return kanban
+}
+
+// Add delta to the WIP of a stage, the caller holds the mutex
+func (kanban *Kanban) move(stage *KanbanStage, delta int) {
+    timeChanged := kanban.env.now()
+    stage.area += float64(stage.wip) * timeChanged.Sub(stage.changed).Seconds()
+    stage.wip += delta
+    stage.peak = max(stage.peak, stage.wip)
+    stage.changed = timeChanged
+    if delta < 0 {
+        close(kanban.freed)
+        kanban.freed = make(chan struct{})
+    }
+}
+
+// Take a card of a stage, waiting for one to be free, false when done is closed first
+func (kanban *Kanban) take(stage *KanbanStage, done <-chan struct{}) bool {
+    waited := false
+    timeWait := kanban.env.now()
+    for {
+        kanban.mutex.Lock()
+        if (stage.cards == 0 || stage.wip < stage.cards) {
+            kanban.move(stage, 1)
+            if waited {
+                stage.waited += kanban.env.since(timeWait)
+            }
+            kanban.mutex.Unlock()
+            return true
+        }
+        if !waited {
+            stage.numWaits++
+            waited = true
+        }
+        freed := kanban.freed
+        kanban.mutex.Unlock()
+        select {
+        case <-freed:
+        case <-done:
+            return false
+        }
+    }
+}
+
+// A Producer starts a Widget once it has a production card, false when the line quits while waiting
+func (kanban *Kanban) start(name string, board *Board, quitChannel <-chan struct{}) bool {
+    if kanban == nil {
+        return true
+    }
+    board.working(name, "waiting for a kanban card", "")
+    return kanban.take(kanban.stages[KANBAN_PRODUCTION], quitChannel)
+}
+
+// The Widget a Producer started holds its production card
+func (kanban *Kanban) produced(wid Widget) {
+    if kanban == nil {
+        return
+    }
+    kanban.mutex.Lock()
+    defer kanban.mutex.Unlock()
+    kanban.holding[wid.id] = KANBAN_PRODUCTION
+}
+
+// A consumer withdraws a Widget once it has a consumption card, giving back the production card of the Widget
+// A Widget withdrawn again, by the consumer taking over from a crashed one, keeps its card
+func (kanban *Kanban) withdraw(ctx context.Context, wid Widget) error {
+    if kanban == nil {
+        return nil
+    }
+    kanban.mutex.Lock()
+    stage, found := kanban.holding[wid.id]
+    kanban.mutex.Unlock()
+    if (found && stage == KANBAN_CONSUMPTION) {
+        return nil
+    }
+    if !kanban.take(kanban.stages[KANBAN_CONSUMPTION], ctx.Done()) {
+        return ctx.Err()
+    }
+    kanban.mutex.Lock()
+    defer kanban.mutex.Unlock()
+    if found {
+        kanban.move(kanban.stages[KANBAN_PRODUCTION], -1)
+    }
+    kanban.holding[wid.id] = KANBAN_CONSUMPTION
+    return nil
+}
+
+// A Widget leaving the line gives back the card it holds
+func (kanban *Kanban) left(wid Widget) {
+    if kanban == nil {
+        return
+    }
+    kanban.mutex.Lock()
+    defer kanban.mutex.Unlock()
+    stage, found := kanban.holding[wid.id]
+    if !found {
+        return
+    }
+    delete(kanban.holding, wid.id)
+    kanban.move(kanban.stages[stage], -1)
+}
+
+// The WIP of every stage over the run so far
+func (kanban *Kanban) outcome() []StageWip {
+    if kanban == nil {
+        return nil
+    }
+    kanban.mutex.Lock()
+    defer kanban.mutex.Unlock()
+    elapsed := kanban.env.since(kanban.timeBegin).Seconds()
+    var wips []StageWip
+    for _, stage := range kanban.stages {
+        area := stage.area + float64(stage.wip) * kanban.env.since(stage.changed).Seconds()
+        wip := StageWip{Stage: stage.name, Cards: stage.cards, Max: stage.peak, NumWaits: stage.numWaits, Waited: stage.waited}
+        if elapsed > 0 {
+            wip.Mean = area / elapsed
+        }
+        wips = append(wips, wip)
+    }
+    return wips
+}
+
+func (kanban *Kanban) report(out io.Writer) {
+    for _, wip := range kanban.outcome() {
+        fmt.Fprintf(out, "WIP %s: mean [ %.2f ] max [ %d ]", wip.Stage, wip.Mean, wip.Max)
+        if wip.Cards > 0 {
+            fmt.Fprintf(out, " of [ %d ] kanban cards, waited for a card [ %d ] times [ %s ] in total", wip.Cards, wip.NumWaits, wip.Waited)
+        }
+        fmt.Fprintln(out)
+    }
+}
+
+//==============================================================================
+// Semaphore bounds the operations of a stage in flight at once, regardless of how many workers the stage has
+// A nil Semaphore lets everything through
+type Semaphore struct {
+    env         *environment
+    stage       string
+    slots       chan struct{}
+    mutex       sync.Mutex
+    numWaits    int             // Operations which had to wait for a slot
+    waited      time.Duration
+}
+
+func newSemaphore(env *environment, stage string, limit int) *Semaphore {
+    if limit <= 0 {
+        return nil
+    }
+    return &Semaphore{env: env, stage: stage, slots: make(chan struct{}, limit)}
+}
+
+// Take a slot, waiting for one until ctx is done
+func (semaphore *Semaphore) acquire(ctx context.Context) error {
+    if semaphore == nil {
+        return nil
+    }
+    select {
+    case semaphore.slots <- struct{}{}:
+        return nil
+    default:
+    }
+
+    timeWait := semaphore.env.now()
+    defer func() {
+        semaphore.mutex.Lock()
+        defer semaphore.mutex.Unlock()
+        semaphore.numWaits++
+        semaphore.waited += semaphore.env.since(timeWait)
+    }()
+    select {
+    case semaphore.slots <- struct{}{}:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func (semaphore *Semaphore) release() {
+    if semaphore == nil {
+        return
+    }
+    <-semaphore.slots
+}
+
+func (semaphore *Semaphore) report(out io.Writer) {
+    if semaphore == nil {
+        return
+    }
+    fmt.Fprintf(out, "Stage %s limited to [ %d ] at once: [ %d ] operations waited [ %s ] in total.\n",
+        semaphore.stage, cap(semaphore.slots), semaphore.numWaits, semaphore.waited)
+}
+
+// StageLimits are the Semaphores of every stage of the line
+type StageLimits struct {
+    produce *Semaphore
+    consume *Semaphore
+    sink    *Semaphore      // Sending to the sinks, the part of consuming which does I/O
+}
+
+func (limits StageLimits) report(out io.Writer) {
+    limits.produce.report(out)
+    limits.consume.report(out)
+    limits.sink.report(out)
+}
@@ -0,0 +1,496 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/groups.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+    "sync"
+    "os"
+    "hash/crc32"
+    "slices"
+    "sync/atomic"
+)
+
+const MEMBERSHIP_CAPACITY = 16
+
+const RESERVE_GROUP = "external"     // The consumer group handing its Widgets out to external systems
+
+const INBOX_CAPACITY = 4             // Widgets handed ahead to a member of a partitioned group, the rest wait for rebalances
+
+//==============================================================================
+// ConsumerGroup gets every Widget once, its consumers compete for them as in a broker's consumer group
+// Only the first group is the line's own, its consumes are the ones counted, verified and stopping the line, the
+// other groups keep counters of their own
+type ConsumerGroup struct {
+    name        string          // Empty for the line's single group when no group is set up
+    size        int
+    drain       string
+    consumers   []Consumer
+    prioritizer *Prioritizer    // nil without priority dispatch
+    pools       *Pools          // nil for a single queue
+    recorder    *Recorder
+    membership  chan Membership // Joins and leaves of a partitioned group, or of a group the Widgets are pushed to
+    numMembers  atomic.Int32    // Consumers in the group right now, kept by the line running it
+    rebalance   string
+    moved       []int           // Widgets moved to another member by every rebalance of a partitioned group
+    members     []string        // The members of a partitioned group at the end of the run
+}
+
+// Groups look like <name>:<consumers>[:<drain>], e.g. audit:1 or billing:4:weighted=5/3/1
+func parseConsumerGroup(spec string) (*ConsumerGroup, error) {
+    parts := strings.SplitN(spec, ":", 3)
+    if (len(parts) < 2 || parts[0] == "") {
+        return nil, fmt.Errorf("consumer group %q is not of the form <name>:<consumers>[:<drain>]", spec)
+    }
+    size, err := strconv.Atoi(parts[1])
+    if (err != nil || size < 1) {
+        return nil, fmt.Errorf("consumer group %q must have at least 1 consumer", spec)
+    }
+    group := &ConsumerGroup{name: parts[0], size: size}
+    if len(parts) == 3 {
+        group.drain = parts[2]
+    }
+    return group, nil
+}
+
+// groupList is a repeatable flag collecting consumer groups
+type GroupList []string
+
+func (list *GroupList) String() string {
+    return strings.Join(*list, " ")
+}
+
+func (list *GroupList) Set(value string) error {
+    if _, err := parseConsumerGroup(value); err != nil {
+        return err
+    }
+    *list = append(*list, value)
+    return nil
+}
+
+// Consumers of the group are named after it, so its events can be told apart
+// How many consumers the group has right now, those which left or crashed with no standby to take over left out
+func (group *ConsumerGroup) live() int {
+    return int(group.numMembers.Load())
+}
+
+func (group *ConsumerGroup) prefix() string {
+    if group.name == "" {
+        return ""
+    }
+    return group.name + "."
+}
+
+// How events name the group
+func (group *ConsumerGroup) title() string {
+    if group.name == "" {
+        return "line"
+    }
+    return group.name
+}
+
+func (group *ConsumerGroup) report(out io.Writer) {
+    if group.name != "" {
+        outcome := group.recorder.recording(LineConfig{}, nil).Outcome
+        numFailed := 0
+        for _, count := range outcome.Failures {
+            numFailed += count
+        }
+        fmt.Fprintf(out, "[group %s of %d consumers] consumed [ %d ] not good [ %d ] mean latency [ %s ] max latency [ %s ]\n",
+            group.name, group.size, outcome.NumConsumed, numFailed, outcome.MeanLatency, outcome.MaxLatency)
+    }
+    if len(group.moved) > 0 {
+        numMoved := 0
+        for _, moved := range group.moved {
+            numMoved += moved
+        }
+        rebalance := group.rebalance
+        if rebalance == "" {
+            rebalance = "range"
+        }
+        fmt.Fprintf(out, "[group %s rebalanced %d times %s, moving %v widgets, %d in all, ending with members %s]\n",
+            group.title(), len(group.moved), rebalance, group.moved, numMoved, strings.Join(group.members, " "))
+    }
+    group.prioritizer.report(out)
+    group.pools.report(out)
+}
+
+// The fan-out hands every Widget to every consumer group in turn, it quits once the inWidgetChannel is closed
+func fanoutLine(wg *sync.WaitGroup, inWidgetChannel <-chan Widget, inEdge *Edge, outWidgetChannels []chan Widget, outEdges []*Edge, quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer func() {
+        for _, outWidgetChannel := range outWidgetChannels {
+            close(outWidgetChannel)
+        }
+    }()
+    timeWait := inEdge.begin()
+    for workingWidget := range inWidgetChannel {
+        inEdge.received(timeWait)
+        for i, outWidgetChannel := range outWidgetChannels {
+            timeSend := outEdges[i].begin()
+            select {
+            case outWidgetChannel <- workingWidget:
+                outEdges[i].sent(timeSend)
+            case <-quitChannel:
+                return
+            }
+        }
+        timeWait = inEdge.begin()
+    }
+}
+
+//==============================================================================
+// Membership changes a consumer group of a running line, a consumer joins a group or leaves it
+type Membership struct {
+    Join        bool
+    Group       string  // Empty for the line's own group
+    Consumer    string  // The consumer leaving
+}
+
+// Commands look like join [<group>] or leave <consumer>, the group of a consumer is the part of its name before the dot
+func ParseMembership(command string) (Membership, bool) {
+    fields := strings.Fields(command)
+    switch {
+    case (len(fields) == 1 && fields[0] == "join"):
+        return Membership{Join: true}, true
+    case (len(fields) == 2 && fields[0] == "join"):
+        return Membership{Join: true, Group: fields[1]}, true
+    case (len(fields) == 2 && fields[0] == "leave"):
+        group, _, found := strings.Cut(fields[1], ".")
+        if !found {
+            group = ""
+        }
+        return Membership{Group: group, Consumer: fields[1]}, true
+    }
+    return Membership{}, false
+}
+
+// Route every membership change to the partitioned group it is for, it quits once membershipChannel is closed
+func membershipLine(wg *sync.WaitGroup, groups []*ConsumerGroup, membershipChannel <-chan Membership, quitChannel <-chan struct{}) {
+    defer wg.Done()
+    for {
+        select {
+        case change, ok := <-membershipChannel:
+            if !ok {
+                return
+            }
+            index := 0
+            if change.Group != "" {
+                index = slices.IndexFunc(groups, func(group *ConsumerGroup) bool { return group.name == change.Group })
+            }
+            if index < 0 {
+                fmt.Fprintf(os.Stderr, "no consumer group %q to change\n", change.Group)
+                continue
+            }
+            select {
+            case groups[index].membership <- change:
+            case <-quitChannel:
+                return
+            }
+        case <-quitChannel:
+            return
+        }
+    }
+}
+
+// The partition of a Widget, by its id
+func partitionOf(wid Widget, numPartitions int) int {
+    return int(crc32.ChecksumIEEE([]byte(wid.id)) % uint32(numPartitions))
+}
+
+// An assignment gives every partition an owner among the members, knowing who owned it before, nil at first
+type Assignment func(members []*Member, previous []*Member, numPartitions int) []*Member
+
+// Rebalances look like range, round-robin or sticky, range when not set
+func parseRebalance(spec string) (Assignment, error) {
+    switch spec {
+    case "", "range":
+        return assignRange, nil
+    case "round-robin":
+        return assignRoundRobin, nil
+    case "sticky":
+        return assignSticky, nil
+    }
+    return nil, fmt.Errorf("rebalance %q must be range, round-robin or sticky", spec)
+}
+
+// Range assignment cuts the partitions in contiguous ranges, one per member in the order they joined
+func assignRange(members []*Member, previous []*Member, numPartitions int) []*Member {
+    owners := make([]*Member, numPartitions)
+    for partition := range owners {
+        owners[partition] = members[partition * len(members) / numPartitions]
+    }
+    return owners
+}
+
+// Round-robin assignment deals the partitions to the members in turn
+func assignRoundRobin(members []*Member, previous []*Member, numPartitions int) []*Member {
+    owners := make([]*Member, numPartitions)
+    for partition := range owners {
+        owners[partition] = members[partition % len(members)]
+    }
+    return owners
+}
+
+// Sticky assignment leaves every partition with its owner as long as the owner is still a member and not above its fair
+// share, only the rest go to the members with the fewest partitions
+func assignSticky(members []*Member, previous []*Member, numPartitions int) []*Member {
+    if previous == nil {
+        return assignRange(members, previous, numPartitions)
+    }
+    // Every member gets low partitions, numHigh of them one more
+    low, numHigh := numPartitions / len(members), numPartitions % len(members)
+    counts := make(map[*Member]int)
+    owners := make([]*Member, numPartitions)
+    for partition, owner := range previous {
+        if !slices.Contains(members, owner) {
+            continue
+        }
+        if counts[owner] == low && numHigh > 0 {
+            numHigh--
+        } else if counts[owner] >= low {
+            continue
+        }
+        owners[partition] = owner
+        counts[owner]++
+    }
+    for partition := range owners {
+        if owners[partition] != nil {
+            continue
+        }
+        fewest := members[0]
+        for _, member := range members[1:] {
+            if counts[member] < counts[fewest] {
+                fewest = member
+            }
+        }
+        owners[partition] = fewest
+        counts[fewest]++
+    }
+    return owners
+}
+
+// Member is a consumer of a partitioned group, handed the Widgets of its partitions in its inbox
+type Member struct {
+    consumer    Consumer
+    inbox       chan Widget
+    crashed     bool
+}
+
+// In partitioned dispatch every Widget goes to the member its partition is assigned to, the partitions are rebalanced
+// over the members whenever one joins or leaves through membershipChannel, or crashes
+// A member leaving consumes what was already handed to it before it goes, what a crashed member held is handed out
+// again, a standby joining in its place when there is one left
+// Once endChannel is closed the members stop as on a broken widget
+func partitionLine(wg *sync.WaitGroup, group *ConsumerGroup, numPartitions int, assign Assignment, standbyNames []string, inWidgetChannel <-chan Widget, inEdge *Edge,
+    outWidgetChannel chan<- Widget, outEdge *Edge, policy *StopPolicy, brokenWidgetChannel chan<- struct{}, endChannel <-chan struct{}) {
+    defer wg.Done()
+    if outWidgetChannel != nil {
+        defer close(outWidgetChannel)
+    }
+    cancellation := newCancellation()
+    defer cancellation.cancel()
+    template := group.consumers[0]
+    go func() {
+        select {
+        case <-endChannel:
+            cancellation.stop(template.checker.stopped)
+        case <-cancellation.ctx.Done():
+        }
+    }()
+
+    exitChannel := make(chan *Member)
+    run := func(member *Member) {
+        workingConsumer := member.consumer
+        defer func() { exitChannel <- member }()
+        timeBegin, busyTime := workingConsumer.env.now(), time.Duration(0)
+        defer func() { workingConsumer.meter.idle(workingConsumer.env.since(timeBegin) - busyTime) }()
+        defer workingConsumer.board.working(workingConsumer.name, "stopped", "")
+        workingConsumer.board.working(workingConsumer.name, "waiting for a widget", "")
+        for workingWidget := range member.inbox {
+            select {
+            case <-cancellation.ctx.Done():
+                return
+            case <-endChannel:
+                cancellation.stop(workingConsumer.checker.stopped)
+                return
+            default:
+                workingConsumer.board.working(workingConsumer.name, "consuming", workingWidget.id)
+                timeConsume := workingConsumer.env.now()
+                stops, err := workingConsumer.consume(cancellation.ctx, workingWidget, cancellation, policy)
+                busyTime += workingConsumer.env.since(timeConsume)
+                if err != nil {
+                    workingConsumer.recorder.interrupted()
+                    return
+                }
+                if (stops) {
+                    cancellation.stop(workingConsumer.checker.stopped)
+                    close(brokenWidgetChannel)
+                    return
+                }
+                if (outWidgetChannel != nil && workingWidget.good()) {
+                    workingConsumer.board.working(workingConsumer.name, "handing over to packaging", workingWidget.id)
+                    timeSend := outEdge.begin()
+                    outWidgetChannel <- workingWidget
+                    outEdge.sent(timeSend)
+                }
+                workingConsumer.board.working(workingConsumer.name, "waiting for a widget", "")
+                if (workingConsumer.crash > 0 && workingConsumer.random.Float64() < workingConsumer.crash) {
+                    workingConsumer.env.logEvent(MSG_CRASH, workingConsumer.name)
+                    member.crashed = true
+                    return
+                }
+            }
+        }
+    }
+
+    // A rebalance moves the partitions changing owner, with the Widgets of theirs still waiting to be handed over
+    var members []*Member
+    var owners []*Member
+    var pending []Widget
+    numRunning, numJoined, numStandbys := 0, len(group.consumers), 0
+    rebalance := func() {
+        previous := owners
+        owners = assign(members, previous, numPartitions)
+        numMoved, numMovedWidgets := 0, 0
+        if previous != nil {
+            for partition := range owners {
+                if owners[partition] != previous[partition] {
+                    numMoved++
+                }
+            }
+            for _, workingWidget := range pending {
+                partition := partitionOf(workingWidget, numPartitions)
+                if owners[partition] != previous[partition] {
+                    numMovedWidgets++
+                }
+            }
+            group.moved = append(group.moved, numMovedWidgets)
+        }
+        var parts []string
+        for _, member := range members {
+            var assigned []int
+            for partition, owner := range owners {
+                if owner == member {
+                    assigned = append(assigned, partition)
+                }
+            }
+            parts = append(parts, fmt.Sprintf("%s=%v", member.consumer.name, assigned))
+        }
+        template.env.logEvent(MSG_REBALANCE, group.title(), strings.Join(parts, " "), numMoved, numMovedWidgets)
+    }
+    join := func(workingConsumer Consumer) {
+        member := &Member{consumer: workingConsumer, inbox: make(chan Widget, INBOX_CAPACITY)}
+        members = append(members, member)
+        numRunning++
+        go run(member)
+    }
+    for _, workingConsumer := range group.consumers {
+        join(workingConsumer)
+    }
+    rebalance()
+    defer func() {
+        group.members = nil
+        for _, member := range members {
+            group.members = append(group.members, member.consumer.name)
+        }
+    }()
+
+    // Widgets taken wait in pending until their member has room, in the order they came
+    closing := false
+    timeWait := inEdge.begin()
+    for {
+        group.numMembers.Store(int32(len(members)))
+        if (!closing && (cancellation.ctx.Err() != nil || (inWidgetChannel == nil && len(pending) == 0) || len(members) == 0)) {
+            // Members finish what they hold and quit
+            closing = true
+            for _, member := range members {
+                close(member.inbox)
+            }
+        }
+        if (closing && numRunning == 0) {
+            return
+        }
+        takeChannel := inWidgetChannel
+        var offerChannel chan<- Widget
+        var offer Widget
+        if (len(pending) > 0 && !closing) {
+            takeChannel, offer = nil, pending[0]
+            offerChannel = owners[partitionOf(offer, numPartitions)].inbox
+        }
+        if closing {
+            takeChannel = nil
+        }
+
+        select {
+        case workingWidget, ok := <-takeChannel:
+            if !ok {
+                inWidgetChannel = nil
+                continue
+            }
+            inEdge.received(timeWait)
+            pending = append(pending, workingWidget)
+            timeWait = inEdge.begin()
+        case offerChannel <- offer:
+            pending = pending[1:]
+        case change := <-group.membership:
+            switch {
+            case closing:
+            case change.Join:
+                workingConsumer := template
+                workingConsumer.name = group.prefix() + "consumer_" + strconv.Itoa(numJoined)
+                workingConsumer.random = namedRandom(workingConsumer.env.workerSeed, workingConsumer.name)
+                numJoined++
+                join(workingConsumer)
+                workingConsumer.env.logEvent(MSG_JOIN, workingConsumer.name, group.title())
+                rebalance()
+            default:
+                // A leave naming no consumer, from a rule scaling the consumers down, takes the newest member
+                if (change.Consumer == "" && len(members) > 0) {
+                    change.Consumer = members[len(members) - 1].consumer.name
+                }
+                index := slices.IndexFunc(members, func(member *Member) bool { return member.consumer.name == change.Consumer })
+                if (index < 0 || len(members) == 1) {
+                    fmt.Fprintf(os.Stderr, "%s cannot leave group %s, it is not one of its members or the last one\n", change.Consumer, group.title())
+                    continue
+                }
+                close(members[index].inbox)
+                members = slices.Delete(members, index, index + 1)
+                template.env.logEvent(MSG_LEAVE, change.Consumer, group.title())
+                rebalance()
+            }
+        case member := <-exitChannel:
+            numRunning--
+            if (!member.crashed || closing) {
+                continue
+            }
+            // What the crashed member still held goes first to the new owners of its partitions
+            var held []Widget
+            for len(member.inbox) > 0 {
+                held = append(held, <-member.inbox)
+            }
+            pending = append(held, pending...)
+            members = slices.DeleteFunc(members, func(other *Member) bool { return other == member })
+            if numStandbys < len(standbyNames) {
+                member.consumer.env.logEvent(MSG_FAILOVER, standbyNames[numStandbys], member.consumer.name)
+                standby := member.consumer
+                standby.name = standbyNames[numStandbys]
+                standby.random = namedRandom(standby.env.workerSeed, standby.name)
+                numStandbys++
+                join(standby)
+            } else {
+                member.consumer.env.logEvent(MSG_NO_STANDBY, member.consumer.name)
+            }
+            if len(members) > 0 {
+                rebalance()
+            }
+        }
+    }
+}
@@ -0,0 +1,128 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/history.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strings"
+    "sort"
+    "math"
+)
+
+const PARETO_BAR = 40                // Width of a bar holding all the defects in a Pareto breakdown
+const PARETO_VITAL_FEW = 80.0        // Cumulative percentage of the defects marked as coming from the vital few
+
+//=============================================================================
+// HistoryEntry is a run kept in the history file, one JSON object per line, so trends show up across runs
+type HistoryEntry struct {
+    Time        time.Time       `json:"time"`
+    Config      LineConfig      `json:"config"`
+    Outcome     Outcome         `json:"outcome"`
+    Annotations []Annotation    `json:"annotations,omitempty"`
+}
+
+// Share of the consumed Widgets which were broken or defective
+func (entry HistoryEntry) DefectRate() float64 {
+    numFailures := 0
+    for _, count := range entry.Outcome.Failures {
+        numFailures += count
+    }
+    if entry.Outcome.NumConsumed == 0 {
+        return 0
+    }
+    return float64(numFailures) / float64(entry.Outcome.NumConsumed)
+}
+
+func AppendHistory(fileName string, recording Recording) error {
+    services := DefaultServices()
+    data, err := services.Codec.Marshal(HistoryEntry{services.Clock.Now(), recording.Config, recording.Outcome, recording.Annotations})
+    if err != nil {
+        return err
+    }
+    return services.Store.AppendFile(fileName, append(data, '\n'))
+}
+
+func ReadHistory(fileName string) ([]HistoryEntry, error) {
+    data, err := DefaultServices().Store.ReadFile(fileName)
+    if err != nil {
+        return nil, err
+    }
+    return decodeHistory(fileName, data)
+}
+
+func decodeHistory(fileName string, data []byte) ([]HistoryEntry, error) {
+    var history []HistoryEntry
+    for i, line := range strings.Split(string(data), "\n") {
+        if strings.TrimSpace(line) == "" {
+            continue
+        }
+        var entry HistoryEntry
+        if err := DefaultServices().Codec.Unmarshal([]byte(line), &entry); err != nil {
+            return nil, fmt.Errorf("%s line %d: %s", fileName, i + 1, err)
+        }
+        history = append(history, entry)
+    }
+    return history, nil
+}
+
+//=============================================================================
+// Pareto is the broken and defective Widgets counted along one dimension, to tell the few causes behind most defects
+type Pareto struct {
+    By      string          // cause, producer or kind
+    Counts  map[string]int
+}
+
+// ParetoBar is one value of a Pareto breakdown with its share of all the defects, and of the bars up to it
+type ParetoBar struct {
+    Name        string
+    Count       int
+    Share       float64
+    Cumulative  float64
+}
+
+// The bars from the most defects to the least, ties by name
+func (pareto Pareto) Bars() []ParetoBar {
+    total := 0
+    bars := make([]ParetoBar, 0, len(pareto.Counts))
+    for name, count := range pareto.Counts {
+        bars = append(bars, ParetoBar{Name: name, Count: count})
+        total += count
+    }
+    sort.Slice(bars, func(i, j int) bool {
+        if bars[i].Count != bars[j].Count {
+            return bars[i].Count > bars[j].Count
+        }
+        return bars[i].Name < bars[j].Name
+    })
+    cumulative := 0
+    for i := range bars {
+        cumulative += bars[i].Count
+        bars[i].Share = 100 * float64(bars[i].Count) / float64(total)
+        bars[i].Cumulative = 100 * float64(cumulative) / float64(total)
+    }
+    return bars
+}
+
+// Print a Pareto breakdown to out, the bars making up 80% of the defects are marked
+func PrintPareto(out io.Writer, pareto Pareto) {
+    bars := pareto.Bars()
+    if len(bars) == 0 {
+        return
+    }
+    fmt.Fprintf(out, "[defects by %s]\n", pareto.By)
+    previous := 0.0
+    for _, bar := range bars {
+        marker := ""
+        if previous < PARETO_VITAL_FEW {
+            marker = " *"
+        }
+        fmt.Fprintf(out, "  %-24s %8d %6.1f%% %6.1f%%  %s%s\n", bar.Name, bar.Count, bar.Share, bar.Cumulative,
+            strings.Repeat("#", int(math.Round(bar.Share * PARETO_BAR / 100))), marker)
+        previous = bar.Cumulative
+    }
+}
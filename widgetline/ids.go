@@ -0,0 +1,246 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/ids.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "math/rand"
+    "bytes"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "math"
+    "regexp"
+    cryptorand "crypto/rand"
+    "encoding/binary"
+)
+
+const ASCII = "abcdefghijklmnopqrstuvxyz0123456789"
+const ID_LENGTH = 32
+
+// IdStrategy makes the random ids of the Widgets, and tells its ids from anything else
+type IdStrategy interface {
+    Make() string
+    Valid(id string) bool   // Whether the id is one the strategy could have made, derived ids aside
+    Pattern() string        // Regular expression matching the ids made, derived ids aside
+    Bits() float64          // Of entropy in an id
+    String() string         // How the ids look
+}
+
+const ID_LEGACY = "legacy"
+const ID_UUID = "uuid"
+const ID_ULID = "ulid"
+
+// IdFormat is how legacy random Widget ids look: length characters of the alphabet, with a dash in the middle
+// The Producers draw them from sources of their own derived from the seed, so a seed makes them again
+type IdFormat struct {
+    length      int
+    alphabet    string
+}
+
+// UUIDv4 ids are random UUIDs of RFC 9562, drawn from crypto/rand, whatever the seed
+type UUIDv4 struct{}
+
+// ULID ids are the time of production in milliseconds followed by 80 bits drawn from crypto/rand, in Crockford's
+// base 32, so they sort by time
+type ULID struct{}
+
+// Alphabets are printable ASCII without repeats, the dash and the dot are kept for the middle of ids and derived ids
+func validAlphabet(alphabet string) error {
+    if len(alphabet) < 2 {
+        return fmt.Errorf("-id-alphabet must have at least 2 characters, got %q", alphabet)
+    }
+    for i, char := range alphabet {
+        if (char <= ' ' || char > '~' || char == '-' || char == '.' || strings.ContainsRune(alphabet[:i], char)) {
+            return fmt.Errorf("-id-alphabet must be printable ASCII without repeats, dashes nor dots, got %q", alphabet)
+        }
+    }
+    return nil
+}
+
+// An id by the strategy of the run, legacy ids are drawn from the source of the Producer making them, ULIDs start with
+// the time of the Widget on the clock of the run, UUIDs ignore both
+func (env *environment) makeId(source *rand.Rand, t time.Time) string {
+    switch strategy := env.ids.(type) {
+    case IdFormat:
+        return strategy.draw(source)
+    case ULID:
+        return strategy.at(t)
+    default:
+        return strategy.Make()
+    }
+}
+
+// Ids made outside of a line are all drawn from one source, seeded once
+var looseIds = struct {
+    mutex   sync.Mutex
+    source  *rand.Rand
+}{source: rand.New(rand.NewSource(rand.Int63()))}
+
+func (format IdFormat) Make() string {
+    looseIds.mutex.Lock()
+    defer looseIds.mutex.Unlock()
+    return format.draw(looseIds.source)
+}
+
+func (format IdFormat) draw(source *rand.Rand) string {
+    var buffer bytes.Buffer
+
+    for i := 0; i < format.length; i++ {
+        if i == format.length / 2 {
+            buffer.WriteString("-")
+        } else {
+            buffer.WriteByte(format.alphabet[source.Intn(len(format.alphabet))])
+        }
+    }
+    return buffer.String()
+}
+
+func (format IdFormat) Valid(id string) bool {
+    if len(id) != format.length {
+        return false
+    }
+    for i, char := range id {
+        if (!strings.ContainsRune(format.alphabet, char) && !(i == format.length / 2 && char == '-')) {
+            return false
+        }
+    }
+    return true
+}
+
+func (format IdFormat) Pattern() string {
+    chars := "[" + regexp.QuoteMeta(format.alphabet) + "]"
+    half := format.length / 2
+    return chars + "{" + strconv.Itoa(half) + "}-" + chars + "{" + strconv.Itoa(format.length - half - 1) + "}"
+}
+
+// The dash carries none
+func (format IdFormat) Bits() float64 {
+    return float64(format.length - 1) * math.Log2(float64(len(format.alphabet)))
+}
+
+func (format IdFormat) String() string {
+    return fmt.Sprintf("%d characters of %d", format.length, len(format.alphabet))
+}
+
+const UUID_PATTERN = `[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`
+
+var uuidPattern = regexp.MustCompile(`^` + UUID_PATTERN + `$`)
+
+func (UUIDv4) Make() string {
+    var uuid [16]byte
+    cryptorand.Read(uuid[:])
+    uuid[6] = uuid[6] & 0x0f | 0x40     // Version 4
+    uuid[8] = uuid[8] & 0x3f | 0x80     // Variant of RFC 9562
+    return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+func (UUIDv4) Valid(id string) bool {
+    return uuidPattern.MatchString(id)
+}
+
+func (UUIDv4) Pattern() string {
+    return UUID_PATTERN
+}
+
+// Six of the 128 bits are the version and the variant
+func (UUIDv4) Bits() float64 {
+    return 122
+}
+
+func (UUIDv4) String() string {
+    return "UUIDv4"
+}
+
+const CROCKFORD = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+const ULID_PATTERN = `[0-7][0-9A-HJKMNP-TV-Z]{25}`
+
+var ulidPattern = regexp.MustCompile(`^` + ULID_PATTERN + `$`)
+
+func (ulid ULID) Make() string {
+    return ulid.at(time.Now())
+}
+
+func (ULID) at(t time.Time) string {
+    var ulid [16]byte
+    milliseconds := uint64(t.UnixMilli())
+    for i := 0; i < 6; i++ {
+        ulid[i] = byte(milliseconds >> (40 - 8 * i))
+    }
+    cryptorand.Read(ulid[6:])
+    // 128 bits as 26 characters of 5 bits, the first one has 3 bits only
+    var text [26]byte
+    high, low := binary.BigEndian.Uint64(ulid[:8]), binary.BigEndian.Uint64(ulid[8:])
+    for i := 25; i >= 0; i-- {
+        text[i] = CROCKFORD[low & 0x1f]
+        low = low >> 5 | high << 59
+        high >>= 5
+    }
+    return string(text[:])
+}
+
+func (ULID) Valid(id string) bool {
+    return ulidPattern.MatchString(id)
+}
+
+func (ULID) Pattern() string {
+    return ULID_PATTERN
+}
+
+// Only the random part, ids made within the same millisecond are the ones which may collide
+func (ULID) Bits() float64 {
+    return 80
+}
+
+func (ULID) String() string {
+    return "ULID"
+}
+
+// Probability of any two of numIds ids being the same, by the birthday bound
+func collisionProbability(strategy IdStrategy, numIds int) float64 {
+    pairs := float64(numIds) * float64(numIds - 1) / 2
+    return -math.Expm1(-pairs * math.Exp2(-strategy.Bits()))
+}
+
+// Report the odds of the ids issued colliding next to the collisions found, which unbounded runs do not look for
+func reportIds(out io.Writer, strategy IdStrategy, numIssued int, numCollisions int, tracked bool) {
+    collisions := strconv.Itoa(numCollisions)
+    if !tracked {
+        collisions = "not tracked"
+    }
+    // ULIDs are counted as if all made within the same millisecond, which bounds the odds rather than telling them
+    bound := ""
+    if _, ok := strategy.(ULID); ok {
+        bound = "at most "
+    }
+    fmt.Fprintf(out, "Ids: [ %s, %.1f bits ] issued [ %d ] collision probability [ %s%.3g ] collisions [ %s ]\n",
+        strategy, strategy.Bits(), numIssued, bound, collisionProbability(strategy, numIssued), collisions)
+}
+
+// SerialAllocator hands out dense, gap-free serial numbers for every Widget of a production line
+// The nodes of a distributed line take turns: node k of n hands out every n-th number from k + 1 on, so the numbers of
+// the nodes never meet, and are gap-free over the whole line as long as the nodes produce as many Widgets
+type SerialAllocator struct {
+    mutex   sync.Mutex
+    width   int     // Padded with zeros to this many digits
+    next    int     // The last number handed out, or the one before the first
+    step    int     // Between the numbers handed out, the number of nodes
+}
+
+// A SerialAllocator going on after the first jobs of the line, for the node of a distributed line or the line itself
+func newSerialAllocator(width int, numDone int, hello RemoteHello) *SerialAllocator {
+    numNodes := max(hello.NumNodes, 1)
+    return &SerialAllocator{width: width, next: numDone + hello.Node + 1 - numNodes, step: numNodes}
+}
+
+func (serials *SerialAllocator) reserve() string {
+    serials.mutex.Lock()
+    defer serials.mutex.Unlock()
+    serials.next += serials.step
+    return fmt.Sprintf("%0*d", serials.width, serials.next)
+}
@@ -0,0 +1,205 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/invariants.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "fmt"
+    "sync"
+)
+
+// LineState is what the Invariants of the line are checked against
+type LineState struct {
+    NumProduced             int
+    NumConsumed             int
+    NumFiltered             int     // Widgets dropped, diverted or shed before reaching the consumers, or dead-lettered by them
+    NumTransformed          int     // Widgets replaced by the Widgets derived from them
+    NumDerived              int
+    NumWidgets              int     // Widgets the line was asked to produce
+    Unbounded               bool    // The line produces until it is stopped, regardless of NumWidgets
+    Stopped                 bool    // A broken widget has stopped the line
+    Interrupted             bool    // The run was interrupted, the Widgets not produced by then never will be
+    NumConsumedAfterStop    int
+}
+
+// Invariant is a property of the line that must hold, Check returns an error describing the violation otherwise
+type Invariant interface {
+    Name() string
+    Check(state LineState) error
+}
+
+// InvariantFunc turns a plain function into a named Invariant
+type InvariantFunc struct {
+    name    string
+    check   func(state LineState) error
+}
+
+// An Invariant of the given name, violated whenever check returns an error
+func NewInvariant(name string, check func(state LineState) error) InvariantFunc {
+    return InvariantFunc{name, check}
+}
+
+func (invariant InvariantFunc) Name() string {
+    return invariant.name
+}
+
+func (invariant InvariantFunc) Check(state LineState) error {
+    return invariant.check(state)
+}
+
+// Built-in Invariants checked after every event
+var continuousInvariants = []Invariant{
+    InvariantFunc{"non-negative-counters", func(state LineState) error {
+        if (state.NumProduced < 0 || state.NumConsumed < 0 || state.NumFiltered < 0) {
+            return fmt.Errorf("produced=%d consumed=%d filtered=%d", state.NumProduced, state.NumConsumed, state.NumFiltered)
+        }
+        return nil
+    }},
+    InvariantFunc{"consumed-at-most-produced", func(state LineState) error {
+        if (state.NumConsumed + state.NumFiltered + state.NumTransformed > state.NumProduced + state.NumDerived) {
+            return fmt.Errorf("consumed %d, filtered %d and transformed %d widgets but only %d were produced and %d derived",
+                state.NumConsumed, state.NumFiltered, state.NumTransformed, state.NumProduced, state.NumDerived)
+        }
+        return nil
+    }},
+    InvariantFunc{"produced-at-most-n", func(state LineState) error {
+        if (!state.Unbounded && state.NumProduced > state.NumWidgets) {
+            return fmt.Errorf("produced %d widgets but only %d were asked for", state.NumProduced, state.NumWidgets)
+        }
+        return nil
+    }},
+    InvariantFunc{"no-consumption-after-stop", func(state LineState) error {
+        if (state.NumConsumedAfterStop > 0) {
+            return fmt.Errorf("%d widgets consumed after the stop signal", state.NumConsumedAfterStop)
+        }
+        return nil
+    }},
+}
+
+// Built-in Invariants checked once the run is over
+var finalInvariants = []Invariant{
+    InvariantFunc{"every-widget-consumed", func(state LineState) error {
+        numGone, numCome := state.NumConsumed + state.NumFiltered + state.NumTransformed, state.NumProduced + state.NumDerived
+        if ((state.Unbounded || state.Interrupted) && !state.Stopped && numGone != numCome) {
+            return fmt.Errorf("produced %d and derived %d, but consumed %d, filtered %d and transformed %d widgets without being stopped",
+                state.NumProduced, state.NumDerived, state.NumConsumed, state.NumFiltered, state.NumTransformed)
+        }
+        if (!state.Unbounded && !state.Interrupted && !state.Stopped && (state.NumProduced != state.NumWidgets || numGone != numCome)) {
+            return fmt.Errorf("produced %d of %d and derived %d, but consumed %d, filtered %d and transformed %d widgets without being stopped",
+                state.NumProduced, state.NumWidgets, state.NumDerived, state.NumConsumed, state.NumFiltered, state.NumTransformed)
+        }
+        return nil
+    }},
+}
+
+// Checker keeps track of the LineState and evaluates the registered Invariants against it, a nil Checker checks nothing
+type Checker struct {
+    mutex       sync.Mutex
+    state       LineState
+    continuous  []Invariant
+    final       []Invariant
+    violations  []string
+}
+
+// The built-in Invariants are followed by those of the program embedding the line, continuous then final
+func newChecker(numWidgets int, unbounded bool, continuous []Invariant, final []Invariant) *Checker {
+    checker := &Checker{state: LineState{NumWidgets: numWidgets, Unbounded: unbounded}}
+    for _, invariant := range continuousInvariants {
+        checker.register(invariant, true)
+    }
+    for _, invariant := range finalInvariants {
+        checker.register(invariant, false)
+    }
+    for _, invariant := range continuous {
+        checker.register(invariant, true)
+    }
+    for _, invariant := range final {
+        checker.register(invariant, false)
+    }
+    return checker
+}
+
+// Register an Invariant checked after every event when continuous, or once the run is over otherwise
+func (checker *Checker) register(invariant Invariant, continuous bool) {
+    if continuous {
+        checker.continuous = append(checker.continuous, invariant)
+    } else {
+        checker.final = append(checker.final, invariant)
+    }
+}
+
+// Apply an event to the LineState and check the continuous Invariants against it
+func (checker *Checker) update(event string, apply func(state *LineState)) {
+    if checker == nil {
+        return
+    }
+    checker.mutex.Lock()
+    defer checker.mutex.Unlock()
+    apply(&checker.state)
+    checker.check(event, checker.continuous)
+}
+
+func (checker *Checker) check(event string, invariants []Invariant) {
+    for _, invariant := range invariants {
+        if err := invariant.Check(checker.state); err != nil {
+            checker.violations = append(checker.violations,
+                fmt.Sprintf("invariant %s violated after %s: %s [state %+v]", invariant.Name(), event, err, checker.state))
+        }
+    }
+}
+
+func (checker *Checker) produced() {
+    checker.update("produce", func(state *LineState) { state.NumProduced++ })
+}
+
+func (checker *Checker) consumed() {
+    checker.update("consume", func(state *LineState) {
+        state.NumConsumed++
+        if state.Stopped {
+            state.NumConsumedAfterStop++
+        }
+    })
+}
+
+func (checker *Checker) filtered() {
+    checker.update("filter", func(state *LineState) { state.NumFiltered++ })
+}
+
+func (checker *Checker) transformed() {
+    checker.update("transform", func(state *LineState) { state.NumTransformed++ })
+}
+
+func (checker *Checker) derived() {
+    checker.update("derive", func(state *LineState) { state.NumDerived++ })
+}
+
+// Report a violation which is not about the LineState
+func (checker *Checker) illegal(violation string) {
+    if checker == nil {
+        return
+    }
+    checker.mutex.Lock()
+    defer checker.mutex.Unlock()
+    checker.violations = append(checker.violations, violation)
+}
+
+func (checker *Checker) stopped() {
+    checker.update("stop", func(state *LineState) { state.Stopped = true })
+}
+
+func (checker *Checker) interrupted() {
+    checker.update("interrupt", func(state *LineState) { state.Interrupted = true })
+}
+
+// Check the final Invariants and return every violation of the run
+func (checker *Checker) finish() []string {
+    if checker == nil {
+        return nil
+    }
+    checker.mutex.Lock()
+    defer checker.mutex.Unlock()
+    checker.check("end of run", checker.final)
+    return checker.violations
+}
@@ -0,0 +1,184 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/ledger.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+    "sync"
+    "os"
+    "encoding/csv"
+    "bufio"
+)
+
+// WidgetLedger writes a WidgetRecord for every Widget reaching a final state, to a file of one JSON object per line for
+// report widgets to query once the run is done, and to a CSV file of one row per Widget for spreadsheets and data
+// frames. Widgets still on the line when it stops are left out
+// A nil WidgetLedger writes nothing
+type WidgetLedger struct {
+    env         *environment
+    mutex       sync.Mutex
+    fileNames   []string
+    files       []*os.File
+    writer      *bufio.Writer   // Of the JSON lines, nil without them
+    csv         *csv.Writer     // Of the CSV rows, nil without them
+    numRecords  int
+    err         error           // Of the first write which failed, nothing is written after it
+}
+
+// The header of the CSV rows
+var ledgerCsvHeader = []string{"id", "producer", "consumer", "status", "created_at", "started_at", "consumed_at", "queue_latency_seconds",
+    "latency_seconds", "broken", "defective", "cause"}
+
+// WidgetRecord is a Widget of the ledger, the consumer and times of its consume are left out for a Widget no consumer took
+type WidgetRecord struct {
+    Id          string      `json:"id"`
+    Source      string      `json:"source"`
+    State       string      `json:"state"`
+    Consumer    string      `json:"consumer,omitempty"`
+    Produced    time.Time   `json:"produced"`
+    Started     time.Time   `json:"started,omitzero"`     // The consume started, the Widget was queued until then
+    Consumed    time.Time   `json:"consumed,omitzero"`
+    Broken      bool        `json:"broken,omitempty"`
+    Defective   bool        `json:"defective,omitempty"`
+    Cause       string      `json:"cause,omitempty"`
+}
+
+// The ledger writing the JSON lines to fileName and the CSV rows to csvFileName, either one may be left empty
+func newWidgetLedger(env *environment, fileName string, csvFileName string) (*WidgetLedger, error) {
+    ledger := &WidgetLedger{env: env}
+    for _, name := range []string{fileName, csvFileName} {
+        if name == "" {
+            continue
+        }
+        file, err := os.Create(name)
+        if err != nil {
+            ledger.close()
+            return nil, err
+        }
+        ledger.fileNames, ledger.files = append(ledger.fileNames, name), append(ledger.files, file)
+        if name == fileName {
+            ledger.writer = bufio.NewWriter(file)
+        } else {
+            ledger.csv = csv.NewWriter(file)
+            ledger.csv.Write(ledgerCsvHeader)
+        }
+    }
+    return ledger, nil
+}
+
+func (ledger *WidgetLedger) consumed(consumer string, wid Widget, state string, timeStart time.Time) {
+    if ledger == nil {
+        return
+    }
+    ledger.write(WidgetRecord{wid.id, wid.source, state, consumer, wid.time, timeStart, ledger.env.now(), wid.broken, wid.defective, wid.cause})
+}
+
+func (ledger *WidgetLedger) left(wid Widget, state string) {
+    if ledger == nil {
+        return
+    }
+    ledger.write(WidgetRecord{Id: wid.id, Source: wid.source, State: state, Produced: wid.time, Broken: wid.broken, Defective: wid.defective,
+        Cause: wid.cause})
+}
+
+func (ledger *WidgetLedger) write(record WidgetRecord) {
+    ledger.mutex.Lock()
+    defer ledger.mutex.Unlock()
+    if ledger.err != nil {
+        return
+    }
+    if ledger.writer != nil {
+        data, err := ledger.env.services.Codec.Marshal(record)
+        if err == nil {
+            _, err = ledger.writer.Write(append(data, '\n'))
+        }
+        if err != nil {
+            ledger.err = err
+            return
+        }
+    }
+    if ledger.csv != nil {
+        if err := ledger.csv.Write(record.row()); err != nil {
+            ledger.err = err
+            return
+        }
+    }
+    ledger.numRecords++
+}
+
+// The CSV row of the record, the times and latencies of its consume are left empty for a Widget no consumer took
+func (record WidgetRecord) row() []string {
+    started, consumed, wait, latency := "", "", "", ""
+    if !record.Consumed.IsZero() {
+        started, consumed = record.Started.Format(time.RFC3339Nano), record.Consumed.Format(time.RFC3339Nano)
+        wait = strconv.FormatFloat(record.Started.Sub(record.Produced).Seconds(), 'f', 6, 64)
+        latency = strconv.FormatFloat(record.Consumed.Sub(record.Produced).Seconds(), 'f', 6, 64)
+    }
+    return []string{record.Id, record.Source, record.Consumer, record.State, record.Produced.Format(time.RFC3339Nano), started, consumed, wait,
+        latency, strconv.FormatBool(record.Broken), strconv.FormatBool(record.Defective), record.Cause}
+}
+
+func (ledger *WidgetLedger) close() {
+    if ledger == nil {
+        return
+    }
+    ledger.mutex.Lock()
+    defer ledger.mutex.Unlock()
+    if ledger.writer != nil {
+        if err := ledger.writer.Flush(); ledger.err == nil {
+            ledger.err = err
+        }
+    }
+    if ledger.csv != nil {
+        ledger.csv.Flush()
+        if err := ledger.csv.Error(); ledger.err == nil {
+            ledger.err = err
+        }
+    }
+    for _, file := range ledger.files {
+        if err := file.Close(); ledger.err == nil {
+            ledger.err = err
+        }
+    }
+}
+
+func (ledger *WidgetLedger) report(out io.Writer) {
+    if ledger == nil {
+        return
+    }
+    ledger.mutex.Lock()
+    defer ledger.mutex.Unlock()
+    fileNames := strings.Join(ledger.fileNames, " and ")
+    if ledger.err != nil {
+        fmt.Fprintf(out, "Ledger: writing %s failed after [ %d ] widgets: %s\n", fileNames, ledger.numRecords, ledger.err)
+        return
+    }
+    fmt.Fprintf(out, "Ledger: [ %d ] widgets written to %s\n", ledger.numRecords, fileNames)
+}
+
+func ReadWidgetLedger(fileName string) ([]WidgetRecord, error) {
+    services := DefaultServices()
+    data, err := services.Store.ReadFile(fileName)
+    if err != nil {
+        return nil, err
+    }
+    var records []WidgetRecord
+    for i, line := range strings.Split(string(data), "\n") {
+        if strings.TrimSpace(line) == "" {
+            continue
+        }
+        var record WidgetRecord
+        if err := services.Codec.Unmarshal([]byte(line), &record); err != nil {
+            return nil, fmt.Errorf("%s line %d: %s", fileName, i + 1, err)
+        }
+        records = append(records, record)
+    }
+    return records, nil
+}
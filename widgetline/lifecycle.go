@@ -0,0 +1,139 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/lifecycle.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "sort"
+)
+
+// States of the lifecycle of a Widget, all but created and queued are final
+const STATE_CREATED = "created"
+const STATE_QUEUED = "queued"
+const STATE_CONSUMED = "consumed"
+const STATE_SCRAPPED = "scrapped"          // Broken or defective, found by a consumer
+const STATE_QUARANTINED = "quarantined"    // Diverted by the filter
+const STATE_DROPPED = "dropped"            // Dropped by the filter, shed by a full queue or over quota
+const STATE_REJECTED = "rejected"          // Malformed, found by the Validator before it was queued
+const STATE_TRANSFORMED = "transformed"    // Replaced by the Widgets the Transformer derived from it
+const STATE_DISCARDED = "discarded"        // Broken beyond repair, found by the Inspector
+const STATE_SENT = "sent"                  // Handed to the consuming process of a distributed line
+const STATE_DEAD_LETTERED = "dead-lettered" // Failed every consume attempt, taken off the line by the dead-letter channel
+
+// The states a Widget may move to from every state, a Widget which is not on the line yet has no state
+var transitions = map[string][]string{
+    "":             {STATE_CREATED},
+    STATE_CREATED:  {STATE_QUEUED, STATE_REJECTED},
+    STATE_QUEUED:   {STATE_CONSUMED, STATE_SCRAPPED, STATE_QUARANTINED, STATE_DROPPED, STATE_TRANSFORMED, STATE_DISCARDED, STATE_SENT,
+        STATE_DEAD_LETTERED},
+}
+
+// Lifecycle follows every Widget through its states, a transition missing from the transitions is reported to the Checker
+// Widgets are forgotten once in a final state, a nil Lifecycle follows nothing
+type Lifecycle struct {
+    mutex   sync.Mutex
+    states  map[string]string   // State of every Widget on the line, by id
+    queued  map[string]time.Time    // When every Widget queued was produced, by id, only kept for a Board
+    counts  map[string]int      // Widgets in every state, final ones included
+    quotas  *Quotas             // Given back the room of every Widget leaving the queued state
+    kanban  *Kanban             // Given back the card of every Widget reaching a final state
+    audit   *JobAudit           // Told of every Widget reaching a consumer
+    ledger  *WidgetLedger       // Told of every Widget reaching a final state without a consumer
+    tracer  *Tracer             // Told of every Widget queued, and of every one reaching a final state without a consumer
+    checker *Checker
+}
+
+func newLifecycle(checker *Checker) *Lifecycle {
+    return &Lifecycle{states: make(map[string]string), counts: make(map[string]int), checker: checker}
+}
+
+func (lifecycle *Lifecycle) move(wid Widget, to string) {
+    if lifecycle == nil {
+        return
+    }
+    lifecycle.mutex.Lock()
+    defer lifecycle.mutex.Unlock()
+    from := lifecycle.states[wid.id]
+    legal := false
+    for _, state := range transitions[from] {
+        legal = legal || state == to
+    }
+    if !legal {
+        if from == "" {
+            from = "nothing"
+        }
+        lifecycle.checker.illegal(fmt.Sprintf("illegal transition of widget %s from %s to %s", wid.id, from, to))
+        return
+    }
+
+    if from != "" {
+        lifecycle.counts[from]--
+    }
+    lifecycle.counts[to]++
+    if from == STATE_QUEUED {
+        lifecycle.quotas.release(wid)
+        delete(lifecycle.queued, wid.id)
+    }
+    if to == STATE_QUEUED {
+        lifecycle.tracer.enqueued(wid)
+        if lifecycle.queued != nil {
+            lifecycle.queued[wid.id] = wid.time
+        }
+    }
+    if (to == STATE_CONSUMED || to == STATE_SCRAPPED) {
+        lifecycle.audit.consumed(wid)
+    }
+    if (len(transitions[to]) == 0 && to != STATE_CONSUMED && to != STATE_SCRAPPED) {
+        lifecycle.ledger.left(wid, to)
+        lifecycle.tracer.left(wid, to)
+    }
+    if len(transitions[to]) == 0 {
+        lifecycle.kanban.left(wid)
+        delete(lifecycle.states, wid.id)
+    } else {
+        lifecycle.states[wid.id] = to
+    }
+}
+
+// Keep the Widgets queued from now on, so a Board can tell which they are
+func (lifecycle *Lifecycle) keepQueued() {
+    lifecycle.mutex.Lock()
+    defer lifecycle.mutex.Unlock()
+    lifecycle.queued = make(map[string]time.Time)
+}
+
+// The oldest Widgets queued at timeNow, at most limit of them, oldest first
+func (lifecycle *Lifecycle) oldestQueued(timeNow time.Time, limit int) []QueuedWidget {
+    lifecycle.mutex.Lock()
+    defer lifecycle.mutex.Unlock()
+    widgets := make([]QueuedWidget, 0, len(lifecycle.queued))
+    for id, timeProduced := range lifecycle.queued {
+        widgets = append(widgets, QueuedWidget{id, timeNow.Sub(timeProduced)})
+    }
+    sort.Slice(widgets, func(i, j int) bool {
+        if widgets[i].Age != widgets[j].Age {
+            return widgets[i].Age > widgets[j].Age
+        }
+        return widgets[i].Id < widgets[j].Id
+    })
+    return widgets[:min(len(widgets), limit)]
+}
+
+// Number of Widgets in every state so far
+func (lifecycle *Lifecycle) census() map[string]int {
+    if lifecycle == nil {
+        return nil
+    }
+    lifecycle.mutex.Lock()
+    defer lifecycle.mutex.Unlock()
+    counts := make(map[string]int, len(lifecycle.counts))
+    for state, count := range lifecycle.counts {
+        counts[state] = count
+    }
+    return counts
+}
@@ -0,0 +1,233 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/maintenance.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "math/rand"
+    "sync"
+)
+
+const SIMULATED_CYCLE = 100 * time.Microsecond   // Cycle time of the machines of a deterministic line without an ideal cycle time
+
+// Maintenance models breakdowns of the Producers' machines and the limited repair crews fixing them
+// The machines of a deterministic line run on a simulated clock, moved on by a cycle with every Widget and by the repair
+// time with every repair, so their breakdowns come after the same Widgets on every run
+type Maintenance struct {
+    env         *environment
+    mtbf        DurationList    // Mean time between random breakdowns per Producer, 0 for none
+    mttr        DurationList    // Mean time to repair per Producer
+    every       int             // Scheduled maintenance after every this many Widgets per Producer, 0 for none
+    idealCycle  DurationList    // Ideal cycle time per Producer, 0 for the fastest cycle of its machine
+    simulated   bool            // Of a deterministic line
+    crewChannel chan struct{}   // Holds one token per repair crew at work
+    mutex       sync.Mutex
+    machines    []*Machine      // Machines that quit working, in order
+}
+
+func newMaintenance(env *environment, mtbf DurationList, mttr DurationList, every int, idealCycle DurationList, numCrews int, simulated bool) *Maintenance {
+    return &Maintenance{env: env, mtbf: mtbf, mttr: mttr, every: every, idealCycle: idealCycle, simulated: simulated, crewChannel: make(chan struct{}, numCrews)}
+}
+
+// The machine of the ith Producer, nil when there is no maintenance
+func (maintenance *Maintenance) machine(i int, name string, source *rand.Rand) *Machine {
+    if maintenance == nil {
+        return nil
+    }
+    machine := &Machine{name: name, mtbf: maintenance.mtbf.at(i), mttr: maintenance.mttr.at(i), idealCycle: maintenance.idealCycle.at(i),
+        maintenance: maintenance, random: source}
+    if maintenance.simulated {
+        machine.simulatedNow = maintenance.env.now()
+        if machine.idealCycle == 0 {
+            machine.idealCycle = SIMULATED_CYCLE
+        }
+    }
+    machine.start()
+    return machine
+}
+
+func (maintenance *Maintenance) report(out io.Writer) {
+    if maintenance == nil {
+        return
+    }
+    var upTime, downTime, idealTime time.Duration
+    numProduced, numBroken := 0, 0
+    for _, machine := range maintenance.machines {
+        fmt.Fprintf(out, "%s availability [ %.2f%% ] performance [ %.2f%% ] with %d breakdowns and %d scheduled maintenances\n",
+            machine.name, 100 * machine.availability(), 100 * machine.performance(), machine.numBreakdowns, machine.numMaintenances)
+        upTime += machine.upTime
+        downTime += machine.downTime
+        idealTime += min(machine.ideal() * time.Duration(machine.numProduced), machine.upTime)
+        numProduced += machine.numProduced
+        numBroken += machine.numBroken
+    }
+    availability, performance, quality := 1.0, 1.0, 1.0
+    if (upTime + downTime > 0) {
+        availability = float64(upTime) / float64(upTime + downTime)
+    }
+    // Performance is the time the Widgets would have taken at the ideal cycle time over the time the machines were up
+    if (upTime > 0) {
+        performance = float64(idealTime) / float64(upTime)
+    }
+    if (numProduced > 0) {
+        quality = float64(numProduced - numBroken) / float64(numProduced)
+    }
+    fmt.Fprintf(out, "The line availability [ %.2f%% ] OEE [ %.2f%% ] (availability %.2f%% performance %.2f%% quality %.2f%%)\n",
+        100 * availability, 100 * availability * performance * quality, 100 * availability, 100 * performance, 100 * quality)
+}
+
+// Machine keeps track of the up and down time of a single Producer, a nil Machine never breaks down
+type Machine struct {
+    name            string
+    mtbf            time.Duration
+    mttr            time.Duration
+    idealCycle      time.Duration   // 0 for the fastest cycle
+    maintenance     *Maintenance
+    upSince         time.Time
+    cycleStart      time.Time       // When the Widget being produced was started
+    fastestCycle    time.Duration
+    simulatedNow    time.Time       // The time of the machine of a deterministic line
+    nextBreakdown   time.Time
+    upTime          time.Duration
+    downTime        time.Duration
+    numProduced     int
+    numBroken       int
+    numBreakdowns   int
+    numMaintenances int
+    random          *rand.Rand      // The one of its Producer
+}
+
+// The time of the machine, the one of the line unless it is simulated
+func (machine *Machine) now() time.Time {
+    if machine.maintenance.simulated {
+        return machine.simulatedNow
+    }
+    return machine.maintenance.env.now()
+}
+
+func (machine *Machine) since(t time.Time) time.Duration {
+    return machine.now().Sub(t)
+}
+
+func (machine *Machine) start() {
+    machine.upSince = machine.now()
+    if machine.mtbf > 0 {
+        machine.nextBreakdown = machine.upSince.Add(time.Duration(machine.random.ExpFloat64() * float64(machine.mtbf)))
+    }
+}
+
+// Called before every Widget is produced, the machine is repaired first if it has broken down by now
+// Reports false when the line quit while the machine was down
+func (machine *Machine) operate(quitChannel <-chan struct{}) bool {
+    if machine == nil {
+        return true
+    }
+    if (machine.mtbf > 0 && !machine.now().Before(machine.nextBreakdown)) {
+        machine.numBreakdowns++
+        if !machine.repair(MSG_BREAKDOWN, quitChannel) {
+            return false
+        }
+    }
+    machine.cycleStart = machine.now()
+    return true
+}
+
+// Called after every Widget is produced, the machine goes through its scheduled maintenance when it is due
+// Reports false when the line quit while the machine was down
+func (machine *Machine) produced(bad bool, quitChannel <-chan struct{}) bool {
+    if machine == nil {
+        return true
+    }
+    if machine.maintenance.simulated {
+        machine.simulatedNow = machine.simulatedNow.Add(machine.idealCycle)
+    }
+    if cycle := machine.since(machine.cycleStart); (machine.numProduced == 0 || cycle < machine.fastestCycle) {
+        machine.fastestCycle = cycle
+    }
+    machine.numProduced++
+    if bad {
+        machine.numBroken++
+    }
+    if (machine.maintenance.every > 0 && machine.numProduced % machine.maintenance.every == 0) {
+        machine.numMaintenances++
+        return machine.repair(MSG_MAINTENANCE, quitChannel)
+    }
+    return true
+}
+
+// The machine is down until a repair crew is free and done fixing it, or the line quits, reporting whether it was repaired
+func (machine *Machine) repair(reason string, quitChannel <-chan struct{}) bool {
+    timeDown := machine.now()
+    machine.upTime += timeDown.Sub(machine.upSince)
+    machine.maintenance.env.logEvent(reason, machine.name)
+    // The time down until the line quit counts, stop adds nothing to the time up after it
+    quit := func() bool {
+        machine.downTime += machine.since(timeDown)
+        machine.upSince = machine.now()
+        return false
+    }
+
+    repairTime := time.Duration(machine.random.ExpFloat64() * float64(machine.mttr))
+    // A deterministic line runs one step at a time, so its crews are always free and the repair takes no time of its own
+    if machine.maintenance.simulated {
+        machine.simulatedNow = machine.simulatedNow.Add(repairTime)
+    } else {
+        select {
+        case machine.maintenance.crewChannel <- struct{}{}:
+        case <-quitChannel:
+            return quit()
+        }
+        timer := time.NewTimer(repairTime)
+        defer timer.Stop()
+        select {
+        case <-timer.C:
+            <-machine.maintenance.crewChannel
+        case <-quitChannel:
+            <-machine.maintenance.crewChannel
+            return quit()
+        }
+    }
+
+    machine.downTime += machine.since(timeDown)
+    machine.maintenance.env.logEvent(MSG_REPAIRED, machine.name, machine.since(timeDown))
+    machine.start()
+    return true
+}
+
+// Called once the Producer quits working
+func (machine *Machine) stop() {
+    if machine == nil {
+        return
+    }
+    machine.upTime += machine.since(machine.upSince)
+    machine.maintenance.mutex.Lock()
+    defer machine.maintenance.mutex.Unlock()
+    machine.maintenance.machines = append(machine.maintenance.machines, machine)
+}
+
+// The ideal cycle time of the machine, its fastest cycle unless one was set
+func (machine *Machine) ideal() time.Duration {
+    if machine.idealCycle > 0 {
+        return machine.idealCycle
+    }
+    return machine.fastestCycle
+}
+
+func (machine *Machine) performance() float64 {
+    if machine.upTime == 0 {
+        return 1
+    }
+    return min(1, float64(machine.ideal() * time.Duration(machine.numProduced)) / float64(machine.upTime))
+}
+
+func (machine *Machine) availability() float64 {
+    if (machine.upTime + machine.downTime == 0) {
+        return 1
+    }
+    return float64(machine.upTime) / float64(machine.upTime + machine.downTime)
+}
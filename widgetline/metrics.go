@@ -0,0 +1,126 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/metrics.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "strconv"
+    "sync"
+    "net"
+    "net/http"
+    "sort"
+)
+
+// Upper bounds of the buckets of the consume latency histogram, in seconds
+var metricsBuckets = []float64{0.00001, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// The counts the recorder makes, under the name and help they are served with
+var metricsCounters = []struct{ count, name, help string }{
+    {"produced", "widgets_produced_total", "Widgets produced."},
+    {"consumed", "widgets_consumed_total", "Widgets consumed, good or not."},
+    {"broken", "broken_widgets_total", "Broken widgets consumed."},
+    {"failed", "failed_widgets_total", "Defective or broken widgets consumed."},
+    {"rejected", "rejected_widgets_total", "Widgets rejected at production."},
+}
+
+// MetricsEndpoint serves the counters of the line in the Prometheus text format on GET /metrics, along with the queue
+// depth and a histogram of the consume latency, for a scraper to follow a long run
+// A nil MetricsEndpoint serves nothing
+type MetricsEndpoint struct {
+    mutex       sync.Mutex
+    counts      map[string]int
+    buckets     []int           // Latencies up to every bound of metricsBuckets, not cumulated
+    numLatencies int
+    sumLatency  float64
+    numScrapes  int
+    lifecycle   *Lifecycle      // Counts the Widgets queued
+    listener    net.Listener
+    server      *http.Server
+}
+
+func newMetricsEndpoint(address string) (*MetricsEndpoint, error) {
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        return nil, err
+    }
+    endpoint := &MetricsEndpoint{counts: make(map[string]int), buckets: make([]int, len(metricsBuckets)), listener: listener}
+    mux := http.NewServeMux()
+    mux.HandleFunc("GET /metrics", endpoint.serveMetrics)
+    endpoint.server = &http.Server{Handler: mux}
+    return endpoint, nil
+}
+
+// Start serving once the lifecycle to take the queue depth from is there, scrapes wait on the listener until then
+func (endpoint *MetricsEndpoint) serve(lifecycle *Lifecycle, out io.Writer) {
+    if endpoint == nil {
+        return
+    }
+    endpoint.lifecycle = lifecycle
+    go endpoint.server.Serve(endpoint.listener)
+    fmt.Fprintf(out, "[metrics] served on http://%s/metrics\n", endpoint.listener.Addr())
+}
+
+// Counted by the recorder of the line, as the Metrics of its services are
+func (endpoint *MetricsEndpoint) Count(name string, delta int) {
+    if endpoint == nil {
+        return
+    }
+    endpoint.mutex.Lock()
+    defer endpoint.mutex.Unlock()
+    endpoint.counts[name] += delta
+}
+
+// Only the consume latency is served
+func (endpoint *MetricsEndpoint) Observe(name string, value float64) {
+    if (endpoint == nil || name != "latency_seconds") {
+        return
+    }
+    endpoint.mutex.Lock()
+    defer endpoint.mutex.Unlock()
+    if i := sort.SearchFloat64s(metricsBuckets, value); i < len(metricsBuckets) {
+        endpoint.buckets[i]++
+    }
+    endpoint.numLatencies++
+    endpoint.sumLatency += value
+}
+
+func (endpoint *MetricsEndpoint) serveMetrics(writer http.ResponseWriter, request *http.Request) {
+    depth := endpoint.lifecycle.census()[STATE_QUEUED]
+    endpoint.mutex.Lock()
+    defer endpoint.mutex.Unlock()
+    endpoint.numScrapes++
+    writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    for _, counter := range metricsCounters {
+        fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", counter.name, counter.help, counter.name, counter.name, endpoint.counts[counter.count])
+    }
+    fmt.Fprintf(writer, "# HELP queue_depth Widgets produced and waiting to be consumed.\n# TYPE queue_depth gauge\nqueue_depth %d\n", depth)
+    fmt.Fprintf(writer, "# HELP consume_latency_seconds Time from the production of a widget to its consume.\n# TYPE consume_latency_seconds histogram\n")
+    cumulated := 0
+    for i, bound := range metricsBuckets {
+        cumulated += endpoint.buckets[i]
+        fmt.Fprintf(writer, "consume_latency_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), cumulated)
+    }
+    fmt.Fprintf(writer, "consume_latency_seconds_bucket{le=\"+Inf\"} %d\n", endpoint.numLatencies)
+    fmt.Fprintf(writer, "consume_latency_seconds_sum %s\nconsume_latency_seconds_count %d\n", strconv.FormatFloat(endpoint.sumLatency, 'g', -1, 64), endpoint.numLatencies)
+}
+
+// Stop serving, the last scrape misses the end of the run
+func (endpoint *MetricsEndpoint) close() {
+    if endpoint == nil {
+        return
+    }
+    endpoint.server.Close()
+}
+
+func (endpoint *MetricsEndpoint) report(out io.Writer) {
+    if endpoint == nil {
+        return
+    }
+    endpoint.mutex.Lock()
+    defer endpoint.mutex.Unlock()
+    fmt.Fprintf(out, "[metrics on %s] scraped [ %d ] times\n", endpoint.listener.Addr(), endpoint.numScrapes)
+}
@@ -0,0 +1,434 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/monitors.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "bytes"
+    "strconv"
+    "strings"
+    "sync"
+    "os"
+    "net/http"
+    "math"
+)
+
+const END_CHECK_EVERY = 5 * time.Millisecond
+const STEADY_SLICES = 5
+
+//==============================================================================
+// ThroughputMonitor raises an alert whenever consumption throughput drops by more than a fraction from one window to the next
+type ThroughputMonitor struct {
+    env         *environment
+    drop        float64         // Fraction of the previous window's throughput, e.g. 0.5 for a 50% drop
+    window      time.Duration
+    webhook     string          // Alerts are also posted here as JSON when not empty
+    client      *http.Client
+    recorder    *Recorder
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+}
+
+// Alert is what gets posted to the webhook
+type Alert struct {
+    Event       string  `json:"event"`
+    Time        string  `json:"time"`
+    Window      string  `json:"window"`
+    Drop        float64 `json:"drop"`
+    Previous    float64 `json:"previous_per_second"`
+    Current     float64 `json:"current_per_second"`
+}
+
+func newThroughputMonitor(env *environment, drop float64, window time.Duration, webhook string, recorder *Recorder) *ThroughputMonitor {
+    return &ThroughputMonitor{env, drop, window, webhook, &http.Client{Transport: env.services.Transport, Timeout: 5 * time.Second}, recorder, make(chan struct{}), make(chan struct{})}
+}
+
+// Watch the throughput until stop is called
+func (monitor *ThroughputMonitor) watch() {
+    defer close(monitor.doneChannel)
+    ticker := time.NewTicker(monitor.window)
+    defer ticker.Stop()
+    lastConsumed, lastThroughput := monitor.recorder.consumedSoFar(), 0.0
+
+    for {
+        select {
+        case <-ticker.C:
+            numConsumed := monitor.recorder.consumedSoFar()
+            throughput := float64(numConsumed - lastConsumed) / monitor.window.Seconds()
+            if (lastThroughput > 0 && (lastThroughput - throughput) / lastThroughput > monitor.drop) {
+                monitor.alert(lastThroughput, throughput)
+            }
+            lastConsumed, lastThroughput = numConsumed, throughput
+        case <-monitor.stopChannel:
+            return
+        }
+    }
+}
+
+func (monitor *ThroughputMonitor) alert(previous float64, current float64) {
+    alert := Alert{"throughput_collapse", monitor.env.now().Format(TIME_FORMAT), monitor.window.String(), (previous - current) / previous, previous, current}
+    monitor.env.logEvent(MSG_ALERT, 100 * alert.Drop, alert.Window, previous, current)
+    if monitor.webhook == "" {
+        return
+    }
+    data, _ := monitor.env.services.Codec.Marshal(alert)
+    response, err := monitor.client.Post(monitor.webhook, "application/json", bytes.NewReader(data))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "throughput alert failed to reach its webhook: %s\n", err)
+        return
+    }
+    response.Body.Close()
+}
+
+// Stop watching and wait for the monitor to quit
+func (monitor *ThroughputMonitor) stop() {
+    if monitor == nil {
+        return
+    }
+    close(monitor.stopChannel)
+    <-monitor.doneChannel
+    monitor.client.CloseIdleConnections()
+}
+
+//==============================================================================
+// Rollup prints a report of the line every so often, so long running lines can be followed without the per widget lines
+type Rollup struct {
+    env         *environment
+    every       time.Duration
+    recorder    *Recorder
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+}
+
+func newRollup(env *environment, every time.Duration, recorder *Recorder) *Rollup {
+    return &Rollup{env, every, recorder, make(chan struct{}), make(chan struct{})}
+}
+
+// Report every period until stop is called
+func (rollup *Rollup) watch() {
+    defer close(rollup.doneChannel)
+    ticker := time.NewTicker(rollup.every)
+    defer ticker.Stop()
+    timeBegin := rollup.env.now()
+    lastProduced, lastConsumed, lastLatency := rollup.recorder.counters()
+
+    for {
+        select {
+        case timeEnd := <-ticker.C:
+            numProduced, numConsumed, totalLatency := rollup.recorder.counters()
+            meanLatency := time.Duration(0)
+            if (numConsumed > lastConsumed) {
+                meanLatency = (totalLatency - lastLatency) / time.Duration(numConsumed - lastConsumed)
+            }
+            fmt.Fprintf(rollup.env.services.Report, "[rollup %s - %s] produced [ %d ] consumed [ %d ] throughput [ %.1f/s ] mean latency [ %s ] total consumed [ %d ]\n",
+                timeBegin.Format(TIME_FORMAT), timeEnd.Format(TIME_FORMAT), numProduced - lastProduced, numConsumed - lastConsumed,
+                float64(numConsumed - lastConsumed) / timeEnd.Sub(timeBegin).Seconds(), meanLatency, numConsumed)
+            timeBegin, lastProduced, lastConsumed, lastLatency = timeEnd, numProduced, numConsumed, totalLatency
+        case <-rollup.stopChannel:
+            return
+        }
+    }
+}
+
+// Stop reporting and wait for the rollup to quit
+func (rollup *Rollup) stop() {
+    if rollup == nil {
+        return
+    }
+    close(rollup.stopChannel)
+    <-rollup.doneChannel
+}
+
+//==============================================================================
+// Steadiness tells when the throughput has held within tolerance of its mean for a whole window
+// The window is cut in STEADY_SLICES, the throughput over every one of the last slices must be within tolerance
+type Steadiness struct {
+    tolerance   float64         // Fraction of the mean throughput, e.g. 0.05 for 5%
+    window      time.Duration
+    samples     []float64       // Throughput over the last slices of the window
+    timeSample  time.Time
+    lastConsumed int
+}
+
+// Steadiness looks like <percent>%/<duration>, e.g. 5%/2s
+func parseSteadiness(spec string) (*Steadiness, error) {
+    tolerance, window, found := strings.Cut(spec, "/")
+    percent, err := strconv.ParseFloat(strings.TrimSuffix(tolerance, "%"), 64)
+    if (!found || !strings.HasSuffix(tolerance, "%") || err != nil || percent <= 0) {
+        return nil, fmt.Errorf("steadiness %q is not of the form <percent>%%/<duration>", spec)
+    }
+    duration, err := time.ParseDuration(window)
+    if (err != nil || duration <= 0) {
+        return nil, fmt.Errorf("steadiness %q must hold for a positive duration", spec)
+    }
+    return &Steadiness{tolerance: percent / 100, window: duration}, nil
+}
+
+// Take a sample once a slice of the window has gone by, reporting whether the throughput is steady
+func (steadiness *Steadiness) sample(numConsumed int, timeNow time.Time) bool {
+    if timeNow.Sub(steadiness.timeSample) < steadiness.window / STEADY_SLICES {
+        return false
+    }
+    steadiness.samples = append(steadiness.samples, float64(numConsumed - steadiness.lastConsumed) / timeNow.Sub(steadiness.timeSample).Seconds())
+    steadiness.timeSample, steadiness.lastConsumed = timeNow, numConsumed
+    if len(steadiness.samples) > STEADY_SLICES {
+        steadiness.samples = steadiness.samples[1:]
+    }
+    if len(steadiness.samples) < STEADY_SLICES {
+        return false
+    }
+    mean := 0.0
+    for _, sample := range steadiness.samples {
+        mean += sample / STEADY_SLICES
+    }
+    for _, sample := range steadiness.samples {
+        if (mean == 0 || math.Abs(sample - mean) > steadiness.tolerance * mean) {
+            return false
+        }
+    }
+    return true
+}
+
+//==============================================================================
+// SteadyDetector restricts the statistics of the run to its steady state, from the moment the throughput is steady on
+// The Widgets consumed until then make up the transient phase, a nil SteadyDetector leaves the statistics alone
+type SteadyDetector struct {
+    env         *environment
+    steadiness  *Steadiness
+    recorder    *Recorder
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+}
+
+func newSteadyDetector(env *environment, spec string, recorder *Recorder) (*SteadyDetector, error) {
+    steadiness, err := parseSteadiness(spec)
+    if err != nil {
+        return nil, err
+    }
+    steadiness.timeSample = env.now()
+    recorder.settling = true
+    return &SteadyDetector{env, steadiness, recorder, make(chan struct{}), make(chan struct{})}, nil
+}
+
+// Sample the throughput until it is steady or stop is called
+func (detector *SteadyDetector) watch() {
+    defer close(detector.doneChannel)
+    ticker := time.NewTicker(END_CHECK_EVERY)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case timeNow := <-ticker.C:
+            if detector.steadiness.sample(detector.recorder.consumedSoFar(), timeNow) {
+                detector.env.logEvent(MSG_STEADY, detector.recorder.settle().String())
+                return
+            }
+        case <-detector.stopChannel:
+            return
+        }
+    }
+}
+
+// Stop watching and wait for the detector to quit
+func (detector *SteadyDetector) stop() {
+    if detector == nil {
+        return
+    }
+    close(detector.stopChannel)
+    <-detector.doneChannel
+}
+
+//==============================================================================
+// EndCondition ends a run on something else than its number of Widgets
+type EndCondition struct {
+    spec        string
+    kind        string          // good, broken, profit or steady
+    target      float64         // Widgets or profit to reach
+    steadiness  *Steadiness     // steady only
+}
+
+// Conditions look like good=<n>, broken=<n>, profit=<amount> or steady=<percent>%/<duration>, e.g. steady=5%/2s
+func parseEndCondition(spec string) (*EndCondition, error) {
+    condition := &EndCondition{spec: spec}
+    kind, value, found := strings.Cut(spec, "=")
+    if !found {
+        return nil, fmt.Errorf("end condition %q is not of the form good|broken=<n>, profit=<amount> or steady=<percent>%%/<duration>", spec)
+    }
+    condition.kind = kind
+    switch kind {
+    case "good", "broken":
+        count, err := strconv.Atoi(value)
+        if (err != nil || count < 1) {
+            return nil, fmt.Errorf("end condition %q must count at least 1 Widget", spec)
+        }
+        condition.target = float64(count)
+    case "profit":
+        amount, err := strconv.ParseFloat(value, 64)
+        if (err != nil || amount <= 0) {
+            return nil, fmt.Errorf("end condition %q must be a positive amount", spec)
+        }
+        condition.target = amount
+    case "steady":
+        steadiness, err := parseSteadiness(value)
+        if err != nil {
+            return nil, fmt.Errorf("end condition %q: %s", spec, err)
+        }
+        condition.steadiness = steadiness
+    default:
+        return nil, fmt.Errorf("end condition %q is not of the form good|broken=<n>, profit=<amount> or steady=<percent>%%/<duration>", spec)
+    }
+    return condition, nil
+}
+
+// endList is a repeatable flag collecting end conditions
+type EndList []string
+
+func (list *EndList) String() string {
+    return strings.Join(*list, " ")
+}
+
+func (list *EndList) Set(value string) error {
+    if _, err := parseEndCondition(value); err != nil {
+        return err
+    }
+    *list = append(*list, value)
+    return nil
+}
+
+// EndConditions end the run as soon as any of them is met, the line then stops as on a broken widget
+// Profit is what the good Widgets earned less what the others cost, the throughput is steady once it held within
+// tolerance of its mean over every slice of the window, a nil EndConditions never ends a run
+type EndConditions struct {
+    env         *environment
+    mutex       sync.Mutex
+    conditions  []*EndCondition
+    price       float64     // Earned per good Widget consumed
+    scrapCost   float64     // Lost per Widget consumed which is not good
+    numGood     int
+    numFailed   int
+    met         string      // The condition which ended the run
+    metChannel  chan struct{}
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+}
+
+func newEndConditions(env *environment, specs []string, price float64, scrapCost float64) (*EndConditions, error) {
+    ends := &EndConditions{env: env, price: price, scrapCost: scrapCost, metChannel: make(chan struct{}), stopChannel: make(chan struct{}), doneChannel: make(chan struct{})}
+    for _, spec := range specs {
+        condition, err := parseEndCondition(spec)
+        if err != nil {
+            return nil, err
+        }
+        ends.conditions = append(ends.conditions, condition)
+    }
+    return ends, nil
+}
+
+// Closed once a condition is met, never for a nil EndConditions
+func (ends *EndConditions) ended() <-chan struct{} {
+    if ends == nil {
+        return nil
+    }
+    return ends.metChannel
+}
+
+// Count a consumed Widget, the conditions on counts are checked right away so the line stops on the very Widget
+func (ends *EndConditions) consumed(wid Widget) {
+    if ends == nil {
+        return
+    }
+    ends.mutex.Lock()
+    defer ends.mutex.Unlock()
+    if wid.good() {
+        ends.numGood++
+    } else {
+        ends.numFailed++
+    }
+    for _, condition := range ends.conditions {
+        var reached bool
+        switch condition.kind {
+        case "good":
+            reached = float64(ends.numGood) >= condition.target
+        case "broken":
+            reached = float64(ends.numFailed) >= condition.target
+        case "profit":
+            reached = ends.profit() >= condition.target
+        }
+        if reached {
+            ends.end(condition)
+            return
+        }
+    }
+}
+
+func (ends *EndConditions) profit() float64 {
+    return ends.price * float64(ends.numGood) - ends.scrapCost * float64(ends.numFailed)
+}
+
+// End the run on condition unless it has already ended, the mutex must be held
+func (ends *EndConditions) end(condition *EndCondition) {
+    if ends.met != "" {
+        return
+    }
+    ends.met = condition.spec
+    ends.env.logEvent(MSG_END, condition.spec)
+    close(ends.metChannel)
+}
+
+// Sample the throughput for the steady conditions until the run ends or stop is called
+func (ends *EndConditions) watch() {
+    defer close(ends.doneChannel)
+    ticker := time.NewTicker(END_CHECK_EVERY)
+    defer ticker.Stop()
+    for _, condition := range ends.conditions {
+        if condition.steadiness != nil {
+            condition.steadiness.timeSample = ends.env.now()
+        }
+    }
+
+    for {
+        select {
+        case timeNow := <-ticker.C:
+            ends.mutex.Lock()
+            for _, condition := range ends.conditions {
+                if (condition.steadiness != nil && condition.steadiness.sample(ends.numGood + ends.numFailed, timeNow)) {
+                    ends.end(condition)
+                }
+            }
+            ends.mutex.Unlock()
+        case <-ends.metChannel:
+            return
+        case <-ends.stopChannel:
+            return
+        }
+    }
+}
+
+// Stop watching and wait for the watch to quit
+func (ends *EndConditions) stop() {
+    if ends == nil {
+        return
+    }
+    close(ends.stopChannel)
+    <-ends.doneChannel
+}
+
+func (ends *EndConditions) report(out io.Writer) {
+    if ends == nil {
+        return
+    }
+    met := ends.met
+    if met == "" {
+        met = "none"
+    }
+    specs := make([]string, len(ends.conditions))
+    for i, condition := range ends.conditions {
+        specs[i] = condition.spec
+    }
+    fmt.Fprintf(out, "[until %s] met [ %s ] good [ %d ] not good [ %d ] profit [ %.2f ]\n", strings.Join(specs, " or "), met, ends.numGood, ends.numFailed, ends.profit())
+}
@@ -0,0 +1,1133 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/pipeline.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "math/rand"
+    "bytes"
+    "strconv"
+    "sync"
+    "context"
+    "slices"
+)
+
+const SOAK_CAPACITY = 1024
+
+//=============================================================================
+// Run the whole line on the calling goroutine, one step of one worker at a time
+// Which worker takes the next step is picked by a random number generator seeded with seed, so the interleaving of a
+// run can be replayed exactly
+func scheduledLine(env *environment, producerTable []Producer, consumerTable []Consumer, filter *Filter, transformer *Transformer, packer *Packer, meter *EnergyMeter, firstJob int, numWidgets int, numKth int,
+    policy *StopPolicy, seed int64) {
+    scheduler := rand.New(rand.NewSource(seed))
+    timeBegin := env.now()
+    busyTimes := make([]time.Duration, len(producerTable) + len(consumerTable) + 1)    // The last one is packaging
+    nextJob := firstJob
+    stopped := false
+    var widgetQueue, packagingQueue []Widget
+
+    for {
+        // Every worker able to take a step right now
+        var runnable []int
+        for i := range producerTable {
+            if (!stopped && nextJob <= numWidgets) {
+                runnable = append(runnable, i)
+            }
+        }
+        for i := range consumerTable {
+            if (!stopped && len(widgetQueue) > 0) {
+                runnable = append(runnable, len(producerTable) + i)
+            }
+        }
+        if (len(packagingQueue) > 0) {
+            runnable = append(runnable, len(busyTimes) - 1)
+        }
+        if (len(runnable) == 0) {
+            break
+        }
+
+        worker := runnable[scheduler.Intn(len(runnable))]
+        timeStep := env.now()
+        switch {
+        case worker < len(producerTable):
+            workingProducer := producerTable[worker]
+            workingProducer.machine.operate(nil)
+            workingWidget := workingProducer.produce(policy.breaks(nextJob, numKth))
+            workingProducer.audit.produced(nextJob, workingWidget)
+            workingProducer.tracer.produced(workingWidget, timeStep)
+            nextJob++
+            if workingProducer.validator.pass(workingWidget) {
+                workingProducer.lifecycle.move(workingWidget, STATE_QUEUED)
+                if filter.pass(workingWidget) {
+                    widgetQueue = append(widgetQueue, transformer.derive(workingWidget)...)
+                }
+            }
+            workingProducer.machine.produced(!workingWidget.good(), nil)
+        case worker < len(producerTable) + len(consumerTable):
+            workingWidget := widgetQueue[0]
+            widgetQueue = widgetQueue[1:]
+            if stops, _ := consumerTable[worker - len(producerTable)].consume(context.Background(), workingWidget, nil, policy); stops {
+                consumerTable[worker - len(producerTable)].checker.stopped()
+                env.logEvent(MSG_STOPS)
+                stopped = true
+            } else if (packer != nil && workingWidget.good()) {
+                packagingQueue = append(packagingQueue, workingWidget)
+            }
+        default:
+            packer.pack(packagingQueue[0])
+            packagingQueue = packagingQueue[1:]
+        }
+        busyTimes[worker] += env.since(timeStep)
+    }
+
+    if packer != nil {
+        packer.flush()
+    } else {
+        busyTimes = busyTimes[:len(busyTimes) - 1]
+    }
+    for _, busyTime := range busyTimes {
+        meter.idle(env.since(timeBegin) - busyTime)
+    }
+    for _, workingProducer := range producerTable {
+        workingProducer.machine.stop()
+    }
+}
+
+//==============================================================================
+// Pipeline is a production line for programs embedding it: a configuration checked once, and the services it runs on
+// Every run has its own stages, channels, wait group and environment, so any number of Pipelines run side by side
+type Pipeline struct {
+    config      LineConfig
+    Services    Services    // Left zero for the default services, the fields set stand in for the defaults
+    Stages      []Stage     // Run after the ones of -stages, they are not recorded with the run
+    Sink        Sink        // When set, every consumer sends its events there instead of to the -sinks, closed with the run
+    Transport   Transport   // When set, carries the Widgets from the last stage to the consumers, closed by the line
+    Invariants  []Invariant // Checked after every event of every run, along with the built-in ones of -verify
+    FinalInvariants []Invariant // Checked once every run is over, along with the built-in ones of -verify
+    mutex       sync.Mutex
+    paused      bool
+    pauseChannel chan bool          // Of the latest run in progress, nil between runs
+    snapshotChannel chan chan<- Snapshot    // Of the same run, nil between runs
+    doneChannel chan struct{}       // Closed once that run is done
+}
+
+// A Pipeline for the configuration, an error when the configuration does not hold together
+// Without a seed, the line gets one from the time so every run differs
+func NewPipeline(config LineConfig) (*Pipeline, error) {
+    config = config.complete()
+    if err := config.Check(); err != nil {
+        return nil, err
+    }
+    if config.Seed == 0 {
+        config.Seed = time.Now().UnixNano()
+    }
+    return &Pipeline{config: config}, nil
+}
+
+func (pipeline *Pipeline) Config() LineConfig {
+    return pipeline.config
+}
+
+// Run the line to its end, or until interruptChannel is closed, the line then stops producing and drains
+// A run started while the Pipeline is paused starts paused, a deterministic run is never paused
+// The error is the one of the recording when the run failed, or why the line could not run at all with an empty recording
+func (pipeline *Pipeline) Run(interruptChannel <-chan struct{}) (Recording, error) {
+    if pipeline.config.Deterministic {
+        return pipeline.line(nil, interruptChannel, nil, nil)
+    }
+    pauseChannel, snapshotChannel, doneChannel := make(chan bool, 1), make(chan chan<- Snapshot), make(chan struct{})
+    pipeline.mutex.Lock()
+    if pipeline.paused {
+        pauseChannel <- true
+    }
+    pipeline.pauseChannel, pipeline.snapshotChannel, pipeline.doneChannel = pauseChannel, snapshotChannel, doneChannel
+    pipeline.mutex.Unlock()
+    defer func() {
+        close(doneChannel)
+        pipeline.mutex.Lock()
+        defer pipeline.mutex.Unlock()
+        if pipeline.pauseChannel == pauseChannel {
+            pipeline.pauseChannel, pipeline.snapshotChannel, pipeline.doneChannel = nil, nil, nil
+        }
+    }()
+    return pipeline.line(nil, interruptChannel, pauseChannel, snapshotChannel)
+}
+
+// Re-drive recorded arrivals through the line instead of producing Widgets
+func (pipeline *Pipeline) Replay(arrivals []Arrival) (Recording, error) {
+    return pipeline.line(arrivals, nil, nil, nil)
+}
+
+// Pause keeps the Producers of the latest run in progress from taking on new jobs, while its consumers drain what is
+// already on the line. Interrupting the run resumes them so it can stop
+func (pipeline *Pipeline) Pause() {
+    pipeline.pause(true)
+}
+
+// Resume the Producers paused by Pause
+func (pipeline *Pipeline) Resume() {
+    pipeline.pause(false)
+}
+
+func (pipeline *Pipeline) Paused() bool {
+    pipeline.mutex.Lock()
+    defer pipeline.mutex.Unlock()
+    return pipeline.paused
+}
+
+// Snapshot of the latest run in progress, taken without stopping it: its counters, workers, queues and the oldest
+// Widgets on the line. False between runs, and for deterministic runs which cannot be looked into
+func (pipeline *Pipeline) Snapshot() (Snapshot, bool) {
+    pipeline.mutex.Lock()
+    snapshotChannel, doneChannel := pipeline.snapshotChannel, pipeline.doneChannel
+    pipeline.mutex.Unlock()
+    if snapshotChannel == nil {
+        return Snapshot{}, false
+    }
+    reply := make(chan Snapshot, 1)
+    select {
+    case snapshotChannel <- reply:
+        return <-reply, true
+    case <-doneChannel:
+        return Snapshot{}, false
+    }
+}
+
+func (pipeline *Pipeline) pause(pause bool) {
+    pipeline.mutex.Lock()
+    defer pipeline.mutex.Unlock()
+    pipeline.paused = pause
+    if pipeline.pauseChannel != nil {
+        select {
+        case pipeline.pauseChannel <- pause:
+        case <-pipeline.doneChannel:
+        }
+    }
+}
+
+func (pipeline *Pipeline) line(arrivals []Arrival, interruptChannel <-chan struct{}, pauseChannel <-chan bool, snapshotChannel <-chan chan<- Snapshot) (Recording, error) {
+    return pipeline.Services.stagedLine(pipeline.config, lineParts{pipeline.Stages, pipeline.Sink, pipeline.Transport, pipeline.Invariants, pipeline.FinalInvariants},
+        LineOptions{Arrivals: arrivals, Interrupt: interruptChannel, Snapshots: snapshotChannel, Pause: pauseChannel})
+}
+
+// LineOptions is what a run of the line is given besides its configuration, any of it may be left out
+type LineOptions struct {
+    Arrivals    []Arrival                   // When not nil, the Widgets are re-driven from a recording instead of being produced
+    Interrupt   <-chan struct{}             // Once closed, a soak run stops producing and any other run stops early, then drains
+    Snapshots   <-chan chan<- Snapshot      // Every Snapshot asked for is answered while the line runs
+    Annotations <-chan string               // Every annotation goes into the event stream of the line
+    Membership  <-chan Membership           // Joins and leaves of the partitioned consumer groups
+    Pause       <-chan bool                 // The Producers pause whenever true is received, and resume on false
+}
+
+// lineParts are the parts a Pipeline gives its line in place of the ones of the configuration, any of them may be nil
+type lineParts struct {
+    stages      []Stage         // Run after the ones of -stages
+    sink        Sink            // In place of the -sinks
+    transport   Transport       // In place of the in-memory transport taking the Widgets to the consumers
+    invariants  []Invariant     // Checked after every event, the line is verified when there are any
+    finalInvariants []Invariant
+}
+
+// ProductionLine should be a Producer produces following by a consumer consumes
+// The error is the one of the recording when the run failed, or why the line could not run at all with an empty recording
+func WidgetProductionConsumptionLine(config LineConfig, options LineOptions) (Recording, error) {
+    return DefaultServices().stagedLine(config, lineParts{}, options)
+}
+
+// The line with the given parts in place of those of the configuration
+func stagedLine(env *environment, config LineConfig, parts lineParts, options LineOptions) (Recording, error) {
+    stages, sink, transport, pauseChannel := parts.stages, parts.sink, parts.transport, options.Pause
+    for _, stage := range stages {
+        if stage.Workers() < 1 {
+            return Recording{}, fmt.Errorf("stage %q must have at least one worker", stage.Name())
+        }
+    }
+    if (transport != nil && (config.Connect != "" || config.Listen != "")) {
+        return Recording{}, fmt.Errorf("a distributed line carries its Widgets over TCP, it takes no other transport")
+    }
+    if ((len(parts.invariants) > 0 || len(parts.finalInvariants) > 0) && (config.Connect != "" || config.Listen != "")) {
+        return Recording{}, fmt.Errorf("a distributed line cannot be verified, it takes no invariants")
+    }
+    if (pauseChannel != nil && config.Deterministic) {
+        return Recording{}, fmt.Errorf("a deterministic line is scheduled in one go, it cannot be paused")
+    }
+    // Sinks are opened before looking for leaks, their connections may outlive the run. Whatever was opened is closed
+    // again when the line cannot run after all
+    var opened lineOpenings
+    var err error
+    defer func() {
+        if err != nil {
+            opened.close(env.services.Report)
+        }
+    }()
+    if sink != nil {
+        opened.sinks = slices.Repeat([]Sink{&sharedSink{sink}}, config.consumers())
+    } else if opened.sinks, err = config.Sinks.open(env, config.consumers(), config.RotateEvery, config.PauseBuffer, config.ProbeEvery); err != nil {
+        return Recording{}, err
+    }
+    if opened.divertSinks, err = config.DivertSink.open(env, 1, config.RotateEvery, config.PauseBuffer, config.ProbeEvery); err != nil {
+        return Recording{}, err
+    }
+    // So is the reservation desk, with the connections of the external systems
+    if config.Reserve != "" {
+        if opened.desk, err = newReservationDesk(env, config.Reserve, config.Lease); err != nil {
+            return Recording{}, err
+        }
+    }
+    if config.MetricsAddr != "" {
+        if opened.endpoint, err = newMetricsEndpoint(config.MetricsAddr); err != nil {
+            return Recording{}, err
+        }
+    }
+    // And the link of a distributed line to its other processes
+    switch {
+    case config.Connect != "":
+        opened.link, err = newRemoteSender(config.Connect)
+    case config.Listen != "":
+        if opened.link, err = newRemoteReceiver(config.Listen, config.RemoteProducers); err == nil {
+            fmt.Fprintf(env.services.Report, "[taking widgets from %d producing processes on %s]\n", opened.link.numProcesses, opened.link.listener.Addr())
+        }
+    }
+    if err != nil {
+        return Recording{}, err
+    }
+    // And the ledger of every Widget
+    if (config.Ledger != "" || config.Out != "") {
+        if opened.ledger, err = newWidgetLedger(env, config.Ledger, config.Out); err != nil {
+            return Recording{}, err
+        }
+    }
+    // And the dead letters, of the Widgets given up on by a retrying consumer or the policy
+    if policy, _ := parseStopPolicy(config.StopPolicy); (config.ConsumeFailRate > 0 || policy.deadLetter) {
+        if opened.deadLetters, err = newDeadLetters(env, config.consumers(), opened.divertSinks[0], config.DeadLetters); err != nil {
+            return Recording{}, err
+        }
+    }
+    leaks := newLeakDetector(env)
+    return leaks.run(func() (Recording, error) {
+        return runLine(env, config, parts, options, opened, leaks)
+    })
+}
+
+// lineOpenings are what a line opens before it runs, kept open for the whole run and closed as it finishes
+type lineOpenings struct {
+    sinks       []Sink
+    divertSinks []Sink
+    desk        *ReservationDesk
+    endpoint    *MetricsEndpoint
+    link        *RemoteLink
+    ledger      *WidgetLedger
+    deadLetters *DeadLetters
+}
+
+// Close what was opened for a line which cannot run after all
+func (opened lineOpenings) close(out io.Writer) {
+    closeSinks(opened.sinks, out)
+    closeSinks(opened.divertSinks, out)
+    opened.desk.close()
+    opened.endpoint.close()
+    opened.link.hangUp()
+    opened.ledger.close()
+}
+
+// The line itself once everything it opens is open, on the goroutine of the run
+func runLine(env *environment, config LineConfig, parts lineParts, options LineOptions, opened lineOpenings, leaks *LeakDetector) (Recording, error) {
+    stages, transport := parts.stages, parts.transport
+    arrivals, interruptChannel, snapshotChannel := options.Arrivals, options.Interrupt, options.Snapshots
+    annotationChannel, membershipChannel, pauseChannel := options.Annotations, options.Membership, options.Pause
+    sinks, divertSinks, desk, endpoint := opened.sinks, opened.divertSinks, opened.desk, opened.endpoint
+    link, ledger, deadLetters := opened.link, opened.ledger, opened.deadLetters
+    resourceMeter := newResourceMeter()
+    recorder := newRecorder(env, !config.Soak, config.Warmup)
+    recorder.endpoint, recorder.pareto = endpoint, config.Pareto
+    var checker *Checker
+    if (config.Verify || len(parts.invariants) > 0 || len(parts.finalInvariants) > 0) {
+        if arrivals != nil {
+            checker = newChecker(len(arrivals), false, parts.invariants, parts.finalInvariants)
+        } else {
+            checker = newChecker(config.NumWidgets - config.ResumeAfter, config.Soak || len(config.Until) > 0, parts.invariants, parts.finalInvariants)
+        }
+    }
+
+    var meter *EnergyMeter
+    if (config.ProduceEnergy > 0 || config.ConsumeEnergy > 0 || config.PackageEnergy > 0 || config.IdlePower > 0) {
+        meter = &EnergyMeter{produceCost: config.ProduceEnergy, consumeCost: config.ConsumeEnergy, packageCost: config.PackageEnergy, idlePower: config.IdlePower}
+    }
+    var maintenance *Maintenance
+    if (len(config.Mtbf) > 0 || config.MaintenanceEvery > 0) {
+        maintenance = newMaintenance(env, config.Mtbf, config.Mttr, config.MaintenanceEvery, config.IdealCycle, config.NumCrews,
+            config.Deterministic)
+    }
+    // Spans are exported from now on, so the exporter is stopped before looking for leaks
+    var tracer *Tracer
+    if config.OtelEndpoint != "" {
+        tracer = newTracer(env, config.OtelEndpoint)
+        go tracer.watch()
+    }
+    lifecycle := newLifecycle(checker)
+    lifecycle.ledger = ledger
+    lifecycle.tracer = tracer
+    endpoint.serve(lifecycle, env.services.Report)
+    // The board also samples the occupancy of the queues for a log at the trace level
+    var board *Board
+    if (snapshotChannel != nil || env.logging(LEVEL_TRACE)) {
+        sampleEvery := time.Duration(0)
+        if env.logging(LEVEL_TRACE) {
+            sampleEvery = OCCUPANCY_EVERY
+        }
+        board = newBoard(env, lifecycle, recorder)
+        go board.serve(snapshotChannel, sampleEvery)
+    }
+    var defects *DefectModel
+    if (config.DefectRate > 0 || config.EnterBad > 0) {
+        defects = newDefectModel(config.DefectRate, config.BadDefectRate, config.EnterBad, config.ExitBad)
+    }
+    var gaps *GapDetector
+    if config.Gaps {
+        gaps = newGapDetector()
+    }
+    var stats *Stats
+    if config.Stats {
+        stats = newStats(!config.Soak)
+    }
+    // The first consumer group stops the line by the policy, the other groups stop themselves by one of their own
+    stopPolicy, _ := parseStopPolicy(config.StopPolicy)
+    var inspector *Inspector
+    if config.Inspect {
+        inspector = newInspector(env, config.RepairRate, divertSinks[0], lifecycle, recorder, checker)
+    }
+    var retry *ConsumeRetry
+    if config.ConsumeFailRate > 0 {
+        retry = newConsumeRetry(config.ConsumeFailRate, config.ConsumeAttempts, config.ConsumeBackoff)
+    }
+    var stageLines []*StageLine
+    for _, stage := range config.Stages.stages(env.workerSeed, stages) {
+        stageLines = append(stageLines, newStageLine(env, stage))
+    }
+    // Every consumer group drains the priority queues its own way, the first one counts for the line
+    groups := config.consumerGroups()
+    groups[0].recorder = recorder
+    for _, group := range groups[1:] {
+        group.recorder = newRecorder(env, false, 0)
+    }
+    // Without priority classes, a dispatch policy orders the Widgets of a single class
+    if (config.classes() > 0 || config.Dispatch != "") {
+        waiting := max(config.NumWidgets, 1)
+        if config.Soak {
+            waiting = SOAK_CAPACITY
+        }
+        for _, group := range groups {
+            weights, _ := parseDrain(group.drain, config.classes())
+            group.prioritizer = newPrioritizer(env, waiting, max(config.classes(), 1), config.PriorityQueues, config.Dispatch, config.Aging, weights)
+        }
+    }
+    // Only the line's consumers, those of the first group, are split into pools
+    groups[0].pools, _ = parsePools(config.Pools, groups[0].size, config.Steal)
+    limits := StageLimits{newSemaphore(env, "produce", config.ProduceLimit), newSemaphore(env, "consume", config.ConsumeLimit), newSemaphore(env, "sink", config.SinkLimit)}
+    var contention *Contention
+    if config.Contention {
+        contention = newContention(env)
+    }
+    var enqueuer *Enqueuer
+    if (config.QueueSize > 0 && config.Retries >= 0) {
+        enqueuer = newEnqueuer(env, config.QueueSize, config.Retries, config.Backoff, lifecycle, checker)
+    }
+    var filter *Filter
+    if len(config.Filters) > 0 {
+        filter, _ = newFilter(env, config.Filters, divertSinks[0], lifecycle, checker)
+    }
+    shutdown := newShutdown(env, config.Shutdown)
+    var scorer *Scorer
+    if len(config.Scores) > 0 {
+        scorer = newScorer(env, config.Scores, config.ScoreThreshold)
+    }
+    var transformer *Transformer
+    if config.Split > 0 {
+        transformer = newTransformer(env, config.Split, config.TransformRate, config.Generations, lifecycle, recorder, checker)
+    }
+    var validator *Validator
+    if config.Validate {
+        validator = newValidator(env, config.Malformed, lifecycle, recorder, checker)
+    }
+    var quotas *Quotas
+    if len(config.Quotas) > 0 {
+        // Quotas are shares of the bounded queue, or of room for every Widget without one
+        queueCapacity := config.QueueSize
+        switch {
+        case queueCapacity > 0:
+        case config.Buffer >= 0:
+            queueCapacity = config.Buffer
+        case config.Soak:
+            queueCapacity = SOAK_CAPACITY
+        default:
+            queueCapacity = config.NumWidgets
+        }
+        quotas, _ = newQuotas(env, config.Quotas, queueCapacity, config.QuotaShed, lifecycle, checker)
+        lifecycle.quotas = quotas
+    }
+
+    // Replays take every recorded arrival, whatever ended the recorded run
+    var ends *EndConditions
+    if (len(config.Until) > 0 && arrivals == nil) {
+        ends, _ = newEndConditions(env, config.Until, config.Price, config.ScrapCost)
+        go ends.watch()
+    }
+
+    // Soak runs have no fixed jobs to account for, replays and the consuming process of a distributed line no jobs at all,
+    // having no Producers, and the producing processes none consumed
+    producing := (arrivals == nil && config.Listen == "")
+    var audit *JobAudit
+    if (config.AuditJobs && !config.Soak && producing && config.Connect == "") {
+        audit = newJobAudit(config.ResumeAfter + 1, config.NumWidgets)
+        lifecycle.audit = audit
+    }
+    var holds *Holds
+    var rules *Rules
+    if (len(config.Rules) > 0 || config.AutoscaleProducers > 0 || pauseChannel != nil) {
+        holds = newHolds(interruptChannel)
+    }
+    if len(config.Rules) > 0 {
+        rules, _ = newRules(env, config.Rules, holds, groups[0].membership, lifecycle, recorder)
+        go rules.watch()
+    }
+    var scaler *Autoscaler
+    if config.Autoscale != "" {
+        scaler = newAutoscaler(env, config, groups[0], holds, lifecycle)
+        go scaler.watch()
+    }
+    var pauser *Pauser
+    if pauseChannel != nil {
+        pauser = newPauser(env, holds)
+        go pauser.watch(pauseChannel)
+    }
+
+    var dues *DueDates
+    if len(config.Due) > 0 {
+        dues = &DueDates{env: env}
+    }
+
+    // Replays have no Producers to tell
+    var feedback *Feedback
+    if (config.Feedback != "" && producing) {
+        feedback, _ = newFeedback(env, config.Feedback)
+    }
+
+    // Replays have no Producers to hold back either
+    var kanban *Kanban
+    if ((len(config.Kanban) > 0 || config.Wip) && producing) {
+        kanban = newKanban(env, config.Kanban)
+        lifecycle.kanban = kanban
+    }
+
+    // Nor to pace
+    var takt *Takt
+    if (config.Takt > 0 && producing) {
+        takt = newTakt(env, config.Takt)
+    }
+    var rates *ProductionRates
+    if (config.ProduceRate > 0 && producing) {
+        rates = newProductionRates(env, config.ProduceRate, config.ProduceJitter)
+    }
+
+    // Make all the Producers first, sharing one serial number allocator if needed, which takes turns with the other nodes
+    // of a distributed line
+    var serials *SerialAllocator
+    if (config.SerialIds && config.Connect != "") {
+        serials = newSerialAllocator(config.IdLength, config.ResumeAfter, link.hello)
+    } else if config.SerialIds {
+        serials = newSerialAllocator(config.IdLength, config.ResumeAfter, RemoteHello{})
+    }
+    // The Producers of a producing process are named after its node, so the consuming process tells them from the others
+    var producerTable []Producer
+    mix, _ := parsePriorityMix(config.PriorityMix, config.classes())
+    for i := 0; i < config.NumProducers; i++ {
+        var buffer bytes.Buffer
+        if config.Connect != "" {
+            buffer.WriteString(link.hello.prefix())
+        }
+        buffer.WriteString("producer_")
+        buffer.WriteString(strconv.Itoa(i))
+        source := producerRandom(env.workerSeed, i)
+        name := buffer.String()
+        producerTable = append(producerTable, Producer{env: env, name: name, serials: serials, meter: meter, machine: maintenance.machine(i, name, source),
+            seq: new(int), defects: defects.chain(source), priorities: config.classes(), mix: mix, allowance: config.Due.at(i), weight: config.Weights.at(i),
+            work: config.Work.at(i), payloadSize: config.PayloadSize, validator: validator, quotas: quotas, enqueuer: enqueuer, holds: holds, feedback: feedback,
+            kanban: kanban, takt: takt, bucket: rates.bucket(name, source), audit: audit, tracer: tracer, stats: stats, limits: limits, board: board,
+            lifecycle: lifecycle, recorder: recorder, checker: checker, random: source})
+        feedback.follow(name, producerTable[i].defects)
+        stats.enlist("producer", name)
+    }
+
+    // Make all the consumers, group by group, the consumers of the other groups leave the line's state alone
+    numSinks := 0
+    for g, group := range groups {
+        for i := 0; i < group.size; i++ {
+            var buffer bytes.Buffer
+            buffer.WriteString(group.prefix())
+            buffer.WriteString("consumer_")
+            buffer.WriteString(strconv.Itoa(i))
+            consumer := Consumer{env: env, name: buffer.String(), delay: config.ConsumeDelay, consumeTime: config.ConsumeTime.at(i), sink: sinks[numSinks],
+                sample: config.Sample, crash: config.ConsumerCrash, retry: retry, deadLetters: deadLetters, meter: meter, feedback: feedback, kanban: kanban,
+                takt: takt, dues: dues, gaps: gaps, ends: ends, stats: stats, ledger: ledger, tracer: tracer, limits: limits, board: board, lifecycle: lifecycle,
+                recorder: recorder, checker: checker, random: namedRandom(env.workerSeed, buffer.String())}
+            if g > 0 {
+                consumer.feedback, consumer.takt, consumer.dues, consumer.gaps, consumer.ends, consumer.lifecycle, consumer.recorder, consumer.checker = nil, nil, nil, nil, nil, nil, group.recorder, nil
+            }
+            if group.name == RESERVE_GROUP {
+                consumer.desk = desk
+            }
+            group.consumers = append(group.consumers, consumer)
+            stats.enlist("consumer", consumer.name)
+            numSinks++
+        }
+    }
+    consumerTable := groups[0].consumers
+
+    // Standby consumers stay idle until they take over from a crashed one of the line's own group
+    var standbyNames []string
+    for i := 0; i < config.NumStandbys; i++ {
+        standbyNames = append(standbyNames, groups[0].prefix() + "standby_" + strconv.Itoa(i))
+    }
+
+    var packer *Packer
+    if (config.LotSize > 0) {
+        packer, _ = newPacker(env, config.LotSize, config.Recall, meter)
+    }
+
+    var monitor *ThroughputMonitor
+    if (config.AlertDrop > 0) {
+        monitor = newThroughputMonitor(env, config.AlertDrop, config.AlertWindow, config.AlertWebhook, recorder)
+        go monitor.watch()
+    }
+
+    var detector *SteadyDetector
+    if config.Steady != "" {
+        detector, _ = newSteadyDetector(env, config.Steady, recorder)
+        go detector.watch()
+    }
+
+    var rollup *Rollup
+    if config.Soak {
+        rollup = newRollup(env, config.RollupEvery, recorder)
+        go rollup.watch()
+    }
+
+    var annotator *Annotator
+    if annotationChannel != nil {
+        annotator = newAnnotator(env, append(append([]Sink{}, sinks...), divertSinks...), recorder)
+        go annotator.watch(annotationChannel)
+    }
+
+    // Jobs thrown away by an interrupt, counted until the line has stopped
+    numDiscarded := 0
+
+    // Every report is printed, the monitor stopped and every sink closed before looking for leaks
+    finish := func() (Recording, error) {
+        out := env.services.Report
+        monitor.stop()
+        rules.stop()
+        scaler.stop()
+        pauser.stop()
+        rollup.stop()
+        detector.stop()
+        ends.stop()
+        annotator.stop()
+        board.stop()
+        meter.report(out)
+        maintenance.report(out)
+        defects.report(out)
+        if config.PayloadSize > 0 {
+            numProduced, _, _ := recorder.counters()
+            fmt.Fprintf(out, "Payloads: [ %d bytes ] per widget, filled [ %s ] for [ %d ] widgets\n", config.PayloadSize,
+                formatBytes(int64(numProduced * config.PayloadSize)), numProduced)
+        }
+        stopPolicy.report(out)
+        inspector.report(out)
+        retry.report(out)
+        deadLetters.closeFile()
+        deadLetters.report(out)
+        for _, line := range stageLines {
+            line.report(out)
+        }
+        filter.report(out)
+        packer.report(out)
+        transformer.report(out)
+        scorer.report(out)
+        shutdown.report(out)
+        quotas.report(out)
+        ends.report(out)
+        rules.report(out)
+        scaler.report(out)
+        pauser.report(out)
+        feedback.report(out)
+        desk.close()
+        desk.report(out)
+        link.hangUp()
+        link.report(out)
+        ledger.close()
+        ledger.report(out)
+        tracer.stop()
+        tracer.report(out)
+        endpoint.close()
+        endpoint.report(out)
+        kanban.report(out)
+        enqueuer.report(out)
+        limits.report(out)
+        for _, group := range groups {
+            group.report(out)
+        }
+        contention.report(out)
+        gaps.report(out)
+        stats.report(out)
+        // A broken widget stops the line whichever group finds it
+        var broken *BrokenWidgetError
+        for _, group := range groups {
+            if (broken == nil && group.recorder.broken != nil) {
+                broken = group.recorder.broken
+            }
+        }
+        audit.report(out, stoppedBy(broken, ends, interruptChannel))
+        recorder.report(out)
+        // The odds of a collision are only reported for ids made other than the default way
+        if (!config.SerialIds && (config.Ids != "" || config.IdLength != ID_LENGTH || config.IdAlphabet != ASCII)) {
+            reportIds(out, env.ids, recorder.numProduced, recorder.numCollisions, recorder.keepArrivals)
+        }
+        closeSinks(sinks, out)
+        closeSinks(divertSinks, out)
+        // The resources are kept in the outcome of every run, only reported on request
+        resources := resourceMeter.used()
+        if config.Resources {
+            resources.report(out)
+        }
+        if tardiness := dues.outcome(); tardiness != nil {
+            tardiness.report(out)
+        }
+        if adherence := takt.outcome(); adherence != nil {
+            adherence.report(out)
+        }
+        rates.report(out)
+        violations, stragglers := checker.finish(), leaks.stragglers(LEAK_GRACE)
+        recording := recorder.recording(config, append(append([]string{}, violations...), stragglers...))
+        recording.err = runErrors(broken, enqueuer, stragglers, violations)
+        recording.Outcome.Census, recording.Outcome.Irregular, recording.Outcome.Resources = lifecycle.census(), gaps.irregular(), &resources
+        recording.Outcome.Tardiness, recording.Outcome.Wip, recording.Outcome.Takt = dues.outcome(), kanban.outcome(), takt.outcome()
+        recording.Outcome.NumDiscarded, recording.Outcome.Stats = numDiscarded, stats.outcome()
+        recording.Outcome.Verdict = judge(config.Verdict, recording.Outcome)
+        recording.Outcome.Verdict.report(out)
+        return recording, recording.err
+    }
+
+    if (config.Deterministic && producing) {
+        fmt.Fprintf(env.services.Report, "[deterministic scheduling with seed %d]\n", config.Seed)
+        scheduledLine(env, producerTable, consumerTable, filter, transformer, packer, meter, config.ResumeAfter + 1, config.NumWidgets, config.NumKth, stopPolicy,
+            config.Seed)
+        return finish()
+    }
+
+    // Unbounded runs cannot size the channels after the number of widgets
+    capacity := config.NumWidgets
+    if config.Soak {
+        capacity = SOAK_CAPACITY
+    }
+    widgetCapacity := capacity
+    if (config.QueueSize > 0) {
+        widgetCapacity = config.QueueSize
+    }
+
+    // With -buffer every channel on the way to the consumers gets that capacity, packaging keeps room for every Widget
+    bufferCapacity := widgetCapacity
+    if (config.Buffer >= 0) {
+        widgetCapacity, bufferCapacity = config.Buffer, config.Buffer
+    }
+
+    // The Widgets go to the consumers over a transport, the in-memory one unless another is given. The stage before the
+    // consumers sends straight into the channel of an in-memory transport, closing it once done, and the consumers
+    // receive straight from it, other transports are sent to and received from by a goroutine each
+    numHops := len(stageLines)
+    for _, hop := range []bool{inspector != nil, filter != nil, transformer != nil, scorer != nil} {
+        if hop {
+            numHops++
+        }
+    }
+    if (transport == nil && config.Connect == "") {
+        transportCapacity := bufferCapacity
+        if numHops == 0 {
+            transportCapacity = widgetCapacity
+        }
+        transport = NewChannelTransport(transportCapacity)
+    }
+    channelTransport, _ := transport.(*ChannelTransport)
+    hopChannel := func(capacity int) chan Widget {
+        if (numHops == 0 && channelTransport != nil) {
+            return channelTransport.widgets
+        }
+        numHops--
+        return make(chan Widget, capacity)
+    }
+
+    var wg sync.WaitGroup                               // The stages of this run alone, so that lines may run side by side
+    jobChannel := make(chan int, capacity)              // Job channel to keep track of how many widgets produced and which widget would be broken
+    widgetChannel := hopChannel(widgetCapacity)         // Widget channel to send to consumers to consume
+    quitChannel := make(chan struct{})                  // To signify when the line is stopping, its stages are stopped by the shutdown
+    brokenWidgetChannel := make(chan struct{})          // Written by a consumer when a broken widget is met
+    consumedChannel := make(chan struct{})              // Closed once every consumer has quit
+    var packagingChannel chan Widget                    // Finished widgets on their way to be packed into lots, nil when packaging is off
+    board.queue("jobs", func() (int, int) { return len(jobChannel), cap(jobChannel) })
+    board.queue("widgets", func() (int, int) { return len(widgetChannel), cap(widgetChannel) })
+
+    // Every channel between two stages is an edge of the pipeline graph, timed with -contention
+    producers, consumers := "producers", "consumers"
+    if arrivals != nil {
+        producers = "replay"
+    } else if config.Listen != "" {
+        producers = "remote"
+    }
+    if config.Pull {
+        consumers = "dispatcher"
+    }
+    widgetsTo, filteredTo, transformedTo, scoredTo := consumers, consumers, consumers, consumers
+    if config.classes() > 0 {
+        widgetsTo, filteredTo, transformedTo, scoredTo = "priority", "priority", "priority", "priority"
+    }
+    if len(groups) > 1 {
+        widgetsTo, filteredTo, transformedTo, scoredTo = "fan-out", "fan-out", "fan-out", "fan-out"
+    }
+    transportedTo := widgetsTo
+    if ((transport != nil && channelTransport == nil) || config.Connect != "") {
+        widgetsTo, filteredTo, transformedTo, scoredTo = "transport", "transport", "transport", "transport"
+    }
+    if scorer != nil {
+        widgetsTo, filteredTo, transformedTo = "scorer", "scorer", "scorer"
+    }
+    if transformer != nil {
+        widgetsTo, filteredTo = "transformer", "transformer"
+    }
+    if filter != nil {
+        widgetsTo = "filter"
+    }
+    stagesTo := widgetsTo
+    if len(stageLines) > 0 {
+        widgetsTo = stageLines[0].stage.Name()
+    }
+    inspectedTo := widgetsTo
+    if inspector != nil {
+        widgetsTo = "inspector"
+    }
+    jobEdge := contention.edge("jobs", "line", "producers")
+    widgetEdge := contention.edge("widgets", producers, widgetsTo)
+
+    if config.Soak {
+        // Jobs keep coming until the run is interrupted, the Producers then finish what they have and the line drains
+        wg.Add(1)
+        shutdown.run("jobs", true, func(quitChannel <-chan struct{}) { jobLine(&wg, jobChannel, jobEdge, interruptChannel, quitChannel) })
+    } else {
+        // Rack up all the jobs first, a resumed run only has the ones left, and the consuming process of a distributed line
+        // none
+        for i := config.ResumeAfter + 1; (i <= config.NumWidgets && config.Listen == ""); i++ {
+            jobChannel <- i
+        }
+        close(jobChannel)
+        // Interrupted, the jobs not yet taken are thrown away, the Producers finish what they have and the line drains
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            select {
+            case <-interruptChannel:
+            case <-quitChannel:
+                return
+            }
+            checker.interrupted()
+            for range jobChannel {
+                numDiscarded++
+            }
+        }()
+    }
+    // Nor may a sink still down hold up the drain of an interrupted run
+    go func() {
+        select {
+        case <-interruptChannel:
+        case <-quitChannel:
+            return
+        }
+        givenUp := make(map[*PausingSink]bool)
+        for _, sink := range append(append([]Sink{}, sinks...), divertSinks...) {
+            if pausing, ok := sink.(*PausingSink); (ok && !givenUp[pausing]) {
+                pausing.giveUp()
+                givenUp[pausing] = true
+            }
+        }
+    }()
+    // The consumers stop as on a broken widget once an end condition is met, or once an interrupted run has drained for
+    // -drain-timeout, leaving what is still on its way unconsumed
+    endChannel, drainTimedOut := make(chan struct{}), false
+    go func() {
+        interrupt, drainChannel := interruptChannel, (<-chan time.Time)(nil)
+        for {
+            select {
+            case <-interrupt:
+                timer := time.NewTimer(config.DrainTimeout)
+                defer timer.Stop()
+                interrupt, drainChannel = nil, timer.C
+            case <-drainChannel:
+                drainTimedOut = true
+                env.logEvent(MSG_DRAIN_TIMEOUT, config.DrainTimeout)
+                close(endChannel)
+                return
+            case <-ends.ended():
+                close(endChannel)
+                return
+            case <-quitChannel:
+                return
+            }
+        }
+    }()
+
+    wg.Add(2)
+    if arrivals != nil {
+        // Recorded arrivals take the place of the Producers
+        shutdown.run("replay", true, func(quitChannel <-chan struct{}) {
+            replayLine(env, &wg, arrivals, lifecycle, recorder, checker, widgetChannel, widgetEdge, quitChannel)
+        })
+    } else if config.Listen != "" {
+        // So do the Widgets of the producing processes of a distributed line
+        shutdown.run("remote", true, func(quitChannel <-chan struct{}) {
+            receiveLine(&wg, link, lifecycle, recorder, checker, widgetChannel, widgetEdge, interruptChannel, quitChannel)
+        })
+    } else {
+        // Producers will then grab job requests from jobChannel and produce
+        shutdown.run("producers", true, func(quitChannel <-chan struct{}) {
+            productionLine(&wg, producerTable, config.NumWidgets, config.NumKth, stopPolicy, jobChannel, jobEdge, widgetChannel, widgetEdge, quitChannel)
+        })
+    }
+
+    // Packaging grabbing finished widgets from consumers and pack them into lots, started after them
+    var packagingEdge *Edge
+    if packer != nil {
+        packagingChannel = make(chan Widget, capacity)
+        packagingEdge = contention.edge("packaging", "consumers", "packaging")
+        board.queue("packaging", func() (int, int) { return len(packagingChannel), cap(packagingChannel) })
+    }
+
+    // The inspector gets the Widgets first, the ones beyond repair go to the scrap bin, which stops on its own once it
+    // has discarded every one of them
+    consumptionChannel, consumptionEdge := widgetChannel, widgetEdge
+    if inspector != nil {
+        inspectedChannel, scrapChannel := hopChannel(bufferCapacity), make(chan Widget, capacity)
+        inspectedEdge := contention.edge("inspected", "inspector", inspectedTo)
+        board.queue("inspected", func() (int, int) { return len(inspectedChannel), cap(inspectedChannel) })
+        board.queue("scrap", func() (int, int) { return len(scrapChannel), cap(scrapChannel) })
+        wg.Add(2)
+        inspectChannel, inspectEdge := consumptionChannel, consumptionEdge
+        shutdown.run("inspector", false, func(quitChannel <-chan struct{}) {
+            inspectionLine(&wg, inspector, inspectChannel, inspectEdge, inspectedChannel, inspectedEdge, scrapChannel, quitChannel)
+        })
+        shutdown.watch("scrap", func() { scrapLine(&wg, inspector, scrapChannel) })
+        consumptionChannel, consumptionEdge = inspectedChannel, inspectedEdge
+    }
+
+    // Every stage works on the Widgets in turn, with workers and a channel of its own
+    for s, line := range stageLines {
+        to := stagesTo
+        if s + 1 < len(stageLines) {
+            to = stageLines[s + 1].stage.Name()
+        }
+        stagedChannel := hopChannel(bufferCapacity)
+        stagedEdge := contention.edge(line.stage.Name(), line.stage.Name(), to)
+        board.queue(line.stage.Name(), func() (int, int) { return len(stagedChannel), cap(stagedChannel) })
+        wg.Add(1)
+        stageChannel, stageEdge := consumptionChannel, consumptionEdge
+        shutdown.run("stage " + line.stage.Name(), false, func(quitChannel <-chan struct{}) {
+            stageLine(&wg, line, board, stageChannel, stageEdge, stagedChannel, stagedEdge, quitChannel)
+        })
+        consumptionChannel, consumptionEdge = stagedChannel, stagedEdge
+    }
+
+    // The filter stage lets through to the consumers only the widgets passing its rules
+    if filter != nil {
+        filteredChannel := hopChannel(bufferCapacity)
+        filteredEdge := contention.edge("filtered", "filter", filteredTo)
+        board.queue("consumption", func() (int, int) { return len(filteredChannel), cap(filteredChannel) })
+        wg.Add(1)
+        filterChannel, filterEdge := consumptionChannel, consumptionEdge
+        shutdown.run("filter", false, func(quitChannel <-chan struct{}) {
+            filterLine(&wg, filter, filterChannel, filterEdge, filteredChannel, filteredEdge, quitChannel)
+        })
+        consumptionChannel, consumptionEdge = filteredChannel, filteredEdge
+    }
+
+    // The transformer stage derives new Widgets from the ones passing the filter
+    if transformer != nil {
+        transformedChannel := hopChannel(bufferCapacity)
+        transformedEdge := contention.edge("transformed", "transformer", transformedTo)
+        board.queue("transformed", func() (int, int) { return len(transformedChannel), cap(transformedChannel) })
+        wg.Add(1)
+        transformChannel, transformEdge := consumptionChannel, consumptionEdge
+        shutdown.run("transformer", false, func(quitChannel <-chan struct{}) {
+            transformLine(&wg, transformer, transformChannel, transformEdge, transformedChannel, transformedEdge, quitChannel)
+        })
+        consumptionChannel, consumptionEdge = transformedChannel, transformedEdge
+    }
+
+    // The scoring stage rates the quality of every Widget about to be consumed
+    if scorer != nil {
+        scoredChannel := hopChannel(bufferCapacity)
+        scoredEdge := contention.edge("scored", "scorer", scoredTo)
+        board.queue("scored", func() (int, int) { return len(scoredChannel), cap(scoredChannel) })
+        wg.Add(1)
+        scoreChannel, scoreEdge := consumptionChannel, consumptionEdge
+        shutdown.run("scorer", false, func(quitChannel <-chan struct{}) {
+            scoreLine(&wg, scorer, scoreChannel, scoreEdge, scoredChannel, scoredEdge, quitChannel)
+        })
+        consumptionChannel, consumptionEdge = scoredChannel, scoredEdge
+    }
+
+    // Any other transport takes the Widgets the rest of the way to the consumers
+    if (transport != nil && channelTransport == nil) {
+        transportedChannel := make(chan Widget, bufferCapacity)
+        transportedEdge := contention.edge("transported", "transport", transportedTo)
+        board.queue("transported", func() (int, int) { return len(transportedChannel), cap(transportedChannel) })
+        wg.Add(1)
+        transportChannel, transportEdge := consumptionChannel, consumptionEdge
+        shutdown.run("transport", false, func(quitChannel <-chan struct{}) {
+            transportLine(env, &wg, transport, transportChannel, transportEdge, transportedChannel, transportedEdge, quitChannel)
+        })
+        consumptionChannel, consumptionEdge = transportedChannel, transportedEdge
+    }
+
+    // With more than one consumer group, the fan-out hands every Widget to every group
+    groupChannels, groupEdges := []<-chan Widget{consumptionChannel}, []*Edge{consumptionEdge}
+    if len(groups) > 1 {
+        fanoutChannels, fanoutEdges := make([]chan Widget, len(groups)), make([]*Edge, len(groups))
+        groupChannels, groupEdges = make([]<-chan Widget, len(groups)), make([]*Edge, len(groups))
+        for g, group := range groups {
+            to := consumers + " " + group.name
+            if group.prioritizer != nil {
+                to = "priority " + group.name
+            }
+            fanoutChannels[g] = make(chan Widget, bufferCapacity)
+            fanoutEdges[g] = contention.edge("group " + group.name, "fan-out", to)
+            groupChannels[g], groupEdges[g] = fanoutChannels[g], fanoutEdges[g]
+        }
+        wg.Add(1)
+        shutdown.run("fan-out", false, func(quitChannel <-chan struct{}) {
+            fanoutLine(&wg, consumptionChannel, consumptionEdge, fanoutChannels, fanoutEdges, quitChannel)
+        })
+    }
+    credits := 0
+    if config.Pull {
+        credits = config.Credits
+    }
+
+    // consumedChannel is closed once every group is done, only the line's own group gets to stop the line
+    // A producing process of a distributed line sends the Widgets to the consuming one instead, which counts as its group
+    var groupWaitGroup sync.WaitGroup
+    consumerGroups := groups
+    if config.Connect != "" {
+        consumerGroups = nil
+        groupWaitGroup.Add(1)
+        sendChannel, sendEdge := consumptionChannel, consumptionEdge
+        shutdown.run("transport", false, func(quitChannel <-chan struct{}) {
+            sendLine(env, &wg, link, lifecycle, sendChannel, sendEdge, quitChannel)
+            groupWaitGroup.Done()
+        })
+    }
+    groupWaitGroup.Add(len(consumerGroups))
+    for g, group := range consumerGroups {
+        groupChannel, groupEdge := groupChannels[g], groupEdges[g]
+        suffix := ""
+        if group.name != "" {
+            suffix = " " + group.name
+        }
+
+        // The priority stage hands the consumers the best Widget waiting whenever one of them is ready, hence unbuffered
+        if group.prioritizer != nil {
+            prioritizedChannel := make(chan Widget)
+            prioritizedEdge := contention.edge("prioritized" + suffix, "priority" + suffix, consumers + suffix)
+            wg.Add(1)
+            priorityChannel, priorityEdge := groupChannel, groupEdge
+            shutdown.run("priority" + suffix, false, func(quitChannel <-chan struct{}) {
+                priorityLine(&wg, group.prioritizer, priorityChannel, priorityEdge, prioritizedChannel, prioritizedEdge, quitChannel)
+            })
+            groupChannel, groupEdge = prioritizedChannel, prioritizedEdge
+        }
+        var inboxEdge *Edge
+        if config.Pull {
+            inboxEdge = contention.edge("inboxes" + suffix, "dispatcher" + suffix, "consumers" + suffix)
+        } else if group.pools != nil {
+            inboxEdge = contention.edge("pools" + suffix, "pool dispatcher" + suffix, "consumers" + suffix)
+        }
+
+        // Consumers grabbing widgets from widget channel and consume, the other groups stop on their own at the broken widget
+        standbys, outChannel, outEdge, brokenChannel, endChannel := standbyNames, packagingChannel, packagingEdge, brokenWidgetChannel, endChannel
+        policy := stopPolicy
+        if g > 0 {
+            standbys, outChannel, outEdge, brokenChannel, endChannel = nil, nil, nil, make(chan struct{}), nil
+            policy, _ = parseStopPolicy(config.StopPolicy)
+            wg.Add(1)
+        }
+        // Consumers have nothing to be told, they stop on their own once their Widgets run out
+        wg.Add(1)
+        shutdown.watch(consumers + suffix, func() {
+            defer wg.Done()
+            if config.Partitions > 0 {
+                assign, _ := parseRebalance(config.Rebalance)
+                partitionLine(&wg, group, config.Partitions, assign, standbys, groupChannel, groupEdge, outChannel, outEdge, policy, brokenChannel, endChannel)
+            } else {
+                consumptionLine(&wg, group, standbys, credits, group.pools, groupChannel, groupEdge, inboxEdge, outChannel, outEdge, policy, brokenChannel, endChannel)
+            }
+            groupWaitGroup.Done()
+            // What is still on its way to a group done early must not hold up the fan-out
+            for range groupChannel {
+            }
+        })
+    }
+    if packer != nil {
+        wg.Add(1)
+        shutdown.watch("packaging", func() { packagingLine(&wg, packer, packagingChannel, packagingEdge) })
+    }
+    // The dead-letter worker stops on its own once the consumers are done giving up on Widgets
+    if deadLetters != nil {
+        wg.Add(1)
+        shutdown.watch("dead letters", func() { deadLetterLine(&wg, deadLetters) })
+    }
+    go func() {
+        groupWaitGroup.Wait()
+        deadLetters.close()
+        close(consumedChannel)
+    }()
+    if (membershipChannel != nil && config.Partitions > 0) {
+        wg.Add(1)
+        go membershipLine(&wg, groups, membershipChannel, quitChannel)
+    }
+
+    // When brokenWidgetChannel is closed by a consumer, this will close the quitChannel to tell consumptionLine and productionLine to stop
+    // Consumers may also all quit without ever meeting the broken widget, when the Widgets run out, when a soak run is
+    // interrupted or when every consumer crashed, the Producers must then not wait on them, nor once an end condition is met
+    reason := "the consumers running out of widgets"
+    select {
+    case <-brokenWidgetChannel:
+    case <-consumedChannel:
+    case <-endChannel:
+        reason = "an end condition"
+        if drainTimedOut {
+            reason = "the drain timing out"
+        }
+    }
+    select {
+    case <-brokenWidgetChannel:
+        env.logEvent(MSG_STOPS)
+        reason = "the broken widget"
+    default:
+    }
+    close(quitChannel)
+    shutdown.stop(reason)
+    wg.Wait()
+    return finish()
+}
@@ -0,0 +1,202 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/pools.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+    "sync"
+    "context"
+    "slices"
+)
+
+const POOL_CAPACITY = 16             // Widgets waiting in the queue of every consumer pool
+
+//==============================================================================
+// Pools split the consumers of a group into named pools, each with a queue of its own the Widgets are dealt to in turn,
+// as a partitioned architecture would. With stealing, a consumer whose pool has nothing waiting takes the oldest Widget
+// of the longest queue of another pool, so the pools share their work as a single queue would
+type Pools struct {
+    mutex       sync.Mutex
+    names       []string
+    of          []int               // The pool of every consumer
+    steal       bool
+    numDealt    []int
+    numStolen   []int               // Widgets of the pool taken by consumers of another one
+    numStole    []int               // Widgets of other pools taken by consumers of the pool
+    maxQueued   []int
+    totalWait   []time.Duration     // In the queue of the pool
+}
+
+// A Widget waiting in the queue of a pool
+type pooledWidget struct {
+    wid     Widget
+    time    time.Time
+}
+
+// Pools look like <name>:<consumers>,..., the consumers of the group are split over them in order
+func parsePools(specs []string, size int, steal bool) (*Pools, error) {
+    if len(specs) == 0 {
+        return nil, nil
+    }
+    pools := &Pools{steal: steal}
+    for _, spec := range specs {
+        name, value, found := strings.Cut(spec, ":")
+        consumers, err := strconv.Atoi(value)
+        if (!found || name == "" || err != nil || consumers < 1) {
+            return nil, fmt.Errorf("pool %q is not of the form <name>:<consumers> with at least 1 consumer", spec)
+        }
+        if slices.Contains(pools.names, name) {
+            return nil, fmt.Errorf("pool %q is set up more than once", name)
+        }
+        for i := 0; i < consumers; i++ {
+            pools.of = append(pools.of, len(pools.names))
+        }
+        pools.names = append(pools.names, name)
+    }
+    if len(pools.of) != size {
+        return nil, fmt.Errorf("-pools split %d consumers, there are %d", len(pools.of), size)
+    }
+    n := len(pools.names)
+    pools.numDealt, pools.numStolen, pools.numStole, pools.maxQueued, pools.totalWait = make([]int, n), make([]int, n), make([]int, n), make([]int, n), make([]time.Duration, n)
+    return pools, nil
+}
+
+func (pools *Pools) dealt(pool int, queued int) {
+    pools.mutex.Lock()
+    defer pools.mutex.Unlock()
+    pools.numDealt[pool]++
+    pools.maxQueued[pool] = max(pools.maxQueued[pool], queued)
+}
+
+// A Widget of the pool was taken by a consumer of the other one, stolen unless it is the same
+func (pools *Pools) taken(pool int, by int, wait time.Duration) {
+    pools.mutex.Lock()
+    defer pools.mutex.Unlock()
+    pools.totalWait[pool] += wait
+    if by != pool {
+        pools.numStolen[pool]++
+        pools.numStole[by]++
+    }
+}
+
+func (pools *Pools) report(out io.Writer) {
+    if pools == nil {
+        return
+    }
+    pools.mutex.Lock()
+    defer pools.mutex.Unlock()
+    mode := "partitioned"
+    if pools.steal {
+        mode = "work stealing"
+    }
+    fmt.Fprintf(out, "[%s pools]\n", mode)
+    for pool, name := range pools.names {
+        meanWait := time.Duration(0)
+        if pools.numDealt[pool] > 0 {
+            meanWait = pools.totalWait[pool] / time.Duration(pools.numDealt[pool])
+        }
+        fmt.Fprintf(out, "Pool %s [ %d consumers ]: dealt [ %d ] stolen by other pools [ %d ] stole [ %d ] queued [ %d ] at most, waited [ %s ] on average\n",
+            name, pools.count(pool), pools.numDealt[pool], pools.numStolen[pool], pools.numStole[pool], pools.maxQueued[pool], meanWait)
+    }
+}
+
+// The number of consumers of the pool
+func (pools *Pools) count(pool int) int {
+    count := 0
+    for _, of := range pools.of {
+        if of == pool {
+            count++
+        }
+    }
+    return count
+}
+
+// The pool dispatcher deals every Widget to the next pool in turn, and waits for the consumers of a pool whose queue is
+// full. Every consumer sends its index on creditChannel once ready for another Widget, it is handed one from its own
+// pool, or with stealing from the longest queue of another pool, as soon as there is one
+// Every inbox is closed once the inWidgetChannel is closed and every queue is empty, or the consumers are cancelled
+func poolLine(env *environment, ctx context.Context, pools *Pools, inWidgetChannel <-chan Widget, inEdge *Edge, creditChannel <-chan int, inboxes []chan Widget,
+    inboxEdge *Edge) {
+    defer func() {
+        for _, inbox := range inboxes {
+            close(inbox)
+        }
+    }()
+    queues := make([][]pooledWidget, len(pools.names))
+    idle := make([][]int, len(pools.names))         // The consumers of every pool waiting for a Widget
+    next, numQueued := 0, 0
+    hand := func(consumer int, pool int) {
+        pooled := queues[pool][0]
+        queues[pool] = queues[pool][1:]
+        numQueued--
+        pools.taken(pool, pools.of[consumer], env.since(pooled.time))
+        timeSend := inboxEdge.begin()
+        inboxes[consumer] <- pooled.wid
+        inboxEdge.sent(timeSend)
+    }
+    // The pool a consumer takes its next Widget from, -1 when none has one for it
+    from := func(consumer int) int {
+        own := pools.of[consumer]
+        if (len(queues[own]) > 0 || !pools.steal) {
+            return own
+        }
+        longest := own
+        for pool := range queues {
+            if len(queues[pool]) > len(queues[longest]) {
+                longest = pool
+            }
+        }
+        return longest
+    }
+    for {
+        if (inWidgetChannel == nil && numQueued == 0) {
+            return
+        }
+        // Only take more while the pool dealt next has room, a nil channel is never ready
+        in := inWidgetChannel
+        if len(queues[next]) == POOL_CAPACITY {
+            in = nil
+        }
+        timeWait := inEdge.begin()
+        select {
+        case consumer := <-creditChannel:
+            if pool := from(consumer); len(queues[pool]) > 0 {
+                hand(consumer, pool)
+            } else {
+                idle[pools.of[consumer]] = append(idle[pools.of[consumer]], consumer)
+            }
+        case workingWidget, ok := <-in:
+            if !ok {
+                inWidgetChannel = nil
+                continue
+            }
+            inEdge.received(timeWait)
+            pool := next
+            next = (next + 1) % len(queues)
+            queues[pool] = append(queues[pool], pooledWidget{workingWidget, env.now()})
+            numQueued++
+            pools.dealt(pool, len(queues[pool]))
+            // A consumer of the pool waiting for a Widget gets it, otherwise with stealing one of another pool takes one
+            waiting := pool
+            for candidate := range idle {
+                if (len(idle[waiting]) == 0 && pools.steal) {
+                    waiting = candidate
+                }
+            }
+            if len(idle[waiting]) > 0 {
+                consumer := idle[waiting][0]
+                idle[waiting] = idle[waiting][1:]
+                hand(consumer, from(consumer))
+            }
+        case <-ctx.Done():
+            return
+        }
+    }
+}
@@ -0,0 +1,257 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/priority.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "math/rand"
+    "strconv"
+    "strings"
+    "sync"
+    "slices"
+)
+
+// Drains look like strict or weighted=<w0>/<w1>/..., with a weight of at least 1 for every one of the classes
+// Strict drains have no weights
+func parseDrain(spec string, classes int) ([]int, error) {
+    if (spec == "" || spec == "strict") {
+        return nil, nil
+    }
+    mode, list, found := strings.Cut(spec, "=")
+    if (!found || mode != "weighted") {
+        return nil, fmt.Errorf("drain %q is not of the form strict or weighted=<w0>/<w1>/...", spec)
+    }
+    var weights []int
+    for _, part := range strings.Split(list, "/") {
+        weight, err := strconv.Atoi(part)
+        if (err != nil || weight < 1) {
+            return nil, fmt.Errorf("drain %q must weigh every queue at least 1", spec)
+        }
+        weights = append(weights, weight)
+    }
+    if len(weights) != classes {
+        return nil, fmt.Errorf("drain %q weighs %d queues, there are %d", spec, len(weights), classes)
+    }
+    return weights, nil
+}
+
+// Priority mixes look like <w0>/<w1>/..., every class getting its weight's share of the Widgets, an even mix when not set
+func parsePriorityMix(spec string, classes int) ([]int, error) {
+    if spec == "" {
+        return nil, nil
+    }
+    var weights []int
+    total := 0
+    for class, part := range strings.Split(spec, "/") {
+        weight, err := strconv.Atoi(part)
+        if (err != nil || weight < 0) {
+            return nil, fmt.Errorf("priority mix %q weighs class %d %q, it must weigh every class 0 or more", spec, class, part)
+        }
+        weights = append(weights, weight)
+        total += weight
+    }
+    if len(weights) != classes {
+        return nil, fmt.Errorf("priority mix %q weighs %d classes, there are %d", spec, len(weights), classes)
+    }
+    if total == 0 {
+        return nil, fmt.Errorf("priority mix %q must weigh some class more than 0", spec)
+    }
+    return weights, nil
+}
+
+// Draw a class by its weight in the mix
+func drawClass(source *rand.Rand, mix []int) int {
+    total := 0
+    for _, weight := range mix {
+        total += weight
+    }
+    draw := source.Intn(total)
+    for class, weight := range mix {
+        if draw < weight {
+            return class
+        }
+        draw -= weight
+    }
+    return len(mix) - 1
+}
+
+//==============================================================================
+// Prioritizer holds the Widgets waiting for a consumer in one queue per priority class, class 0 first
+// With aging, every period a Widget waits promotes it by one class, so the lower classes cannot be starved
+// With weights the queues are drained round-robin instead, each taking up to its weight in Widgets in a row
+type Prioritizer struct {
+    env         *environment
+    capacity    int                 // Widgets waiting at most, the priority stage stops taking more beyond
+    numWaiting  int
+    aging       time.Duration       // 0 means strict priorities
+    weights     []int               // nil means strict priorities
+    turn        int                 // The queue whose turn it is when weighted
+    served      int                 // Widgets the queue whose turn it is has taken in a row
+    names       []string            // Of the queues, their class otherwise
+    sequence    string              // Which Widget of a class goes first: fifo, edd or spt
+    queues      [][]Widget          // In the order of the sequence in every class, oldest first for fifo
+    arrivals    [][]time.Time       // When every queued Widget arrived
+    numWidgets  []int
+    maxWait     []time.Duration
+    totalWait   []time.Duration
+    maxLatency  []time.Duration     // Since production, up to the handover to a consumer
+    totalLatency []time.Duration
+}
+
+func newPrioritizer(env *environment, capacity int, classes int, names []string, sequence string, aging time.Duration, weights []int) *Prioritizer {
+    return &Prioritizer{env: env, capacity: capacity, aging: aging, weights: weights, names: names, sequence: sequence, queues: make([][]Widget, classes), arrivals: make([][]time.Time, classes),
+        numWidgets: make([]int, classes), maxWait: make([]time.Duration, classes), totalWait: make([]time.Duration, classes),
+        maxLatency: make([]time.Duration, classes), totalLatency: make([]time.Duration, classes)}
+}
+
+// A Widget goes behind the ones of its class which go first by the sequence, and the ones as good as it
+func (prioritizer *Prioritizer) push(wid Widget) {
+    queue := prioritizer.queues[wid.priority]
+    at := len(queue)
+    if prioritizer.sequence != "" && prioritizer.sequence != "fifo" {
+        if i := slices.IndexFunc(queue, func(queued Widget) bool { return prioritizer.before(wid, queued) }); i >= 0 {
+            at = i
+        }
+    }
+    prioritizer.queues[wid.priority] = slices.Insert(queue, at, wid)
+    prioritizer.arrivals[wid.priority] = slices.Insert(prioritizer.arrivals[wid.priority], at, prioritizer.env.now())
+    prioritizer.numWaiting++
+}
+
+// Whether a Widget goes strictly before another, earliest due date first for edd, Widgets without one last, and
+// shortest work first for spt
+func (prioritizer *Prioritizer) before(wid Widget, other Widget) bool {
+    if prioritizer.sequence == "spt" {
+        return wid.work < other.work
+    }
+    return !wid.due.IsZero() && (other.due.IsZero() || wid.due.Before(other.due))
+}
+
+// The class whose oldest Widget goes first, -1 when nothing is waiting
+func (prioritizer *Prioritizer) best() int {
+    if prioritizer.weights != nil {
+        return prioritizer.next()
+    }
+    best, bestRank := -1, 0
+    for class, queue := range prioritizer.queues {
+        if len(queue) == 0 {
+            continue
+        }
+        rank := class
+        if prioritizer.aging > 0 {
+            rank -= int(prioritizer.env.since(prioritizer.arrivals[class][0]) / prioritizer.aging)
+        }
+        if (best < 0 || rank < bestRank) {
+            best, bestRank = class, rank
+        }
+    }
+    return best
+}
+
+// The queue whose turn it is, or the next one with Widgets waiting once its turn is over or it is empty
+// A queue whose turn is over still goes on when it is the only one with Widgets waiting
+func (prioritizer *Prioritizer) next() int {
+    for i := range prioritizer.queues {
+        class := (prioritizer.turn + i) % len(prioritizer.queues)
+        if (len(prioritizer.queues[class]) == 0 || (class == prioritizer.turn && prioritizer.served >= prioritizer.weights[class])) {
+            continue
+        }
+        return class
+    }
+    if len(prioritizer.queues[prioritizer.turn]) > 0 {
+        return prioritizer.turn
+    }
+    return -1
+}
+
+func (prioritizer *Prioritizer) pop(class int) {
+    if class != prioritizer.turn {
+        prioritizer.turn, prioritizer.served = class, 0
+    }
+    prioritizer.served++
+    latency := prioritizer.env.since(prioritizer.queues[class][0].time)
+    prioritizer.totalLatency[class] += latency
+    prioritizer.maxLatency[class] = max(prioritizer.maxLatency[class], latency)
+    wait := prioritizer.env.since(prioritizer.arrivals[class][0])
+    prioritizer.queues[class] = prioritizer.queues[class][1:]
+    prioritizer.arrivals[class] = prioritizer.arrivals[class][1:]
+    prioritizer.numWaiting--
+    prioritizer.numWidgets[class]++
+    prioritizer.totalWait[class] += wait
+    if wait > prioritizer.maxWait[class] {
+        prioritizer.maxWait[class] = wait
+    }
+}
+
+func (prioritizer *Prioritizer) report(out io.Writer) {
+    if prioritizer == nil {
+        return
+    }
+    if (prioritizer.sequence != "") {
+        fmt.Fprintf(out, "[%s dispatch]\n", prioritizer.sequence)
+    }
+    if prioritizer.weights != nil {
+        weights := make([]string, len(prioritizer.weights))
+        for class, weight := range prioritizer.weights {
+            weights[class] = strconv.Itoa(weight)
+        }
+        fmt.Fprintf(out, "[weighted round-robin drain %s]\n", strings.Join(weights, "/"))
+    }
+    for class := range prioritizer.queues {
+        meanWait, meanLatency := time.Duration(0), time.Duration(0)
+        if prioritizer.numWidgets[class] > 0 {
+            meanWait = prioritizer.totalWait[class] / time.Duration(prioritizer.numWidgets[class])
+            meanLatency = prioritizer.totalLatency[class] / time.Duration(prioritizer.numWidgets[class])
+        }
+        queue := "class " + strconv.Itoa(class)
+        if prioritizer.names != nil {
+            queue = "queue " + prioritizer.names[class]
+        }
+        fmt.Fprintf(out, "Priority %s: [ %d ] widgets waited [ %s ] on average, [ %s ] at most, latency [ %s ] on average, [ %s ] at most.\n",
+            queue, prioritizer.numWidgets[class], meanWait, prioritizer.maxWait[class], meanLatency, prioritizer.maxLatency[class])
+    }
+}
+
+// The priority stage quits once the inWidgetChannel is closed and every Widget waiting has been handed over
+// Its waits are put down to whichever of taking or offering a Widget ended them
+func priorityLine(wg *sync.WaitGroup, prioritizer *Prioritizer, inWidgetChannel <-chan Widget, inEdge *Edge, outWidgetChannel chan<- Widget, outEdge *Edge,
+    quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(outWidgetChannel)
+    for {
+        class := prioritizer.best()
+        if (inWidgetChannel == nil && class < 0) {
+            return
+        }
+        // Only offer a Widget when one is waiting, and take more only while there is room, a nil channel is never ready
+        var offerChannel chan<- Widget
+        var offer Widget
+        if class >= 0 {
+            offerChannel, offer = outWidgetChannel, prioritizer.queues[class][0]
+        }
+        takeChannel := inWidgetChannel
+        if prioritizer.numWaiting >= prioritizer.capacity {
+            takeChannel = nil
+        }
+        timeWait := inEdge.begin()
+        select {
+        case workingWidget, ok := <-takeChannel:
+            if !ok {
+                inWidgetChannel = nil
+                continue
+            }
+            inEdge.received(timeWait)
+            prioritizer.push(workingWidget)
+        case offerChannel <- offer:
+            outEdge.sent(timeWait)
+            prioritizer.pop(class)
+        case <-quitChannel:
+            return
+        }
+    }
+}
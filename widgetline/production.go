@@ -0,0 +1,222 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/production.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "time"
+    "math/rand"
+    "sync"
+    "context"
+)
+
+type Producer struct {
+    env         *environment
+    name        string
+    serials     *SerialAllocator    // Shared by all Producers of the line, nil for random ids
+    meter       *EnergyMeter
+    machine     *Machine            // nil when machines never break down
+    seq         *int                // Sequence number of the last Widget produced
+    defects     *DefectChain        // nil when Widgets are never defective
+    priorities  int                 // Number of priority classes the Widgets are spread over, 0 without priority dispatch
+    mix         []int               // Share of the Widgets every class gets, nil for an even mix
+    allowance   time.Duration       // From making a Widget to its due date, 0 without due dates
+    weight      float64             // Of the Widgets with a due date
+    work        time.Duration       // Consuming every Widget of the Producer takes this much longer
+    payloadSize int                 // Bytes of random payload in every Widget, 0 for none
+    validator   *Validator
+    quotas      *Quotas
+    enqueuer    *Enqueuer
+    holds       *Holds              // Pausing the Producer while a rule says so
+    feedback    *Feedback
+    kanban      *Kanban
+    takt        *Takt
+    bucket      *TokenBucket        // Limiting the Producer to its production rate
+    audit       *JobAudit
+    tracer      *Tracer
+    stats       *Stats
+    limits      StageLimits
+    board       *Board
+    lifecycle   *Lifecycle
+    recorder    *Recorder
+    checker     *Checker
+    random      *rand.Rand          // Drawn from by the goroutine of the Producer only
+}
+
+// The process when a Producer produces a Widget
+func (prod Producer) produce(broken bool) Widget {
+    prod.meter.produced()
+    *prod.seq++
+    timeMade := prod.env.now()
+    wid := Widget{id: prod.env.makeId(prod.random, timeMade), source: prod.name, time: timeMade, broken: broken, seq: *prod.seq, defective: prod.defects.next(),
+        work: prod.work}
+    if prod.allowance > 0 {
+        wid.due, wid.weight = wid.time.Add(prod.allowance), prod.weight
+    }
+    if (prod.priorities > 0 && prod.mix == nil) {
+        wid.priority = prod.random.Intn(prod.priorities)
+    } else if prod.priorities > 0 {
+        wid.priority = drawClass(prod.random, prod.mix)
+    }
+    if prod.payloadSize > 0 {
+        wid.payload = make([]byte, prod.payloadSize)
+        prod.random.Read(wid.payload)
+    }
+    if prod.serials != nil {
+        wid.id = prod.serials.reserve()
+    }
+    wid.checksum = wid.sum()
+    wid = prod.validator.malform(wid, prod.random)
+    switch {
+    case wid.broken:
+        wid.cause = CAUSE_INJECTED
+    case wid.defective:
+        wid.cause = CAUSE_RANDOM_DEFECT
+    }
+    prod.lifecycle.move(wid, STATE_CREATED)
+    if prod.env.logging(LEVEL_VERBOSE) {
+        prod.env.logEvent(MSG_PRODUCE, prod.name, wid.id, wid.time.Format(TIME_FORMAT), wid.broken)
+    }
+    prod.stats.produced(prod.name)
+    prod.board.finished("producer", prod.name)
+    prod.recorder.produced(wid)
+    prod.checker.produced()
+    return wid
+}
+
+// Hand out jobs to the Producers until interrupted or the line stops, for runs without a fixed number of widgets
+func jobLine(wg *sync.WaitGroup, jobChannel chan<- int, jobEdge *Edge, interruptChannel <-chan struct{}, quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(jobChannel)
+    for i := 1; ; i++ {
+        timeSend := jobEdge.begin()
+        select {
+        case jobChannel <- i:
+            jobEdge.sent(timeSend)
+        case <-interruptChannel:
+            return
+        case <-quitChannel:
+            return
+        }
+    }
+}
+
+// jobChannel will be used to keep track of how many widgets got produced, and which widget is broken
+func productionLine(wg *sync.WaitGroup, producerTable []Producer, numWidgets int, numKth int, policy *StopPolicy, jobChannel <-chan int, jobEdge *Edge,
+    outWidgetChannel chan<- Widget, outEdge *Edge, quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(outWidgetChannel)
+    var productionWaitGroup sync.WaitGroup
+
+    productionWaitGroup.Add(len(producerTable))
+    for _, workingProducer := range producerTable {
+        go func(workingProducer Producer) {
+            defer productionWaitGroup.Done()
+            timeBegin, busyTime := workingProducer.env.now(), time.Duration(0)
+            defer func() { workingProducer.meter.idle(workingProducer.env.since(timeBegin) - busyTime) }()
+            defer workingProducer.machine.stop()
+            defer workingProducer.board.working(workingProducer.name, "stopped", "")
+            workingProducer.board.working(workingProducer.name, "waiting for a job", "")
+            timeWait := jobEdge.begin()
+            for i := range jobChannel {
+                jobEdge.received(timeWait)
+                timeJob := workingProducer.env.now()
+                select {
+                default:
+                    if paused, _ := workingProducer.holds.paused(workingProducer.name); paused {
+                        workingProducer.board.working(workingProducer.name, "paused", "")
+                    }
+                    if !workingProducer.holds.wait(workingProducer.name, quitChannel) {
+                        return
+                    }
+                    if !workingProducer.feedback.respond(workingProducer.name, workingProducer.board, quitChannel) {
+                        return
+                    }
+                    if !workingProducer.takt.pace(workingProducer.name, workingProducer.board, quitChannel) {
+                        return
+                    }
+                    if !workingProducer.bucket.take(workingProducer.board, quitChannel) {
+                        return
+                    }
+                    if !workingProducer.kanban.start(workingProducer.name, workingProducer.board, quitChannel) {
+                        return
+                    }
+                    workingProducer.board.working(workingProducer.name, "operating its machine", "")
+                    if !workingProducer.machine.operate(quitChannel) {
+                        return
+                    }
+                    workingProducer.limits.produce.acquire(context.Background())
+                    timeProduce := workingProducer.env.now()
+                    workingWidget := workingProducer.produce(policy.breaks(i, numKth))
+                    workingProducer.kanban.produced(workingWidget)
+                    workingProducer.audit.produced(i, workingWidget)
+                    workingProducer.tracer.produced(workingWidget, timeJob)
+                    busyTime += workingProducer.env.since(timeProduce)
+                    workingProducer.limits.produce.release()
+                    // A Widget shed over quota or by a full queue is not output of the machine
+                    shed := false
+                    if workingProducer.validator.pass(workingWidget) {
+                        workingProducer.board.working(workingProducer.name, "waiting for quota", workingWidget.id)
+                        workingProducer.lifecycle.move(workingWidget, STATE_QUEUED)
+                        admitted, ok := workingProducer.quotas.admit(workingWidget, quitChannel)
+                        if !ok {
+                            return
+                        }
+                        enqueued := false
+                        if admitted {
+                            workingProducer.board.working(workingProducer.name, "enqueuing", workingWidget.id)
+                            if enqueued, ok = workingProducer.enqueuer.enqueue(workingWidget, outWidgetChannel, outEdge, quitChannel); !ok {
+                                return
+                            }
+                        }
+                        shed = !enqueued
+                    }
+                    workingProducer.board.working(workingProducer.name, "waiting for a job", "")
+                    if (!shed && !workingProducer.machine.produced(!workingWidget.good(), quitChannel)) {
+                        return
+                    }
+                    timeWait = jobEdge.begin()
+                case <-quitChannel:
+                    return
+                }
+            }
+        }(workingProducer)
+    }
+    productionWaitGroup.Wait()
+}
+
+// Re-drive a recorded arrival pattern, every Widget is produced at the same offset from the start of the line as it was recorded
+func replayLine(env *environment, wg *sync.WaitGroup, arrivals []Arrival, lifecycle *Lifecycle, recorder *Recorder, checker *Checker, outWidgetChannel chan<- Widget, outEdge *Edge,
+    quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(outWidgetChannel)
+    seqs := make(map[string]int)
+
+    for _, arrival := range arrivals {
+        select {
+        case <-time.After(env.until(recorder.timeBegin.Add(arrival.Offset))):
+            seqs[arrival.Source]++
+            timeMade := env.now()
+            wid := Widget{id: env.makeId(env.random, timeMade), source: arrival.Source, time: timeMade, broken: arrival.Broken, seq: seqs[arrival.Source],
+                defective: arrival.Defective, cause: arrival.Cause, priority: arrival.Priority, weight: arrival.Weight, work: arrival.Work}
+            if arrival.Due > 0 {
+                wid.due = wid.time.Add(arrival.Due)
+            }
+            lifecycle.move(wid, STATE_CREATED)
+            recorder.produced(wid)
+            checker.produced()
+            lifecycle.move(wid, STATE_QUEUED)
+            timeSend := outEdge.begin()
+            select {
+            case outWidgetChannel <- wid:
+                outEdge.sent(timeSend)
+            case <-quitChannel:
+                return
+            }
+        case <-quitChannel:
+            return
+        }
+    }
+}
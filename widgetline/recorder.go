@@ -0,0 +1,269 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/recorder.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "sync"
+    "sort"
+)
+
+// Recorder keeps track of the arrival pattern and the outcome of a run
+type Recorder struct {
+    env             *environment
+    mutex           sync.Mutex
+    timeBegin       time.Time
+    keepArrivals    bool        // Unbounded runs only keep the counters
+    warmup          time.Duration
+    settling        bool        // The warm-up lasts until the line is steady, see settle
+    settled         bool        // The warm-up ended once the line got steady
+    arrivals        []Arrival
+    issued          map[string]bool     // Ids of the Widgets produced, kept along with the arrivals
+    numCollisions   int
+    numProduced     int
+    numConsumed     int
+    numWarmup       int         // Widgets consumed before the warm-up was over, part of numConsumed
+    warmupLatency   time.Duration
+    warmupMaxLatency time.Duration
+    numInterrupted  int
+    broken          *BrokenWidgetError  // The broken Widget which stopped the line
+    failures        map[string]int
+    failuresBySource map[string]int
+    failuresByKind  map[string]int
+    rejects         map[string]int  // Widgets rejected at production, by reason
+    annotations     []Annotation
+    numDerived      int
+    derivations     []Derivation
+    totalLatency    time.Duration
+    maxLatency      time.Duration
+    endpoint        *MetricsEndpoint    // Counted on next to the Metrics of the services, nil without one
+    pareto          bool        // The report breaks the defects down by cause
+}
+
+func newRecorder(env *environment, keepArrivals bool, warmup time.Duration) *Recorder {
+    return &Recorder{env: env, timeBegin: env.now(), keepArrivals: keepArrivals, warmup: warmup, issued: make(map[string]bool)}
+}
+
+// Count on the Metrics of the services and on the endpoint of the run
+func (recorder *Recorder) count(name string, delta int) {
+    recorder.env.services.Metrics.Count(name, delta)
+    recorder.endpoint.Count(name, delta)
+}
+
+func (recorder *Recorder) observe(name string, value float64) {
+    recorder.env.services.Metrics.Observe(name, value)
+    recorder.endpoint.Observe(name, value)
+}
+
+func (recorder *Recorder) produced(wid Widget) {
+    recorder.count("produced", 1)
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    recorder.numProduced++
+    if recorder.keepArrivals {
+        if recorder.issued[wid.id] {
+            recorder.numCollisions++
+        }
+        recorder.issued[wid.id] = true
+        arrival := Arrival{Offset: wid.time.Sub(recorder.timeBegin), Source: wid.source, Broken: wid.broken, Defective: wid.defective, Cause: wid.cause,
+            Priority: wid.priority, Weight: wid.weight, Work: wid.work}
+        if !wid.due.IsZero() {
+            arrival.Due = wid.due.Sub(wid.time)
+        }
+        recorder.arrivals = append(recorder.arrivals, arrival)
+    }
+}
+
+func (recorder *Recorder) derived(parent Widget, child Widget) {
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    recorder.numDerived++
+    if recorder.keepArrivals {
+        recorder.derivations = append(recorder.derivations, Derivation{parent.id, child.id})
+    }
+}
+
+func (recorder *Recorder) consumed(latency time.Duration) {
+    recorder.count("consumed", 1)
+    recorder.observe("latency_seconds", latency.Seconds())
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    recorder.numConsumed++
+    if (recorder.settling || recorder.env.since(recorder.timeBegin) < recorder.warmup) {
+        recorder.numWarmup++
+        recorder.warmupLatency += latency
+        recorder.warmupMaxLatency = max(recorder.warmupMaxLatency, latency)
+        return
+    }
+    recorder.totalLatency += latency
+    if latency > recorder.maxLatency {
+        recorder.maxLatency = latency
+    }
+}
+
+// Count a Widget which is not good by its cause, its Producer and whether it is broken, good Widgets have no cause
+func (recorder *Recorder) failed(wid Widget) {
+    if wid.cause == "" {
+        return
+    }
+    recorder.count("failed", 1)
+    if wid.broken {
+        recorder.count("broken", 1)
+    }
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    if recorder.failures == nil {
+        recorder.failures = make(map[string]int)
+        recorder.failuresBySource = make(map[string]int)
+        recorder.failuresByKind = make(map[string]int)
+    }
+    recorder.failures[wid.cause]++
+    recorder.failuresBySource[wid.source]++
+    if wid.broken {
+        recorder.failuresByKind["broken"]++
+    } else {
+        recorder.failuresByKind["defective"]++
+    }
+}
+
+// The consumer stopped the line on a broken Widget, the first one counts
+func (recorder *Recorder) stoppedBy(consumer string, wid Widget) {
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    if recorder.broken == nil {
+        recorder.broken = &BrokenWidgetError{consumer, wid.id, wid.cause}
+    }
+}
+
+func (recorder *Recorder) rejected(reason string) {
+    recorder.count("rejected", 1)
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    if recorder.rejects == nil {
+        recorder.rejects = make(map[string]int)
+    }
+    recorder.rejects[reason]++
+}
+
+func (recorder *Recorder) annotated(text string) {
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    recorder.annotations = append(recorder.annotations, Annotation{recorder.env.since(recorder.timeBegin), text})
+}
+
+func (recorder *Recorder) interrupted() {
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    recorder.numInterrupted++
+}
+
+// End the warm-up now the line is steady, returning how long it lasted
+func (recorder *Recorder) settle() time.Duration {
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    recorder.settling, recorder.settled, recorder.warmup = false, true, recorder.env.since(recorder.timeBegin)
+    return recorder.warmup
+}
+
+func (recorder *Recorder) consumedSoFar() int {
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    return recorder.numConsumed
+}
+
+// Broken and defective Widgets consumed so far
+func (recorder *Recorder) brokenSoFar() int {
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    return recorder.failuresByKind["broken"]
+}
+
+// Whether a broken Widget has stopped the line so far
+func (recorder *Recorder) stoppedSoFar() bool {
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    return recorder.broken != nil
+}
+
+func (recorder *Recorder) failedSoFar() int {
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    numFailed := 0
+    for _, count := range recorder.failures {
+        numFailed += count
+    }
+    return numFailed
+}
+
+// The counters so far, for reports made while the line is running, Widgets consumed during the warm-up are left out
+func (recorder *Recorder) counters() (numProduced int, numConsumed int, totalLatency time.Duration) {
+    recorder.mutex.Lock()
+    defer recorder.mutex.Unlock()
+    return recorder.numProduced, recorder.numConsumed - recorder.numWarmup, recorder.totalLatency
+}
+
+func (recorder *Recorder) recording(config LineConfig, violations []string) Recording {
+    outcome := Outcome{Duration: recorder.env.since(recorder.timeBegin), NumProduced: recorder.numProduced, NumConsumed: recorder.numConsumed, NumDerived: recorder.numDerived, MaxLatency: recorder.maxLatency,
+        NumWarmup: recorder.numWarmup, NumInterrupted: recorder.numInterrupted, Collisions: recorder.numCollisions, Failures: recorder.failures,
+        FailuresBySource: recorder.failuresBySource, FailuresByKind: recorder.failuresByKind, Rejects: recorder.rejects, Violations: violations}
+    warmup, totalLatency := recorder.warmup, recorder.totalLatency
+    if recorder.settling {
+        // A line which never got steady is measured as a whole
+        warmup, totalLatency, outcome.NumWarmup = 0, recorder.warmupLatency, 0
+        outcome.MaxLatency = recorder.warmupMaxLatency
+    }
+    if numMeasured := outcome.NumConsumed - outcome.NumWarmup; numMeasured > 0 {
+        outcome.MeanLatency = totalLatency / time.Duration(numMeasured)
+        if outcome.Duration > warmup {
+            outcome.Throughput = float64(numMeasured) / (outcome.Duration - warmup).Seconds()
+        }
+    }
+    return Recording{config, recorder.arrivals, outcome, recorder.annotations, recorder.derivations, nil}
+}
+
+// Report the consumes interrupted by the stop, the defects by cause if asked, and what the statistics of warm-up runs are made of
+func (recorder *Recorder) report(out io.Writer) {
+    if (recorder.numInterrupted > 0) {
+        fmt.Fprintf(out, "[%d consumes interrupted mid-flight]\n", recorder.numInterrupted)
+    }
+    if (recorder.pareto && len(recorder.failures) > 0) {
+        PrintPareto(out, Pareto{"cause", recorder.failures})
+    }
+    reasons := make([]string, 0, len(recorder.rejects))
+    for reason := range recorder.rejects {
+        reasons = append(reasons, reason)
+    }
+    sort.Strings(reasons)
+    for _, reason := range reasons {
+        fmt.Fprintf(out, "Rejected at production for %s: [ %d ]\n", reason, recorder.rejects[reason])
+    }
+    if recorder.settling {
+        fmt.Fprintln(out, "[steady state never reached, statistics cover the whole run]")
+        return
+    }
+    if recorder.warmup == 0 {
+        return
+    }
+    outcome := recorder.recording(LineConfig{}, nil).Outcome
+    transient := recorder.warmup
+    if outcome.Duration < transient {
+        transient = outcome.Duration
+    }
+    meanLatency := time.Duration(0)
+    if recorder.numWarmup > 0 {
+        meanLatency = recorder.warmupLatency / time.Duration(recorder.numWarmup)
+    }
+    fmt.Fprintf(out, "[transient phase of %s] consumed [ %d ] throughput [ %.1f/s ] mean latency [ %s ] max latency [ %s ]\n",
+        transient, recorder.numWarmup, float64(recorder.numWarmup) / transient.Seconds(), meanLatency, recorder.warmupMaxLatency)
+    phase := "statistics after %s warm-up"
+    if recorder.settled {
+        phase = "steady phase after %s"
+    }
+    fmt.Fprintf(out, "[" + phase + "] consumed [ %d ] excluded [ %d ] throughput [ %.1f/s ] mean latency [ %s ] max latency [ %s ]\n",
+        recorder.warmup, outcome.NumConsumed - outcome.NumWarmup, outcome.NumWarmup, outcome.Throughput, outcome.MeanLatency, outcome.MaxLatency)
+}
@@ -0,0 +1,142 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/recording.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "fmt"
+    "time"
+)
+
+// Derivation links a Widget derived by the Transformer to its parent
+type Derivation struct {
+    Parent  string  `json:"parent"`
+    Child   string  `json:"child"`
+}
+
+// Arrival is a Widget being produced, offset from the start of the line
+type Arrival struct {
+    Offset  time.Duration   `json:"offset"`
+    Source  string          `json:"source"`
+    Broken  bool            `json:"broken"`
+    Defective   bool        `json:"defective,omitempty"`
+    Cause       string      `json:"cause,omitempty"`
+    Priority    int         `json:"priority,omitempty"`
+    Due         time.Duration   `json:"due,omitempty"`    // From the arrival to its due date, 0 without one
+    Weight      float64     `json:"weight,omitempty"`
+    Work        time.Duration   `json:"work,omitempty"`
+}
+
+// Outcome summarizes how a run of the line went
+type Outcome struct {
+    Duration    time.Duration   `json:"duration"`
+    NumProduced int             `json:"produced"`
+    NumConsumed int             `json:"consumed"`
+    NumDerived  int             `json:"derived,omitempty"`        // Widgets derived by the Transformer, part of NumConsumed once consumed
+    MeanLatency time.Duration   `json:"mean_latency"`
+    MaxLatency  time.Duration   `json:"max_latency"`
+    Throughput  float64         `json:"throughput"`               // Widgets consumed per second once warmed up
+    NumWarmup   int             `json:"warmup,omitempty"`         // Widgets consumed during the warm-up, left out of the latencies and the throughput
+    NumInterrupted  int         `json:"interrupted,omitempty"`    // Consumes cut short by the line stopping
+    NumDiscarded    int         `json:"discarded,omitempty"`      // Jobs thrown away unproduced when the run was interrupted
+    Failures    map[string]int  `json:"failures,omitempty"`       // Broken and defective Widgets consumed, by cause
+    FailuresBySource    map[string]int  `json:"failures_by_source,omitempty"`    // The same Widgets by the Producer which made them
+    FailuresByKind      map[string]int  `json:"failures_by_kind,omitempty"`      // The same Widgets, broken or defective
+    Rejects     map[string]int  `json:"rejects,omitempty"`        // Malformed Widgets rejected at production, by reason
+    Violations  []string        `json:"violations,omitempty"`     // Invariants violated and goroutines leaked during the run
+    Census      map[string]int  `json:"census,omitempty"`         // Widgets in every state of their lifecycle at the end
+    Irregular   *int            `json:"irregular,omitempty"`      // Sequence numbers missing, out of order or duplicated, nil without -gaps
+    Resources   *Resources      `json:"resources,omitempty"`      // CPU, memory and garbage collection of the run
+    Tardiness   *Tardiness      `json:"tardiness,omitempty"`      // Widgets consumed past their due date, nil without -due
+    Wip         []StageWip      `json:"wip,omitempty"`            // Work in process of every stage, nil without -kanban or -wip
+    Stats       []WorkerStats   `json:"stats,omitempty"`          // Of every Producer and consumer, nil without -stats
+    Takt        *TaktAdherence  `json:"takt,omitempty"`           // How closely the Widgets consumed kept to the takt time, nil without -takt
+    Verdict     *Verdict        `json:"verdict,omitempty"`        // Of the run on its criteria, nil without -verdict
+    Collisions  int             `json:"collisions,omitempty"`     // Widgets produced with the id of another, not looked for in unbounded runs
+}
+
+// StageWip is how many Widgets were in process in a stage of the line
+type StageWip struct {
+    Stage       string          `json:"stage"`
+    Cards       int             `json:"cards,omitempty"`          // Kanban cards of the stage, 0 when not limited
+    Mean        float64         `json:"mean"`                     // Over the time of the run
+    Max         int             `json:"max"`
+    NumWaits    int             `json:"waits,omitempty"`          // Times a card was waited for
+    Waited      time.Duration   `json:"waited,omitempty"`
+}
+
+// Recording is everything needed to re-drive a run through a modified configuration
+type Recording struct {
+    Config      LineConfig      `json:"config"`
+    Arrivals    []Arrival       `json:"arrivals"`
+    Outcome     Outcome         `json:"outcome"`
+    Annotations []Annotation    `json:"annotations,omitempty"`
+    Derivations []Derivation    `json:"derivations,omitempty"`
+    err         error           // The failures of the run, only known to the process which ran it
+}
+
+// What went wrong in the run, nil for a run without failures or a recording read back from a file
+// Every failure wraps one of ErrBrokenWidget, ErrQueueFull, ErrStageTimeout or ErrVerificationFailed
+func (recording Recording) Err() error {
+    return recording.err
+}
+
+//==============================================================================
+// Recordings are read and written through the Store and Codec of the default services
+func ReadRecording(fileName string) (Recording, error) {
+    data, err := DefaultServices().Store.ReadFile(fileName)
+    if err != nil {
+        return Recording{}, err
+    }
+    return decodeRecording(data)
+}
+
+// Settings added since the recording was made keep their defaults
+func decodeRecording(data []byte) (Recording, error) {
+    recording := Recording{Config: DefaultConfig()}
+    if err := DefaultServices().Codec.Unmarshal(data, &recording); err != nil {
+        return recording, err
+    }
+    return recording, recording.validate()
+}
+
+// Reject recordings that cannot be replayed
+func (recording Recording) validate() error {
+    if err := recording.Config.Check(); err != nil {
+        return err
+    }
+    if len(recording.Arrivals) > recording.Config.NumWidgets {
+        return fmt.Errorf("recording has %d arrivals but only %d widgets", len(recording.Arrivals), recording.Config.NumWidgets)
+    }
+    numBroken := 0
+    for _, arrival := range recording.Arrivals {
+        if arrival.Broken {
+            numBroken++
+        }
+    }
+    if policy, _ := parseStopPolicy(recording.Config.StopPolicy); ((numBroken > 1 && policy.halts()) || (numBroken > 0 && recording.Config.NumKth <= 0)) {
+        return fmt.Errorf("recording has %d broken arrivals with k=%d", numBroken, recording.Config.NumKth)
+    }
+    return nil
+}
+
+func WriteRecording(fileName string, recording Recording) error {
+    services := DefaultServices()
+    data, err := services.Codec.Marshal(recording)
+    if err != nil {
+        return err
+    }
+    return services.Store.WriteFile(fileName, data)
+}
+
+// Write the outcome of a run alone, for the programs which only need to know how it went
+func WriteSummary(fileName string, outcome Outcome) error {
+    services := DefaultServices()
+    data, err := services.Codec.Marshal(outcome)
+    if err != nil {
+        return err
+    }
+    return services.Store.WriteFile(fileName, data)
+}
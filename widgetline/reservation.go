@@ -0,0 +1,215 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/reservation.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strconv"
+    "sync"
+    "net"
+    "net/http"
+    "context"
+    "encoding/json"
+    "slices"
+)
+
+// LeasedWidget is a Widget as an external system sees it
+type LeasedWidget struct {
+    Id          string      `json:"id"`
+    Source      string      `json:"source"`
+    Time        time.Time   `json:"time"`
+    Broken      bool        `json:"broken"`
+    Defective   bool        `json:"defective"`
+    Cause       string      `json:"cause,omitempty"`
+    Priority    int         `json:"priority"`
+}
+
+// Lease is a batch of Widgets reserved by an external system until it confirms or releases them, or the lease expires
+type Lease struct {
+    Id          string          `json:"lease,omitempty"`
+    Widgets     []LeasedWidget  `json:"widgets"`
+    Expires     time.Time       `json:"expires,omitzero"`
+}
+
+// Reservation is a Widget handed out by a consumer of the external group, waiting to be confirmed
+type Reservation struct {
+    wid         Widget
+    confirmed   chan struct{}
+    withdrawn   bool            // The consumer stopped waiting, the Widget must not be handed out again
+}
+
+// ReservationDesk serves the Widgets of the external group to external systems over HTTP: POST /reserve?n=<n>&lease=<d>
+// leases up to n waiting Widgets, POST /leases/<id>/confirm consumes them and POST /leases/<id>/release puts them back
+// A nil ReservationDesk serves nothing
+type ReservationDesk struct {
+    env         *environment
+    mutex       sync.Mutex
+    maxLease    time.Duration
+    waiting     []*Reservation      // Oldest first, released and expired ones go back to the front
+    leases      map[string][]*Reservation
+    timers      map[string]*time.Timer
+    numLeases   int
+    numReserved int
+    numConfirmed int
+    numReleased int
+    numExpired  int
+    listener    net.Listener
+    server      *http.Server
+}
+
+func newReservationDesk(env *environment, address string, maxLease time.Duration) (*ReservationDesk, error) {
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        return nil, err
+    }
+    desk := &ReservationDesk{env: env, maxLease: maxLease, leases: make(map[string][]*Reservation), timers: make(map[string]*time.Timer), listener: listener}
+    mux := http.NewServeMux()
+    mux.HandleFunc("POST /reserve", desk.serveReserve)
+    mux.HandleFunc("POST /leases/{lease}/confirm", desk.serveConfirm)
+    mux.HandleFunc("POST /leases/{lease}/release", desk.serveRelease)
+    desk.server = &http.Server{Handler: mux}
+    go desk.server.Serve(listener)
+    fmt.Fprintf(env.services.Report, "[reservations] served on http://%s\n", listener.Addr())
+    return desk, nil
+}
+
+// Hand the Widget out and wait until an external system confirms it, the error is the one of ctx when it is done first
+func (desk *ReservationDesk) handOut(ctx context.Context, wid Widget) error {
+    reservation := &Reservation{wid: wid, confirmed: make(chan struct{})}
+    desk.mutex.Lock()
+    desk.waiting = append(desk.waiting, reservation)
+    desk.mutex.Unlock()
+    select {
+    case <-reservation.confirmed:
+        return nil
+    case <-ctx.Done():
+        desk.mutex.Lock()
+        defer desk.mutex.Unlock()
+        reservation.withdrawn = true
+        desk.waiting = slices.DeleteFunc(desk.waiting, func(waiting *Reservation) bool { return waiting == reservation })
+        return ctx.Err()
+    }
+}
+
+// Lease up to n waiting Widgets, an empty lease without an id when none are waiting
+func (desk *ReservationDesk) reserve(n int, duration time.Duration) Lease {
+    desk.mutex.Lock()
+    defer desk.mutex.Unlock()
+    lease := Lease{Widgets: []LeasedWidget{}}
+    reservations := desk.waiting[:min(n, len(desk.waiting))]
+    if len(reservations) == 0 {
+        return lease
+    }
+    desk.waiting = desk.waiting[len(reservations):]
+    for _, reservation := range reservations {
+        wid := reservation.wid
+        lease.Widgets = append(lease.Widgets, LeasedWidget{wid.id, wid.source, wid.time, wid.broken, wid.defective, wid.cause, wid.priority})
+    }
+    desk.numLeases++
+    desk.numReserved += len(reservations)
+    lease.Id, lease.Expires = "lease_" + strconv.Itoa(desk.numLeases), desk.env.now().Add(duration)
+    desk.leases[lease.Id] = reservations
+    desk.timers[lease.Id] = time.AfterFunc(duration, func() { desk.release(lease.Id, true) })
+    desk.env.logEvent(MSG_RESERVE, lease.Id, len(reservations), duration)
+    return lease
+}
+
+// Consume the Widgets of the lease, reporting false when it is unknown or has expired
+func (desk *ReservationDesk) confirm(id string) bool {
+    desk.mutex.Lock()
+    defer desk.mutex.Unlock()
+    reservations, ok := desk.leases[id]
+    if !ok {
+        return false
+    }
+    desk.timers[id].Stop()
+    delete(desk.leases, id)
+    delete(desk.timers, id)
+    for _, reservation := range reservations {
+        close(reservation.confirmed)
+    }
+    desk.numConfirmed += len(reservations)
+    desk.env.logEvent(MSG_CONFIRM, id, len(reservations))
+    return true
+}
+
+// Put the Widgets of the lease back in front of the waiting ones, reporting false when it is unknown or has expired
+func (desk *ReservationDesk) release(id string, expired bool) bool {
+    desk.mutex.Lock()
+    defer desk.mutex.Unlock()
+    reservations, ok := desk.leases[id]
+    if !ok {
+        return false
+    }
+    desk.timers[id].Stop()
+    delete(desk.leases, id)
+    delete(desk.timers, id)
+    reservations = slices.DeleteFunc(reservations, func(reservation *Reservation) bool { return reservation.withdrawn })
+    desk.waiting = append(reservations, desk.waiting...)
+    if expired {
+        desk.numExpired += len(reservations)
+        desk.env.logEvent(MSG_RELEASE, id, len(reservations), "expired")
+    } else {
+        desk.numReleased += len(reservations)
+        desk.env.logEvent(MSG_RELEASE, id, len(reservations), "released")
+    }
+    return true
+}
+
+func (desk *ReservationDesk) serveReserve(writer http.ResponseWriter, request *http.Request) {
+    n, duration := 1, desk.maxLease
+    var err error
+    if value := request.URL.Query().Get("n"); value != "" {
+        if n, err = strconv.Atoi(value); (err != nil || n < 1) {
+            http.Error(writer, "n must be a positive number of widgets", http.StatusBadRequest)
+            return
+        }
+    }
+    if value := request.URL.Query().Get("lease"); value != "" {
+        if duration, err = time.ParseDuration(value); (err != nil || duration <= 0 || duration > desk.maxLease) {
+            http.Error(writer, "lease must be a positive duration up to " + desk.maxLease.String(), http.StatusBadRequest)
+            return
+        }
+    }
+    writer.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(writer).Encode(desk.reserve(n, duration))
+}
+
+func (desk *ReservationDesk) serveConfirm(writer http.ResponseWriter, request *http.Request) {
+    if !desk.confirm(request.PathValue("lease")) {
+        http.Error(writer, "no such lease, it may have expired", http.StatusNotFound)
+        return
+    }
+    writer.WriteHeader(http.StatusNoContent)
+}
+
+func (desk *ReservationDesk) serveRelease(writer http.ResponseWriter, request *http.Request) {
+    if !desk.release(request.PathValue("lease"), false) {
+        http.Error(writer, "no such lease, it may have expired", http.StatusNotFound)
+        return
+    }
+    writer.WriteHeader(http.StatusNoContent)
+}
+
+// Stop serving, the external group is done with every Widget by then
+func (desk *ReservationDesk) close() {
+    if desk == nil {
+        return
+    }
+    desk.server.Close()
+}
+
+func (desk *ReservationDesk) report(out io.Writer) {
+    if desk == nil {
+        return
+    }
+    desk.mutex.Lock()
+    defer desk.mutex.Unlock()
+    fmt.Fprintf(out, "[reservations on %s] leases [ %d ] reserved [ %d ] confirmed [ %d ] released [ %d ] expired [ %d ]\n",
+        desk.listener.Addr(), desk.numLeases, desk.numReserved, desk.numConfirmed, desk.numReleased, desk.numExpired)
+}
@@ -0,0 +1,163 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/resources.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strings"
+    "runtime"
+    "runtime/pprof"
+    "context"
+    "bytes"
+    "strconv"
+    "slices"
+    "syscall"
+)
+
+const LEAK_GRACE = 100 * time.Millisecond
+const LEAK_LABEL = "widgetline_run"     // Profiler label of the goroutines of a run
+
+//==============================================================================
+// Resources is what a run cost the process, so a configuration can be told by its footprint
+type Resources struct {
+    UserCPU     time.Duration   `json:"user_cpu"`
+    SystemCPU   time.Duration   `json:"system_cpu"`
+    PeakRSS     int64           `json:"peak_rss"`       // Bytes, the peak of the whole process which may predate the run
+    NumGC       uint32          `json:"gc_cycles"`
+    GCPause     time.Duration   `json:"gc_pause"`
+    Allocated   uint64          `json:"allocated"`      // Bytes
+    NumAllocs   uint64          `json:"allocations"`
+}
+
+// ResourceMeter keeps the usage of the process when a run starts, the run is charged what was used since
+type ResourceMeter struct {
+    usage       syscall.Rusage
+    memStats    runtime.MemStats
+}
+
+func newResourceMeter() *ResourceMeter {
+    meter := &ResourceMeter{}
+    syscall.Getrusage(syscall.RUSAGE_SELF, &meter.usage)
+    runtime.ReadMemStats(&meter.memStats)
+    return meter
+}
+
+// The resources used since the meter was made
+func (meter *ResourceMeter) used() Resources {
+    var usage syscall.Rusage
+    var memStats runtime.MemStats
+    syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+    runtime.ReadMemStats(&memStats)
+    peakRSS := int64(usage.Maxrss)
+    if runtime.GOOS != "darwin" {
+        peakRSS *= 1024     // Kilobytes everywhere else
+    }
+    return Resources{
+        UserCPU:    time.Duration(usage.Utime.Nano() - meter.usage.Utime.Nano()),
+        SystemCPU:  time.Duration(usage.Stime.Nano() - meter.usage.Stime.Nano()),
+        PeakRSS:    peakRSS,
+        NumGC:      memStats.NumGC - meter.memStats.NumGC,
+        GCPause:    time.Duration(memStats.PauseTotalNs - meter.memStats.PauseTotalNs),
+        Allocated:  memStats.TotalAlloc - meter.memStats.TotalAlloc,
+        NumAllocs:  memStats.Mallocs - meter.memStats.Mallocs,
+    }
+}
+
+// CPU time in user and system mode together, nothing for an outcome without resources
+func (resources *Resources) CPU() time.Duration {
+    if resources == nil {
+        return 0
+    }
+    return (resources.UserCPU + resources.SystemCPU).Round(time.Microsecond)
+}
+
+func (resources Resources) report(out io.Writer) {
+    const mebibyte = 1 << 20
+    fmt.Fprintf(out, "Resources: CPU [ %s user %s system ] peak RSS [ %.1f MiB ] GC [ %d cycles %s paused ] allocated [ %.1f MiB in %d allocations ]\n",
+        resources.UserCPU.Round(time.Microsecond), resources.SystemCPU.Round(time.Microsecond), float64(resources.PeakRSS) / mebibyte,
+        resources.NumGC, resources.GCPause.Round(time.Microsecond), float64(resources.Allocated) / mebibyte, resources.NumAllocs)
+}
+
+// A size in bytes under 1 KiB, in KiB under 1 MiB, and in MiB from then on
+func formatBytes(numBytes int64) string {
+    switch {
+    case numBytes < 1 << 10:
+        return fmt.Sprintf("%d bytes", numBytes)
+    case numBytes < 1 << 20:
+        return fmt.Sprintf("%.1f KiB", float64(numBytes) / (1 << 10))
+    }
+    return fmt.Sprintf("%.1f MiB", float64(numBytes) / (1 << 20))
+}
+
+//==============================================================================
+// LeakDetector notices goroutines started during a run that are still around once the run is over. The run goes on a
+// goroutine of its own labelled with it, which hands the label down to every goroutine it starts, so only the
+// goroutines of this run are looked for, whatever other runs go on side by side
+type LeakDetector struct {
+    label   string
+}
+
+func newLeakDetector(env *environment) *LeakDetector {
+    return &LeakDetector{fmt.Sprintf("%p", env)}
+}
+
+// Run the line on a goroutine labelled with the run and wait for it, the calling goroutine keeps its own labels
+// A panic of the line is raised again on the calling goroutine
+func (detector *LeakDetector) run(line func() (Recording, error)) (Recording, error) {
+    var recording Recording
+    var err error
+    var panicked any
+    doneChannel := make(chan struct{})
+    go pprof.Do(context.Background(), pprof.Labels(LEAK_LABEL, detector.label), func(context.Context) {
+        defer close(doneChannel)
+        defer func() {
+            panicked = recover()
+        }()
+        recording, err = line()
+    })
+    <-doneChannel
+    if panicked != nil {
+        panic(panicked)
+    }
+    return recording, err
+}
+
+// Stacks of the goroutines carrying the label of the run, one for every goroutine though the profile counts the
+// goroutines of the same stack together
+func (detector *LeakDetector) goroutines() []string {
+    var buffer bytes.Buffer
+    pprof.Lookup("goroutine").WriteTo(&buffer, 1)
+    label := fmt.Sprintf("# labels: {%q:%q}", LEAK_LABEL, detector.label)
+    // The first stack follows the total of the profile on its first line, the stack with the most goroutines
+    _, profile, _ := strings.Cut(buffer.String(), "\n")
+    var stacks []string
+    for _, stack := range strings.Split(profile, "\n\n") {
+        // Every stack starts with "<count> @ <addresses>"
+        if count, err := strconv.Atoi(strings.Fields(stack + " x")[0]); (err == nil && strings.Contains(stack, label)) {
+            stacks = append(stacks, slices.Repeat([]string{stack}, count)...)
+        }
+    }
+    return stacks
+}
+
+// Stack dumps of the goroutines of the run which are still alive after a grace period, the goroutine of the run losing
+// its label first. The grace period leaves time for goroutines which are already on their way out to finish returning
+func (detector *LeakDetector) stragglers(grace time.Duration) []string {
+    pprof.SetGoroutineLabels(context.Background())
+    deadline := time.Now().Add(grace)
+    for {
+        var leaks []string
+        for _, stack := range detector.goroutines() {
+            leaks = append(leaks, "goroutine leaked past the end of the run:\n" + stack)
+        }
+        if (len(leaks) == 0 || time.Now().After(deadline)) {
+            return leaks
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
@@ -0,0 +1,526 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/rules.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+    "sync"
+    "path"
+    "slices"
+)
+
+const RULE_EVERY = 100 * time.Millisecond
+const RULE_WINDOW = time.Second      // Rates and latencies of the rules are taken over this last period
+
+//==============================================================================
+// Metrics rules are evaluated against, rates and latencies over the last RULE_WINDOW
+var ruleMetrics = []string{"queue_depth", "defect_rate", "throughput", "latency"}
+
+// Rule is a reactive operator action: once its condition has held long enough the action is taken, and a paused
+// Producer is resumed as soon as the condition no longer holds
+type Rule struct {
+    spec        string
+    metric      string          // One of ruleMetrics
+    above       bool            // The condition is metric > threshold, or metric < threshold
+    inclusive   bool            // >= or <=
+    threshold   float64         // Percent for defect_rate, Widgets per second for throughput, milliseconds for latency
+    lasting     time.Duration   // How long the condition must hold before the action is taken, 0 for at once
+    action      string          // The action as written
+    scaleBy     int             // Consumers joining, or leaving when negative
+    producer    string          // Producers to pause, as understood by path.Match
+    timeHeld    time.Time       // When the condition started holding, zero while it does not
+    fired       bool
+    numFired    int
+}
+
+// Rules look like [if] <metric> <op> <value>[%] [for <duration>] then <action>, e.g.
+// if queue_depth > 10000 for 30s then scale consumers +2, or defect_rate > 5% then pause producer producer_1
+// The action is scale consumers +<n>|-<n> or pause producer <pattern>
+func parseRule(spec string) (*Rule, error) {
+    usage := fmt.Errorf("rule %q is not of the form [if] <metric> <op> <value> [for <duration>] then scale consumers +<n>|-<n> or pause producer <pattern>", spec)
+    fields := strings.Fields(spec)
+    if (len(fields) > 0 && fields[0] == "if") {
+        fields = fields[1:]
+    }
+    then := slices.Index(fields, "then")
+    if (then != 3 && then != 5) {
+        return nil, usage
+    }
+    rule := &Rule{spec: strings.Join(fields, " "), metric: fields[0], action: strings.Join(fields[then + 1:], " ")}
+    if !slices.Contains(ruleMetrics, rule.metric) {
+        return nil, fmt.Errorf("rule %q: the metric must be one of %s", spec, strings.Join(ruleMetrics, ", "))
+    }
+    switch fields[1] {
+    case ">", ">=":
+        rule.above = true
+    case "<", "<=":
+    default:
+        return nil, usage
+    }
+    rule.inclusive = strings.HasSuffix(fields[1], "=")
+    threshold, err := strconv.ParseFloat(strings.TrimSuffix(fields[2], "%"), 64)
+    if (err != nil || threshold < 0 || strings.HasSuffix(fields[2], "%") != (rule.metric == "defect_rate")) {
+        return nil, fmt.Errorf("rule %q: the value must not be negative, a percentage for defect_rate only", spec)
+    }
+    rule.threshold = threshold
+    if then == 5 {
+        lasting, err := time.ParseDuration(fields[4])
+        if (fields[3] != "for" || err != nil || lasting <= 0) {
+            return nil, fmt.Errorf("rule %q must hold for a positive duration", spec)
+        }
+        rule.lasting = lasting
+    }
+
+    action := fields[then + 1:]
+    switch {
+    case (len(action) == 3 && action[0] == "scale" && action[1] == "consumers"):
+        rule.scaleBy, err = strconv.Atoi(action[2])
+        if (err != nil || rule.scaleBy == 0 || (action[2][0] != '+' && action[2][0] != '-')) {
+            return nil, fmt.Errorf("rule %q must scale the consumers by +<n> or -<n>", spec)
+        }
+    case (len(action) == 3 && action[0] == "pause" && action[1] == "producer"):
+        if _, err := path.Match(action[2], ""); err != nil {
+            return nil, fmt.Errorf("rule %q: %s", spec, err)
+        }
+        rule.producer = action[2]
+    default:
+        return nil, usage
+    }
+    return rule, nil
+}
+
+// Whether the metric meets the condition of the rule
+func (rule *Rule) holds(value float64) bool {
+    switch {
+    case (rule.above && rule.inclusive):
+        return value >= rule.threshold
+    case rule.above:
+        return value > rule.threshold
+    case rule.inclusive:
+        return value <= rule.threshold
+    }
+    return value < rule.threshold
+}
+
+// ruleList is a repeatable flag collecting rules, several may be given at once separated by semicolons
+type RuleList []string
+
+func (list *RuleList) String() string {
+    return strings.Join(*list, "; ")
+}
+
+func (list *RuleList) Set(value string) error {
+    for _, spec := range strings.Split(value, ";") {
+        if _, err := parseRule(spec); err != nil {
+            return err
+        }
+        *list = append(*list, strings.TrimSpace(spec))
+    }
+    return nil
+}
+
+// RuleSample is the counters of the line at a tick of the Rules, rates are taken between the oldest and the newest
+type RuleSample struct {
+    time        time.Time
+    numConsumed int
+    numFailed   int
+    numMeasured int             // Consumed after the warm-up, for the latency
+    totalLatency time.Duration
+}
+
+// Rules evaluate every rule against the live metrics of the line, taking the actions of the rules which fire
+// Consumers are scaled through the membership of the line's own group, a nil Rules does nothing
+type Rules struct {
+    env         *environment
+    rules       []*Rule
+    holds       *Holds
+    membership  chan<- Membership
+    lifecycle   *Lifecycle
+    recorder    *Recorder
+    samples     []RuleSample
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+}
+
+func newRules(env *environment, specs RuleList, holds *Holds, membership chan<- Membership, lifecycle *Lifecycle, recorder *Recorder) (*Rules, error) {
+    rules := &Rules{env: env, holds: holds, membership: membership, lifecycle: lifecycle, recorder: recorder, stopChannel: make(chan struct{}), doneChannel: make(chan struct{})}
+    for _, spec := range specs {
+        rule, err := parseRule(spec)
+        if err != nil {
+            return nil, err
+        }
+        rules.rules = append(rules.rules, rule)
+    }
+    return rules, nil
+}
+
+// The live value of a metric, over the samples of the window
+func (rules *Rules) metric(name string) float64 {
+    first, last := rules.samples[0], rules.samples[len(rules.samples) - 1]
+    switch name {
+    case "queue_depth":
+        return float64(rules.lifecycle.census()[STATE_QUEUED])
+    case "defect_rate":
+        if last.numConsumed == first.numConsumed {
+            return 0
+        }
+        return 100 * float64(last.numFailed - first.numFailed) / float64(last.numConsumed - first.numConsumed)
+    case "throughput":
+        if !last.time.After(first.time) {
+            return 0
+        }
+        return float64(last.numConsumed - first.numConsumed) / last.time.Sub(first.time).Seconds()
+    }
+    if last.numMeasured == first.numMeasured {
+        return 0
+    }
+    return float64((last.totalLatency - first.totalLatency) / time.Duration(last.numMeasured - first.numMeasured)) / float64(time.Millisecond)
+}
+
+// Evaluate the rules every RULE_EVERY until stop is called
+func (rules *Rules) watch() {
+    defer close(rules.doneChannel)
+    ticker := time.NewTicker(RULE_EVERY)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case timeNow := <-ticker.C:
+            _, numMeasured, totalLatency := rules.recorder.counters()
+            rules.samples = append(rules.samples, RuleSample{timeNow, rules.recorder.consumedSoFar(), rules.recorder.failedSoFar(), numMeasured, totalLatency})
+            for (len(rules.samples) > 2 && timeNow.Sub(rules.samples[1].time) >= RULE_WINDOW) {
+                rules.samples = rules.samples[1:]
+            }
+            for _, rule := range rules.rules {
+                if !rules.evaluate(rule, timeNow) {
+                    return
+                }
+            }
+        case <-rules.stopChannel:
+            return
+        }
+    }
+}
+
+// Fire the rule once its condition has held long enough, and clear it once it no longer holds
+// Reports false when stopped while scaling the consumers
+func (rules *Rules) evaluate(rule *Rule, timeNow time.Time) bool {
+    value := rules.metric(rule.metric)
+    if !rule.holds(value) {
+        if rule.fired {
+            rules.env.logEvent(MSG_RULE_CLEAR, rule.spec, rule.metric, value)
+            if rule.producer != "" {
+                rules.holds.resume(rule.producer)
+            }
+        }
+        rule.timeHeld, rule.fired = time.Time{}, false
+        return true
+    }
+    if rule.timeHeld.IsZero() {
+        rule.timeHeld = timeNow
+    }
+    if (rule.fired || timeNow.Sub(rule.timeHeld) < rule.lasting) {
+        return true
+    }
+    rule.fired = true
+    rule.numFired++
+    rules.env.logEvent(MSG_RULE, rule.spec, rule.metric, value, rule.action)
+    if rule.producer != "" {
+        rules.holds.pause(rule.producer)
+    }
+    for i := 0; i < max(rule.scaleBy, -rule.scaleBy); i++ {
+        select {
+        case rules.membership <- Membership{Join: rule.scaleBy > 0}:
+        case <-rules.stopChannel:
+            return false
+        }
+    }
+    return true
+}
+
+// Stop evaluating and wait for the rules to quit, paused Producers are left paused as the line is stopping anyway
+func (rules *Rules) stop() {
+    if rules == nil {
+        return
+    }
+    close(rules.stopChannel)
+    <-rules.doneChannel
+}
+
+func (rules *Rules) report(out io.Writer) {
+    if rules == nil {
+        return
+    }
+    for _, rule := range rules.rules {
+        fmt.Fprintf(out, "[rule %s] fired [ %d ] times\n", rule.spec, rule.numFired)
+    }
+}
+
+//==============================================================================
+// Autoscaler looks at the queue depth every period and scales the consumers of the line's own group by one between its
+// bounds: up while more Widgets than the up threshold are queued, down while no more than the down threshold are. It goes
+// by the members the group has right now, so consumers which crashed or were told to leave are made up for
+// With a producer minimum the Producers beyond it start paused, one is resumed while the queue is down to the down
+// threshold, and one paused again while it is above the up threshold with every consumer already running
+// A nil Autoscaler does nothing
+type Autoscaler struct {
+    env         *environment
+    minConsumers int
+    maxConsumers int
+    up          int
+    down        int
+    every       time.Duration
+    group       *ConsumerGroup      // Its members are counted by the line running it
+    maxRunning  int                 // Consumers running at most
+    numProducers int
+    producers   []string            // The Producers which can be paused, those beyond the minimum
+    numPaused   int                 // The last ones of producers are paused
+    numUp       int
+    numDown     int
+    numResumed  int
+    numHeld     int                 // Producers paused again after being resumed
+    holds       *Holds
+    lifecycle   *Lifecycle
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+}
+
+// Autoscale bounds look like <min>..<max>
+func parseAutoscale(spec string) (int, int, error) {
+    low, high, found := strings.Cut(spec, "..")
+    minConsumers, errMin := strconv.Atoi(low)
+    maxConsumers, errMax := strconv.Atoi(high)
+    if (!found || errMin != nil || errMax != nil || minConsumers < 1 || maxConsumers < minConsumers) {
+        return 0, 0, fmt.Errorf("-autoscale must be <min>..<max> with 1 <= min <= max, got %q", spec)
+    }
+    return minConsumers, maxConsumers, nil
+}
+
+// The Producers beyond the producer minimum are paused right away, before they take on any job
+func newAutoscaler(env *environment, config LineConfig, group *ConsumerGroup, holds *Holds, lifecycle *Lifecycle) *Autoscaler {
+    minConsumers, maxConsumers, _ := parseAutoscale(config.Autoscale)
+    scaler := &Autoscaler{env: env, minConsumers: minConsumers, maxConsumers: maxConsumers, up: config.ScaleUp, down: config.ScaleDown, every: config.ScaleEvery,
+        group: group, maxRunning: group.size, numProducers: config.NumProducers, holds: holds, lifecycle: lifecycle,
+        stopChannel: make(chan struct{}), doneChannel: make(chan struct{})}
+    if config.AutoscaleProducers > 0 {
+        for i := config.AutoscaleProducers; i < config.NumProducers; i++ {
+            scaler.producers = append(scaler.producers, "producer_" + strconv.Itoa(i))
+            holds.pause(scaler.producers[len(scaler.producers) - 1])
+        }
+        scaler.numPaused = len(scaler.producers)
+    }
+    return scaler
+}
+
+// Take one scaling step every period until stop is called
+func (scaler *Autoscaler) watch() {
+    defer close(scaler.doneChannel)
+    ticker := time.NewTicker(scaler.every)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            if !scaler.scale(scaler.lifecycle.census()[STATE_QUEUED]) {
+                return
+            }
+        case <-scaler.stopChannel:
+            return
+        }
+    }
+}
+
+// Scale the consumers, or failing that the Producers, by one step for the queue depth
+// Reports false when stopped while scaling the consumers
+func (scaler *Autoscaler) scale(depth int) bool {
+    numRunning, numConsumers := scaler.numProducers - scaler.numPaused, scaler.group.live()
+    scaler.maxRunning = max(scaler.maxRunning, numConsumers)
+    switch {
+    case (depth > scaler.up && numConsumers < scaler.maxConsumers):
+        select {
+        case scaler.group.membership <- Membership{Join: true}:
+        case <-scaler.stopChannel:
+            return false
+        }
+        scaler.env.logEvent(MSG_SCALE_CONSUMERS, numConsumers, numConsumers + 1, depth)
+        scaler.numUp++
+        scaler.maxRunning = max(scaler.maxRunning, numConsumers + 1)
+    case (depth > scaler.up && scaler.numPaused < len(scaler.producers)):
+        scaler.numPaused++
+        scaler.holds.pause(scaler.producers[len(scaler.producers) - scaler.numPaused])
+        scaler.env.logEvent(MSG_SCALE_PRODUCERS, numRunning, numRunning - 1, depth)
+        scaler.numHeld++
+    case (depth <= scaler.down && scaler.numPaused > 0):
+        scaler.holds.resume(scaler.producers[len(scaler.producers) - scaler.numPaused])
+        scaler.numPaused--
+        scaler.env.logEvent(MSG_SCALE_PRODUCERS, numRunning, numRunning + 1, depth)
+        scaler.numResumed++
+    case (depth <= scaler.down && numConsumers > scaler.minConsumers):
+        select {
+        case scaler.group.membership <- Membership{}:
+        case <-scaler.stopChannel:
+            return false
+        }
+        scaler.env.logEvent(MSG_SCALE_CONSUMERS, numConsumers, numConsumers - 1, depth)
+        scaler.numDown++
+    }
+    return true
+}
+
+// Stop scaling and wait for the autoscaler to quit
+func (scaler *Autoscaler) stop() {
+    if scaler == nil {
+        return
+    }
+    close(scaler.stopChannel)
+    <-scaler.doneChannel
+}
+
+func (scaler *Autoscaler) report(out io.Writer) {
+    if scaler == nil {
+        return
+    }
+    fmt.Fprintf(out, "[autoscale %d..%d consumers, up above %d, down at %d queued] scaled up [ %d ] down [ %d ] times, [ %d ] consumers at most, [ %d ] at the end\n",
+        scaler.minConsumers, scaler.maxConsumers, scaler.up, scaler.down, scaler.numUp, scaler.numDown, scaler.maxRunning, scaler.group.live())
+    if scaler.producers != nil {
+        fmt.Fprintf(out, "[autoscale producers] resumed [ %d ] paused again [ %d ] times, [ %d ] of %d running at the end\n",
+            scaler.numResumed, scaler.numHeld, scaler.numProducers - scaler.numPaused, scaler.numProducers)
+    }
+}
+
+//==============================================================================
+// Holds keep the Producers paused by a rule, the autoscaler or the operator from taking on new jobs until resumed, a nil Holds
+// never pauses anything
+// Interrupting a run resumes every Producer, so the line can drain
+type Holds struct {
+    mutex       sync.Mutex
+    patterns    map[string]int      // Rules holding the Producers matching every pattern, as understood by path.Match
+    resumed     chan struct{}       // Closed and replaced whenever a pattern is resumed
+    interruptChannel <-chan struct{}
+}
+
+func newHolds(interruptChannel <-chan struct{}) *Holds {
+    return &Holds{patterns: make(map[string]int), resumed: make(chan struct{}), interruptChannel: interruptChannel}
+}
+
+func (holds *Holds) pause(pattern string) {
+    holds.mutex.Lock()
+    defer holds.mutex.Unlock()
+    holds.patterns[pattern]++
+}
+
+func (holds *Holds) resume(pattern string) {
+    holds.mutex.Lock()
+    defer holds.mutex.Unlock()
+    if holds.patterns[pattern]--; holds.patterns[pattern] <= 0 {
+        delete(holds.patterns, pattern)
+    }
+    close(holds.resumed)
+    holds.resumed = make(chan struct{})
+}
+
+// Whether the Producer is paused, along with the channel closed on the next resume
+func (holds *Holds) paused(name string) (bool, <-chan struct{}) {
+    if holds == nil {
+        return false, nil
+    }
+    holds.mutex.Lock()
+    defer holds.mutex.Unlock()
+    for pattern := range holds.patterns {
+        if matched, _ := path.Match(pattern, name); matched {
+            return true, holds.resumed
+        }
+    }
+    return false, nil
+}
+
+// Wait while the Producer is paused, reporting false when the line quits first
+func (holds *Holds) wait(name string, quitChannel <-chan struct{}) bool {
+    for {
+        paused, resumed := holds.paused(name)
+        if !paused {
+            return true
+        }
+        select {
+        case <-resumed:
+        case <-holds.interruptChannel:
+            return true
+        case <-quitChannel:
+            return false
+        }
+    }
+}
+
+//==============================================================================
+// Pauser pauses every Producer whenever the operator asks on the pause channel, true to pause and false to resume, while
+// the consumers drain what is already on the line. A nil Pauser pauses nothing
+type Pauser struct {
+    env         *environment
+    holds       *Holds
+    paused      bool
+    timePaused  time.Time       // Since when the line is paused
+    numPauses   int
+    totalPaused time.Duration
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+}
+
+func newPauser(env *environment, holds *Holds) *Pauser {
+    return &Pauser{env: env, holds: holds, stopChannel: make(chan struct{}), doneChannel: make(chan struct{})}
+}
+
+// Pause and resume the line as asked until stop is called, asking for the state it is already in does nothing
+func (pauser *Pauser) watch(pauseChannel <-chan bool) {
+    defer close(pauser.doneChannel)
+    for {
+        select {
+        case pause, ok := <-pauseChannel:
+            if !ok {
+                pauseChannel = nil
+                continue
+            }
+            if pause == pauser.paused {
+                continue
+            }
+            pauser.paused = pause
+            if pause {
+                pauser.holds.pause("*")
+                pauser.timePaused = pauser.env.now()
+                pauser.numPauses++
+                pauser.env.logEvent(MSG_LINE_PAUSED)
+            } else {
+                pauser.holds.resume("*")
+                paused := pauser.env.since(pauser.timePaused)
+                pauser.totalPaused += paused
+                pauser.env.logEvent(MSG_LINE_RESUMED, paused)
+            }
+        case <-pauser.stopChannel:
+            return
+        }
+    }
+}
+
+// Stop taking pauses and wait for the pauser to quit, a line still paused counts as paused until now
+func (pauser *Pauser) stop() {
+    if pauser == nil {
+        return
+    }
+    close(pauser.stopChannel)
+    <-pauser.doneChannel
+    if pauser.paused {
+        pauser.totalPaused += pauser.env.since(pauser.timePaused)
+    }
+}
+
+func (pauser *Pauser) report(out io.Writer) {
+    if pauser == nil {
+        return
+    }
+    fmt.Fprintf(out, "[pause] the producers were paused [ %d ] times for [ %s ] in all\n", pauser.numPauses, pauser.totalPaused)
+}
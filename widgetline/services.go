@@ -0,0 +1,231 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/services.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "time"
+    "math/rand"
+    "sync"
+    "os"
+    "net/http"
+    "io"
+    "encoding/json"
+    "log/slog"
+    "hash/fnv"
+)
+
+// lockedSource makes a rand.Source safe for concurrent use
+type lockedSource struct {
+    mutex   sync.Mutex
+    source  rand.Source64
+}
+
+func (src *lockedSource) Int63() int64 {
+    src.mutex.Lock()
+    defer src.mutex.Unlock()
+    return src.source.Int63()
+}
+
+func (src *lockedSource) Uint64() uint64 {
+    src.mutex.Lock()
+    defer src.mutex.Unlock()
+    return src.source.Uint64()
+}
+
+func (src *lockedSource) Seed(seed int64) {
+    src.mutex.Lock()
+    defer src.mutex.Unlock()
+    src.source.Seed(seed)
+}
+
+// Every Producer draws its ids, defects and breakdowns from a source of its own, derived from the worker seed of the run
+// and its index, so they do not depend on how the Producers are interleaved
+func producerRandom(seed int64, i int) *rand.Rand {
+    return rand.New(rand.NewSource(seed ^ int64(uint64(i + 1) * 0x9E3779B97F4A7C15)))
+}
+
+// Every consumer and stage draws from a source of its own as well, derived from the worker seed and its name, so what one of them
+// scraps, repairs or retries does not depend on the draws of the others, the source is safe for the workers of a stage
+func namedRandom(seed int64, name string) *rand.Rand {
+    hash := fnv.New64a()
+    hash.Write([]byte(name))
+    return rand.New(&lockedSource{source: rand.NewSource(seed ^ int64(hash.Sum64())).(rand.Source64)})
+}
+
+//==============================================================================
+// Clock tells the time of the line, timers and sleeps keep running on the system clock
+type Clock interface {
+    Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+    return time.Now()
+}
+
+// Metrics hears of every Widget as the recorder counts it
+type Metrics interface {
+    Count(name string, delta int)
+    Observe(name string, value float64)
+}
+
+type noMetrics struct{}
+
+func (noMetrics) Count(name string, delta int) {}
+
+func (noMetrics) Observe(name string, value float64) {}
+
+// Store keeps the recordings and the history
+type Store interface {
+    ReadFile(name string) ([]byte, error)
+    WriteFile(name string, data []byte) error
+    AppendFile(name string, data []byte) error
+}
+
+type fileStore struct{}
+
+func (fileStore) ReadFile(name string) ([]byte, error) {
+    return os.ReadFile(name)
+}
+
+func (fileStore) WriteFile(name string, data []byte) error {
+    return os.WriteFile(name, data, 0644)
+}
+
+func (fileStore) AppendFile(name string, data []byte) error {
+    file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        return err
+    }
+    if _, err = file.Write(data); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// Codec encodes the recordings, the history and the alerts
+type Codec interface {
+    Marshal(value any) ([]byte, error)
+    Unmarshal(data []byte, value any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(value any) ([]byte, error) {
+    return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value any) error {
+    return json.Unmarshal(data, value)
+}
+
+// Services are what a line relies on outside of itself, a fake for any of them makes the line testable
+type Services struct {
+    Clock       Clock
+    Random      rand.Source64       // Seeded with the seed of the run, not to be shared by runs side by side, nil for a source of the run's own
+    Log         io.Writer           // Where the events go
+    Report      io.Writer           // Where the reports of the run go
+    Metrics     Metrics
+    Store       Store
+    Transport   http.RoundTripper   // Of the url sinks and the alert webhook
+    Codec       Codec
+}
+
+// stdoutWriter writes to the standard output of the moment, rather than the one when the services were made
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(data []byte) (int, error) {
+    return os.Stdout.Write(data)
+}
+
+func DefaultServices() Services {
+    return Services{Clock: systemClock{}, Log: stdoutWriter{}, Report: stdoutWriter{}, Metrics: noMetrics{}, Store: fileStore{}, Transport: http.DefaultTransport, Codec: jsonCodec{}}
+}
+
+// The defaults stand in for the services left nil
+func (injected Services) complete() Services {
+    complete := DefaultServices()
+    if injected.Clock != nil {
+        complete.Clock = injected.Clock
+    }
+    complete.Random = injected.Random
+    if injected.Log != nil {
+        complete.Log = injected.Log
+    }
+    if injected.Report != nil {
+        complete.Report = injected.Report
+    }
+    if injected.Metrics != nil {
+        complete.Metrics = injected.Metrics
+    }
+    if injected.Store != nil {
+        complete.Store = injected.Store
+    }
+    if injected.Transport != nil {
+        complete.Transport = injected.Transport
+    }
+    if injected.Codec != nil {
+        complete.Codec = injected.Codec
+    }
+    return complete
+}
+
+// Line runs WidgetProductionConsumptionLine on these services, any number of lines may run side by side on services of
+// their own
+func (injected Services) Line(config LineConfig, options LineOptions) (Recording, error) {
+    return injected.stagedLine(config, lineParts{}, options)
+}
+
+// Line with parts of its own in place of those of the configuration
+func (injected Services) stagedLine(config LineConfig, parts lineParts, options LineOptions) (Recording, error) {
+    config = config.complete()
+    env := newEnvironment(injected.complete(), config)
+    config.Seed = env.seed
+    return stagedLine(env, config, parts, options)
+}
+
+// environment is what a run of the line works in: its services, its random source, its event messages and log, and its
+// ids. Every stage of the run tells the time, draws, logs and makes ids through the environment of its own run, so that
+// runs side by side leave each other alone
+type environment struct {
+    services    Services
+    seed        int64               // Of the run, from the time when the configuration has none
+    random      *rand.Rand          // Shared by the goroutines of the run, seeded with its seed
+    workerSeed  int64               // Of the sources of every Producer, consumer and stage, the first draw of random
+    messages    map[string]string   // Of the locale of the run, with its overrides
+    format      string              // Of the consume events
+    handler     slog.Handler        // The log of the run
+    ids         IdStrategy
+}
+
+func newEnvironment(services Services, config LineConfig) *environment {
+    seed := config.Seed
+    if seed == 0 {
+        seed = time.Now().UnixNano()
+    }
+    source := services.Random
+    if source == nil {
+        source = rand.NewSource(seed).(rand.Source64)
+    }
+    random := rand.New(&lockedSource{source: source})
+    random.Seed(seed)
+    return &environment{services: services, seed: seed, random: random, workerSeed: random.Int63(), messages: newMessages(config.Locale, config.Messages), format: config.Format,
+        handler: newEventHandler(config.LogLevel, config.LogFormat, services.Log), ids: config.idStrategy()}
+}
+
+func (env *environment) now() time.Time {
+    return env.services.Clock.Now()
+}
+
+func (env *environment) since(t time.Time) time.Duration {
+    return env.now().Sub(t)
+}
+
+func (env *environment) until(t time.Time) time.Duration {
+    return t.Sub(env.now())
+}
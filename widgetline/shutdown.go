@@ -0,0 +1,140 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/shutdown.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strings"
+    "sync"
+)
+
+// Shutdown stops the stages of the line in the order asked for once the line has to stop, and keeps the timeline of it
+// cancel stops every stage at once, producers-first stops the producers before the rest, drain stops the producers and
+// then lets every stage in turn finish what it holds, from the producers to the consumers
+type Shutdown struct {
+    env         *environment
+    mutex       sync.Mutex
+    order       string      // Empty for cancel, with no timeline reported
+    stages      []*ShutdownStage    // From the producers to the consumers
+    timeStop    time.Time
+    reason      string
+    timeline    []Milestone
+}
+
+// ShutdownStage is one stage of the line as the Shutdown sees it
+type ShutdownStage struct {
+    name        string
+    source      bool            // Producing the Widgets, stopped first unless everything is cancelled at once
+    quitChannel chan struct{}   // nil for the stages stopping on their own once their input runs out
+    doneChannel chan struct{}
+}
+
+type Milestone struct {
+    time    time.Time
+    what    string
+}
+
+func newShutdown(env *environment, order string) *Shutdown {
+    return &Shutdown{env: env, order: order}
+}
+
+func (shutdown *Shutdown) mark(what string) {
+    shutdown.mutex.Lock()
+    defer shutdown.mutex.Unlock()
+    shutdown.timeline = append(shutdown.timeline, Milestone{shutdown.env.now(), what})
+}
+
+// Run a stage of the line on its own goroutine, handing it the channel telling it to quit, stages are to be run from
+// the producers to the consumers
+func (shutdown *Shutdown) run(name string, source bool, line func(quitChannel <-chan struct{})) {
+    stage := &ShutdownStage{name: name, source: source, quitChannel: make(chan struct{}), doneChannel: make(chan struct{})}
+    shutdown.start(stage, func() { line(stage.quitChannel) })
+}
+
+// Run a stage of the line which stops on its own once its input runs out
+func (shutdown *Shutdown) watch(name string, line func()) {
+    shutdown.start(&ShutdownStage{name: name, doneChannel: make(chan struct{})}, line)
+}
+
+func (shutdown *Shutdown) start(stage *ShutdownStage, line func()) {
+    shutdown.stages = append(shutdown.stages, stage)
+    go func() {
+        defer close(stage.doneChannel)
+        line()
+        shutdown.mark(stage.name + " done")
+    }()
+}
+
+// Tell the stages to quit, the ones already done are left out of the timeline
+func (shutdown *Shutdown) quit(stages []*ShutdownStage) {
+    var names []string
+    for _, stage := range stages {
+        if stage.quitChannel == nil {
+            continue
+        }
+        close(stage.quitChannel)
+        select {
+        case <-stage.doneChannel:
+        default:
+            names = append(names, stage.name)
+        }
+    }
+    if len(names) > 0 {
+        shutdown.mark("stop " + strings.Join(names, ", "))
+    }
+}
+
+// Stop the stages in order, returning once every one of them is done
+func (shutdown *Shutdown) stop(reason string) {
+    shutdown.mutex.Lock()
+    shutdown.timeStop, shutdown.reason = shutdown.env.now(), reason
+    shutdown.mutex.Unlock()
+    var sources, rest []*ShutdownStage
+    for _, stage := range shutdown.stages {
+        if stage.source {
+            sources = append(sources, stage)
+        } else {
+            rest = append(rest, stage)
+        }
+    }
+    switch shutdown.order {
+    case "", "cancel":
+        shutdown.quit(shutdown.stages)
+    case "producers-first":
+        shutdown.quit(sources)
+        for _, stage := range sources {
+            <-stage.doneChannel
+        }
+        shutdown.quit(rest)
+    case "drain":
+        // Once its input is closed, a stage finishes what it holds and closes its output, the stage after it follows
+        // Nothing but the producers is told to quit
+        shutdown.quit(sources)
+    }
+    for _, stage := range shutdown.stages {
+        <-stage.doneChannel
+    }
+}
+
+// The timeline from the stop on, the stages done before it are listed first
+func (shutdown *Shutdown) report(out io.Writer) {
+    if shutdown.order == "" {
+        return
+    }
+    shutdown.mutex.Lock()
+    defer shutdown.mutex.Unlock()
+    fmt.Fprintf(out, "[shutdown %s on %s]\n", shutdown.order, shutdown.reason)
+    for _, milestone := range shutdown.timeline {
+        offset := milestone.time.Sub(shutdown.timeStop)
+        if offset < 0 {
+            fmt.Fprintf(out, "%-14s %s\n", "before stop", milestone.what)
+        } else {
+            fmt.Fprintf(out, "+%-13s %s\n", offset.Round(time.Microsecond), milestone.what)
+        }
+    }
+}
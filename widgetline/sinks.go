@@ -0,0 +1,380 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/sinks.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "sync"
+    "os"
+    "net/http"
+    "context"
+    "log/slog"
+    "io"
+    "slices"
+    "reflect"
+)
+
+// Sink is where a Consumer sends a line for every Widget it consumes
+type Sink interface {
+    Send(ctx context.Context, line string) error     // Sinks which can block give up once ctx is done
+    Close() error
+}
+
+// StdoutSink sends every line to the log of its run, at debug level, a StdoutSink made outside of a line writes the lines
+// to the standard output as they are
+type StdoutSink struct {
+    env *environment
+}
+
+func (sink StdoutSink) Send(ctx context.Context, line string) error {
+    if sink.env == nil {
+        _, err := io.WriteString(os.Stdout, line)
+        return err
+    }
+    sink.env.logLine(slog.LevelDebug, line, slog.String("sink", "stdout"))
+    return nil
+}
+
+func (sink StdoutSink) Close() error {
+    return nil
+}
+
+type NullSink struct{}
+
+func (sink NullSink) Send(ctx context.Context, line string) error {
+    return nil
+}
+
+func (sink NullSink) Close() error {
+    return nil
+}
+
+const ROTATED_FORMAT = "20060102-150405.000000000"     // Of the time in the name of a rotated file, sorting in time order
+
+// FileSink appends to a file, it may be shared by several Consumers
+// A rotating FileSink moves its file aside to <file>.<time it was opened> every so often and starts a new one, the time
+// down to the nanosecond so rotations less than a second apart keep a file each
+type FileSink struct {
+    env         *environment
+    mutex       sync.Mutex
+    file        *os.File
+    fileName    string
+    rotateEvery time.Duration   // 0 for never
+    opened      time.Time
+}
+
+func openFileSink(env *environment, fileName string, rotateEvery time.Duration) (*FileSink, error) {
+    file, err := os.OpenFile(fileName, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &FileSink{env: env, file: file, fileName: fileName, rotateEvery: rotateEvery, opened: env.now()}, nil
+}
+
+func (sink *FileSink) Send(ctx context.Context, line string) error {
+    sink.mutex.Lock()
+    defer sink.mutex.Unlock()
+    if (sink.rotateEvery > 0 && sink.env.since(sink.opened) >= sink.rotateEvery) {
+        if err := sink.rotate(); err != nil {
+            return err
+        }
+    }
+    _, err := sink.file.WriteString(line)
+    return err
+}
+
+func (sink *FileSink) rotate() error {
+    if err := sink.file.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(sink.fileName, sink.fileName + "." + sink.opened.Format(ROTATED_FORMAT)); err != nil {
+        return err
+    }
+    file, err := os.OpenFile(sink.fileName, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    sink.file, sink.opened = file, sink.env.now()
+    return nil
+}
+
+func (sink *FileSink) Close() error {
+    return sink.file.Close()
+}
+
+// HTTPSink posts every line as a plain text request
+type HTTPSink struct {
+    url     string
+    client  *http.Client
+}
+
+func (sink HTTPSink) Send(ctx context.Context, line string) error {
+    request, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.url, strings.NewReader(line))
+    if err != nil {
+        return err
+    }
+    request.Header.Set("Content-Type", "text/plain")
+    response, err := sink.client.Do(request)
+    if err != nil {
+        return err
+    }
+    response.Body.Close()
+    if (response.StatusCode >= 300) {
+        return fmt.Errorf("%s answered %s", sink.url, response.Status)
+    }
+    return nil
+}
+
+func (sink HTTPSink) Close() error {
+    sink.client.CloseIdleConnections()
+    return nil
+}
+
+// PausingSink stands in front of a sink which may go away: once a send fails it pauses, keeping the lines in a buffer
+// while probing the sink with the oldest of them every probeEvery, and once a probe gets through it sends the buffer on
+// and resumes. With the buffer full, sends wait for the resume, holding up the consumers instead of losing lines, unless
+// the sink has been given up on
+type PausingSink struct {
+    env         *environment
+    mutex       sync.Mutex
+    sink        Sink
+    name        string
+    limit       int             // Lines buffered at most while paused
+    probeEvery  time.Duration
+    buffer      []string
+    resumed     chan struct{}   // nil unless paused, closed on resume
+    timePaused  time.Time
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+    giveUpChannel chan struct{}   // Closed once the lines not fitting the buffer are to be lost rather than waited on
+    numPauses   int
+    pausedTime  time.Duration
+    maxBuffered int
+    numLost     int
+}
+
+func newPausingSink(env *environment, sink Sink, name string, limit int, probeEvery time.Duration) *PausingSink {
+    return &PausingSink{env: env, sink: sink, name: name, limit: limit, probeEvery: probeEvery, stopChannel: make(chan struct{}), giveUpChannel: make(chan struct{})}
+}
+
+func (sink *PausingSink) Send(ctx context.Context, line string) error {
+    sink.mutex.Lock()
+    for {
+        if sink.resumed == nil {
+            sink.mutex.Unlock()
+            err := sink.sink.Send(ctx, line)
+            if (err == nil || ctx.Err() != nil) {
+                return err
+            }
+            sink.mutex.Lock()
+            if sink.resumed == nil {
+                sink.pause(err)
+            }
+            continue
+        }
+        if len(sink.buffer) < sink.limit {
+            sink.buffer = append(sink.buffer, line)
+            sink.maxBuffered = max(sink.maxBuffered, len(sink.buffer))
+            sink.mutex.Unlock()
+            return nil
+        }
+        resumed := sink.resumed
+        sink.mutex.Unlock()
+        select {
+        case <-resumed:
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-sink.giveUpChannel:
+            sink.mutex.Lock()
+            sink.numLost++
+            sink.mutex.Unlock()
+            return nil
+        }
+        sink.mutex.Lock()
+    }
+}
+
+// Stop holding up the consumers, as when a run is interrupted while the sink is still down
+func (sink *PausingSink) giveUp() {
+    close(sink.giveUpChannel)
+}
+
+// Called with the mutex held
+func (sink *PausingSink) pause(err error) {
+    sink.env.logEvent(MSG_PAUSE, sink.name, err)
+    sink.resumed, sink.timePaused = make(chan struct{}), sink.env.now()
+    sink.doneChannel = make(chan struct{})
+    sink.numPauses++
+    go sink.probe()
+}
+
+// Probe the paused sink until the buffer has all gone through, then resume
+func (sink *PausingSink) probe() {
+    defer close(sink.doneChannel)
+    ticker := time.NewTicker(sink.probeEvery)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-sink.stopChannel:
+            return
+        }
+        sink.mutex.Lock()
+        if sink.flush() {
+            pausedFor := sink.env.since(sink.timePaused)
+            sink.pausedTime += pausedFor
+            close(sink.resumed)
+            sink.resumed = nil
+            sink.env.logEvent(MSG_RESUME, sink.name, pausedFor)
+            sink.mutex.Unlock()
+            return
+        }
+        sink.mutex.Unlock()
+    }
+}
+
+// Send the buffer on in order, reporting whether all of it went through, called with the mutex held
+func (sink *PausingSink) flush() bool {
+    for len(sink.buffer) > 0 {
+        if sink.sink.Send(context.Background(), sink.buffer[0]) != nil {
+            return false
+        }
+        sink.buffer = sink.buffer[1:]
+    }
+    return true
+}
+
+// The lines still buffered get a last chance to go through, the ones which do not are lost
+func (sink *PausingSink) Close() error {
+    close(sink.stopChannel)
+    sink.mutex.Lock()
+    doneChannel := sink.doneChannel
+    sink.mutex.Unlock()
+    if doneChannel != nil {
+        <-doneChannel
+    }
+    sink.mutex.Lock()
+    if sink.resumed != nil {
+        sink.pausedTime += sink.env.since(sink.timePaused)
+        if !sink.flush() {
+            sink.numLost += len(sink.buffer)
+        }
+    }
+    sink.mutex.Unlock()
+    return sink.sink.Close()
+}
+
+func (sink *PausingSink) report(out io.Writer) {
+    if sink.numPauses == 0 {
+        return
+    }
+    fmt.Fprintf(out, "[sink %s paused %d times for %s in all] buffered at most [ %d ] lost [ %d ]\n",
+        sink.name, sink.numPauses, sink.pausedTime.Round(time.Millisecond), sink.maxBuffered, sink.numLost)
+}
+
+// sinkList is a flag holding comma separated sinks: stdout, null, file:<path>, rotate:<path> or an http(s):// url
+type sinkList []string
+
+func (list *sinkList) String() string {
+    return strings.Join(*list, ",")
+}
+
+func (list *sinkList) Set(value string) error {
+    *list = strings.Split(value, ",")
+    return list.validate()
+}
+
+func (list sinkList) validate() error {
+    for _, spec := range list {
+        if (spec != "stdout" && spec != "null" && !strings.HasPrefix(spec, "file:") && !strings.HasPrefix(spec, "rotate:") &&
+            !strings.HasPrefix(spec, "http://") && !strings.HasPrefix(spec, "https://")) {
+            return fmt.Errorf("unknown sink %q", spec)
+        }
+    }
+    return nil
+}
+
+// Open the sink of each of numConsumers Consumers, the last sink applies to everyone past the end of the list
+// Consumers writing to the same file share a single FileSink, rotate:<path> files are rotated every rotateEvery
+// With a pauseBuffer, the files and urls pause when they fail, probed every probeEvery, the Consumers posting to the same
+// url then share the pause
+func (list sinkList) open(env *environment, numConsumers int, rotateEvery time.Duration, pauseBuffer int, probeEvery time.Duration) ([]Sink, error) {
+    sinks := make([]Sink, numConsumers)
+    files, urls := make(map[string]Sink), make(map[string]Sink)
+    paused := func(sink Sink, spec string) Sink {
+        if pauseBuffer == 0 {
+            return sink
+        }
+        return newPausingSink(env, sink, spec, pauseBuffer, probeEvery)
+    }
+    for i := range sinks {
+        spec := "stdout"
+        if (i < len(list)) {
+            spec = list[i]
+        } else if (len(list) > 0) {
+            spec = list[len(list) - 1]
+        }
+        switch {
+        case spec == "stdout":
+            sinks[i] = StdoutSink{env}
+        case spec == "null":
+            sinks[i] = NullSink{}
+        case strings.HasPrefix(spec, "file:") || strings.HasPrefix(spec, "rotate:"):
+            kind, fileName, _ := strings.Cut(spec, ":")
+            if files[fileName] == nil {
+                every := time.Duration(0)
+                if (kind == "rotate") {
+                    every = rotateEvery
+                }
+                sink, err := openFileSink(env, fileName, every)
+                if err != nil {
+                    closeSinks(sinks[:i], env.services.Report)
+                    return nil, err
+                }
+                files[fileName] = paused(sink, spec)
+            }
+            sinks[i] = files[fileName]
+        case pauseBuffer > 0:
+            if urls[spec] == nil {
+                urls[spec] = paused(HTTPSink{spec, &http.Client{Transport: env.services.Transport, Timeout: 5 * time.Second}}, spec)
+            }
+            sinks[i] = urls[spec]
+        default:
+            sinks[i] = HTTPSink{spec, &http.Client{Transport: env.services.Transport, Timeout: 5 * time.Second}}
+        }
+    }
+    return sinks, nil
+}
+
+// sharedSink stands for the one Sink given to the line in place of the -sinks, shared by every consumer through a pointer so
+// it is closed once whatever its type
+type sharedSink struct {
+    Sink
+}
+
+// Close every sink once, shared sinks included, reporting the pauses of the ones which paused
+// Sinks are told apart without hashing them, a Sink given by a program embedding the line may not be comparable
+func closeSinks(sinks []Sink, out io.Writer) {
+    var closed []Sink
+    for _, sink := range sinks {
+        if slices.ContainsFunc(closed, func(other Sink) bool { return sameSink(sink, other) }) {
+            continue
+        }
+        sink.Close()
+        closed = append(closed, sink)
+        if pausing, ok := sink.(*PausingSink); ok {
+            pausing.report(out)
+        }
+    }
+}
+
+// Whether two sinks are the same one, a sink whose type cannot be compared is never the same as another
+func sameSink(sink Sink, other Sink) bool {
+    kind := reflect.TypeOf(sink)
+    return (kind == reflect.TypeOf(other) && kind.Comparable() && sink == other)
+}
@@ -0,0 +1,844 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/stages.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "math/rand"
+    "strconv"
+    "strings"
+    "sync"
+    "os"
+    "path"
+    "context"
+    "math"
+    "slices"
+)
+
+const SCORE_BUCKETS = 10
+const SCORE_BAR = 40                 // Width of the longest bar of the score distribution
+
+//==============================================================================
+// FilterRule lets through the Widgets matching its predicates, the others are dropped or diverted
+type FilterRule struct {
+    spec        string
+    any         [][]filterPredicate     // The Widget matches when every predicate of one of them holds
+    divert      bool
+    numFiltered int
+}
+
+// filterPredicate holds when the field of the Widget matches its pattern, or does not when negated
+type filterPredicate struct {
+    field       string  // source, type, priority or label
+    pattern     string  // As understood by path.Match
+    negated     bool
+}
+
+// Rules look like <predicates> to drop non-matching Widgets, or <predicates>:divert to divert them
+// A predicate is source=<pattern>, type=<pattern>, priority=<pattern> or label=<pattern>, preceded by ! to negate it,
+// predicates joined by & must all hold and the ones joined by | any of them, & binding tighter
+// e.g. 'source=producer_[01]&!label=due|priority=0'
+func parseFilterRule(spec string) (*FilterRule, error) {
+    rule := &FilterRule{spec: spec}
+    matcher, action, _ := strings.Cut(spec, ":")
+    switch action {
+    case "", "drop":
+    case "divert":
+        rule.divert = true
+    default:
+        return nil, fmt.Errorf("filter %q has unknown action %q", spec, action)
+    }
+    var err error
+    if rule.any, err = parseFilterPredicates(matcher); err != nil {
+        return nil, fmt.Errorf("filter %q %s, then [:drop|:divert]", spec, err)
+    }
+    return rule, nil
+}
+
+// Predicates joined by & and |, as in a filter rule or a recall
+func parseFilterPredicates(matcher string) ([][]filterPredicate, error) {
+    var any [][]filterPredicate
+    for _, all := range strings.Split(matcher, "|") {
+        var predicates []filterPredicate
+        for _, term := range strings.Split(all, "&") {
+            var predicate filterPredicate
+            var found bool
+            term, predicate.negated = strings.CutPrefix(term, "!")
+            predicate.field, predicate.pattern, found = strings.Cut(term, "=")
+            if (!found || !slices.Contains([]string{"source", "type", "priority", "label"}, predicate.field)) {
+                return nil, fmt.Errorf("is not of the form [!]source|type|priority|label=<pattern>, joined by & or |")
+            }
+            if _, err := path.Match(predicate.pattern, ""); err != nil {
+                return nil, fmt.Errorf("has a bad pattern %q", predicate.pattern)
+            }
+            predicates = append(predicates, predicate)
+        }
+        any = append(any, predicates)
+    }
+    return any, nil
+}
+
+func (rule *FilterRule) matches(wid Widget) bool {
+    for _, all := range rule.any {
+        if !slices.ContainsFunc(all, func(predicate filterPredicate) bool { return !predicate.holds(wid) }) {
+            return true
+        }
+    }
+    return false
+}
+
+// The type of a Widget is good, or defective once a station scrapped it, its labels are the names of what it carries:
+// source, time, seq, checksum, due, payload and cause
+func (predicate filterPredicate) holds(wid Widget) bool {
+    var values []string
+    switch predicate.field {
+    case "source":
+        values = []string{wid.source}
+    case "type":
+        values = []string{"good"}
+        if wid.defective {
+            values = []string{"defective"}
+        }
+    case "priority":
+        values = []string{strconv.Itoa(wid.priority)}
+    default:
+        for label, set := range map[string]bool{"source": wid.source != "", "time": !wid.time.IsZero(), "seq": wid.seq > 0,
+            "checksum": wid.checksum != 0, "due": !wid.due.IsZero(), "payload": wid.payload != nil, "cause": wid.cause != ""} {
+            if set {
+                values = append(values, label)
+            }
+        }
+    }
+    matched := slices.ContainsFunc(values, func(value string) bool {
+        matched, _ := path.Match(predicate.pattern, value)
+        return matched
+    })
+    return matched != predicate.negated
+}
+
+// filterList is a repeatable flag collecting filter rules
+type filterList []string
+
+func (list *filterList) String() string {
+    return strings.Join(*list, " ")
+}
+
+func (list *filterList) Set(value string) error {
+    if _, err := parseFilterRule(value); err != nil {
+        return err
+    }
+    *list = append(*list, value)
+    return nil
+}
+
+// Filter holds the rules every good Widget must pass before it reaches the consumers, a nil Filter lets everything through
+// Broken widgets are always let through, so a consumer still gets to stop the line
+type Filter struct {
+    env         *environment
+    rules       []*FilterRule
+    divertSink  Sink
+    lifecycle   *Lifecycle
+    checker     *Checker
+}
+
+func newFilter(env *environment, specs filterList, divertSink Sink, lifecycle *Lifecycle, checker *Checker) (*Filter, error) {
+    filter := &Filter{env: env, divertSink: divertSink, lifecycle: lifecycle, checker: checker}
+    for _, spec := range specs {
+        rule, err := parseFilterRule(spec)
+        if err != nil {
+            return nil, err
+        }
+        filter.rules = append(filter.rules, rule)
+    }
+    return filter, nil
+}
+
+// Whether the Widget passes every rule, it is counted against and dropped or diverted by the first rule it fails otherwise
+// Only ever called from one goroutine at a time
+func (filter *Filter) pass(wid Widget) bool {
+    if (filter == nil || wid.broken) {
+        return true
+    }
+    for _, rule := range filter.rules {
+        if rule.matches(wid) {
+            continue
+        }
+        rule.numFiltered++
+        filter.checker.filtered()
+        if rule.divert {
+            filter.lifecycle.move(wid, STATE_QUARANTINED)
+            line := filter.env.event(MSG_DIVERT, wid.id, wid.source, wid.time.Format(TIME_FORMAT), wid.broken, rule.spec)
+            if err := filter.divertSink.Send(context.Background(), line); err != nil {
+                fmt.Fprintf(os.Stderr, "filter failed to send to its divert sink: %s\n", err)
+            }
+        } else {
+            filter.lifecycle.move(wid, STATE_DROPPED)
+        }
+        return false
+    }
+    return true
+}
+
+func (filter *Filter) report(out io.Writer) {
+    if filter == nil {
+        return
+    }
+    for _, rule := range filter.rules {
+        action := "dropped"
+        if rule.divert {
+            action = "diverted"
+        }
+        fmt.Fprintf(out, "Filter rule %s %s [ %d ] widgets.\n", rule.spec, action, rule.numFiltered)
+    }
+}
+
+// The filter stage sits between the producers and the consumers, it quits once the inWidgetChannel is closed
+func filterLine(wg *sync.WaitGroup, filter *Filter, inWidgetChannel <-chan Widget, inEdge *Edge, outWidgetChannel chan<- Widget, outEdge *Edge, quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(outWidgetChannel)
+    timeWait := inEdge.begin()
+    for workingWidget := range inWidgetChannel {
+        inEdge.received(timeWait)
+        if filter.pass(workingWidget) {
+            timeSend := outEdge.begin()
+            select {
+            case outWidgetChannel <- workingWidget:
+                outEdge.sent(timeSend)
+            case <-quitChannel:
+                return
+            }
+        }
+        timeWait = inEdge.begin()
+    }
+}
+
+//==============================================================================
+// Stage is a station of the assembly line between the producers and the consumers, e.g. inspect, paint or package
+// Workers() of them take the Widgets off the channel in front of the stage and pass them on once Work is done with them
+// An error from Work scraps the Widget, the consumers get it defective with the name of the stage and the error as its
+// cause, an error of ctx is taken as the line stopping
+type Stage interface {
+    Name() string
+    Workers() int
+    Work(ctx context.Context, id string) error
+}
+
+// Station is the Stage of a -stages entry, <name>:<workers>:<work>[:<scrap rate>], its workers take the given work over
+// every Widget and scrap it with the scrap rate
+type Station struct {
+    name        string
+    workers     int
+    work        time.Duration
+    scrapRate   float64
+    random      *rand.Rand  // Shared by the workers of the station
+}
+
+func parseStation(spec string) (*Station, error) {
+    parts := strings.Split(spec, ":")
+    if (len(parts) < 3 || len(parts) > 4 || parts[0] == "") {
+        return nil, fmt.Errorf("stage %q must look like <name>:<workers>:<work>[:<scrap rate>]", spec)
+    }
+    station := &Station{name: parts[0]}
+    var err error
+    if station.workers, err = strconv.Atoi(parts[1]); (err != nil || station.workers < 1) {
+        return nil, fmt.Errorf("stage %q must have at least one worker", spec)
+    }
+    if station.work, err = time.ParseDuration(parts[2]); (err != nil || station.work < 0) {
+        return nil, fmt.Errorf("stage %q must have a work duration which is not negative", spec)
+    }
+    if len(parts) == 4 {
+        if station.scrapRate, err = strconv.ParseFloat(parts[3], 64); (err != nil || station.scrapRate < 0 || station.scrapRate > 1) {
+            return nil, fmt.Errorf("stage %q must have a scrap rate between 0 and 1", spec)
+        }
+    }
+    return station, nil
+}
+
+func (station *Station) Name() string {
+    return station.name
+}
+
+func (station *Station) Workers() int {
+    return station.workers
+}
+
+func (station *Station) Work(ctx context.Context, id string) error {
+    if station.work > 0 {
+        timer := time.NewTimer(station.work)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return ctx.Err()
+        }
+    }
+    if (station.scrapRate > 0 && station.random.Float64() < station.scrapRate) {
+        return ErrScrapped
+    }
+    return nil
+}
+
+// StageList is a comma separated flag of the stations of -stages, in the order the Widgets go through them
+type StageList []string
+
+func (list *StageList) String() string {
+    return strings.Join(*list, ",")
+}
+
+func (list *StageList) Set(value string) error {
+    *list = nil
+    for _, part := range strings.Split(value, ",") {
+        spec := strings.TrimSpace(part)
+        if _, err := parseStation(spec); err != nil {
+            return err
+        }
+        *list = append(*list, spec)
+    }
+    return nil
+}
+
+// The stations of the list, each scrapping with a source of its own derived from the worker seed, followed by the given
+// stages
+func (list StageList) stages(seed int64, more []Stage) []Stage {
+    stages := []Stage{}
+    for i, spec := range list {
+        station, _ := parseStation(spec)
+        station.random = namedRandom(seed, "station_" + strconv.Itoa(i))
+        stages = append(stages, station)
+    }
+    return append(stages, more...)
+}
+
+// StageLine keeps the counters of a Stage while its workers run
+type StageLine struct {
+    env         *environment
+    stage       Stage
+    mutex       sync.Mutex
+    numWorked   int
+    numScrapped int
+    busy        time.Duration   // Over every worker
+    timeBegin   time.Time
+}
+
+func newStageLine(env *environment, stage Stage) *StageLine {
+    return &StageLine{env: env, stage: stage, timeBegin: env.now()}
+}
+
+// Work on the Widget, false when the line stopped meanwhile
+func (line *StageLine) work(ctx context.Context, wid Widget) (Widget, bool) {
+    timeWork := line.env.now()
+    err := line.stage.Work(ctx, wid.id)
+    if (err != nil && ctx.Err() != nil) {
+        return wid, false
+    }
+    line.mutex.Lock()
+    defer line.mutex.Unlock()
+    line.numWorked++
+    line.busy += line.env.since(timeWork)
+    if err != nil {
+        line.numScrapped++
+        if wid.good() {
+            wid.defective, wid.cause = true, line.stage.Name() + ": " + err.Error()
+        }
+    }
+    return wid, true
+}
+
+func (line *StageLine) report(out io.Writer) {
+    line.mutex.Lock()
+    defer line.mutex.Unlock()
+    utilization := 0.0
+    if elapsed := line.env.since(line.timeBegin); elapsed > 0 {
+        utilization = 100 * line.busy.Seconds() / (float64(line.stage.Workers()) * elapsed.Seconds())
+    }
+    fmt.Fprintf(out, "Stage %s: workers [ %d ] worked [ %d ] scrapped [ %d ] busy [ %s ] utilization [ %.1f%% ]\n",
+        line.stage.Name(), line.stage.Workers(), line.numWorked, line.numScrapped, line.busy, utilization)
+}
+
+// The workers of the stage pass every Widget on once worked, in whatever order they finish them
+func stageLine(wg *sync.WaitGroup, line *StageLine, board *Board, inWidgetChannel <-chan Widget, inEdge *Edge, outWidgetChannel chan<- Widget, outEdge *Edge,
+    quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(outWidgetChannel)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go func() {
+        select {
+        case <-quitChannel:
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+
+    var workerWaitGroup sync.WaitGroup
+    workerWaitGroup.Add(line.stage.Workers())
+    for i := 0; i < line.stage.Workers(); i++ {
+        go func(name string) {
+            defer workerWaitGroup.Done()
+            defer board.working(name, "stopped", "")
+            board.working(name, "waiting for a widget", "")
+            timeWait := inEdge.begin()
+            for workingWidget := range inWidgetChannel {
+                inEdge.received(timeWait)
+                board.working(name, "working", workingWidget.id)
+                workingWidget, ok := line.work(ctx, workingWidget)
+                if !ok {
+                    return
+                }
+                board.finished("stage", name)
+                board.working(name, "passing on", workingWidget.id)
+                timeSend := outEdge.begin()
+                select {
+                case outWidgetChannel <- workingWidget:
+                    outEdge.sent(timeSend)
+                case <-quitChannel:
+                    return
+                }
+                board.working(name, "waiting for a widget", "")
+                timeWait = inEdge.begin()
+            }
+        }(line.stage.Name() + "_" + strconv.Itoa(i))
+    }
+    workerWaitGroup.Wait()
+}
+
+//==============================================================================
+// Inspector looks at every Widget on its way from the producers, repairs the broken ones with the repair rate and throws
+// the others into the scrap bin, so a broken Widget no longer reaches a consumer to stop the line
+// A nil Inspector lets everything through
+type Inspector struct {
+    env         *environment
+    repairRate  float64
+    divertSink  Sink            // Where the scrap bin sends the discarded Widgets
+    lifecycle   *Lifecycle
+    recorder    *Recorder
+    checker     *Checker
+    random      *rand.Rand
+    numInspected int
+    numRepaired int
+    numDiscarded int            // Counted by the scrap bin
+}
+
+func newInspector(env *environment, repairRate float64, divertSink Sink, lifecycle *Lifecycle, recorder *Recorder, checker *Checker) *Inspector {
+    return &Inspector{env: env, repairRate: repairRate, divertSink: divertSink, lifecycle: lifecycle, recorder: recorder, checker: checker, random: namedRandom(env.workerSeed, "inspector")}
+}
+
+// The Widget once inspected, repaired when it was broken, and false when it is beyond repair
+// Only ever called from one goroutine at a time
+func (inspector *Inspector) inspect(wid Widget) (Widget, bool) {
+    inspector.numInspected++
+    if !wid.broken {
+        return wid, true
+    }
+    if (inspector.repairRate > 0 && inspector.random.Float64() < inspector.repairRate) {
+        inspector.numRepaired++
+        inspector.env.logEvent(MSG_REPAIR, wid.id, wid.source, wid.cause)
+        wid.broken, wid.cause = false, ""
+        return wid, true
+    }
+    return wid, false
+}
+
+// Take a Widget beyond repair off the line, it counts as a failure by its cause
+func (inspector *Inspector) discard(wid Widget) {
+    inspector.numDiscarded++
+    inspector.lifecycle.move(wid, STATE_DISCARDED)
+    inspector.recorder.failed(wid)
+    inspector.checker.filtered()
+    line := inspector.env.event(MSG_DISCARD, wid.id, wid.source, wid.time.Format(TIME_FORMAT), wid.cause)
+    if err := inspector.divertSink.Send(context.Background(), line); err != nil {
+        fmt.Fprintf(os.Stderr, "scrap bin failed to send to its divert sink: %s\n", err)
+    }
+}
+
+func (inspector *Inspector) report(out io.Writer) {
+    if inspector == nil {
+        return
+    }
+    fmt.Fprintf(out, "Inspector [ repair rate %g ]: inspected [ %d ] repaired [ %d ] discarded [ %d ]\n",
+        inspector.repairRate, inspector.numInspected, inspector.numRepaired, inspector.numDiscarded)
+}
+
+// The inspection stage sits right after the producers, it hands the Widgets beyond repair to the scrap bin
+func inspectionLine(wg *sync.WaitGroup, inspector *Inspector, inWidgetChannel <-chan Widget, inEdge *Edge, outWidgetChannel chan<- Widget, outEdge *Edge,
+    scrapChannel chan<- Widget, quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(outWidgetChannel)
+    defer close(scrapChannel)
+    timeWait := inEdge.begin()
+    for workingWidget := range inWidgetChannel {
+        inEdge.received(timeWait)
+        workingWidget, ok := inspector.inspect(workingWidget)
+        if !ok {
+            scrapChannel <- workingWidget
+            timeWait = inEdge.begin()
+            continue
+        }
+        timeSend := outEdge.begin()
+        select {
+        case outWidgetChannel <- workingWidget:
+            outEdge.sent(timeSend)
+        case <-quitChannel:
+            return
+        }
+        timeWait = inEdge.begin()
+    }
+}
+
+// The scrap bin discards every Widget thrown into it, until the inspector is done
+func scrapLine(wg *sync.WaitGroup, inspector *Inspector, scrapChannel <-chan Widget) {
+    defer wg.Done()
+    for workingWidget := range scrapChannel {
+        inspector.discard(workingWidget)
+    }
+}
+
+//==============================================================================
+// Transformer derives new Widgets from the good ones on their way to the consumers, split into parts or enriched and
+// forwarded when split is 1, a nil Transformer forwards every Widget as it is
+// Derived Widgets are transformed again until they are generations deep, every derivation is kept for their lineage
+type Transformer struct {
+    env             *environment
+    split           int         // Widgets derived from every Widget transformed
+    rate            float64     // Probability of a Widget being transformed
+    generations     int
+    lifecycle       *Lifecycle
+    recorder        *Recorder
+    checker         *Checker
+    random          *rand.Rand
+    numTransformed  int
+    numDerived      int
+    deepest         int
+}
+
+func newTransformer(env *environment, split int, rate float64, generations int, lifecycle *Lifecycle, recorder *Recorder, checker *Checker) *Transformer {
+    return &Transformer{env: env, split: split, rate: rate, generations: generations, lifecycle: lifecycle, recorder: recorder, checker: checker,
+        random: namedRandom(env.workerSeed, "transformer")}
+}
+
+// The Widgets to forward in place of a Widget, the Widget itself when it is not transformed
+func (transformer *Transformer) derive(wid Widget) []Widget {
+    if (transformer == nil || !wid.good() || wid.generation >= transformer.generations || transformer.random.Float64() >= transformer.rate) {
+        return []Widget{wid}
+    }
+    transformer.numTransformed++
+    transformer.lifecycle.move(wid, STATE_TRANSFORMED)
+    transformer.checker.transformed()
+
+    var ids []string
+    var children, forwarded []Widget
+    for i := 1; i <= transformer.split; i++ {
+        child := Widget{id: wid.id + "." + strconv.Itoa(i), source: "transformer", time: transformer.env.now(), priority: wid.priority,
+            parent: wid.id, generation: wid.generation + 1, due: wid.due, weight: wid.weight, work: wid.work, payload: wid.payload}
+        transformer.numDerived++
+        transformer.deepest = max(transformer.deepest, child.generation)
+        transformer.lifecycle.move(child, STATE_CREATED)
+        transformer.lifecycle.move(child, STATE_QUEUED)
+        transformer.recorder.derived(wid, child)
+        transformer.checker.derived()
+        ids = append(ids, child.id)
+        children = append(children, child)
+    }
+    transformer.env.logEvent(MSG_TRANSFORM, transformer.split, wid.id, wid.generation, strings.Join(ids, " "))
+    for _, child := range children {
+        forwarded = append(forwarded, transformer.derive(child)...)
+    }
+    return forwarded
+}
+
+func (transformer *Transformer) report(out io.Writer) {
+    if transformer == nil {
+        return
+    }
+    fmt.Fprintf(out, "Transformer derived [ %d ] widgets from [ %d ], [ %d ] generations deep at most.\n",
+        transformer.numDerived, transformer.numTransformed, transformer.deepest)
+}
+
+// The transformer stage forwards the Widgets derived from every Widget it takes, it quits once the inWidgetChannel is closed
+func transformLine(wg *sync.WaitGroup, transformer *Transformer, inWidgetChannel <-chan Widget, inEdge *Edge, outWidgetChannel chan<- Widget, outEdge *Edge,
+    quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(outWidgetChannel)
+    timeWait := inEdge.begin()
+    for workingWidget := range inWidgetChannel {
+        inEdge.received(timeWait)
+        for _, derivedWidget := range transformer.derive(workingWidget) {
+            timeSend := outEdge.begin()
+            select {
+            case outWidgetChannel <- derivedWidget:
+                outEdge.sent(timeSend)
+            case <-quitChannel:
+                return
+            }
+        }
+        timeWait = inEdge.begin()
+    }
+}
+
+//==============================================================================
+// ScoreRule rates one aspect of the quality of a Widget between 0 and 1, weighed against the other rules
+type ScoreRule struct {
+    spec        string
+    kind        string          // skew, entropy or labels
+    maxSkew     time.Duration   // Skew scoring 0, for skew rules
+    weight      float64
+    total       float64         // Of the scores given, for the mean
+}
+
+// Rules look like skew=<max>, entropy or labels, followed by :<weight> to weigh them other than 1
+// skew rates how late a Widget reaches the scorer, entropy how random its id looks and labels how many of its source,
+// time, sequence number and checksum it has
+func parseScoreRule(spec string) (*ScoreRule, error) {
+    rule := &ScoreRule{spec: spec, weight: 1}
+    matcher, weight, weighed := strings.Cut(spec, ":")
+    if weighed {
+        value, err := strconv.ParseFloat(weight, 64)
+        if (err != nil || value <= 0) {
+            return nil, fmt.Errorf("score rule %q must weigh more than 0", spec)
+        }
+        rule.weight = value
+    }
+    kind, param, _ := strings.Cut(matcher, "=")
+    rule.kind = kind
+    switch {
+    case kind == "skew":
+        maxSkew, err := time.ParseDuration(param)
+        if (err != nil || maxSkew <= 0) {
+            return nil, fmt.Errorf("score rule %q must allow a positive skew, e.g. skew=10ms", spec)
+        }
+        rule.maxSkew = maxSkew
+    case (kind == "entropy" || kind == "labels") && param == "":
+    default:
+        return nil, fmt.Errorf("score rule %q is not of the form skew=<max>, entropy or labels, then [:<weight>]", spec)
+    }
+    return rule, nil
+}
+
+func (rule *ScoreRule) score(wid Widget, now time.Time) float64 {
+    switch rule.kind {
+    case "skew":
+        return max(0, 1 - float64(now.Sub(wid.time)) / float64(rule.maxSkew))
+    case "entropy":
+        // Shannon entropy of the characters of the id, against that of as many distinct characters
+        counts := make(map[rune]int)
+        for _, char := range wid.id {
+            counts[char]++
+        }
+        if len(counts) < 2 {
+            return 0
+        }
+        entropy := 0.0
+        for _, count := range counts {
+            p := float64(count) / float64(len(wid.id))
+            entropy -= p * math.Log2(p)
+        }
+        return entropy / math.Log2(float64(min(len(wid.id), 36)))
+    default:
+        labels := 0
+        for _, set := range []bool{wid.source != "", !wid.time.IsZero(), wid.seq > 0, wid.checksum != 0} {
+            if set {
+                labels++
+            }
+        }
+        return float64(labels) / 4
+    }
+}
+
+// scoreList is a repeatable flag collecting score rules
+type ScoreList []string
+
+func (list *ScoreList) String() string {
+    return strings.Join(*list, " ")
+}
+
+func (list *ScoreList) Set(value string) error {
+    if _, err := parseScoreRule(value); err != nil {
+        return err
+    }
+    *list = append(*list, value)
+    return nil
+}
+
+// Scorer gives every Widget on its way to the consumers the weighted mean of the scores of its rules, flagging the
+// Widgets scoring below the threshold, a nil Scorer scores nothing
+// Broken widgets are not scored, they stop the line whatever their quality
+type Scorer struct {
+    env         *environment
+    rules       []*ScoreRule
+    threshold   float64
+    buckets     [SCORE_BUCKETS]int
+    numScored   int
+    numFlagged  int
+    lowest      float64
+}
+
+func newScorer(env *environment, specs ScoreList, threshold float64) *Scorer {
+    scorer := &Scorer{env: env, threshold: threshold, lowest: 1}
+    for _, spec := range specs {
+        rule, _ := parseScoreRule(spec)
+        scorer.rules = append(scorer.rules, rule)
+    }
+    return scorer
+}
+
+// Only ever called from one goroutine at a time
+func (scorer *Scorer) score(wid Widget) {
+    if (scorer == nil || wid.broken) {
+        return
+    }
+    timeScored := scorer.env.now()
+    total, weights := 0.0, 0.0
+    for _, rule := range scorer.rules {
+        score := rule.score(wid, timeScored)
+        rule.total += score
+        total += rule.weight * score
+        weights += rule.weight
+    }
+    score := total / weights
+    scorer.numScored++
+    scorer.buckets[min(int(score * SCORE_BUCKETS), SCORE_BUCKETS - 1)]++
+    scorer.lowest = min(scorer.lowest, score)
+    if score < scorer.threshold {
+        scorer.numFlagged++
+        scorer.env.logEvent(MSG_LOW_SCORE, wid.id, score, scorer.threshold)
+    }
+}
+
+// The distribution of the scores, one bar per bucket
+func (scorer *Scorer) report(out io.Writer) {
+    if (scorer == nil || scorer.numScored == 0) {
+        return
+    }
+    fmt.Fprintf(out, "[quality scores of %d widgets] lowest [ %.2f ] flagged below %.2f [ %d ]\n", scorer.numScored, scorer.lowest,
+        scorer.threshold, scorer.numFlagged)
+    for _, rule := range scorer.rules {
+        fmt.Fprintf(out, "Score rule %s weighing %g: mean [ %.2f ]\n", rule.spec, rule.weight, rule.total / float64(scorer.numScored))
+    }
+    most := slices.Max(scorer.buckets[:])
+    for i, count := range scorer.buckets {
+        bar := strings.Repeat("#", count * SCORE_BAR / most)
+        fmt.Fprintln(out, strings.TrimSpace(fmt.Sprintf("Score %.1f-%.1f [ %6d ] %s", float64(i) / SCORE_BUCKETS, float64(i + 1) / SCORE_BUCKETS, count, bar)))
+    }
+}
+
+// The scoring stage rates every Widget as it goes by, it quits once the inWidgetChannel is closed
+func scoreLine(wg *sync.WaitGroup, scorer *Scorer, inWidgetChannel <-chan Widget, inEdge *Edge, outWidgetChannel chan<- Widget, outEdge *Edge, quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(outWidgetChannel)
+    timeWait := inEdge.begin()
+    for workingWidget := range inWidgetChannel {
+        inEdge.received(timeWait)
+        scorer.score(workingWidget)
+        timeSend := outEdge.begin()
+        select {
+        case outWidgetChannel <- workingWidget:
+            outEdge.sent(timeSend)
+        case <-quitChannel:
+            return
+        }
+        timeWait = inEdge.begin()
+    }
+}
+
+//==============================================================================
+type Lot struct {
+    number  int         // Lot number, assigned in order of completion
+    widgets []Widget    // Finished widgets packed into this lot
+}
+
+func (lot Lot) name() string {
+    return fmt.Sprintf("lot_%d", lot.number)
+}
+
+// Emit the lot-completed event to the log of the run, the lot being completed now
+func (lot Lot) complete(env *environment) {
+    first, last := lot.widgets[0], lot.widgets[len(lot.widgets) - 1]
+    env.logEvent(MSG_LOT, lot.name(), len(lot.widgets), first.id, last.id, env.now().Format(TIME_FORMAT))
+}
+
+// Packer groups finished widgets into lots of lotSize widgets, recalling whole lots holding a Widget the recall matches
+type Packer struct {
+    env         *environment
+    lotSize     int
+    workingLot  Lot
+    meter       *EnergyMeter
+    recall      *FilterRule     // nil without recalls
+    numLots     int
+    numPacked   int
+    numRecalled int
+    numRecalledWidgets  int
+}
+
+func newPacker(env *environment, lotSize int, recall string, meter *EnergyMeter) (*Packer, error) {
+    packer := &Packer{env: env, lotSize: lotSize, workingLot: Lot{1, nil}, meter: meter}
+    if recall != "" {
+        any, err := parseFilterPredicates(recall)
+        if err != nil {
+            return nil, fmt.Errorf("recall %q %s", recall, err)
+        }
+        packer.recall = &FilterRule{spec: recall, any: any}
+    }
+    return packer, nil
+}
+
+func (packer *Packer) pack(wid Widget) {
+    packer.workingLot.widgets = append(packer.workingLot.widgets, wid)
+    if (len(packer.workingLot.widgets) == packer.lotSize) {
+        packer.completeLot()
+    }
+}
+
+// Pack the partial lot left over once there are no more finished widgets
+func (packer *Packer) flush() {
+    if (len(packer.workingLot.widgets) > 0) {
+        packer.completeLot()
+    }
+}
+
+func (packer *Packer) completeLot() {
+    lot := packer.workingLot
+    lot.complete(packer.env)
+    packer.meter.packed(len(lot.widgets))
+    packer.numLots++
+    packer.numPacked += len(lot.widgets)
+    if packer.recall != nil {
+        if i := slices.IndexFunc(lot.widgets, packer.recall.matches); i >= 0 {
+            packer.env.logEvent(MSG_RECALL, lot.name(), len(lot.widgets), lot.widgets[i].id, packer.recall.spec)
+            packer.numRecalled++
+            packer.numRecalledWidgets += len(lot.widgets)
+        }
+    }
+    packer.workingLot = Lot{lot.number + 1, nil}
+}
+
+func (packer *Packer) report(out io.Writer) {
+    if packer == nil {
+        return
+    }
+    fmt.Fprintf(out, "Packaging [ lots of %d ]: lots [ %d ] widgets [ %d ]\n", packer.lotSize, packer.numLots, packer.numPacked)
+    if packer.recall != nil {
+        fmt.Fprintf(out, "Recall %s: lots [ %d ] widgets [ %d ]\n", packer.recall.spec, packer.numRecalled, packer.numRecalledWidgets)
+    }
+}
+
+// Packaging will quit once the inWidgetChannel is closed
+func packagingLine(wg *sync.WaitGroup, packer *Packer, inWidgetChannel <-chan Widget, inEdge *Edge) {
+    defer wg.Done()
+    timeBegin, busyTime := packer.env.now(), time.Duration(0)
+    defer func() { packer.meter.idle(packer.env.since(timeBegin) - busyTime) }()
+
+    timeWait := inEdge.begin()
+    for workingWidget := range inWidgetChannel {
+        inEdge.received(timeWait)
+        timePack := packer.env.now()
+        packer.pack(workingWidget)
+        busyTime += packer.env.since(timePack)
+        timeWait = inEdge.begin()
+    }
+    packer.flush()
+}
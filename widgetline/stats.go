@@ -0,0 +1,419 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/stats.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+    "sync"
+    "sort"
+    "slices"
+)
+
+// Edge times the handoffs over one channel of the line, between the stage sending and the stage receiving
+// Blocked senders point at a slow receiving stage, waiting receivers at a slow sending one, a nil Edge times nothing
+type Edge struct {
+    env             *environment
+    mutex           sync.Mutex
+    name            string
+    from            string
+    to              string
+    numSends        int
+    sendBlocked     time.Duration
+    numReceives     int
+    receiveWaited   time.Duration
+}
+
+// When a send or a receive begins, to time it with, the zero time for a nil Edge
+func (edge *Edge) begin() time.Time {
+    if edge == nil {
+        return time.Time{}
+    }
+    return edge.env.now()
+}
+
+// A send which started at timeBegin went through
+func (edge *Edge) sent(timeBegin time.Time) {
+    if edge == nil {
+        return
+    }
+    edge.mutex.Lock()
+    defer edge.mutex.Unlock()
+    edge.numSends++
+    edge.sendBlocked += edge.env.since(timeBegin)
+}
+
+// A receive which started at timeBegin got something
+func (edge *Edge) received(timeBegin time.Time) {
+    if edge == nil {
+        return
+    }
+    edge.mutex.Lock()
+    defer edge.mutex.Unlock()
+    edge.numReceives++
+    edge.receiveWaited += edge.env.since(timeBegin)
+}
+
+// Contention keeps an Edge for every channel of the line, a nil Contention keeps none
+type Contention struct {
+    env     *environment
+    edges   []*Edge
+}
+
+func newContention(env *environment) *Contention {
+    return &Contention{env: env}
+}
+
+// The Edge of a channel from one stage to another, nil without contention
+func (contention *Contention) edge(name string, from string, to string) *Edge {
+    if contention == nil {
+        return nil
+    }
+    edge := &Edge{env: contention.env, name: name, from: from, to: to}
+    contention.edges = append(contention.edges, edge)
+    return edge
+}
+
+func (contention *Contention) report(out io.Writer) {
+    if contention == nil {
+        return
+    }
+    var choke *Edge
+    for _, edge := range contention.edges {
+        fmt.Fprintf(out, "Edge %s (%s -> %s): [ %d ] sends blocked [ %s ] in total, [ %d ] receives waited [ %s ] in total.\n",
+            edge.name, edge.from, edge.to, edge.numSends, edge.sendBlocked, edge.numReceives, edge.receiveWaited)
+        if (edge.sendBlocked > 0 && (choke == nil || edge.sendBlocked > choke.sendBlocked)) {
+            choke = edge
+        }
+    }
+    if choke != nil {
+        fmt.Fprintf(out, "Choke point: %s, whose senders were blocked the longest waiting on %s.\n", choke.name, choke.to)
+    }
+}
+
+//==============================================================================
+// Stats count the Widgets of every Producer and consumer, with the queue latency of the Widgets every consumer took
+// on, from production to the consume starting. Unbounded runs only keep the counters and the extremes of the latencies
+// A nil Stats counts nothing
+type Stats struct {
+    mutex           sync.Mutex
+    keepLatencies   bool
+    producers       map[string]int
+    consumers       map[string]*ConsumerStats
+}
+
+type ConsumerStats struct {
+    numConsumed     int
+    totalLatency    time.Duration
+    minLatency      time.Duration
+    maxLatency      time.Duration
+    latencies       []time.Duration     // To tell the percentiles, nil in unbounded runs
+}
+
+// WorkerStats is what a Producer or consumer went through, the latencies are the queue latencies of a consumer
+type WorkerStats struct {
+    Worker      string          `json:"worker"`
+    Role        string          `json:"role"`                     // producer or consumer
+    Count       int             `json:"count"`                    // Widgets produced or consumed
+    MinLatency  time.Duration   `json:"min_latency,omitempty"`
+    MeanLatency time.Duration   `json:"mean_latency,omitempty"`
+    MaxLatency  time.Duration   `json:"max_latency,omitempty"`
+    P99Latency  time.Duration   `json:"p99_latency,omitempty"`    // 0 when not kept, in unbounded runs
+}
+
+func newStats(keepLatencies bool) *Stats {
+    return &Stats{keepLatencies: keepLatencies, producers: make(map[string]int), consumers: make(map[string]*ConsumerStats)}
+}
+
+// List a Producer or consumer from the start, even if it never gets a Widget
+func (stats *Stats) enlist(role string, worker string) {
+    if stats == nil {
+        return
+    }
+    stats.mutex.Lock()
+    defer stats.mutex.Unlock()
+    if role == "producer" {
+        stats.producers[worker] += 0
+    } else if stats.consumers[worker] == nil {
+        stats.consumers[worker] = &ConsumerStats{}
+    }
+}
+
+func (stats *Stats) produced(producer string) {
+    if stats == nil {
+        return
+    }
+    stats.mutex.Lock()
+    defer stats.mutex.Unlock()
+    stats.producers[producer]++
+}
+
+// A Widget consumed after waiting latency since its production for the consumer to take it on
+func (stats *Stats) consumed(consumer string, latency time.Duration) {
+    if stats == nil {
+        return
+    }
+    stats.mutex.Lock()
+    defer stats.mutex.Unlock()
+    worker := stats.consumers[consumer]
+    if worker == nil {
+        worker = &ConsumerStats{}
+        stats.consumers[consumer] = worker
+    }
+    if (worker.numConsumed == 0 || latency < worker.minLatency) {
+        worker.minLatency = latency
+    }
+    worker.numConsumed++
+    worker.totalLatency += latency
+    worker.maxLatency = max(worker.maxLatency, latency)
+    if stats.keepLatencies {
+        worker.latencies = append(worker.latencies, latency)
+    }
+}
+
+// Every Producer then every consumer, by name
+func (stats *Stats) outcome() []WorkerStats {
+    if stats == nil {
+        return nil
+    }
+    stats.mutex.Lock()
+    defer stats.mutex.Unlock()
+    producers := make([]string, 0, len(stats.producers))
+    for producer := range stats.producers {
+        producers = append(producers, producer)
+    }
+    sort.Strings(producers)
+    consumers := make([]string, 0, len(stats.consumers))
+    for consumer := range stats.consumers {
+        consumers = append(consumers, consumer)
+    }
+    sort.Strings(consumers)
+    var outcome []WorkerStats
+    for _, producer := range producers {
+        outcome = append(outcome, WorkerStats{Worker: producer, Role: "producer", Count: stats.producers[producer]})
+    }
+    for _, consumer := range consumers {
+        worker := stats.consumers[consumer]
+        workerStats := WorkerStats{Worker: consumer, Role: "consumer", Count: worker.numConsumed, MinLatency: worker.minLatency, MaxLatency: worker.maxLatency}
+        if worker.numConsumed > 0 {
+            workerStats.MeanLatency = worker.totalLatency / time.Duration(worker.numConsumed)
+        }
+        if len(worker.latencies) > 0 {
+            latencies := slices.Sorted(slices.Values(worker.latencies))
+            // Nearest rank
+            workerStats.P99Latency = latencies[(len(latencies) * 99 + 99) / 100 - 1]
+        }
+        outcome = append(outcome, workerStats)
+    }
+    return outcome
+}
+
+func (stats *Stats) report(out io.Writer) {
+    if stats == nil {
+        return
+    }
+    fmt.Fprintf(out, "%-16s %-9s %9s %14s %14s %14s %14s\n", "worker", "role", "widgets", "min latency", "mean latency", "max latency", "p99 latency")
+    for _, worker := range stats.outcome() {
+        if worker.Role == "producer" {
+            fmt.Fprintf(out, "%-16s %-9s %9d\n", worker.Worker, worker.Role, worker.Count)
+            continue
+        }
+        p99 := "not tracked"
+        if stats.keepLatencies {
+            p99 = worker.P99Latency.String()
+        }
+        fmt.Fprintf(out, "%-16s %-9s %9d %14s %14s %14s %14s\n", worker.Worker, worker.Role, worker.Count,
+            worker.MinLatency, worker.MeanLatency, worker.MaxLatency, p99)
+    }
+}
+
+//==============================================================================
+// GapDetector follows the sequence numbers consumed from every source, reporting the ones missing or out of order
+// Widgets filtered, shed or left over when the line stops count as missing too, but like any consumer side detector it cannot
+// tell the Widgets lost after the last one seen from a source. A nil GapDetector follows nothing
+type GapDetector struct {
+    mutex   sync.Mutex
+    sources map[string]*SourceSequence
+}
+
+type SourceSequence struct {
+    next            int             // Sequence number expected next
+    missing         map[int]bool    // Skipped over and not seen since
+    numSeen         int
+    numOutOfOrder   int             // Seen after a later sequence number of the same source
+    numDuplicates   int
+}
+
+func newGapDetector() *GapDetector {
+    return &GapDetector{sources: make(map[string]*SourceSequence)}
+}
+
+func (gaps *GapDetector) seen(wid Widget) {
+    if (gaps == nil || wid.parent != "") {
+        return
+    }
+    gaps.mutex.Lock()
+    defer gaps.mutex.Unlock()
+    source, found := gaps.sources[wid.source]
+    if !found {
+        source = &SourceSequence{next: 1, missing: make(map[int]bool)}
+        gaps.sources[wid.source] = source
+    }
+    source.numSeen++
+    switch {
+    case wid.seq == source.next:
+        source.next++
+    case wid.seq > source.next:
+        for seq := source.next; seq < wid.seq; seq++ {
+            source.missing[seq] = true
+        }
+        source.next = wid.seq + 1
+    case source.missing[wid.seq]:
+        delete(source.missing, wid.seq)
+        source.numOutOfOrder++
+    default:
+        source.numDuplicates++
+    }
+}
+
+// Sequence numbers missing, out of order or duplicated over every source, nil without a GapDetector
+func (gaps *GapDetector) irregular() *int {
+    if gaps == nil {
+        return nil
+    }
+    gaps.mutex.Lock()
+    defer gaps.mutex.Unlock()
+    numIrregular := 0
+    for _, source := range gaps.sources {
+        numIrregular += len(source.missing) + source.numOutOfOrder + source.numDuplicates
+    }
+    return &numIrregular
+}
+
+func (gaps *GapDetector) report(out io.Writer) {
+    if gaps == nil {
+        return
+    }
+    names := make([]string, 0, len(gaps.sources))
+    for name := range gaps.sources {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        source := gaps.sources[name]
+        fmt.Fprintf(out, "Sequence of %s: seen [ %d ] missing [ %d ] out of order [ %d ] duplicates [ %d ]\n",
+            name, source.numSeen, len(source.missing), source.numOutOfOrder, source.numDuplicates)
+    }
+}
+
+//==============================================================================
+// States of a job in the JobAudit, a job is never produced until its Widget is
+const JOB_UNSTARTED = 0
+const JOB_PRODUCED = 1
+const JOB_CONSUMED = 2
+
+// JobAudit accounts for every job of a run which ended with jobs not consumed by its number: never produced, produced
+// but never consumed, or consumed, which its Widget is once it or any Widget derived from it reached a consumer
+// Derived Widgets are traced back to their job by their id, which extends the id of their parent
+// A nil JobAudit accounts for nothing
+type JobAudit struct {
+    mutex       sync.Mutex
+    firstJob    int
+    states      []int           // State of every job, from firstJob on
+    jobs        map[string]int  // Job of every Widget produced, by id
+}
+
+func newJobAudit(firstJob int, lastJob int) *JobAudit {
+    return &JobAudit{firstJob: firstJob, states: make([]int, max(lastJob - firstJob + 1, 0)), jobs: make(map[string]int)}
+}
+
+func (audit *JobAudit) produced(job int, wid Widget) {
+    if audit == nil {
+        return
+    }
+    audit.mutex.Lock()
+    defer audit.mutex.Unlock()
+    audit.jobs[wid.id] = job
+    audit.states[job - audit.firstJob] = JOB_PRODUCED
+}
+
+func (audit *JobAudit) consumed(wid Widget) {
+    if audit == nil {
+        return
+    }
+    root, _, _ := strings.Cut(wid.id, ".")
+    audit.mutex.Lock()
+    defer audit.mutex.Unlock()
+    if job, found := audit.jobs[root]; found {
+        audit.states[job - audit.firstJob] = JOB_CONSUMED
+    }
+}
+
+// The jobs in a state as ranges, e.g. 1-4, 7, 9-12
+func (audit *JobAudit) ranges(state int) (int, string) {
+    var ranges []string
+    count := 0
+    for i := 0; i < len(audit.states); i++ {
+        if audit.states[i] != state {
+            continue
+        }
+        first := i
+        for (i + 1 < len(audit.states) && audit.states[i + 1] == state) {
+            i++
+        }
+        count += i - first + 1
+        if i == first {
+            ranges = append(ranges, strconv.Itoa(audit.firstJob + i))
+        } else {
+            ranges = append(ranges, fmt.Sprintf("%d-%d", audit.firstJob + first, audit.firstJob + i))
+        }
+    }
+    return count, strings.Join(ranges, ", ")
+}
+
+// What stopped a run early, empty when nothing did and its jobs were simply not all consumed, e.g. being dead-lettered
+func stoppedBy(broken *BrokenWidgetError, ends *EndConditions, interruptChannel <-chan struct{}) string {
+    select {
+    case <-interruptChannel:
+        return "interrupted"
+    default:
+    }
+    switch {
+    case broken != nil:
+        return "by the broken widget " + broken.Id
+    case (ends != nil && ends.met != ""):
+        return "by -until " + ends.met
+    }
+    return ""
+}
+
+// Report the jobs of a run which ended before every job was consumed, and what stopped it if anything did
+func (audit *JobAudit) report(out io.Writer, stopped string) {
+    if audit == nil {
+        return
+    }
+    numConsumed, consumed := audit.ranges(JOB_CONSUMED)
+    if numConsumed == len(audit.states) {
+        return
+    }
+    numProduced, produced := audit.ranges(JOB_PRODUCED)
+    numUnstarted, unstarted := audit.ranges(JOB_UNSTARTED)
+    if stopped == "" {
+        fmt.Fprintf(out, "[jobs %d-%d not all consumed]\n", audit.firstJob, audit.firstJob + len(audit.states) - 1)
+    } else {
+        fmt.Fprintf(out, "[jobs %d-%d stopped early, %s]\n", audit.firstJob, audit.firstJob + len(audit.states) - 1, stopped)
+    }
+    for _, line := range []string{
+        fmt.Sprintf("Consumed: [ %d ] %s", numConsumed, consumed),
+        fmt.Sprintf("Produced, never consumed: [ %d ] %s", numProduced, produced),
+        fmt.Sprintf("Never produced: [ %d ] %s", numUnstarted, unstarted),
+    } {
+        fmt.Fprintln(out, strings.TrimSpace(line))
+    }
+}
@@ -0,0 +1,271 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/tracing.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "bytes"
+    "strconv"
+    "strings"
+    "sync"
+    "net/http"
+    "encoding/json"
+    "crypto/sha256"
+    cryptorand "crypto/rand"
+    "encoding/hex"
+)
+
+// Spans are exported in batches of TRACE_BATCH, or every TRACE_EVERY, at most TRACE_BACKLOG batches waiting for the
+// collector before spans are dropped
+const TRACE_BATCH = 512
+const TRACE_EVERY = time.Second
+const TRACE_BACKLOG = 16
+
+// Tracer exports a trace of every Widget to an OpenTelemetry collector, OTLP over HTTP in JSON as the standard library
+// can put it: a widget span from the job its Producer took to the end of the Widget, with a production span until it
+// is queued, a queue span until a consumer takes it and a consumption span until it is consumed under it. The trace id
+// is drawn from the id of the Widget and a salt of the run, so runs making the same ids again with the same seed still
+// have traces of their own. A nil Tracer traces nothing
+type Tracer struct {
+    env         *environment
+    url         string
+    salt        []byte                  // From crypto/rand, mixed into every trace and span id of the run
+    client      *http.Client
+    mutex       sync.Mutex
+    started     map[string]time.Time    // When the Producer of every Widget on the line took its job, by id
+    queued      map[string]time.Time    // When every Widget on the line was queued, by id
+    pending     []otlpSpan              // Waiting for the next batch
+    batchChannel chan []otlpSpan
+    numTraces   int
+    numSpans    int
+    numExported int
+    numDropped  int
+    err         error                   // Of the first export which failed
+    stopChannel chan struct{}
+    doneChannel chan struct{}
+}
+
+// The OTLP/JSON encoding of a span, ids in hex and times in nanoseconds since the epoch as strings
+type otlpSpan struct {
+    TraceId         string          `json:"traceId"`
+    SpanId          string          `json:"spanId"`
+    ParentSpanId    string          `json:"parentSpanId,omitempty"`
+    Name            string          `json:"name"`
+    Kind            int             `json:"kind"`
+    Start           string          `json:"startTimeUnixNano"`
+    End             string          `json:"endTimeUnixNano"`
+    Attributes      []otlpAttribute `json:"attributes,omitempty"`
+    Status          *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+    Key     string          `json:"key"`
+    Value   map[string]any  `json:"value"`
+}
+
+type otlpStatus struct {
+    Code    int     `json:"code"`
+    Message string  `json:"message,omitempty"`
+}
+
+const OTLP_SPAN_INTERNAL = 1
+const OTLP_STATUS_ERROR = 2
+
+// The collector at the endpoint takes traces at /v1/traces, e.g. http://localhost:4318
+func newTracer(env *environment, endpoint string) *Tracer {
+    url := strings.TrimSuffix(endpoint, "/")
+    if !strings.HasSuffix(url, "/v1/traces") {
+        url += "/v1/traces"
+    }
+    salt := make([]byte, 16)
+    cryptorand.Read(salt)
+    return &Tracer{env: env, url: url, salt: salt, client: &http.Client{Transport: env.services.Transport, Timeout: 5 * time.Second}, started: make(map[string]time.Time),
+        queued: make(map[string]time.Time), batchChannel: make(chan []otlpSpan, TRACE_BACKLOG), stopChannel: make(chan struct{}),
+        doneChannel: make(chan struct{})}
+}
+
+// The Producer of the Widget took its job at timeJob
+func (tracer *Tracer) produced(wid Widget, timeJob time.Time) {
+    if tracer == nil {
+        return
+    }
+    tracer.mutex.Lock()
+    defer tracer.mutex.Unlock()
+    tracer.started[wid.id] = timeJob
+}
+
+func (tracer *Tracer) enqueued(wid Widget) {
+    if tracer == nil {
+        return
+    }
+    tracer.mutex.Lock()
+    defer tracer.mutex.Unlock()
+    tracer.queued[wid.id] = tracer.env.now()
+}
+
+// A consumer started consuming the Widget at timeStart and left it in the state
+func (tracer *Tracer) consumed(consumer string, wid Widget, state string, timeStart time.Time) {
+    if tracer == nil {
+        return
+    }
+    tracer.trace(wid, state, consumer, timeStart)
+}
+
+// The Widget reached a final state without a consumer
+func (tracer *Tracer) left(wid Widget, state string) {
+    if tracer == nil {
+        return
+    }
+    tracer.trace(wid, state, "", time.Time{})
+}
+
+// The SHA-256 of the text salted with the salt of the run
+func (tracer *Tracer) hash(text string) [sha256.Size]byte {
+    return sha256.Sum256(append(append([]byte{}, tracer.salt...), text...))
+}
+
+// The spans of a Widget which is done, those of the steps it never went through left out. Replayed and derived Widgets,
+// which no Producer took a job for, start when they were made
+func (tracer *Tracer) trace(wid Widget, state string, consumer string, timeStart time.Time) {
+    timeEnd := tracer.env.now()
+    tracer.mutex.Lock()
+    defer tracer.mutex.Unlock()
+    started, found := tracer.started[wid.id]
+    if !found {
+        started = wid.time
+    }
+    queued, isQueued := tracer.queued[wid.id]
+    delete(tracer.started, wid.id)
+    delete(tracer.queued, wid.id)
+
+    sum := tracer.hash(wid.id)
+    traceId := hex.EncodeToString(sum[:16])
+    span := func(name string, parent string, start time.Time, end time.Time, attributes ...otlpAttribute) otlpSpan {
+        id := tracer.hash(wid.id + "/" + name)
+        return otlpSpan{traceId, hex.EncodeToString(id[:8]), parent, name, OTLP_SPAN_INTERNAL, strconv.FormatInt(start.UnixNano(), 10),
+            strconv.FormatInt(end.UnixNano(), 10), attributes, nil}
+    }
+    text := func(key string, value string) otlpAttribute {
+        return otlpAttribute{key, map[string]any{"stringValue": value}}
+    }
+    root := span("widget", "", started, timeEnd, text("widget.id", wid.id), text("widget.source", wid.source), text("widget.state", state),
+        otlpAttribute{"widget.broken", map[string]any{"boolValue": wid.broken}})
+    if wid.cause != "" {
+        root.Attributes = append(root.Attributes, text("widget.cause", wid.cause))
+    }
+    if (state != STATE_CONSUMED && state != STATE_TRANSFORMED && state != STATE_SENT) {
+        root.Status = &otlpStatus{OTLP_STATUS_ERROR, state}
+    }
+    spans := []otlpSpan{root}
+    if !isQueued {
+        spans = append(spans, span("production", root.SpanId, started, timeEnd, text("producer", wid.source)))
+    } else {
+        spans = append(spans, span("production", root.SpanId, started, queued, text("producer", wid.source)))
+        if consumer == "" {
+            spans = append(spans, span("queue", root.SpanId, queued, timeEnd))
+        } else {
+            spans = append(spans, span("queue", root.SpanId, queued, timeStart), span("consumption", root.SpanId, timeStart, timeEnd,
+                text("consumer", consumer)))
+        }
+    }
+    tracer.numTraces++
+    tracer.numSpans += len(spans)
+    tracer.pending = append(tracer.pending, spans...)
+    if len(tracer.pending) >= TRACE_BATCH {
+        tracer.flush()
+    }
+}
+
+// Hand the pending spans over for export, dropping them when the collector is too far behind, the caller holds the mutex
+func (tracer *Tracer) flush() {
+    if len(tracer.pending) == 0 {
+        return
+    }
+    select {
+    case tracer.batchChannel <- tracer.pending:
+    default:
+        tracer.numDropped += len(tracer.pending)
+    }
+    tracer.pending = nil
+}
+
+// Export every batch handed over, and the pending spans every TRACE_EVERY, until stop is called
+func (tracer *Tracer) watch() {
+    defer close(tracer.doneChannel)
+    ticker := time.NewTicker(TRACE_EVERY)
+    defer ticker.Stop()
+    for {
+        select {
+        case batch := <-tracer.batchChannel:
+            tracer.export(batch)
+        case <-ticker.C:
+            tracer.mutex.Lock()
+            tracer.flush()
+            tracer.mutex.Unlock()
+        case <-tracer.stopChannel:
+            tracer.mutex.Lock()
+            tracer.flush()
+            tracer.mutex.Unlock()
+            for {
+                select {
+                case batch := <-tracer.batchChannel:
+                    tracer.export(batch)
+                default:
+                    return
+                }
+            }
+        }
+    }
+}
+
+// Post a batch of spans to the collector as one ExportTraceServiceRequest
+func (tracer *Tracer) export(batch []otlpSpan) {
+    request := map[string]any{"resourceSpans": []any{map[string]any{
+        "resource": map[string]any{"attributes": []otlpAttribute{{"service.name", map[string]any{"stringValue": "widgetline"}}}},
+        "scopeSpans": []any{map[string]any{"scope": map[string]any{"name": "widgetline"}, "spans": batch}},
+    }}}
+    data, _ := json.Marshal(request)
+    response, err := tracer.client.Post(tracer.url, "application/json", bytes.NewReader(data))
+    if err == nil {
+        response.Body.Close()
+        if response.StatusCode >= 300 {
+            err = fmt.Errorf("%s answered %s", tracer.url, response.Status)
+        }
+    }
+    tracer.mutex.Lock()
+    defer tracer.mutex.Unlock()
+    if err != nil {
+        tracer.numDropped += len(batch)
+        if tracer.err == nil {
+            tracer.err = err
+        }
+        return
+    }
+    tracer.numExported += len(batch)
+}
+
+// Export what is left and wait for the tracer to quit
+func (tracer *Tracer) stop() {
+    if tracer == nil {
+        return
+    }
+    close(tracer.stopChannel)
+    <-tracer.doneChannel
+    tracer.client.CloseIdleConnections()
+}
+
+func (tracer *Tracer) report(out io.Writer) {
+    if tracer == nil {
+        return
+    }
+    fmt.Fprintf(out, "[otel] [ %d ] widgets traced in [ %d ] spans, [ %d ] exported to %s, [ %d ] dropped\n", tracer.numTraces, tracer.numSpans,
+        tracer.numExported, tracer.url, tracer.numDropped)
+    if tracer.err != nil {
+        fmt.Fprintf(out, "[otel] exporting failed: %s\n", tracer.err)
+    }
+}
@@ -0,0 +1,419 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/transport.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "fmt"
+    "time"
+    "sync"
+    "os"
+    "net"
+    "context"
+    "io"
+    "syscall"
+    "errors"
+    "encoding/gob"
+    "bufio"
+    "strconv"
+)
+
+// Transport carries the Widgets from the last stage of the line to the consumers, a ChannelTransport unless another is given
+// Send blocks until the Widget is on its way or ctx is done, Receive until a Widget arrives or ctx is done, and returns
+// io.EOF once the sending end is closed and every Widget sent was received. The sending end calls Close once it has no
+// more Widgets, a Transport whose receiving end is gone returns ErrHungUp from Send
+// Transports carrying the Widgets out of the process send them as WireWidgets
+type Transport interface {
+    Send(ctx context.Context, wid Widget) error
+    Receive(ctx context.Context) (Widget, error)
+    Close() error
+}
+
+var ErrHungUp = errors.New("hung up")
+
+// A Transport buffering what it sends, flushed whenever the line has no Widget left waiting to be sent
+type flusher interface {
+    Flush() error
+}
+
+// ChannelTransport is the in-memory Transport, a buffered channel like the ones between the stages. The line sends to it
+// and receives from it on the channel itself, in the selects of the stage before the consumers and of the consumers
+type ChannelTransport struct {
+    widgets     chan Widget
+}
+
+func NewChannelTransport(capacity int) *ChannelTransport {
+    return &ChannelTransport{widgets: make(chan Widget, capacity)}
+}
+
+func (transport *ChannelTransport) Send(ctx context.Context, wid Widget) error {
+    select {
+    case transport.widgets <- wid:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func (transport *ChannelTransport) Receive(ctx context.Context) (Widget, error) {
+    select {
+    case wid, ok := <-transport.widgets:
+        if !ok {
+            return Widget{}, io.EOF
+        }
+        return wid, nil
+    case <-ctx.Done():
+        return Widget{}, ctx.Err()
+    }
+}
+
+func (transport *ChannelTransport) Close() error {
+    close(transport.widgets)
+    return nil
+}
+
+// WireWidget is a Widget on its way out of the process, gob encoded by a distributed line
+type WireWidget struct {
+    Id          string
+    Source      string
+    Time        time.Time       // Of production, on the clock of the producing process
+    Broken      bool
+    Seq         int
+    Defective   bool
+    Cause       string
+    Priority    int
+    Checksum    uint32
+    Parent      string
+    Generation  int
+    Due         time.Time
+    Weight      float64
+    Work        time.Duration
+    Payload     []byte
+}
+
+func (wid Widget) Wire() WireWidget {
+    return WireWidget{Id: wid.id, Source: wid.source, Time: wid.time, Broken: wid.broken, Seq: wid.seq, Defective: wid.defective, Cause: wid.cause,
+        Priority: wid.priority, Checksum: wid.checksum, Parent: wid.parent, Generation: wid.generation, Due: wid.due, Weight: wid.weight, Work: wid.work,
+        Payload: wid.payload}
+}
+
+func (wire WireWidget) Widget() Widget {
+    return Widget{id: wire.Id, source: wire.Source, time: wire.Time, broken: wire.Broken, seq: wire.Seq, defective: wire.Defective, cause: wire.Cause,
+        priority: wire.Priority, checksum: wire.Checksum, parent: wire.Parent, generation: wire.Generation, due: wire.Due, weight: wire.Weight, work: wire.Work,
+        payload: wire.Payload}
+}
+
+// RemoteLink is the Transport of a distributed line over TCP: every producing process dials the consuming one, which
+// takes Widgets from as many producing processes as it waits for, and is done once they have all hung up
+// The latencies are measured from the time of production, so the clocks of the processes had better agree
+type RemoteLink struct {
+    mutex           sync.Mutex
+    address         string
+    connection      net.Conn        // To the consuming process, for a producing one
+    writer          *bufio.Writer
+    encoder         *gob.Encoder
+    listener        net.Listener    // For the producing processes, in the consuming one
+    numProcesses    int             // Producing processes the consuming one waits for
+    accepted        []net.Conn
+    widgets         chan Widget     // Decoded from every producing process
+    hungUp          chan struct{}
+    numWidgets      int             // Sent or received
+    numBytes        int64           // Of the payloads
+    hello           RemoteHello     // Told by the consuming process, for a producing one
+}
+
+// RemoteHello is what the consuming process tells every producing process it takes on: which node of the line it is,
+// numbered from 0 in the order they connected, out of how many
+type RemoteHello struct {
+    Node        int
+    NumNodes    int
+}
+
+// The names of the Producers of the node, told apart from those of the other producing processes
+func (hello RemoteHello) prefix() string {
+    return "node_" + strconv.Itoa(hello.Node) + "."
+}
+
+const REMOTE_DIAL_TIMEOUT = 5 * time.Second
+
+// The link of a producing process, the consuming one may take a while to start listening
+func newRemoteSender(address string) (*RemoteLink, error) {
+    deadline := time.Now().Add(REMOTE_DIAL_TIMEOUT)
+    for {
+        connection, err := net.DialTimeout("tcp", address, time.Second)
+        if err == nil {
+            // The consuming process says hello once it takes the producing one on, which it never does beyond the number it waits for
+            var hello RemoteHello
+            connection.SetReadDeadline(deadline)
+            if err := gob.NewDecoder(connection).Decode(&hello); err != nil {
+                connection.Close()
+                return nil, fmt.Errorf("the consuming process on %s took no more producing processes: %w", address, err)
+            }
+            connection.SetReadDeadline(time.Time{})
+            writer := bufio.NewWriter(connection)
+            return &RemoteLink{address: address, connection: connection, writer: writer, encoder: gob.NewEncoder(writer), hello: hello}, nil
+        }
+        if time.Now().After(deadline) {
+            return nil, err
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+}
+
+// The link of a consuming process, waiting for numProcesses producing ones
+func newRemoteReceiver(address string, numProcesses int) (*RemoteLink, error) {
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        return nil, err
+    }
+    link := &RemoteLink{address: address, listener: listener, numProcesses: numProcesses, widgets: make(chan Widget),
+        hungUp: make(chan struct{})}
+    go link.accept()
+    return link, nil
+}
+
+// Decode the Widgets of every producing process as they come, until they have all hung up or the link hangs up on them
+func (link *RemoteLink) accept() {
+    defer close(link.widgets)
+    var connectionWaitGroup sync.WaitGroup
+    defer connectionWaitGroup.Wait()
+    for i := 0; i < link.numProcesses; i++ {
+        connection, err := link.listener.Accept()
+        if err != nil {
+            return
+        }
+        link.mutex.Lock()
+        link.accepted = append(link.accepted, connection)
+        link.mutex.Unlock()
+        if err := gob.NewEncoder(connection).Encode(RemoteHello{i, link.numProcesses}); err != nil {
+            fmt.Fprintf(os.Stderr, "greeting %s failed: %s\n", connection.RemoteAddr(), err)
+        }
+        connectionWaitGroup.Add(1)
+        go func() {
+            defer connectionWaitGroup.Done()
+            defer connection.Close()
+            decoder := gob.NewDecoder(bufio.NewReader(connection))
+            for {
+                var wire WireWidget
+                if err := decoder.Decode(&wire); err != nil {
+                    if (err != io.EOF && !errors.Is(err, net.ErrClosed)) {
+                        fmt.Fprintf(os.Stderr, "receiving from %s failed: %s\n", connection.RemoteAddr(), err)
+                    }
+                    return
+                }
+                select {
+                case link.widgets <- wire.Widget():
+                case <-link.hungUp:
+                    return
+                }
+            }
+        }()
+    }
+}
+
+func (link *RemoteLink) Send(ctx context.Context, wid Widget) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    err := link.encoder.Encode(wid.Wire())
+    if (errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)) {
+        return fmt.Errorf("the consuming process on %s %w", link.address, ErrHungUp)
+    }
+    if err != nil {
+        return fmt.Errorf("sending to %s failed: %w", link.address, err)
+    }
+    link.counted(wid)
+    return nil
+}
+
+func (link *RemoteLink) Flush() error {
+    err := link.writer.Flush()
+    if (errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)) {
+        return fmt.Errorf("the consuming process on %s %w", link.address, ErrHungUp)
+    }
+    return err
+}
+
+func (link *RemoteLink) Receive(ctx context.Context) (Widget, error) {
+    select {
+    case wid, ok := <-link.widgets:
+        if !ok {
+            return Widget{}, io.EOF
+        }
+        link.counted(wid)
+        return wid, nil
+    case <-ctx.Done():
+        return Widget{}, ctx.Err()
+    }
+}
+
+// The producing process is done sending, the consuming one stops taking Widgets
+func (link *RemoteLink) Close() error {
+    if link.connection != nil {
+        link.writer.Flush()
+        return link.connection.Close()
+    }
+    link.hangUp()
+    return nil
+}
+
+func (link *RemoteLink) counted(wid Widget) {
+    link.mutex.Lock()
+    defer link.mutex.Unlock()
+    link.numWidgets++
+    link.numBytes += int64(len(wid.payload))
+}
+
+// Stop taking Widgets, from the producing processes already connected too, or stop sending them
+func (link *RemoteLink) hangUp() {
+    if link == nil {
+        return
+    }
+    if link.connection != nil {
+        link.connection.Close()
+        return
+    }
+    link.mutex.Lock()
+    defer link.mutex.Unlock()
+    select {
+    case <-link.hungUp:
+        return
+    default:
+    }
+    close(link.hungUp)
+    link.listener.Close()
+    for _, connection := range link.accepted {
+        connection.Close()
+    }
+}
+
+func (link *RemoteLink) report(out io.Writer) {
+    if link == nil {
+        return
+    }
+    link.mutex.Lock()
+    defer link.mutex.Unlock()
+    if link.connection != nil {
+        fmt.Fprintf(out, "Remote: node_%d of %d sent [ %d ] widgets to %s, payloads [ %s ]\n", link.hello.Node, link.hello.NumNodes, link.numWidgets,
+            link.address, formatBytes(link.numBytes))
+    } else {
+        fmt.Fprintf(out, "Remote: received [ %d ] widgets from [ %d ] producing processes on %s, payloads [ %s ]\n", link.numWidgets,
+            len(link.accepted), link.address, formatBytes(link.numBytes))
+    }
+}
+
+// Hand every Widget on to the transport, closing it once there are none left. The sending stops when the receiving end
+// hangs up first, as the consuming process of a distributed line does when it stops on a broken Widget
+func sendLine(env *environment, wg *sync.WaitGroup, transport Transport, lifecycle *Lifecycle, inWidgetChannel <-chan Widget, inEdge *Edge, quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer transport.Close()
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go func() {
+        select {
+        case <-quitChannel:
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+
+    timeWait := inEdge.begin()
+    for wid := range inWidgetChannel {
+        inEdge.received(timeWait)
+        err := transport.Send(ctx, wid)
+        // Flushing only once the channel is empty keeps the latency down without a write for every Widget
+        if flusher, ok := transport.(flusher); (err == nil && ok && len(inWidgetChannel) == 0) {
+            err = flusher.Flush()
+        }
+        switch {
+        case errors.Is(err, ErrHungUp):
+            fmt.Fprintf(env.services.Report, "[%s]\n", err)
+            return
+        case ctx.Err() != nil:
+            return
+        case err != nil:
+            fmt.Fprintln(os.Stderr, err)
+            return
+        }
+        lifecycle.move(wid, STATE_SENT)
+        timeWait = inEdge.begin()
+    }
+}
+
+// Take the Widgets off the transport as they come, in the place of Producers, until the sending end is done, the line
+// is interrupted or it stops
+func receiveLine(wg *sync.WaitGroup, transport Transport, lifecycle *Lifecycle, recorder *Recorder, checker *Checker, outWidgetChannel chan<- Widget,
+    outEdge *Edge, interruptChannel <-chan struct{}, quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(outWidgetChannel)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go func() {
+        select {
+        case <-interruptChannel:
+            cancel()
+        case <-quitChannel:
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+
+    for {
+        wid, err := transport.Receive(ctx)
+        if err != nil {
+            if (err != io.EOF && ctx.Err() == nil) {
+                fmt.Fprintln(os.Stderr, err)
+            }
+            return
+        }
+        lifecycle.move(wid, STATE_CREATED)
+        recorder.produced(wid)
+        checker.produced()
+        lifecycle.move(wid, STATE_QUEUED)
+        timeSend := outEdge.begin()
+        select {
+        case outWidgetChannel <- wid:
+            outEdge.sent(timeSend)
+        case <-quitChannel:
+            return
+        }
+    }
+}
+
+// Carry the Widgets of the line over a transport other than a ChannelTransport between its stages and its consumers,
+// sent from a goroutine of their own while this one receives them
+func transportLine(env *environment, wg *sync.WaitGroup, transport Transport, inWidgetChannel <-chan Widget, inEdge *Edge, outWidgetChannel chan<- Widget, outEdge *Edge,
+    quitChannel <-chan struct{}) {
+    defer wg.Done()
+    defer close(outWidgetChannel)
+    wg.Add(1)
+    go sendLine(env, wg, transport, nil, inWidgetChannel, inEdge, quitChannel)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go func() {
+        select {
+        case <-quitChannel:
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+
+    for {
+        wid, err := transport.Receive(ctx)
+        if err != nil {
+            if (err != io.EOF && ctx.Err() == nil) {
+                fmt.Fprintln(os.Stderr, err)
+            }
+            return
+        }
+        timeSend := outEdge.begin()
+        select {
+        case outWidgetChannel <- wid:
+            outEdge.sent(timeSend)
+        case <-quitChannel:
+            return
+        }
+    }
+}
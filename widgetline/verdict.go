@@ -0,0 +1,156 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/verdict.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "strconv"
+    "strings"
+    "slices"
+)
+
+// Verdicts of a run, from the health of its criteria: every criterion within its warning limit passes, and a health
+// below VERDICT_FAIL_BELOW fails
+const VERDICT_PASS = "PASS"
+const VERDICT_WARN = "WARN"
+const VERDICT_FAIL = "FAIL"
+const VERDICT_FAIL_BELOW = 0.5
+
+// criterionList is a repeatable flag of verdict criteria
+type CriterionList []string
+
+func (list *CriterionList) String() string {
+    return strings.Join(*list, " ")
+}
+
+func (list *CriterionList) Set(value string) error {
+    if _, err := parseCriterion(value); err != nil {
+        return err
+    }
+    *list = append(*list, value)
+    return nil
+}
+
+// Criterion is what a metric of the run scores: 1 up to its warning limit, 0 from its failure limit on, and linearly
+// in between. A warning limit above the failure one means the higher the better
+type Criterion struct {
+    spec        string
+    metric      string      // defects, sla, violations or drops
+    warn        float64
+    fail        float64
+    weight      float64
+}
+
+// Criteria look like <metric>:<warn>:<fail>[:<weight>], e.g. defects:0.05:0.1:2 or sla:0.95:0.9
+func parseCriterion(spec string) (*Criterion, error) {
+    fields := strings.Split(spec, ":")
+    if (len(fields) < 3 || len(fields) > 4 || !slices.Contains([]string{"defects", "sla", "violations", "drops"}, fields[0])) {
+        return nil, fmt.Errorf("criterion %q is not of the form defects|sla|violations|drops:<warn>:<fail>[:<weight>]", spec)
+    }
+    criterion := &Criterion{spec: spec, metric: fields[0], weight: 1}
+    var errWarn, errFail error
+    criterion.warn, errWarn = strconv.ParseFloat(fields[1], 64)
+    criterion.fail, errFail = strconv.ParseFloat(fields[2], 64)
+    if (errWarn != nil || errFail != nil || criterion.warn == criterion.fail) {
+        return nil, fmt.Errorf("criterion %q must have different numbers for its warning and failure limits", spec)
+    }
+    if len(fields) == 4 {
+        weight, err := strconv.ParseFloat(fields[3], 64)
+        if (err != nil || weight <= 0) {
+            return nil, fmt.Errorf("criterion %q must weigh more than 0", spec)
+        }
+        criterion.weight = weight
+    }
+    return criterion, nil
+}
+
+// The metric of the criterion in an outcome: the share of the Widgets consumed which failed, of the Widgets due
+// consumed on time, of the Widgets produced which were dropped, or the number of violations
+func (criterion *Criterion) value(outcome Outcome) float64 {
+    switch criterion.metric {
+    case "defects":
+        numFailed := 0
+        for _, count := range outcome.Failures {
+            numFailed += count
+        }
+        return float64(numFailed) / float64(max(outcome.NumConsumed, 1))
+    case "sla":
+        if (outcome.Tardiness == nil || outcome.Tardiness.NumDue == 0) {
+            return 1
+        }
+        return 1 - float64(outcome.Tardiness.NumTardy) / float64(outcome.Tardiness.NumDue)
+    case "drops":
+        return float64(outcome.Census[STATE_DROPPED]) / float64(max(outcome.NumProduced, 1))
+    default:
+        return float64(len(outcome.Violations))
+    }
+}
+
+func (criterion *Criterion) score(value float64) float64 {
+    return min(max((value - criterion.fail) / (criterion.warn - criterion.fail), 0), 1)
+}
+
+// CriterionScore is how a metric of the run did against its criterion
+type CriterionScore struct {
+    Criterion   string      `json:"criterion"`
+    Value       float64     `json:"value"`
+    Score       float64     `json:"score"`
+}
+
+// Verdict is the one answer to whether a run went well, the health being the weighted mean of the scores
+type Verdict struct {
+    Verdict     string              `json:"verdict"`
+    Health      float64             `json:"health"`
+    Scores      []CriterionScore    `json:"scores"`
+}
+
+// The verdict of an outcome on every criterion, nil without criteria
+func judge(specs CriterionList, outcome Outcome) *Verdict {
+    if len(specs) == 0 {
+        return nil
+    }
+    verdict := &Verdict{Verdict: VERDICT_PASS}
+    totalWeight := 0.0
+    for _, spec := range specs {
+        criterion, _ := parseCriterion(spec)
+        value := criterion.value(outcome)
+        score := criterion.score(value)
+        verdict.Scores = append(verdict.Scores, CriterionScore{spec, value, score})
+        verdict.Health += criterion.weight * score
+        totalWeight += criterion.weight
+        if score < 1 {
+            verdict.Verdict = VERDICT_WARN
+        }
+    }
+    verdict.Health /= totalWeight
+    if verdict.Health < VERDICT_FAIL_BELOW {
+        verdict.Verdict = VERDICT_FAIL
+    }
+    return verdict
+}
+
+func (verdict *Verdict) report(out io.Writer) {
+    if verdict == nil {
+        return
+    }
+    banner := strings.Repeat("=", 24)
+    fmt.Fprintf(out, "%s VERDICT: %s (health %.2f) %s\n", banner, verdict.Verdict, verdict.Health, banner)
+    for _, score := range verdict.Scores {
+        fmt.Fprintf(out, "Criterion %s: value [ %.4g ] score [ %.2f ]\n", score.Criterion, score.Value, score.Score)
+    }
+}
+
+// The exit status of a verdict, 4 to warn and 5 to fail
+func (verdict *Verdict) ExitCode() int {
+    switch verdict.Verdict {
+    case VERDICT_WARN:
+        return 4
+    case VERDICT_FAIL:
+        return 5
+    }
+    return 0
+}
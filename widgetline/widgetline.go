@@ -0,0 +1,112 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/widgetline.go
+//==============================================================================
+
+// Package widgetline simulates a widget production line: Producers make Widgets, Consumers consume them, and the
+// Pipeline between them is set up from a LineConfig
+package widgetline
+
+import (
+    "fmt"
+    "time"
+    "hash/crc32"
+)
+
+const TIME_FORMAT = "15:04:05.000000"
+
+// Causes of the Widgets which are not good, machine readable so failures can be aggregated by origin
+const CAUSE_INJECTED = "injected-by-k"
+const CAUSE_RANDOM_DEFECT = "random-defect"
+
+//==============================================================================
+type Widget struct {
+    id      string      // Universally unique
+    source  string      // Which Producer created this Widget
+    time    time.Time   // Time set by Producer when Widget was created
+    broken  bool        // Widget is broken or not
+    seq     int         // Sequence number among the Widgets of the same source, from 1
+    defective   bool    // Scrapped by the consumer, unlike a broken Widget it does not stop production
+    cause   string      // Why the Widget is broken or defective, empty for good Widgets
+    priority    int     // Priority class, 0 first, always 0 without priority dispatch
+    checksum    uint32  // Of the id, source, time and sequence number, set by the Producer
+    parent      string  // Id of the Widget this one was derived from by the Transformer, empty for produced Widgets
+    generation  int     // Derivations away from the produced Widget it comes from, 0 for produced Widgets
+    due         time.Time   // When the Widget should be consumed by, zero without due dates
+    weight      float64     // Cost of every second the Widget is consumed past its due date
+    work        time.Duration   // How much longer than the consume delay consuming the Widget takes, known ahead
+    payload     []byte          // Random bytes filled in by the Producer, nil without a payload size
+}
+
+// Checksum of what makes a Widget, to tell a malformed one
+func (wid Widget) sum() uint32 {
+    return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s|%s|%d|%d", wid.id, wid.source, wid.time.UnixNano(), wid.seq)))
+}
+
+// Neither broken nor defective
+func (wid Widget) good() bool {
+    return !wid.broken && !wid.defective
+}
+
+// What a Widget is made of, for the Stages, Sinks and Transports of programs embedding the line
+func (wid Widget) Id() string {
+    return wid.id
+}
+
+func (wid Widget) Source() string {
+    return wid.source
+}
+
+func (wid Widget) Time() time.Time {
+    return wid.time
+}
+
+func (wid Widget) Broken() bool {
+    return wid.broken
+}
+
+func (wid Widget) Seq() int {
+    return wid.seq
+}
+
+func (wid Widget) Defective() bool {
+    return wid.defective
+}
+
+func (wid Widget) Good() bool {
+    return wid.good()
+}
+
+func (wid Widget) Cause() string {
+    return wid.cause
+}
+
+func (wid Widget) Priority() int {
+    return wid.priority
+}
+
+func (wid Widget) Parent() string {
+    return wid.parent
+}
+
+func (wid Widget) Generation() int {
+    return wid.generation
+}
+
+// Zero without due dates
+func (wid Widget) Due() time.Time {
+    return wid.due
+}
+
+func (wid Widget) Weight() float64 {
+    return wid.weight
+}
+
+func (wid Widget) Work() time.Duration {
+    return wid.work
+}
+
+// Nil without a payload size, the bytes are the Widget's own and must not be changed
+func (wid Widget) Payload() []byte {
+    return wid.payload
+}
@@ -0,0 +1,922 @@
+//==============================================================================
+// Project name: Widget Production line
+// File: widgetline/widgetline_test.go
+//==============================================================================
+
+package widgetline
+
+import (
+    "io"
+    "fmt"
+    "flag"
+    "os"
+    "path/filepath"
+    "net"
+    "errors"
+    "encoding/json"
+    "bytes"
+    "regexp"
+    "slices"
+    "strings"
+    "testing"
+    "time"
+    "math"
+    "math/rand"
+    "context"
+    "sync"
+    "runtime/pprof"
+    "net/http"
+)
+
+func TestCheck(t *testing.T) {
+    if err := DefaultConfig().Check(); err != nil {
+        t.Errorf("DefaultConfig: %s", err)
+    }
+    // The fields left zero stand for their defaults
+    if err := (LineConfig{}).Check(); err != nil {
+        t.Errorf("zero LineConfig: %s", err)
+    }
+    for _, test := range []struct {
+        name    string
+        change  func(config *LineConfig)
+        want    string
+    }{
+        {"negative widgets", func(config *LineConfig) { config.NumWidgets = -1 }, "-n must not be negative"},
+        {"negative producers", func(config *LineConfig) { config.NumProducers = -1 }, "-p must be at least 1"},
+        {"short ids", func(config *LineConfig) { config.IdLength = 1 }, "-id-length must be at least 2"},
+        {"unknown ids", func(config *LineConfig) { config.Ids = "guid" }, "-ids must be legacy, uuid or ulid"},
+        {"sample above 1", func(config *LineConfig) { config.Sample = 2 }, "-sample must be between 0 and 1"},
+        {"kth past the widgets", func(config *LineConfig) { config.NumKth = 11 }, "-k must be at most -n"},
+        {"recall without lots", func(config *LineConfig) { config.Recall = "source=producer_0" }, "-recall works on lots"},
+        {"deterministic soak", func(config *LineConfig) { config.Soak, config.Deterministic = true, true }, "cannot be -deterministic"},
+        {"bad priority mix", func(config *LineConfig) { config.Priorities, config.PriorityMix = 3, "3/x/1" }, `weighs class 1 "x"`},
+    } {
+        config := DefaultConfig()
+        test.change(&config)
+        if err := config.Check(); (err == nil || !strings.Contains(err.Error(), test.want)) {
+            t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+        }
+    }
+}
+
+func TestParseConfig(t *testing.T) {
+    config, err := ParseConfig([]byte(`{"n": 50, "p": 2, "ids": "ulid"}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if (config.NumWidgets != 50 || config.NumProducers != 2 || config.Ids != ID_ULID) {
+        t.Errorf("got n=%d p=%d ids=%q, want n=50 p=2 ids=ulid", config.NumWidgets, config.NumProducers, config.Ids)
+    }
+    // The keys left out keep their defaults
+    if (config.NumConsumers != 1 || config.IdLength != ID_LENGTH || config.Buffer != -1) {
+        t.Errorf("got c=%d id_length=%d buffer=%d, want the defaults", config.NumConsumers, config.IdLength, config.Buffer)
+    }
+    if _, err := ParseConfig([]byte(`{"n": -5}`)); err == nil {
+        t.Error("negative n: got no error")
+    }
+    if _, err := ParseConfig([]byte(`{"n": "many"}`)); err == nil {
+        t.Error("n of the wrong type: got no error")
+    }
+    // Durations are in nanoseconds or Go duration strings, lists of them either way or as the flags have them
+    config, err = ParseConfig([]byte(`{"consume_delay": "100us", "backoff": 2000000, "mtbf": ["1ms", 2000000], "mttr": "1ms,3ms"}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if (config.ConsumeDelay != 100 * time.Microsecond || config.Backoff != 2 * time.Millisecond ||
+        !slices.Equal(config.Mtbf, DurationList{time.Millisecond, 2 * time.Millisecond}) || !slices.Equal(config.Mttr, DurationList{time.Millisecond, 3 * time.Millisecond})) {
+        t.Errorf("got consume_delay=%s backoff=%s mtbf=%v mttr=%v", config.ConsumeDelay, config.Backoff, config.Mtbf, config.Mttr)
+    }
+    for _, data := range []string{`{"consume_delay": "soon"}`, `{"mtbf": ["1ms", "often"]}`, `{"consume_dleay": "1ms"}`} {
+        if _, err := ParseConfig([]byte(data)); err == nil {
+            t.Errorf("%s: got no error", data)
+        }
+    }
+    // So are the ones of the config of a recording
+    var recording Recording
+    if err := json.Unmarshal([]byte(`{"config": {"consume_delay": "1ms", "due": "5ms"}}`), &recording); (err != nil || recording.Config.ConsumeDelay != time.Millisecond ||
+        !slices.Equal(recording.Config.Due, DurationList{5 * time.Millisecond})) {
+        t.Errorf("recording: got %v and consume_delay=%s due=%v", err, recording.Config.ConsumeDelay, recording.Config.Due)
+    }
+}
+
+func TestResolveConfig(t *testing.T) {
+    // The profile is found after flags with a value, and the flags given still win over it
+    config, err := ResolveConfig(flag.NewFlagSet("", flag.ContinueOnError), []string{"-n", "50", "-profile", "demo"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if (config.NumWidgets != 50 || config.NumProducers != 3 || config.LotSize != 5) {
+        t.Errorf("got n=%d p=%d lot=%d, want n=50 and the p=3 lot=5 of the demo profile", config.NumWidgets, config.NumProducers, config.LotSize)
+    }
+    // So is it after a flag of the command running the line, and after a boolean flag
+    flagSet := flag.NewFlagSet("", flag.ContinueOnError)
+    flagSet.String("record", "", "")
+    config, err = ResolveConfig(flagSet, []string{"-record", "run.json", "-verify", "-profile=smoke"})
+    if (err != nil || config.NumWidgets != 20) {
+        t.Errorf("got %v and n=%d, want the n=20 of the smoke profile", err, config.NumWidgets)
+    }
+    // The config file is read after -n too, the flags given still winning over it
+    fileName := filepath.Join(t.TempDir(), "line.json")
+    if err := os.WriteFile(fileName, []byte(`{"n": 40, "c": 3, "consume_delay": "1ms"}`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    config, err = ResolveConfig(flag.NewFlagSet("", flag.ContinueOnError), []string{"-n", "7", "-config", fileName})
+    if (err != nil || config.NumWidgets != 7 || config.NumConsumers != 3 || config.ConsumeDelay != time.Millisecond) {
+        t.Errorf("got %v and n=%d c=%d consume_delay=%s, want n=7 and the c=3 consume_delay=1ms of the file", err, config.NumWidgets, config.NumConsumers,
+            config.ConsumeDelay)
+    }
+}
+
+func TestIdStrategies(t *testing.T) {
+    for _, strategy := range []IdStrategy{IdFormat{ID_LENGTH, ASCII}, IdFormat{9, "0123456789abcdef"}, UUIDv4{}, ULID{}} {
+        pattern := regexp.MustCompile("^" + strategy.Pattern() + "$")
+        seen := make(map[string]bool)
+        for i := 0; i < 100; i++ {
+            id := strategy.Make()
+            if (!strategy.Valid(id) || !pattern.MatchString(id)) {
+                t.Errorf("%s: made %q, which it does not take for one of its own", strategy, id)
+            }
+            if seen[id] {
+                t.Errorf("%s: made %q twice", strategy, id)
+            }
+            seen[id] = true
+        }
+        if strategy.Valid("") {
+            t.Errorf("%s: takes the empty id", strategy)
+        }
+    }
+    // ULIDs sort by their millisecond
+    earlier, later := ULID{}.at(time.UnixMilli(1000)), ULID{}.at(time.UnixMilli(2000))
+    if earlier >= later {
+        t.Errorf("ULID of 1s %q does not sort before the one of 2s %q", earlier, later)
+    }
+    // Legacy ids are made again from the same seed
+    format := IdFormat{ID_LENGTH, ASCII}
+    first, second := format.draw(rand.New(rand.NewSource(7))), format.draw(rand.New(rand.NewSource(7)))
+    if first != second {
+        t.Errorf("ids of the same seed differ: %q and %q", first, second)
+    }
+}
+
+// The entropy of the ids follows their length and alphabet, and so do the odds of them colliding
+func TestIdEntropy(t *testing.T) {
+    // 8 hexadecimal digits and the dash, 32 bits, which 2^16 ids collide in with a probability of 1 - e^-0.5
+    format := IdFormat{9, "0123456789abcdef"}
+    if format.Bits() != 32 {
+        t.Errorf("%s has %g bits, want 32", format, format.Bits())
+    }
+    if got, want := collisionProbability(format, 1 << 16), 1 - math.Exp(-0.5); math.Abs(got - want) > 1e-3 {
+        t.Errorf("collision probability of 2^16 ids of %s is %g, want %g", format, got, want)
+    }
+    if (collisionProbability(format, 1) != 0 || collisionProbability(IdFormat{17, "0123456789abcdef"}, 1 << 16) >= collisionProbability(format, 1 << 16)) {
+        t.Errorf("collision probability does not drop with the length of the ids")
+    }
+    // Ids of 4 bits collide within a run of 40 widgets, which reports them
+    config := DefaultConfig()
+    config.NumWidgets, config.IdLength, config.IdAlphabet, config.Seed = 40, 5, "ab", 1
+    var report bytes.Buffer
+    recording, _ := Services{Log: io.Discard, Report: &report}.Line(config, LineOptions{})
+    if recording.Outcome.Collisions == 0 {
+        t.Errorf("no collisions among 40 ids of 4 bits")
+    }
+    if !strings.Contains(report.String(), "[ 5 characters of 2, 4.0 bits ] issued [ 40 ] collision probability [ 1 ]") {
+        t.Errorf("report without the entropy of the ids:\n%s", report.String())
+    }
+}
+
+func TestFilterRule(t *testing.T) {
+    good := Widget{source: "producer_1", priority: 1, time: time.Now(), seq: 3}
+    late := Widget{source: "producer_2", due: time.Now(), defective: true}
+    for _, test := range []struct {
+        spec    string
+        good    bool
+        late    bool
+    }{
+        {"source=producer_[01]", true, false},
+        {"!source=producer_1", false, true},
+        {"priority=1&label=seq", true, false},
+        {"type=defective|label=due:divert", false, true},
+        {"source=producer_2&!type=good|priority=1", true, true},
+    } {
+        rule, err := parseFilterRule(test.spec)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if (rule.matches(good) != test.good || rule.matches(late) != test.late) {
+            t.Errorf("%s: matches %t and %t, want %t and %t", test.spec, rule.matches(good), rule.matches(late), test.good, test.late)
+        }
+    }
+    for _, spec := range []string{"colour=red", "source=[", "source=*&", "source=*:keep"} {
+        if _, err := parseFilterRule(spec); err == nil {
+            t.Errorf("%s: got no error", spec)
+        }
+    }
+}
+
+// Ids of the Widgets consumed, in the order of the log
+func consumedIds(log string) []string {
+    var ids []string
+    for _, match := range regexp.MustCompile(`\[id=(\S+) `).FindAllStringSubmatch(log, -1) {
+        ids = append(ids, match[1])
+    }
+    return ids
+}
+
+// The breakdowns and repairs of the machines in the order of the log, among the Widgets consumed
+func machineSteps(log string) []string {
+    return regexp.MustCompile(`\[id=\S+ |producer_\d+ (breaks down|repaired after \S+)`).FindAllString(log, -1)
+}
+
+func TestDeterministicRun(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.NumProducers, config.NumConsumers, config.Deterministic, config.Seed = 20, 2, 3, true, 42
+    config.Mtbf, config.Mttr = DurationList{500 * time.Microsecond}, DurationList{time.Millisecond}
+    var runs, steps [][]string
+    for i := 0; i < 2; i++ {
+        pipeline, err := NewPipeline(config)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var log bytes.Buffer
+        pipeline.Services = Services{Log: &log, Report: io.Discard}
+        recording, err := pipeline.Run(nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if (recording.Outcome.NumProduced != 20 || recording.Outcome.NumConsumed != 20) {
+            t.Errorf("produced %d and consumed %d widgets, want 20 and 20", recording.Outcome.NumProduced, recording.Outcome.NumConsumed)
+        }
+        runs, steps = append(runs, consumedIds(log.String())), append(steps, machineSteps(log.String()))
+    }
+    if (len(runs[0]) != 20 || !slices.Equal(runs[0], runs[1])) {
+        t.Errorf("runs of the same seed consumed\n%v\nand\n%v", runs[0], runs[1])
+    }
+    if (len(steps[0]) == len(runs[0]) || !slices.Equal(steps[0], steps[1])) {
+        t.Errorf("the machines of runs of the same seed broke down\n%v\nand\n%v", steps[0], steps[1])
+    }
+}
+
+func TestBrokenWidgetStopsRun(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.NumKth, config.StopPolicy, config.Seed = 20, 5, "halt", 1
+    recording, err := Services{Log: io.Discard, Report: io.Discard}.Line(config, LineOptions{})
+    var broken *BrokenWidgetError
+    if !errors.As(err, &broken) {
+        t.Fatalf("got %v, want a BrokenWidgetError", err)
+    }
+    if recording.Err() != err {
+        t.Errorf("the error of the run %v is not the one of its recording %v", err, recording.Err())
+    }
+}
+
+// An interrupted run drains the Widgets already produced, for -drain-timeout at most
+func TestDrainTimeout(t *testing.T) {
+    for _, drainTimeout := range []time.Duration{0, 20 * time.Millisecond} {
+        config := DefaultConfig()
+        config.NumWidgets, config.ConsumeDelay, config.DrainTimeout, config.Seed = 40, 5 * time.Millisecond, drainTimeout, 1
+        interruptChannel := make(chan struct{})
+        time.AfterFunc(20 * time.Millisecond, func() { close(interruptChannel) })
+        var log bytes.Buffer
+        timeBegin := time.Now()
+        recording, err := Services{Log: &log, Report: io.Discard}.Line(config, LineOptions{Interrupt: interruptChannel})
+        if err != nil {
+            t.Fatal(err)
+        }
+        elapsed, outcome := time.Since(timeBegin), recording.Outcome
+        timedOut := strings.Contains(log.String(), "[drain timed out after 20ms, the line stops]")
+        if drainTimeout == 0 {
+            // The default drain is long enough for all 40, 200ms of consumes
+            if (timedOut || outcome.NumConsumed != outcome.NumProduced) {
+                t.Errorf("default drain: consumed %d of %d widgets produced, timed out %v", outcome.NumConsumed, outcome.NumProduced, timedOut)
+            }
+            continue
+        }
+        if (!timedOut || outcome.NumConsumed >= outcome.NumProduced || elapsed > 150 * time.Millisecond) {
+            t.Errorf("drain of %s: consumed %d of %d widgets produced in %s, timed out %v", drainTimeout, outcome.NumConsumed, outcome.NumProduced,
+                elapsed, timedOut)
+        }
+    }
+}
+
+// Payloads are reported in the unit of their size, small ones in bytes rather than as 0.0 MiB
+func TestPayloadReport(t *testing.T) {
+    for _, test := range []struct {
+        size    int
+        want    string
+    }{
+        {16, "filled [ 160 bytes ] for [ 10 ] widgets"},
+        {512, "filled [ 5.0 KiB ] for [ 10 ] widgets"},
+        {1 << 20, "filled [ 10.0 MiB ] for [ 10 ] widgets"},
+    } {
+        config := DefaultConfig()
+        config.PayloadSize, config.Seed = test.size, 1
+        var report bytes.Buffer
+        Services{Log: io.Discard, Report: &report}.Line(config, LineOptions{})
+        if !strings.Contains(report.String(), test.want) {
+            t.Errorf("payload of %d bytes: report without %q:\n%s", test.size, test.want, report.String())
+        }
+    }
+}
+
+// The jobs are only audited on request, and a run which was not stopped is not said to be
+func TestJobAudit(t *testing.T) {
+    for _, test := range []struct {
+        policy  string
+        audit   bool
+        want    string
+    }{
+        {"halt", false, ""},
+        {"halt", true, "[jobs 1-30 stopped early, by the broken widget "},
+        {"dead-letter", true, "[jobs 1-30 not all consumed]"},
+    } {
+        config := DefaultConfig()
+        config.NumWidgets, config.NumKth, config.StopPolicy, config.AuditJobs, config.Seed = 30, 10, test.policy, test.audit, 1
+        var report bytes.Buffer
+        Services{Log: io.Discard, Report: &report}.Line(config, LineOptions{})
+        if (test.want == "" && strings.Contains(report.String(), "[jobs ")) {
+            t.Errorf("%s: audited the jobs without -audit-jobs:\n%s", test.policy, report.String())
+        }
+        if !strings.Contains(report.String(), test.want) {
+            t.Errorf("%s: report without %q:\n%s", test.policy, test.want, report.String())
+        }
+    }
+}
+
+// The defects are only broken down by cause on request
+func TestParetoReport(t *testing.T) {
+    for _, pareto := range []bool{false, true} {
+        config := DefaultConfig()
+        config.NumWidgets, config.NumKth, config.Pareto, config.Seed = 20, 5, pareto, 1
+        var report bytes.Buffer
+        Services{Log: io.Discard, Report: &report}.Line(config, LineOptions{})
+        if got := strings.Contains(report.String(), "[defects by cause]"); got != pareto {
+            t.Errorf("-pareto %v: breakdown reported %v, want %v:\n%s", pareto, got, pareto, report.String())
+        }
+    }
+}
+
+// Defective Widgets are scrapped without the stop policy counting them, even one halting at the first broken Widget
+func TestDefectsDoNotStopRun(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.DefectRate, config.StopPolicy, config.Seed = 40, 0.5, "halt", 1
+    recording, err := Services{Log: io.Discard, Report: io.Discard}.Line(config, LineOptions{})
+    if err != nil {
+        t.Fatalf("got %v, want the run to go on", err)
+    }
+    if recording.Outcome.NumConsumed != 40 {
+        t.Errorf("consumed %d widgets, want 40", recording.Outcome.NumConsumed)
+    }
+    if recording.Outcome.FailuresByKind["defective"] == 0 {
+        t.Errorf("no defective widgets among %v, want some", recording.Outcome.FailuresByKind)
+    }
+}
+
+// A Snapshot of a run in progress lists the Widgets waiting on the line, oldest first, and none is taken between runs
+func TestPipelineSnapshot(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.ConsumeDelay, config.Seed = 20, 5 * time.Millisecond, 1
+    pipeline, err := NewPipeline(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := pipeline.Snapshot(); ok {
+        t.Errorf("took a snapshot before the run")
+    }
+    pipeline.Services = Services{Log: io.Discard, Report: io.Discard}
+    doneChannel := make(chan struct{})
+    go func() {
+        defer close(doneChannel)
+        pipeline.Run(nil)
+    }()
+    var snapshot Snapshot
+    for deadline := time.Now().Add(5 * time.Second); (len(snapshot.Queued) < 2 && time.Now().Before(deadline)); {
+        time.Sleep(time.Millisecond)
+        snapshot, _ = pipeline.Snapshot()
+    }
+    if len(snapshot.Queued) < 2 {
+        t.Fatalf("the snapshot lists %d widgets queued, want some", len(snapshot.Queued))
+    }
+    seen := make(map[string]bool)
+    for i, queued := range snapshot.Queued {
+        if (queued.Id == "" || seen[queued.Id]) {
+            t.Errorf("widget %q listed twice or without an id", queued.Id)
+        }
+        seen[queued.Id] = true
+        if (i > 0 && queued.Age > snapshot.Queued[i - 1].Age) {
+            t.Errorf("widget %s of age %v listed after one of age %v", queued.Id, queued.Age, snapshot.Queued[i - 1].Age)
+        }
+    }
+    <-doneChannel
+    if _, ok := pipeline.Snapshot(); ok {
+        t.Errorf("took a snapshot after the run")
+    }
+}
+
+// The profiler labels of the goroutine running a line are its own before and after the run
+func TestRunKeepsCallerLabels(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.Seed = 10, 1
+    pprof.Do(context.Background(), pprof.Labels("caller", "test"), func(context.Context) {
+        Services{Log: io.Discard, Report: io.Discard}.Line(config, LineOptions{})
+        var profile bytes.Buffer
+        pprof.Lookup("goroutine").WriteTo(&profile, 1)
+        for _, stack := range strings.Split(profile.String(), "\n\n") {
+            if (strings.Contains(stack, "TestRunKeepsCallerLabels") && !strings.Contains(stack, `# labels: {"caller":"test"}`)) {
+                t.Errorf("the labels of the caller were not kept:\n%s", stack)
+            }
+        }
+    })
+}
+
+// A Stage leaving goroutines of its own behind fails the run, however many of them there are
+type leakyStage struct {
+    releaseChannel  chan struct{}   // Closed to let the goroutines left behind go
+}
+
+func (leakyStage) Name() string {
+    return "leaky"
+}
+
+func (leakyStage) Workers() int {
+    return 1
+}
+
+func (stage leakyStage) Work(ctx context.Context, id string) error {
+    go func() {
+        <-stage.releaseChannel
+    }()
+    return nil
+}
+
+func TestLeakedGoroutines(t *testing.T) {
+    for _, numWidgets := range []int{1, 5} {
+        config := DefaultConfig()
+        config.NumWidgets, config.Seed = numWidgets, 1
+        pipeline, err := NewPipeline(config)
+        if err != nil {
+            t.Fatal(err)
+        }
+        stage := leakyStage{make(chan struct{})}
+        pipeline.Services, pipeline.Stages = Services{Log: io.Discard, Report: io.Discard}, []Stage{stage}
+        _, err = pipeline.Run(nil)
+        close(stage.releaseChannel)
+        var timeout *StageTimeoutError
+        if (!errors.As(err, &timeout) || len(timeout.Stacks) != numWidgets) {
+            t.Errorf("%d widgets: got %v, want a StageTimeoutError with %d stacks", numWidgets, err, numWidgets)
+        }
+    }
+}
+
+// A collector keeping the trace ids of the spans posted to it
+type traceCollector struct {
+    mutex       sync.Mutex
+    traceIds    map[string]bool
+}
+
+func (collector *traceCollector) RoundTrip(request *http.Request) (*http.Response, error) {
+    body, _ := io.ReadAll(request.Body)
+    collector.mutex.Lock()
+    defer collector.mutex.Unlock()
+    for _, match := range regexp.MustCompile(`"traceId":"([0-9a-f]+)"`).FindAllStringSubmatch(string(body), -1) {
+        collector.traceIds[match[1]] = true
+    }
+    return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Request: request}, nil
+}
+
+// Runs of the same seed make the same widget ids, but not the same traces
+func TestTraceIdsOfRuns(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.Seed, config.OtelEndpoint = 10, 1, "http://collector:4318"
+    var runs []map[string]bool
+    for range 2 {
+        collector := &traceCollector{traceIds: make(map[string]bool)}
+        Services{Log: io.Discard, Report: io.Discard, Transport: collector}.Line(config, LineOptions{})
+        if len(collector.traceIds) != 10 {
+            t.Fatalf("%d traces collected, want 10", len(collector.traceIds))
+        }
+        runs = append(runs, collector.traceIds)
+    }
+    for traceId := range runs[0] {
+        if runs[1][traceId] {
+            t.Errorf("trace %s collected from both runs", traceId)
+        }
+    }
+}
+
+// A source ignoring its seed, drawing the value it is given over and over
+type constantSource struct {
+    value   int64
+}
+
+func (source constantSource) Int63() int64 {
+    return source.value
+}
+
+func (source constantSource) Uint64() uint64 {
+    return uint64(source.value)
+}
+
+func (constantSource) Seed(int64) {}
+
+// The Random source of the services decides the draws of the Producers and consumers, whatever the seed
+func TestRandomService(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.NumProducers, config.NumConsumers, config.DefectRate = 20, 1, 1, 0.5
+    // Which of the widgets, in the order produced, were defective
+    defects := func(seed int64, value int64) []bool {
+        config.Seed = seed
+        recording, _ := Services{Random: constantSource{value}, Log: io.Discard, Report: io.Discard}.Line(config, LineOptions{})
+        var defective []bool
+        for _, arrival := range recording.Arrivals {
+            defective = append(defective, arrival.Defective)
+        }
+        return defective
+    }
+    first, second, other := defects(1, 7), defects(2, 7), defects(1, 8)
+    if !slices.Equal(first, second) {
+        t.Errorf("the same source made defects %v and %v", first, second)
+    }
+    if slices.Equal(first, other) {
+        t.Errorf("different sources made the same defects %v", first)
+    }
+}
+
+// A Clock which only moves when told to
+type stepClock struct {
+    time    time.Time
+}
+
+func (clock *stepClock) Now() time.Time {
+    return clock.time
+}
+
+// With aging a Widget of a lower class goes first once it has waited a period for every class it is behind
+func TestPriorityAging(t *testing.T) {
+    clock := &stepClock{time.Unix(0, 0)}
+    env := newEnvironment(Services{Clock: clock, Log: io.Discard}, DefaultConfig())
+    for _, aging := range []time.Duration{0, 10 * time.Millisecond} {
+        clock.time = time.Unix(0, 0)
+        prioritizer := newPrioritizer(env, 10, 3, nil, "", aging, nil)
+        prioritizer.push(Widget{id: "low", priority: 2, time: clock.time})
+        // Two periods make up for two classes, but only overtake the Widget of class 0 once over
+        clock.time = clock.time.Add(25 * time.Millisecond)
+        prioritizer.push(Widget{id: "high", priority: 0, time: clock.time})
+        if best := prioritizer.best(); best != 0 {
+            t.Errorf("aging %s: class %d goes first after 25ms, want 0", aging, best)
+        }
+        clock.time = clock.time.Add(5 * time.Millisecond)
+        want := 0
+        if aging > 0 {
+            want = 2
+        }
+        best := prioritizer.best()
+        if best != want {
+            t.Errorf("aging %s: class %d goes first after 30ms, want %d", aging, best, want)
+        }
+        prioritizer.pop(best)
+        if (aging > 0 && prioritizer.maxWait[2] != 30 * time.Millisecond) {
+            t.Errorf("aging %s: class 2 waited %s at most, want 30ms", aging, prioritizer.maxWait[2])
+        }
+    }
+}
+
+// A Widget over its quota waits for room, or is shed when shedding, and the Widgets no rule matches are let through
+func TestQuotas(t *testing.T) {
+    env := newEnvironment(Services{Clock: systemClock{}, Log: io.Discard}, DefaultConfig())
+    for _, spec := range []string{"priority=2:0%", "priority=2:10", "kind=a:10%", "source=[:10%"} {
+        if _, err := parseQuota(spec); err == nil {
+            t.Errorf("%s: got no error", spec)
+        }
+    }
+    quit := make(chan struct{})
+    close(quit)
+    for _, shed := range []bool{false, true} {
+        // 20% of a queue of 10 is room for 2
+        quotas, err := newQuotas(env, QuotaList{"priority=2:20%"}, 10, shed, nil, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, id := range []string{"a", "b"} {
+            if admitted, _ := quotas.admit(Widget{id: id, priority: 2}, quit); !admitted {
+                t.Errorf("shed %v: widget %s not admitted within the quota", shed, id)
+            }
+        }
+        if admitted, _ := quotas.admit(Widget{id: "other", priority: 1}, quit); !admitted {
+            t.Errorf("shed %v: widget of no quota not admitted", shed)
+        }
+        admitted, ok := quotas.admit(Widget{id: "c", priority: 2}, quit)
+        if (admitted || ok != shed) {
+            t.Errorf("shed %v: widget over the quota got admitted %v ok %v", shed, admitted, ok)
+        }
+        var report bytes.Buffer
+        quotas.report(&report)
+        want := "Quota priority=2:20% of 2 widgets: peak [ 2 ] (100% used) delayed [ 1 ] shed [ 0 ]"
+        if shed {
+            want = "Quota priority=2:20% of 2 widgets: peak [ 2 ] (100% used) delayed [ 0 ] shed [ 1 ]"
+        }
+        if !strings.Contains(report.String(), want) {
+            t.Errorf("shed %v: report without %q:\n%s", shed, want, report.String())
+        }
+    }
+    // A Widget waiting for room is let in once another leaves the queue
+    quotas, _ := newQuotas(env, QuotaList{"source=producer_*:10%"}, 10, false, nil, nil)
+    quotas.admit(Widget{id: "a", source: "producer_0"}, quit)
+    admittedChannel := make(chan bool)
+    go func() {
+        admitted, _ := quotas.admit(Widget{id: "b", source: "producer_1"}, make(chan struct{}))
+        admittedChannel <- admitted
+    }()
+    quotas.release(Widget{id: "a"})
+    if !<-admittedChannel {
+        t.Error("waiting widget not admitted once another left the queue")
+    }
+}
+
+// The partitions are dealt in ranges or in turn, and sticky rebalances only move the ones of the members gone
+func TestRebalance(t *testing.T) {
+    a, b, c := &Member{}, &Member{}, &Member{}
+    names := map[*Member]string{a: "a", b: "b", c: "c"}
+    owners := func(assigned []*Member) string {
+        var text []string
+        for _, member := range assigned {
+            text = append(text, names[member])
+        }
+        return strings.Join(text, "")
+    }
+    for _, test := range []struct {
+        spec    string
+        first   string
+        second  string  // Once c has left
+    }{
+        {"range", "aabbcc", "aaabbb"},
+        {"round-robin", "abcabc", "ababab"},
+        {"sticky", "aabbcc", "aabbab"},
+    } {
+        assign, err := parseRebalance(test.spec)
+        if err != nil {
+            t.Fatal(err)
+        }
+        first := assign([]*Member{a, b, c}, nil, 6)
+        second := assign([]*Member{a, b}, first, 6)
+        if (owners(first) != test.first || owners(second) != test.second) {
+            t.Errorf("%s: partitions went to %s then %s, want %s then %s", test.spec, owners(first), owners(second), test.first, test.second)
+        }
+    }
+    if _, err := parseRebalance("random"); err == nil {
+        t.Error("random: got no error")
+    }
+    // Every rebalance of a run counts the Widgets it moved, and they add up to the total
+    movedPattern := regexp.MustCompile(`rebalanced (\d+) times \S+, moving \[([\d ]*)\] widgets, (\d+) in all`)
+    for _, rebalance := range []string{"range", "round-robin", "sticky"} {
+        config := DefaultConfig()
+        config.NumWidgets, config.NumConsumers, config.Partitions, config.ConsumerCrash, config.Rebalance, config.Seed = 60, 3, 6, 0.1, rebalance, 3
+        var report bytes.Buffer
+        Services{Log: io.Discard, Report: &report}.Line(config, LineOptions{})
+        match := movedPattern.FindStringSubmatch(report.String())
+        if match == nil {
+            t.Errorf("%s: report without the rebalances:\n%s", rebalance, report.String())
+            continue
+        }
+        moved, total := strings.Fields(match[2]), 0
+        for _, count := range moved {
+            var numMoved int
+            fmt.Sscan(count, &numMoved)
+            total += numMoved
+        }
+        if (match[1] == "0" || match[1] != fmt.Sprint(len(moved)) || match[3] != fmt.Sprint(total)) {
+            t.Errorf("%s: rebalances do not add up: %s", rebalance, match[0])
+        }
+    }
+}
+
+// A Producer limited to a rate waits for a token for every Widget but the first
+func TestProduceRate(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.NumProducers, config.ProduceRate, config.ProduceJitter, config.Seed = 11, 1, 100, 0.5, 1
+    var report bytes.Buffer
+    timeBegin := time.Now()
+    recording, err := Services{Log: io.Discard, Report: &report}.Line(config, LineOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Ten waits of 10ms, none shorter than half of it
+    if elapsed := time.Since(timeBegin); elapsed < 50 * time.Millisecond {
+        t.Errorf("11 widgets at 100/s took %s, want at least 50ms", elapsed)
+    }
+    if recording.Outcome.NumProduced != 11 {
+        t.Errorf("produced %d widgets, want 11", recording.Outcome.NumProduced)
+    }
+    if !strings.Contains(report.String(), "Produce rate of producer_0 [ 100/s ± 50% ]: waited for a token [ 10 ] times") {
+        t.Errorf("report without the waits for a token:\n%s", report.String())
+    }
+}
+
+// A Transport of its own, which the line can only Send to and Receive from
+type countingTransport struct {
+    *ChannelTransport
+    numSent     int
+}
+
+func (transport *countingTransport) Send(ctx context.Context, wid Widget) error {
+    transport.numSent++
+    return transport.ChannelTransport.Send(ctx, wid)
+}
+
+func TestTransport(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.NumConsumers, config.Seed = 30, 2, 1
+    given := &countingTransport{ChannelTransport: NewChannelTransport(4)}
+    for _, transport := range []Transport{nil, NewChannelTransport(4), given} {
+        pipeline, err := NewPipeline(config)
+        if err != nil {
+            t.Fatal(err)
+        }
+        pipeline.Services, pipeline.Transport = Services{Log: io.Discard, Report: io.Discard}, transport
+        recording, err := pipeline.Run(nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if recording.Outcome.NumConsumed != 30 {
+            t.Errorf("transport %T: consumed %d widgets, want 30", transport, recording.Outcome.NumConsumed)
+        }
+    }
+    if given.numSent != 30 {
+        t.Errorf("sent %d widgets over the transport given, want 30", given.numSent)
+    }
+}
+
+// A JSON encoded LineConfig goes through validation, and the line runs when it is small enough to finish quickly
+// A sink which cannot be compared, holding the lines it was sent
+type listSink struct {
+    mutex   *sync.Mutex
+    lines   *[]string
+    closed  *int
+    tags    []string
+}
+
+func (sink listSink) Send(ctx context.Context, line string) error {
+    sink.mutex.Lock()
+    defer sink.mutex.Unlock()
+    *sink.lines = append(*sink.lines, line)
+    return nil
+}
+
+func (sink listSink) Close() error {
+    sink.mutex.Lock()
+    defer sink.mutex.Unlock()
+    *sink.closed++
+    return nil
+}
+
+func TestUncomparableSink(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.NumConsumers, config.Seed = 20, 3, 1
+    pipeline, err := NewPipeline(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var lines []string
+    numClosed := 0
+    pipeline.Services, pipeline.Sink = Services{Log: io.Discard, Report: io.Discard}, listSink{&sync.Mutex{}, &lines, &numClosed, []string{"test"}}
+    if _, err := pipeline.Run(nil); err != nil {
+        t.Fatal(err)
+    }
+    if len(lines) != 20 {
+        t.Errorf("sink got %d lines, want 20", len(lines))
+    }
+    if numClosed != 1 {
+        t.Errorf("sink closed %d times, want once", numClosed)
+    }
+}
+
+func TestUserInvariants(t *testing.T) {
+    config := DefaultConfig()
+    config.NumWidgets, config.Seed = 12, 1
+    pipeline, err := NewPipeline(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pipeline.Services = Services{Log: io.Discard, Report: io.Discard}
+    pipeline.Invariants = []Invariant{NewInvariant("at-most-10-produced", func(state LineState) error {
+        if state.NumProduced > 10 {
+            return fmt.Errorf("produced %d", state.NumProduced)
+        }
+        return nil
+    })}
+    pipeline.FinalInvariants = []Invariant{NewInvariant("every-widget-consumed-again", func(state LineState) error {
+        if state.NumConsumed != state.NumWidgets {
+            return fmt.Errorf("consumed %d of %d", state.NumConsumed, state.NumWidgets)
+        }
+        return nil
+    })}
+    recording, err := pipeline.Run(nil)
+    var verification *VerificationError
+    if (!errors.As(err, &verification) || !errors.Is(recording.Err(), ErrVerificationFailed)) {
+        t.Fatalf("got error %v, want a VerificationError", err)
+    }
+    // The continuous invariant fails from the 11th widget produced on, after every event, the final one holds
+    if !strings.Contains(verification.Violations[0], "at-most-10-produced violated after produce: produced 11") {
+        t.Errorf("first violation %q, want at-most-10-produced on the 11th widget", verification.Violations[0])
+    }
+    for _, violation := range verification.Violations {
+        if strings.Contains(violation, "every-widget-consumed-again") {
+            t.Errorf("violation %q of an invariant which holds", violation)
+        }
+    }
+}
+
+// Run a consuming process and producing processes of one distributed line side by side in this one, on a free port
+func distributedRun(t *testing.T, consuming LineConfig, producing ...LineConfig) (Recording, []Recording) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    address := listener.Addr().String()
+    listener.Close()
+    consuming.Listen, consuming.RemoteProducers = address, len(producing)
+    consumed := make(chan Recording)
+    go func() {
+        recording, err := Services{Log: io.Discard, Report: io.Discard}.Line(consuming, LineOptions{})
+        if err != nil {
+            t.Error(err)
+        }
+        consumed <- recording
+    }()
+    produced := make([]Recording, len(producing))
+    var wg sync.WaitGroup
+    for i, config := range producing {
+        config.Connect = address
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            var err error
+            if produced[i], err = (Services{Log: io.Discard, Report: io.Discard}.Line(config, LineOptions{})); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+    return <-consumed, produced
+}
+
+func TestDistributedProducers(t *testing.T) {
+    consuming, producing := DefaultConfig(), DefaultConfig()
+    consuming.Gaps, producing.NumWidgets = true, 20
+    recording, _ := distributedRun(t, consuming, producing, producing)
+    if recording.Outcome.NumConsumed != 40 {
+        t.Errorf("consumed %d widgets, want 40", recording.Outcome.NumConsumed)
+    }
+    // Both processes have a producer_0, told apart by their node
+    if (recording.Outcome.Irregular == nil || *recording.Outcome.Irregular != 0) {
+        t.Errorf("irregular sequence numbers %v, want 0", recording.Outcome.Irregular)
+    }
+}
+
+// Producing processes take turns at the serial numbers, none of which arrives twice
+func TestDistributedSerials(t *testing.T) {
+    consuming, producing := DefaultConfig(), DefaultConfig()
+    producing.NumWidgets, producing.SerialIds = 20, true
+    recording, _ := distributedRun(t, consuming, producing, producing)
+    if recording.Outcome.NumConsumed != 40 {
+        t.Errorf("consumed %d widgets, want 40", recording.Outcome.NumConsumed)
+    }
+    if recording.Outcome.Collisions != 0 {
+        t.Errorf("%d serial numbers arrived twice, want 0", recording.Outcome.Collisions)
+    }
+}
+
+func FuzzLineConfig(f *testing.F) {
+    for _, seed := range []string{`{}`, `{"n": 5, "p": 2, "c": 2}`, `{"n": 10, "k": 3, "stop_policy": "skip"}`, `{"n": 8, "deterministic": true, "seed": 3}`,
+        `{"n": -1}`, `{"ids": "ulid", "n": 4}`} {
+        f.Add([]byte(seed))
+    }
+    f.Fuzz(func(t *testing.T, data []byte) {
+        var config LineConfig
+        if err := json.Unmarshal(data, &config); err != nil {
+            return
+        }
+        if err := config.Check(); err != nil {
+            return
+        }
+        if (config.NumWidgets > 100 || config.NumProducers > 16 || config.NumConsumers > 16 || config.ConsumeDelay > time.Millisecond ||
+            len(config.Mtbf) > 0 || config.MaintenanceEvery > 0 || len(config.Sinks) > 0 || len(config.DivertSink) > 0 || config.AlertDrop > 0 ||
+            config.Soak) {
+            return
+        }
+        Services{Log: io.Discard, Report: io.Discard}.Line(config, LineOptions{})
+    })
+}
+
+// Raw bytes go through the recording decoder without crashing it
+func FuzzRecording(f *testing.F) {
+    config := DefaultConfig()
+    config.NumWidgets, config.Seed = 5, 1
+    recording, _ := Services{Log: io.Discard, Report: io.Discard}.Line(config, LineOptions{})
+    data, _ := json.Marshal(recording)
+    f.Add(data)
+    f.Add([]byte(`{}`))
+    f.Add([]byte(`{"config": {"n": 3}, "arrivals": [{"offset": 1, "source": "producer_0", "broken": true}]}`))
+    f.Fuzz(func(t *testing.T, data []byte) {
+        decodeRecording(data)
+    })
+}